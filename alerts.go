@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// With -alert-immediately every image is checked against the index right
+// after it is indexed, and its matches are reported then and there, rather
+// than once the whole scan is through its check phase; watch and daemon
+// setups get to react to a duplicate as it arrives. The check phase still
+// runs and reports every pair once more, grouped. Files that aren't images
+// are only ever paired by the check phase. Every image arriving with copies
+// already indexed is also reported as a whole, with the count and paths of
+// the copies, to the log and to -alert-events, where automation can pick it
+// up to reject or reroute the file.
+
+// alerted remembers the pairs already alerted on: two duplicates ingested at
+// the same time may each find the other.
+var alerted = struct {
+	sync.Mutex
+	pairs map[[2]string]struct{}
+}{pairs: make(map[[2]string]struct{})}
+
+// alertEvent is written to -alert-events for an image ingested with copies.
+type alertEvent struct {
+	Time     time.Time   `json:"time"`
+	Path     string      `json:"path"`
+	Copies   int         `json:"copies"`
+	Existing []alertCopy `json:"existing"`
+}
+
+type alertCopy struct {
+	Path     string `json:"path"`
+	Distance int    `json:"distance"`
+	Relation string `json:"relation,omitempty"`
+}
+
+// alertEvents serializes the writes to -alert-events.
+var alertEvents sync.Mutex
+
+// alertMatches reports the indexed images within the threshold of img, whose
+// hash is h.
+func alertMatches(idx *bkTree, img *Image, h uint64) {
+	cfg := rootConfig
+	copies := make([]alertCopy, 0)
+	defer func() { alertCopies(cfg, img, copies) }()
+	for _, match := range idx.query(h, min(cfg.searchRadius(), 64)) {
+		if match.path == img.Path {
+			continue
+		}
+		other, known := &Image{Path: match.path}, false
+		if dat, err := imageStore.Get([]byte(match.path)); err == nil {
+			known = sonic.Unmarshal(dat, other) == nil
+		}
+		if extendedLayout(hashLayout) {
+			// the index only measured the first words.
+			distance, err := recordDistance(img, other)
+			if !known || err != nil {
+				continue
+			}
+			match.distance = distance
+		}
+		if (cfg.ignoreZero && match.distance == 0) || other.staleLayout() ||
+			match.distance >= cfg.pairThreshold(img, other) {
+			continue
+		}
+		found := alertCopy{Path: match.path, Distance: match.distance}
+		if known {
+			found.Relation = relation(img, other)
+		}
+		copies = append(copies, found)
+		key := [2]string{min(img.Path, match.path), max(img.Path, match.path)}
+		alerted.Lock()
+		_, seen := alerted.pairs[key]
+		alerted.pairs[key] = struct{}{}
+		alerted.Unlock()
+		if seen {
+			continue
+		}
+		ev := log.Warn().Int("distance", match.distance)
+		if known {
+			ev = ev.Str("relation", found.Relation)
+		}
+		ev.Msgf("duplicate ingested: %s matches %s", displayPath(img.Path), displayPath(match.path))
+	}
+}
+
+// alertCopies reports img along with all of its copies, closest first.
+func alertCopies(cfg *config, img *Image, copies []alertCopy) {
+	if len(copies) == 0 {
+		return
+	}
+	sort.Slice(copies, func(i, j int) bool {
+		if copies[i].Distance != copies[j].Distance {
+			return copies[i].Distance < copies[j].Distance
+		}
+		return copies[i].Path < copies[j].Path
+	})
+	paths := make([]string, len(copies))
+	for i, c := range copies {
+		paths[i] = c.Path
+	}
+	log.Warn().Int("copies", len(copies)).Strs("existing", paths).
+		Msgf("incoming duplicate: %s", displayPath(img.Path))
+	if cfg.alertEvents == nil {
+		return
+	}
+	dat, err := sonic.Marshal(alertEvent{Time: time.Now(), Path: img.Path, Copies: len(copies), Existing: copies})
+	if err == nil {
+		alertEvents.Lock()
+		_, err = cfg.alertEvents.Write(append(dat, '\n'))
+		alertEvents.Unlock()
+	}
+	if err != nil {
+		log.Error().Err(err).Str("caller", img.Path).Msg("failed to write alert event")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import "sort"
+
+// allFiles makes scans index files that aren't images by their content
+// checksum instead of skipping them, so identical documents and archives are
+// reported alongside duplicate images.
+var allFiles bool
+
+// checksumStage checksums a file that isn't an image in place of decoding and
+// hashing it. The file is closed either way.
+func (img *Image) checksumStage() bool {
+	defer func() { _ = img.f.Close() }()
+	sum, err := contentChecksum(img.f)
+	if err != nil {
+		log.Warn().Caller().Err(err).Str("caller", img.Name).Msg("failed to checksum")
+		return false
+	}
+	img.Type, img.Checksum = NULL, sum[:]
+	return true
+}
+
+// checksumPairs pairs the records that aren't images with the identical ones,
+// each pair once in path order. With other set, only pairs of a record in
+// records and one in other are returned.
+func checksumPairs(records, other map[string]*Image) []dupePair {
+	candidates := records
+	if other != nil {
+		candidates = other
+	}
+	bySum := make(map[string][]string)
+	for p, img := range candidates {
+		if len(img.Checksum) > 0 {
+			bySum[string(img.Checksum)] = append(bySum[string(img.Checksum)], p)
+		}
+	}
+
+	var (
+		pairs = make([]dupePair, 0)
+		seen  = make(map[[2]string]struct{})
+	)
+	for p, img := range records {
+		if len(img.Checksum) == 0 {
+			continue
+		}
+		for _, q := range bySum[string(img.Checksum)] {
+			key := [2]string{min(p, q), max(p, q)}
+			if _, dup := seen[key]; p == q || dup {
+				continue
+			}
+			seen[key] = struct{}{}
+			pairs = append(pairs, dupePair{a: key[0], b: key[1]})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].a != pairs[j].a {
+			return pairs[i].a < pairs[j].a
+		}
+		return pairs[i].b < pairs[j].b
+	})
+	return pairs
+}
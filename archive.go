@@ -0,0 +1,358 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// With -archives the members of zip archives are ingested like the pages of a
+// multi-page TIFF, each as its own record keyed "path#page=N", numbered in
+// archive order over the members that could be ingested. Images are hashed as
+// usual, and with -all-files the other members are checksummed. Members are
+// decoded under -decode-workers, and with -isolate-decode in a decoder child
+// like any file; decoded in-process, images over maxMemberPixels are refused.
+// Checks then tell which archives are fully duplicated on disk: those whose
+// every member was ingested and has an exact copy outside of any archive,
+// which makes the archive itself safe to delete. Copies are told by their
+// hashes first and confirmed by the checksums of their content before an
+// archive is reported. Archives within archives aren't opened.
+
+// archiveImages makes scans ingest the members of zip archives, see -archives.
+var archiveImages bool
+
+const (
+	// maxArchiveMembers bounds the members ingested from one archive.
+	maxArchiveMembers = 65536
+	// maxArchiveMember is the largest member that is decompressed, anything
+	// bigger is taken for a zip bomb.
+	maxArchiveMember = 256 << 20
+	// maxMemberPixels is the largest image decoded from a container
+	// in-process, about 512MiB of RGBA.
+	maxMemberPixels = 1 << 27
+)
+
+// isArchive tells whether contentType, as sniffed, is that of a zip archive.
+func isArchive(contentType string) bool {
+	return contentType == "application/zip"
+}
+
+// archiveFiles returns the members of zr that are files, in archive order.
+func archiveFiles(zr *zip.Reader) []*zip.File {
+	files := make([]*zip.File, 0, len(zr.File))
+	for _, zf := range zr.File {
+		if !zf.FileInfo().IsDir() {
+			files = append(files, zf)
+		}
+	}
+	return files
+}
+
+// readArchiveMember decompresses zf, refusing members over maxArchiveMember.
+func readArchiveMember(zf *zip.File) ([]byte, error) {
+	if zf.UncompressedSize64 > maxArchiveMember {
+		return nil, fmt.Errorf("member is larger than %s", formatBytes(maxArchiveMember))
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rc.Close() }()
+	dat, err := io.ReadAll(io.LimitReader(rc, maxArchiveMember+1))
+	if err == nil && len(dat) > maxArchiveMember {
+		err = fmt.Errorf("member is larger than %s", formatBytes(maxArchiveMember))
+	}
+	return dat, err
+}
+
+// hashArchiveMember decodes and hashes the member dat into member, or with
+// -all-files checksums it when it isn't an image. It reports false for
+// members that aren't ingested.
+func hashArchiveMember(member *Image, dat []byte) (bool, error) {
+	t := sniffImageType(dat[:min(len(dat), sniffLen)])
+	switch {
+	case t == NULL && allFiles:
+		sum := sha256.Sum256(dat)
+		member.Checksum = sum[:]
+		return true, nil
+	case t == NULL:
+		return false, nil
+	}
+	var err error
+	stages.decode.do(func() { err = decodeMember(member, dat) })
+	if err != nil {
+		return false, err
+	}
+	if sandbox != nil {
+		// the decoder child hashed it.
+		return true, nil
+	}
+	return true, hashImage(member)
+}
+
+// decodeMember decodes the image dat, a member of a container, into member,
+// in a decoder child with -isolate-decode.
+func decodeMember(member *Image, dat []byte) error {
+	if sandbox != nil {
+		return sandbox.decodeBytes(member, dat)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(dat))
+	if err != nil {
+		return err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxMemberPixels {
+		return fmt.Errorf("%dx%d is too large to decode in-process, use -isolate-decode", cfg.Width, cfg.Height)
+	}
+	member.i, member.Type, err = decImg(bytes.NewReader(dat))
+	return err
+}
+
+// ingestArchive ingests every member of the zip archive img as its own record.
+func (img *Image) ingestArchive(start time.Time) {
+	zr, err := zip.NewReader(img.f, img.Size)
+	if err != nil {
+		_ = img.f.Close()
+		log.Debug().Err(err).Str("caller", img.Name).Msg("skipping, not a readable zip archive")
+		rememberFailure(img, "not-image", "unreadable zip archive: "+err.Error())
+		return
+	}
+	files := archiveFiles(zr)
+	hashed := make([]*Image, 0, len(files))
+	for _, zf := range files {
+		if len(hashed) == maxArchiveMembers {
+			log.Warn().Str("caller", img.Name).Int("members", len(files)).
+				Msgf("archive has too many members, only ingesting the first %d", maxArchiveMembers)
+			break
+		}
+		n := len(hashed) + 1
+		member := &Image{
+			ClaimedType: claimedImageType(zf.Name),
+			Name:        pagePath(img.Name, n),
+			Path:        pagePath(img.Path, n),
+			ModTime:     img.ModTime,
+			Origin:      img.Origin,
+			Size:        img.Size,
+			b:           img.b,
+		}
+		dat, err := readArchiveMember(zf)
+		var ok bool
+		if err == nil {
+			ok, err = hashArchiveMember(member, dat)
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("caller", img.Name).Str("member", zf.Name).Msg("failed to decode archive member")
+			continue
+		}
+		if ok {
+			hashed = append(hashed, member)
+		}
+	}
+	_ = img.f.Close()
+	if img.storeMembers(start, hashed, "zip archive") {
+		log.Debug().Str("caller", img.Name).Int("members", len(files)).Int("ingested", len(hashed)).
+			Msg("ingested zip archive")
+	}
+}
+
+// storeMembers ingests the hashed members of the container img once it is
+// closed, what it is describing it. It reports false if the container
+// couldn't be revalidated, and nothing was stored.
+func (img *Image) storeMembers(start time.Time, hashed []*Image, what string) bool {
+	changed, err := img.revalidate()
+	if err != nil {
+		log.Warn().Caller().Err(err).Str("caller", img.Name).Msg("failed to revalidate")
+		return false
+	}
+	if changed {
+		log.Warn().Str("caller", img.Name).Msg("file changed while hashing its members, storing provisional records")
+	}
+	timings.record(img, time.Since(start))
+
+	for _, member := range hashed {
+		member.ModTime, member.Size, member.Provisional = img.ModTime, img.Size, changed
+		err = ingestImage(member)
+		member.b = nil
+		if err != nil {
+			log.Warn().Err(err).Str("caller", member.Name).Msg("failed to ingest " + what + " member")
+			continue
+		}
+		img.stored = append(img.stored, member.Path)
+		collectionMu.Lock()
+		Collection = append(Collection, member)
+		collectionMu.Unlock()
+	}
+	if len(hashed) > 0 {
+		forgetFailure(img.Path)
+	} else {
+		rememberFailure(img, "not-image", what+" without members to ingest")
+	}
+	return true
+}
+
+// archiveVerdict is an archive every member of which has an exact copy on
+// disk.
+type archiveVerdict struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Members int    `json:"members"`
+}
+
+// exactCopy tells whether the records a and b may be of the same file: of the
+// same picture in the same format, or of the same content for those that
+// aren't images. Records of archive members carry the size of their archive,
+// so sizes aren't compared, and images are only confirmed to be the same
+// file by checksumming them.
+func exactCopy(a, b *Image, distance int) bool {
+	if len(a.Checksum) > 0 || len(b.Checksum) > 0 {
+		return bytes.Equal(a.Checksum, b.Checksum)
+	}
+	return distance == 0 && a.Type == b.Type && a.Width == b.Width && a.Height == b.Height
+}
+
+// duplicatedArchives returns the archives among records that are fully
+// duplicated on disk, in path order.
+func duplicatedArchives(pairs *pairSet, records map[string]*Image) []archiveVerdict {
+	members := make(map[string][]string)
+	for p := range records {
+		if file, _, ok := strings.Cut(p, pageSuffix); ok {
+			members[file] = append(members[file], p)
+		}
+	}
+	// the files on disk each member may be a copy of.
+	copies := make(map[string][]string)
+	pairs.each(func(pair dupePair) {
+		a, b := records[pair.a], records[pair.b]
+		if a == nil || b == nil || !exactCopy(a, b, pair.distance) {
+			return
+		}
+		aMember, bMember := strings.Contains(pair.a, pageSuffix), strings.Contains(pair.b, pageSuffix)
+		switch {
+		case aMember && !bMember:
+			copies[pair.a] = append(copies[pair.a], pair.b)
+		case bMember && !aMember:
+			copies[pair.b] = append(copies[pair.b], pair.a)
+		}
+	})
+
+	var (
+		verdicts = make([]archiveVerdict, 0)
+		sums     = make(map[string]*[sha256.Size]byte)
+	)
+	for file, paths := range members {
+		all := true
+		for _, p := range paths {
+			all = all && len(copies[p]) > 0
+		}
+		if !all {
+			continue
+		}
+		// multi-page TIFFs share the key scheme, and the archive may have
+		// changed since its members were ingested.
+		files, size, err := verifyArchiveCopies(file, copies, sums)
+		if err != nil {
+			log.Debug().Err(err).Str("caller", displayPath(file)).Msg("not reporting archive as duplicated")
+			continue
+		}
+		if files != len(paths) || size != records[paths[0]].Size {
+			continue
+		}
+		verdicts = append(verdicts, archiveVerdict{Path: file, Size: size, Members: files})
+	}
+	sort.Slice(verdicts, func(i, j int) bool { return verdicts[i].Path < verdicts[j].Path })
+	return verdicts
+}
+
+// verifyArchiveCopies checksums every member of the zip archive at path and
+// returns an error unless the content of each is that of one of its copies,
+// which are checksummed once into sums. It returns how many files the archive
+// holds, and its size.
+func verifyArchiveCopies(path string, copies map[string][]string, sums map[string]*[sha256.Size]byte) (int, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = f.Close() }()
+	finfo, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	zr, err := zip.NewReader(f, finfo.Size())
+	if err != nil {
+		return 0, 0, err
+	}
+	files := archiveFiles(zr)
+	for i, zf := range files {
+		// every member was ingested, so pages are numbered as files are.
+		member := pagePath(path, i+1)
+		sum, err := memberChecksum(zf)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", zf.Name, err)
+		}
+		if !slices.ContainsFunc(copies[member], func(p string) bool {
+			other, ok := sums[p]
+			if !ok {
+				if s, err := withFile(p, contentChecksum); err == nil {
+					other = &s
+				}
+				sums[p] = other
+			}
+			return other != nil && *other == sum
+		}) {
+			return 0, 0, fmt.Errorf("%s has no identical copy on disk", zf.Name)
+		}
+	}
+	return len(files), finfo.Size(), nil
+}
+
+// memberChecksum returns the SHA-256 of the content of zf.
+func memberChecksum(zf *zip.File) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	rc, err := zf.Open()
+	if err != nil {
+		return sum, err
+	}
+	defer func() { _ = rc.Close() }()
+	h := sha256.New()
+	if _, err = io.Copy(h, rc); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// reportArchives logs the archives fully duplicated on disk.
+func reportArchives(verdicts []archiveVerdict) {
+	var total int64
+	for _, v := range verdicts {
+		total += v.Size
+		log.Info().Int("members", v.Members).Str("size", formatBytes(v.Size)).
+			Msgf("archive fully duplicated on disk: %s", displayPath(v.Path))
+	}
+	if len(verdicts) > 0 {
+		log.Info().Int("archives", len(verdicts)).Str("reclaimable", formatBytes(total)).
+			Msg("archives whose every member has an exact copy on disk can be deleted")
+	}
+}
+
+// writeArchives writes verdicts as the text of a report.
+func writeArchives(w io.Writer, verdicts []archiveVerdict) error {
+	if len(verdicts) == 0 {
+		_, err := fmt.Fprintln(w, "no archives fully duplicated on disk")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "archives fully duplicated on disk")
+	for _, v := range verdicts {
+		_, _ = fmt.Fprintf(tw, "  %d members\t%s\t%s\n", v.Members, formatBytes(v.Size), displayPath(v.Path))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime falls back to the modification time where the access time isn't
+// portably available.
+func accessTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
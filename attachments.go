@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sidecars hold what editors and phones know about an image besides its
+// pixels: XMP metadata from Lightroom and darktable, JSON from Google Takeout,
+// AAE edits from iOS. They are attachments of their image rather than files
+// of their own, so they are never indexed, and when clean moves or recycles a
+// duplicate its sidecars go with it. A sidecar is attached by name, either
+// the image's full name plus the extension (IMG_1.JPG.xmp) or its name with
+// the extension replaced (IMG_1.xmp); the latter only when no other file
+// shares the name, like the raw of a raw+JPEG pair, which the sidecar may
+// just as well belong to.
+
+var sidecarExts = []string{".xmp", ".json", ".aae"}
+
+func isSidecar(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range sidecarExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// attachedSidecars returns the paths of the sidecars of the image at path.
+func attachedSidecars(path string) []string {
+	dir, name := filepath.Split(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var (
+		full   = strings.ToLower(name)
+		stem   = strings.TrimSuffix(full, strings.ToLower(filepath.Ext(name)))
+		byFull []string
+		byStem []string
+		shared bool
+	)
+	for _, e := range entries {
+		n := e.Name()
+		if n == name || !e.Type().IsRegular() {
+			continue
+		}
+		lower := strings.ToLower(n)
+		ext := filepath.Ext(lower)
+		switch {
+		case isSidecar(n) && lower == full+ext:
+			byFull = append(byFull, filepath.Join(dir, n))
+		case isSidecar(n) && lower == stem+ext:
+			byStem = append(byStem, filepath.Join(dir, n))
+		case !isSidecar(n) && strings.TrimSuffix(lower, ext) == stem:
+			shared = true
+		}
+	}
+	if shared {
+		return byFull
+	}
+	return append(byFull, byStem...)
+}
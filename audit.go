@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// Every change to the index and every file a clean action touches is noted
+// in the "audit" store: ingests and record updates, removals by db rm, prune
+// or clean, the clean actions themselves, undos, purges, and the API requests
+// that change anything. An entry says what happened to which path, when, and
+// on whose behalf: the command line of a run, or the token of an API request
+// along with the request. Entries are never changed or removed, the audit
+// command lists them.
+
+// auditEntry is one change noted in the audit store.
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// Actor is who made the change, "cli" for a run or api:<token>.
+	Actor string `json:"actor"`
+	// Command is the command line of a run, or the method and path of an API
+	// request.
+	Command string `json:"command"`
+	Op      string `json:"op"`
+	Path    string `json:"path,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// auditor keeps who the changes being made are on behalf of, and hands out
+// the keys of entries: their time in nanoseconds, bumped past the last one so
+// entries noted at once keep their order.
+var auditor struct {
+	sync.Mutex
+	actor, command string
+	last           uint64
+}
+
+// auditAs notes the changes made until restore is called as being made by
+// actor running command. Callers make sure no other changes are made
+// meanwhile, like the API does by holding its lock.
+func auditAs(actor, command string) (restore func()) {
+	auditor.Lock()
+	prevActor, prevCommand := auditor.actor, auditor.command
+	auditor.actor, auditor.command = actor, command
+	auditor.Unlock()
+	return func() {
+		auditor.Lock()
+		auditor.actor, auditor.command = prevActor, prevCommand
+		auditor.Unlock()
+	}
+}
+
+// auditRequest returns the actor and command of the API request r.
+func (s *apiServer) auditRequest(r *http.Request) (actor, command string) {
+	var name string
+	if tok := s.authenticate(r); tok != nil {
+		name = tok.name
+	}
+	return "api:" + name, r.Method + " " + r.URL.RequestURI()
+}
+
+// audit notes op on path in the audit store, made on behalf of the actor
+// auditAs set.
+func audit(op, path, detail string) {
+	auditor.Lock()
+	actor, command := auditor.actor, auditor.command
+	auditor.Unlock()
+	auditBy(actor, command, op, path, detail)
+}
+
+// auditBy notes op on path in the audit store. A change that was made is
+// never undone for failing to note it, the failure is logged.
+func auditBy(actor, command, op, path, detail string) {
+	auditor.Lock()
+	key := uint64(time.Now().UnixNano())
+	if key <= auditor.last {
+		key = auditor.last + 1
+	}
+	auditor.last = key
+	auditor.Unlock()
+	e := auditEntry{Time: time.Unix(0, int64(key)), Actor: actor, Command: command, Op: op, Path: path, Detail: detail}
+	dat, err := sonic.Marshal(e)
+	if err == nil {
+		err = DB.With("audit").Put(binary.BigEndian.AppendUint64(nil, key), dat)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("caller", path).Str("op", op).Msg("failed to note change in the audit log")
+	}
+}
+
+var auditCommands = []command{
+	{"ls", "list the changes noted in the audit log", func(args []string) error { return auditLs(args, os.Stdout) }},
+}
+
+func runAudit(args []string) error {
+	fs := newFlagSet("audit", "<command> [flags]", "Browse the log of changes made to the index and the files in it.")
+	usage := fs.Usage
+	fs.Usage = func() {
+		usage()
+		printCommands(fs.Output(), "audit", auditCommands)
+	}
+	return dispatch(fs, auditCommands, args)
+}
+
+func auditLs(args []string, w io.Writer) error {
+	fs := newFlagSet("audit ls", "[--since AGE] [--op OP] [--actor ACTOR] [--json] [glob|path...]",
+		"List the changes noted in the audit log, oldest first, optionally only those to paths selected\n"+
+			"by exact path, glob pattern, or directory.")
+	since := fs.String("since", "", "only list changes made within `age`, e.g. 7d")
+	op := fs.String("op", "", "only list changes of `kind`, e.g. ingest, update, remove, clean or api")
+	actor := fs.String("actor", "", "only list changes made by `actor`, cli or api:<token>")
+	asJSON := fs.Bool("json", false, "write one JSON object per change")
+	targets, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	var cutoff time.Time
+	if *since != "" {
+		age, err := parseAge(*since)
+		if err != nil {
+			return usageError(fs, "invalid value %q for --since: %s", *since, err)
+		}
+		cutoff = time.Now().Add(-age)
+	}
+
+	store := DB.With("audit")
+	keys := store.Keys()
+	sort.Slice(keys, func(i, j int) bool { return string(keys[i]) < string(keys[j]) })
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if !*asJSON {
+		_, _ = io.WriteString(tw, "TIME\tACTOR\tOP\tPATH\tDETAIL\tCOMMAND\n")
+	}
+	for _, k := range keys {
+		dat, err := store.Get(k)
+		if err != nil {
+			return err
+		}
+		e := &auditEntry{}
+		if err = sonic.Unmarshal(dat, e); err != nil {
+			log.Warn().Err(err).Msg("skipping corrupt audit entry")
+			continue
+		}
+		switch {
+		case e.Time.Before(cutoff),
+			*op != "" && e.Op != *op,
+			*actor != "" && e.Actor != *actor,
+			len(targets) > 0 && (e.Path == "" || !selectedBy(targets, e.Path)):
+			continue
+		}
+		if *asJSON {
+			if _, err = w.Write(append(dat, '\n')); err != nil {
+				return err
+			}
+			continue
+		}
+		_, _ = io.WriteString(tw, strings.Join([]string{e.Time.Format(time.RFC3339), e.Actor, e.Op,
+			displayPath(e.Path), e.Detail, e.Command}, "\t")+"\n")
+	}
+	if *asJSON {
+		return nil
+	}
+	return tw.Flush()
+}
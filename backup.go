@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.tcp.direct/tcp.direct/database"
+	"github.com/bytedance/sonic"
+)
+
+// Backups are gzipped JSON lines: a header, one line per record, and a footer
+// carrying the record count and a sha256 over every line preceding it.
+// Only live records are written, so a restored store starts out compacted.
+
+const backupFormat = "dupehunter-backup"
+
+const backupVersion = 1
+
+var ErrBackupCorrupt = errors.New("backup is corrupt")
+
+type backupHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Store   string    `json:"store"`
+}
+
+type backupRecord struct {
+	Key    string          `json:"key"`
+	Record json.RawMessage `json:"record"`
+}
+
+type backupFooter struct {
+	Records int    `json:"records"`
+	SHA256  string `json:"sha256"`
+}
+
+type backupWriter struct {
+	w   io.Writer
+	sum hash.Hash
+}
+
+func (bw *backupWriter) writeLine(v any) error {
+	dat, err := sonic.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dat = append(dat, '\n')
+	_, _ = bw.sum.Write(dat)
+	_, err = bw.w.Write(dat)
+	return err
+}
+
+func dbBackup(args []string) error {
+	fs := newFlagSet("db backup", "<file>",
+		"Write a compacted, checksummed snapshot of the index to file.")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "exactly one destination file is required")
+	}
+	dest := fs.Arg(0)
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("refusing to overwrite existing file: %s", dest)
+	}
+
+	if err := DB.SyncAll(); err != nil {
+		return fmt.Errorf("failed to sync database before backup: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".dupehunter-backup-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	gz := gzip.NewWriter(tmp)
+	bw := &backupWriter{w: gz, sum: sha256.New()}
+
+	if err = bw.writeLine(backupHeader{
+		Format: backupFormat, Version: backupVersion, Created: time.Now(), Store: "images",
+	}); err != nil {
+		return err
+	}
+
+	var count int
+	if err = imageStore.each(func(k, dat []byte) error {
+		count++
+		return bw.writeLine(backupRecord{Key: string(k), Record: dat})
+	}); err != nil {
+		return err
+	}
+
+	footer := backupFooter{Records: count, SHA256: hex.EncodeToString(bw.sum.Sum(nil))}
+	if err = bw.writeLine(footer); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), dest); err != nil {
+		return err
+	}
+
+	log.Info().Str("path", dest).Int("records", count).Str("sha256", footer.SHA256).Msg("backup written")
+	return nil
+}
+
+// readBackup verifies the backup at path and returns its records.
+func readBackup(path string) ([]backupRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBackupCorrupt, err)
+	}
+
+	var (
+		sum     = sha256.New()
+		scanner = bufio.NewScanner(gz)
+		records = make([]backupRecord, 0)
+		header  backupHeader
+		footer  *backupFooter
+	)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for line := 0; scanner.Scan(); line++ {
+		dat := scanner.Bytes()
+		switch {
+		case footer != nil:
+			return nil, fmt.Errorf("%w: trailing data after footer", ErrBackupCorrupt)
+		case line == 0:
+			if err = sonic.Unmarshal(dat, &header); err != nil || header.Format != backupFormat {
+				return nil, fmt.Errorf("%w: missing header", ErrBackupCorrupt)
+			}
+			if header.Version > backupVersion {
+				return nil, fmt.Errorf("backup version %d is newer than supported version %d",
+					header.Version, backupVersion)
+			}
+		default:
+			var bl struct {
+				backupRecord
+				backupFooter
+			}
+			if err = sonic.Unmarshal(dat, &bl); err != nil {
+				return nil, fmt.Errorf("%w: line %d: %w", ErrBackupCorrupt, line+1, err)
+			}
+			if bl.SHA256 != "" {
+				footer = &bl.backupFooter
+				continue
+			}
+			records = append(records, bl.backupRecord)
+		}
+		_, _ = sum.Write(dat)
+		_, _ = sum.Write([]byte{'\n'})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBackupCorrupt, err)
+	}
+
+	switch {
+	case footer == nil:
+		return nil, fmt.Errorf("%w: missing footer, backup is truncated", ErrBackupCorrupt)
+	case footer.Records != len(records):
+		return nil, fmt.Errorf("%w: expected %d records, found %d", ErrBackupCorrupt, footer.Records, len(records))
+	case footer.SHA256 != hex.EncodeToString(sum.Sum(nil)):
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrBackupCorrupt)
+	}
+
+	return records, nil
+}
+
+func dbRestore(args []string) error {
+	fs := newFlagSet("db restore", "[--replace] <file>",
+		"Verify a snapshot written by db backup and load its records into the index.")
+	replace := fs.Bool("replace", false, "remove records that are not present in the backup")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "exactly one backup file is required")
+	}
+
+	records, err := readBackup(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// readers see the store either before or after the restore, not halfway.
+	if err = imageStore.batch(func(store database.Filer) error {
+		if *replace {
+			keep := make(map[string]struct{}, len(records))
+			for _, rec := range records {
+				keep[rec.Key] = struct{}{}
+			}
+			for _, k := range store.Keys() {
+				if _, ok := keep[string(k)]; ok {
+					continue
+				}
+				if err := store.Delete(k); err != nil {
+					return fmt.Errorf("failed to remove %s: %w", string(k), err)
+				}
+			}
+		}
+		for _, rec := range records {
+			if err := store.Put([]byte(rec.Key), rec.Record); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", rec.Key, err)
+			}
+			forgetTombstone(rec.Key)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	audit("restore", "", fmt.Sprintf("%d records from %s", len(records), fs.Arg(0)))
+	if _, err = rebuildIndex(); err != nil {
+		return fmt.Errorf("failed to rebuild the similarity index: %w", err)
+	}
+
+	if err = DB.SyncAll(); err != nil {
+		return err
+	}
+
+	log.Info().Str("path", fs.Arg(0)).Int("records", len(records)).Msg("backup restored")
+	return nil
+}
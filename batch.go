@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/corona10/goimagehash"
+)
+
+// POST /v1/records:batch stores records hashed elsewhere, by agents or
+// importers that already know the hashes of their images, many to a request
+// rather than a round trip per image. Records are keyed by an absolute path or
+// a URL, URLs standing for images that aren't on the server's disk, which
+// prune therefore leaves alone. Each item either carries a hash under
+// hashLayout, which has to be one of the 64 bit layouts, or the sha256
+// checksum of a file that isn't an image.
+
+// recordsBatchLimit caps the records of a /v1/records:batch request.
+const recordsBatchLimit = 1000
+
+// batchRecord is a precomputed record of a /v1/records:batch request.
+type batchRecord struct {
+	Path     string     `json:"path"`
+	Hash     string     `json:"hash"`
+	Checksum string     `json:"checksum"`
+	Size     int64      `json:"size"`
+	ModTime  time.Time  `json:"mtime"`
+	Width    int        `json:"width"`
+	Height   int        `json:"height"`
+	Type     string     `json:"type"`
+	Captured *time.Time `json:"captured"`
+}
+
+// batchResult is what became of a batchRecord: ingested, replaced, skipped
+// because the path was already indexed, or failed.
+type batchResult struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// remoteRecord tells whether the record path is a URL rather than a file.
+func remoteRecord(p string) bool {
+	u, err := url.Parse(p)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// image turns rec into a record to ingest.
+func (rec *batchRecord) image() (*Image, error) {
+	img := &Image{Size: rec.Size, ModTime: rec.ModTime, Width: rec.Width, Height: rec.Height}
+	switch {
+	case remoteRecord(rec.Path):
+		img.Path, img.Name = rec.Path, path.Base(rec.Path)
+	case filepath.IsAbs(rec.Path):
+		img.Path = filepath.Clean(rec.Path)
+		img.Name = filepath.Base(img.Path)
+	default:
+		return nil, errors.New("path must be absolute or a URL")
+	}
+	img.ClaimedType = claimedImageType(img.Name)
+	if rec.Type != "" {
+		t, err := parseImageType(rec.Type)
+		if err != nil {
+			return nil, fmt.Errorf("unknown type %q", rec.Type)
+		}
+		img.Type = t
+	}
+	if rec.Captured != nil {
+		img.Captured = *rec.Captured
+	}
+
+	switch {
+	case rec.Hash != "" && rec.Checksum != "":
+		return nil, errors.New("give either a hash or a checksum")
+	case rec.Checksum != "":
+		sum, err := hex.DecodeString(rec.Checksum)
+		if err != nil || len(sum) != 32 {
+			return nil, errors.New("checksum must be a hex sha256")
+		}
+		img.Checksum = sum
+	case rec.Hash != "":
+		if !strings.HasPrefix(rec.Hash, hashing.name[:1]+":") {
+			return nil, fmt.Errorf("hash must be a %s like %s:0123456789abcdef", hashing.name, hashing.name[:1])
+		}
+		h, err := goimagehash.ImageHashFromString(rec.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash: %w", err)
+		}
+		var b bytes.Buffer
+		if err = h.Dump(&b); err != nil {
+			return nil, err
+		}
+		img.PHash, img.HashLayout = b.Bytes(), hashLayout
+	default:
+		return nil, errors.New("hash or checksum is required")
+	}
+	return img, nil
+}
+
+// recordsBatch stores a batch of precomputed records right away, reporting
+// on each of them. Records of paths already indexed are kept unless replace
+// is set, as with db import.
+func (s *apiServer) recordsBatch(r *http.Request) (any, error) {
+	var req struct {
+		Records []batchRecord `json:"records"`
+		Replace bool          `json:"replace"`
+		Source  string        `json:"source"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	}
+	if len(req.Records) == 0 {
+		return nil, &apiBadRequest{"records is required"}
+	}
+	if len(req.Records) > recordsBatchLimit {
+		return nil, &apiBadRequest{fmt.Sprintf("at most %d records per request", recordsBatchLimit)}
+	}
+	if extendedLayout(hashLayout) {
+		return nil, &apiBadRequest{"the index holds extended hashes, precomputed records are 64 bits wide"}
+	}
+
+	var (
+		origin  = newOrigin(req.Source, "api:"+s.authenticate(r).name)
+		results = make([]batchResult, 0, len(req.Records))
+		totals  = make(map[string]int)
+	)
+	for i := range req.Records {
+		res := storeBatchRecord(&req.Records[i], req.Replace, origin)
+		totals[res.Status]++
+		results = append(results, res)
+	}
+	if totals["ingested"]+totals["replaced"] > 0 {
+		if err := DB.SyncAll(); err != nil {
+			return nil, err
+		}
+	}
+	log.Info().Int("ingested", totals["ingested"]).Int("replaced", totals["replaced"]).
+		Int("skipped", totals["skipped"]).Int("failed", totals["failed"]).Msg("records batch stored")
+	return map[string]any{"results": results, "totals": totals}, nil
+}
+
+// storeBatchRecord ingests rec unless its path is indexed and replace is unset.
+func storeBatchRecord(rec *batchRecord, replace bool, origin Origin) batchResult {
+	res := batchResult{Path: rec.Path}
+	img, err := rec.image()
+	if err != nil {
+		res.Status, res.Error = "failed", err.Error()
+		return res
+	}
+	res.Path = img.Path
+	exists := imageStore.Has([]byte(img.Path))
+	if exists && !replace {
+		res.Status = "skipped"
+		return res
+	}
+	img.Origin, img.b = origin, bufs.Get()
+	err = ingestImage(img)
+	img.release()
+	if err != nil {
+		res.Status, res.Error = "failed", err.Error()
+		return res
+	}
+	forgetTombstone(img.Path)
+	res.Status = "ingested"
+	if exists {
+		res.Status = "replaced"
+	}
+	return res
+}
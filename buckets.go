@@ -0,0 +1,25 @@
+package main
+
+import "git.tcp.direct/kayos/dupehunter/internal/bucket"
+
+// bucketIndex is the bucket index of package bucket as a similarityIndex,
+// a cheap exact pre-filter that has nothing to persist or rebuild between
+// runs.
+type bucketIndex struct {
+	*bucket.Index
+}
+
+func buildBuckets(hashes map[string]uint64, radius int) *bucketIndex {
+	return &bucketIndex{bucket.Build(hashes, radius)}
+}
+
+// query returns the paths within radius of h. Radii beyond the one the buckets
+// were built for can't be answered exactly and are clamped.
+func (b *bucketIndex) query(h uint64, radius int) []indexMatch {
+	found := b.Query(h, radius)
+	matches := make([]indexMatch, len(found))
+	for i, m := range found {
+		matches[i] = indexMatch{path: m.Path, distance: m.Distance}
+	}
+	return matches
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// check --time-budget bounds how long the records are matched, for quick
+// passes over libraries too big to check in full. The distinct hashes are
+// queried most promising first: those shared by the most records, whose
+// copies are duplicates for sure, then those sharing a segment of the bucket
+// index with the most others, which are where near-duplicates crowd. The
+// check queries the bucket index under a budget, which that ordering is read
+// from, unless -index hnsw asks for the approximate one, which orders by
+// copies alone. Once the budget is spent the hashes left aren't queried, and
+// the check reports what it found so far as partial, which may miss pairs and
+// group members and so can't be cleaned.
+
+type timeBudget struct {
+	mu       sync.Mutex
+	deadline time.Time
+	skipped  atomic.Int64
+	// partial is set once a query was skipped.
+	partial bool
+	// given is whether the check had a budget, still set after its end.
+	given bool
+}
+
+var budget = &timeBudget{}
+
+// begin starts spending a budget of d, none if 0.
+func (b *timeBudget) begin(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deadline, b.partial, b.given = time.Time{}, false, d > 0
+	if d > 0 {
+		b.deadline = time.Now().Add(d)
+	}
+	b.skipped.Store(0)
+}
+
+func (b *timeBudget) active() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.deadline.IsZero()
+}
+
+// bounded reports whether the check was given a budget, which its reports
+// then tell whether it ran out of.
+func (b *timeBudget) bounded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.given
+}
+
+// spent reports whether the budget ran out, counting another query skipped
+// if so.
+func (b *timeBudget) spent() bool {
+	if !b.overdue() {
+		return false
+	}
+	b.mu.Lock()
+	b.partial = true
+	b.mu.Unlock()
+	b.skipped.Add(1)
+	return true
+}
+
+// overdue reports whether the budget ran out, without counting anything.
+func (b *timeBudget) overdue() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.deadline.IsZero() && !time.Now().Before(b.deadline)
+}
+
+// exhausted reports whether queries were skipped for lack of time.
+func (b *timeBudget) exhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.partial
+}
+
+// end reports on the budget and stops spending it.
+func (b *timeBudget) end(queried int) {
+	if b.exhausted() {
+		log.Warn().Int64("skipped", b.skipped.Load()).Int("hashes", queried).
+			Msg("time budget spent, the hashes left weren't queried and the results are partial")
+	}
+	b.mu.Lock()
+	b.deadline = time.Time{}
+	b.mu.Unlock()
+}
+
+// prioritizeCheckEvery is how many hashes prioritize weighs between looks at
+// the clock.
+const prioritizeCheckEvery = 1024
+
+// prioritize orders unique, the first path of every distinct hash, by how
+// promising their queries are: by the records sharing their hash, then by
+// the hashes of buckets, the index queried if it's one, sharing a segment with
+// theirs, then by path. It gives up, leaving unique as it is, once the budget
+// is spent, as nothing will be queried anyway.
+func prioritize(unique []string, hashes map[string]uint64, buckets *bucketIndex) {
+	var (
+		copies = make(map[uint64]int, len(unique))
+		crowd  = make(map[uint64]int, len(unique))
+		n      int
+	)
+	for _, h := range hashes {
+		if n++; n%prioritizeCheckEvery == 0 && budget.overdue() {
+			return
+		}
+		copies[h]++
+	}
+	if buckets != nil {
+		for i, p := range unique {
+			if i%prioritizeCheckEvery == 0 && budget.overdue() {
+				return
+			}
+			crowd[hashes[p]] = buckets.Crowding(hashes[p])
+		}
+	}
+	sort.SliceStable(unique, func(i, j int) bool {
+		hi, hj := hashes[unique[i]], hashes[unique[j]]
+		if copies[hi] != copies[hj] {
+			return copies[hi] > copies[hj]
+		}
+		if crowd[hi] != crowd[hj] {
+			return crowd[hi] > crowd[hj]
+		}
+		return unique[i] < unique[j]
+	})
+}
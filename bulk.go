@@ -0,0 +1,67 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// -bulk trades the per-file account of a scan for throughput, which starts to
+// matter past a few hundred thousand files. Debug messages and the per-file
+// progress messages are dropped, the console goes without colors, and a line
+// of counters is logged every bulkReportEvery instead. Writes of the
+// similarity index are batched, each node written once per batch however
+// often it changed within it; the index is marked incomplete meanwhile, so
+// that a scan cut short has the next run rebuild it from the records. The
+// records themselves are written as each file is hashed: the store has no
+// batched put to save anything on, and records held back would be missing
+// from the lookups the scan itself makes.
+
+// bulkMode is set by -bulk.
+var bulkMode bool
+
+const (
+	// bulkReportEvery is how often -bulk logs its counters.
+	bulkReportEvery = 10 * time.Second
+	// indexWriteBatch bounds the index nodes a batch holds back.
+	indexWriteBatch = 4096
+)
+
+// neverSampler drops every message.
+type neverSampler struct{}
+
+func (neverSampler) Sample(zerolog.Level) bool { return false }
+
+// enableBulk drops the messages -bulk does without.
+func enableBulk() {
+	bulkMode = true
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	progressSampler = neverSampler{}
+}
+
+// reportBulkProgress logs the counters of the running phase every
+// bulkReportEvery until the returned function is called.
+func reportBulkProgress() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(bulkReportEvery)
+		defer ticker.Stop()
+		var last int
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			snap := progress.snapshot()
+			ev := log.Info().Int("processed", snap.Processed).Int("total", snap.Total).
+				Float64("per_second", float64(snap.Processed-last)/bulkReportEvery.Seconds())
+			if snap.ETA != "" {
+				ev = ev.Str("eta", snap.ETA)
+			}
+			ev.Msg(snap.Phase)
+			last = snap.Processed
+		}
+	}()
+	return func() { close(done) }
+}
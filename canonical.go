@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/bytedance/sonic"
+)
+
+// A canonical collection is a library whose images are never proposed for
+// deletion, e.g. the archive that SD-card imports are checked against: they
+// are kept over any duplicate outside it, and duplicates within it aren't
+// reported at all. Collections are pinned as canonical with db pin, recorded
+// next to the collections rather than in their databases.
+
+func canonicalPath() (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "canonical.json"), nil
+}
+
+// canonicalCollections returns the names of the pinned collections, "" for
+// the main index.
+func canonicalCollections() ([]string, error) {
+	path, err := canonicalPath()
+	if err != nil {
+		return nil, err
+	}
+	dat, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	if err = sonic.Unmarshal(dat, &names); err != nil {
+		return nil, fmt.Errorf("corrupt %s: %w", path, err)
+	}
+	return names, nil
+}
+
+func isCanonical(collection string) bool {
+	names, err := canonicalCollections()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to read the canonical collections")
+	}
+	return slices.Contains(names, collection)
+}
+
+func setCanonical(collection string, pinned bool) error {
+	names, err := canonicalCollections()
+	if err != nil {
+		return err
+	}
+	names = slices.DeleteFunc(names, func(name string) bool { return name == collection })
+	if pinned {
+		names = append(names, collection)
+	}
+	slices.Sort(names)
+	path, err := canonicalPath()
+	if err != nil {
+		return err
+	}
+	dat, err := sonic.Marshal(names)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, dat, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// markCanonical flags the records of a canonical collection.
+func markCanonical(records map[string]*Image) {
+	for _, img := range records {
+		img.canonical = true
+	}
+}
+
+// keepCanonical prefers members of a canonical collection.
+func keepCanonical(a, b *Image) int {
+	switch {
+	case a.canonical && !b.canonical:
+		return -1
+	case b.canonical && !a.canonical:
+		return 1
+	}
+	return 0
+}
+
+func dbPin(unpin bool) func(args []string) error {
+	name, desc := "db pin", "Pin the collection selected with -collection, or the main index, as canonical: "+
+		"its images\nare never proposed for deletion."
+	if unpin {
+		name, desc = "db unpin", "Stop treating the collection selected with -collection, or the main index, as canonical."
+	}
+	return func(args []string) error {
+		fs := newFlagSet(name, "", desc)
+		if err := parseFlags(fs, args); err != nil {
+			return err
+		}
+		if fs.NArg() > 0 {
+			return usageError(fs, "unexpected argument: %s", fs.Arg(0))
+		}
+		collection := rootConfig.collection
+		if err := setCanonical(collection, !unpin); err != nil {
+			return fmt.Errorf("failed to update the canonical collections: %w", err)
+		}
+		log.Info().Str("collection", collectionLabel(collection)).Bool("canonical", !unpin).Msg("collection updated")
+		return nil
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bytedance/sonic"
+)
+
+// Records are keyed by their path as given, so an export taken on a
+// case-sensitive filesystem can hold photo.jpg and Photo.jpg, which on a
+// case-insensitive one are the same file, and the other way around an index
+// built there can hold a path in another case than an export of it. db import
+// compares the paths of the records it imports by their case-folded form with
+// those indexed and imported before, reports every collision, and settles it
+// under --merge-strategy.
+
+const (
+	// mergeBoth keeps the records of both paths, e.g. for a case-sensitive
+	// filesystem, only reporting them.
+	mergeBoth = "both"
+	// mergeKeep keeps the record indexed or imported first.
+	mergeKeep = "keep"
+	// mergeReplace replaces it with the record imported.
+	mergeReplace = "replace"
+	// mergeNewer keeps the record of the file modified last.
+	mergeNewer = "newer"
+)
+
+var mergeStrategies = map[string]string{
+	mergeBoth:    "keep the records of both paths, only reporting them",
+	mergeKeep:    "keep the record indexed or imported first",
+	mergeReplace: "replace it with the record imported",
+	mergeNewer:   "keep the record of the file modified last",
+}
+
+func mergeStrategyNames() string {
+	names := make([]string, 0, len(mergeStrategies))
+	for name := range mergeStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// foldPath is the form of path that paths differing only in case share.
+func foldPath(path string) string {
+	return strings.ToLower(path)
+}
+
+// caseFolds maps the folded form of the paths indexed to the path.
+func caseFolds() map[string]string {
+	folds := make(map[string]string, imageStore.Len())
+	for _, key := range imageStore.Keys() {
+		folds[foldPath(string(key))] = string(key)
+	}
+	return folds
+}
+
+// settleCollision decides, under strategy, on the record of img colliding by
+// case with the record of the path indexed as other. It reports whether img
+// is to be imported, and whether the record of other is to go.
+func settleCollision(strategy string, img *Image, other string) (importing, replacing bool, err error) {
+	switch strategy {
+	case mergeKeep:
+		return false, false, nil
+	case mergeReplace:
+		return true, true, nil
+	case mergeNewer:
+		dat, err := imageStore.Get([]byte(other))
+		if err != nil {
+			return false, false, fmt.Errorf("failed to read %s: %w", other, err)
+		}
+		indexed := &Image{}
+		if err = sonic.Unmarshal(dat, indexed); err != nil {
+			return false, false, fmt.Errorf("json deserialize fail for %s: %w", other, err)
+		}
+		newer := img.ModTime.After(indexed.ModTime)
+		return newer, newer, nil
+	}
+	return true, false, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// -center-weight also hashes the center of every image, e.g. the central 80%
+// of each side, so that copies which only differ around the edges, by an
+// added border, a watermark in a corner, or the window chrome of a
+// screenshot, still match. Checks compare the center hash of every image with
+// the full and center hashes of the others, besides the full hashes with each
+// other, under the same thresholds, and the pairs found are duplicates like
+// any other. Records keep the center hash along with the share it was cropped
+// to, and scans hash the files of records without one of the -center-weight
+// again.
+
+// centerWeight is the share of each side -center-weight hashes, 0 without it.
+var centerWeight float64
+
+// centerShare is the -center-weight flag.
+type centerShare float64
+
+func (c *centerShare) String() string { return (*sampleRate)(c).String() }
+
+func (c *centerShare) Set(s string) error {
+	if err := (*sampleRate)(c).Set(s); err != nil {
+		return err
+	}
+	if *c == 1 {
+		return errors.New("the central 100% is the full image, give less")
+	}
+	return nil
+}
+
+// centerHash is the hash of the center of a record's image.
+type centerHash struct {
+	Share float64 `json:"share"`
+	Hash  []byte  `json:"hash"`
+}
+
+// centerCrop returns the central share of each side of i.
+func centerCrop(i image.Image, share float64) image.Image {
+	b := i.Bounds()
+	w := max(int(math.Round(float64(b.Dx())*share)), 1)
+	h := max(int(math.Round(float64(b.Dy())*share)), 1)
+	r := image.Rect(0, 0, w, h).Add(b.Min.Add(image.Pt((b.Dx()-w)/2, (b.Dy()-h)/2)))
+	if sub, ok := i.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), i, r.Min, draw.Src)
+	return dst
+}
+
+// hashCenter hashes the center of i under -center-weight, nil without it.
+func hashCenter(i image.Image) (*centerHash, error) {
+	if centerWeight == 0 {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := hashing.dump(&buf, "", centerCrop(i, centerWeight)); err != nil {
+		return nil, err
+	}
+	return &centerHash{Share: centerWeight, Hash: buf.Bytes()}, nil
+}
+
+// hasCenter reports whether img holds a center hash of the -center-weight.
+func (img *Image) hasCenter() bool {
+	return img.Center != nil && img.Center.Share == centerWeight
+}
+
+// centerPairs pairs the records at paths whose center hash is within the
+// threshold of the full or center hash of an indexed record, or whose full
+// hash is of the center hash of one, other than those their full hashes
+// already pair. idx indexes the full hashes of indexed.
+func centerPairs(cfg *config, paths []string, indexed map[string]uint64, records map[string]*Image,
+	idx similarityIndex, radius int) []dupePair {
+	var (
+		centers = make(map[string]uint64)
+		words   = make(map[string][]uint64)
+		found   = make(map[[2]string]struct{})
+		missing int
+	)
+	centerWords := func(p string) ([]uint64, bool) {
+		if w, ok := words[p]; ok {
+			return w, w != nil
+		}
+		img := records[p]
+		if img == nil || !img.hasCenter() {
+			words[p] = nil
+			return nil, false
+		}
+		w, err := loadHash(img.layout(), img.Center.Hash)
+		if err != nil {
+			log.Warn().Err(err).Str("caller", displayPath(p)).Msg("unreadable center hash")
+		}
+		words[p] = w
+		return w, err == nil
+	}
+	for p := range indexed {
+		if w, ok := centerWords(p); ok {
+			centers[p] = w[0]
+		} else {
+			missing++
+		}
+	}
+	if missing > 0 {
+		log.Warn().Int("records", missing).Msg("records without a center hash of this -center-weight only " +
+			"match by their full hash, scan their files again or run db rehash to hash their centers")
+	}
+	centerIdx := buildBuckets(centers, radius)
+
+	pairs := make([]dupePair, 0)
+	match := func(k string, hk []uint64, matches []indexMatch, other func(string) ([]uint64, bool)) {
+		for _, m := range matches {
+			l := m.path
+			if l == k || records[l] == nil {
+				continue
+			}
+			key := [2]string{min(k, l), max(k, l)}
+			if _, seen := found[key]; seen {
+				continue
+			}
+			if d, err := recordDistance(records[k], records[l]); err == nil && d < cfg.pairThreshold(records[k], records[l]) {
+				continue
+			}
+			hl, ok := other(l)
+			if !ok || len(hl) != len(hk) {
+				continue
+			}
+			var distance int
+			for i := range hk {
+				distance += hashDistance(hk[i], hl[i])
+			}
+			if distance >= cfg.pairThreshold(records[k], records[l]) || (cfg.ignoreZero && distance == 0) {
+				continue
+			}
+			found[key] = struct{}{}
+			hotLog().Trace().Msgf("%s vs %s: %d by their centers", key[0], key[1], distance)
+			pairs = append(pairs, dupePair{a: key[0], b: key[1], distance: distance})
+		}
+	}
+	full := func(p string) ([]uint64, bool) {
+		h, err := recordHash(records[p])
+		return h, err == nil
+	}
+	for _, k := range paths {
+		if hk, ok := full(k); ok {
+			match(k, hk, centerIdx.query(hk[0], radius), centerWords)
+		}
+		if ck, ok := centerWords(k); ok {
+			match(k, ck, idx.query(ck[0], radius), full)
+			match(k, ck, centerIdx.query(ck[0], radius), centerWords)
+		}
+	}
+	log.Debug().Int("pairs", len(pairs)).Float64("center_weight", centerWeight).Msg("matched the centers")
+	return pairs
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clean actions act on the duplicates of the reported groups, never on their
+// keepers. Right before a group is cleaned, each of its members is read again
+// and checked against its record, by hash or checksum; if any of them is no
+// longer the file that was indexed, the check's verdict on the group is stale
+// and the whole group is left alone. A dry run goes as far as that check and
+// reports what it would do instead of doing it.
+//
+// Undo brings back the duplicates a destructive action removed or replaced
+// from copies of their keepers, which only restores those that were identical
+// to it. Duplicates that differ, near-duplicates, are left alone by delete,
+// hardlink, symlink and auto unless -snapshot keeps them in a snapshot or
+// -clean-near-duplicates accepts losing them.
+
+const (
+	actionNone     = "none"
+	actionDelete   = "delete"
+	actionHardlink = "hardlink"
+	actionSymlink  = "symlink"
+	actionMove     = "move"
+	actionRecycle  = "recycle"
+	// actionAuto plans one of the link actions per group, see planGroup.
+	actionAuto = "auto"
+	// actionReflink is only ever planned by actionAuto.
+	actionReflink = "reflink"
+)
+
+type cleaner struct {
+	action     string
+	quarantine string
+	// preserveTimes keeps the access and modification times of keepers, moved
+	// duplicates and the directories they are in, for tools that sort by them.
+	preserveTimes bool
+	dryRun        bool
+	// snapshot has the filesystems of the duplicates snapshotted before a
+	// destructive action, vouched lets it go on where they can't be.
+	snapshot, vouched bool
+	snapshots         []fsSnapshot
+	// nearDupes lets a destructive action clean the duplicates whose content
+	// differs from their keeper's without a snapshot, see unrecoverable.
+	nearDupes bool
+	// undoPath is where the undo log goes, a new file in the data directory
+	// if empty.
+	undoPath string
+	undo     *undoLog
+	idx      *bkTree
+	// probed and planned are what actionAuto found feasible where, and the
+	// duplicates it planned each action for.
+	probed  map[planProbe]bool
+	planned map[string]int
+
+	cleaned, skipped, failed int
+	// unrecorded counts the duplicates moved into the quarantine that its
+	// manifest failed to record, which quarantine purge then leaves alone.
+	unrecorded int
+}
+
+// clean applies the action to every duplicate in groups.
+func (c *cleaner) clean(ctx context.Context, groups []*dupeGroup) error {
+	idx, err := getIndex()
+	if err != nil {
+		return fmt.Errorf("similarity index: %w", err)
+	}
+	c.idx = idx
+	if !c.dryRun {
+		if destructiveAction(c.action) && !c.snapshot && !c.vouched {
+			return errUnvouched
+		}
+		if c.snapshot && destructiveAction(c.action) {
+			var paths []string
+			for _, g := range groups {
+				for _, dupe := range g.removable() {
+					paths = append(paths, dupe.Path)
+				}
+			}
+			if c.snapshots, err = snapshotFilesystems(paths, c.vouched); err != nil {
+				return err
+			}
+		}
+		if c.undoPath == "" {
+			if c.undoPath, err = defaultUndoLog(); err != nil {
+				return err
+			}
+		}
+		if c.undo, err = openUndoLog(c.undoPath); err != nil {
+			return fmt.Errorf("failed to open undo log: %w", err)
+		}
+		defer func() { _ = c.undo.Close() }()
+	}
+
+	var total int
+	for _, g := range groups {
+		total += len(g.duplicates())
+	}
+	progress.begin(phaseClean, total)
+	defer progress.end()
+
+cleaning:
+	for _, g := range groups {
+		if ctx.Err() != nil {
+			break
+		}
+		keeper := g.keeper()
+		if member, reason := verifyGroup(g); reason != "" {
+			role := "duplicate"
+			if member == keeper {
+				role = "keeper"
+			}
+			log.Warn().Str("caller", member.Path).Msg(role + " " + reason + ", leaving its group alone")
+			for range g.duplicates() {
+				progress.advance()
+			}
+			c.skipped += len(g.duplicates())
+			continue
+		}
+		for _, dupe := range g.edits() {
+			log.Info().Str("caller", dupe.Path).Str("keeper", keeper.Path).Msg("edited variant, leaving it for review")
+			progress.advance()
+			c.skipped++
+		}
+		action := c.action
+		if action == actionAuto {
+			if action = c.planGroup(g); action == actionNone {
+				log.Warn().Str("caller", keeper.Path).
+					Msg("group spans filesystems that can't be linked across, leaving it for review")
+				for range g.removable() {
+					progress.advance()
+				}
+				c.skipped += len(g.removable())
+				continue
+			}
+			if c.planned == nil {
+				c.planned = make(map[string]int)
+			}
+			c.planned[action] += len(g.removable())
+		}
+		for _, dupe := range g.removable() {
+			if ctx.Err() != nil {
+				break cleaning
+			}
+			progress.advance()
+			if c.unrecoverable(keeper, dupe) {
+				log.Warn().Str("caller", dupe.Path).Str("keeper", keeper.Path).Str("action", action).
+					Msg("near-duplicate that undo couldn't restore, leaving it; pass -snapshot or -clean-near-duplicates " +
+						"to clean it")
+				c.skipped++
+				continue
+			}
+			if c.dryRun {
+				log.Info().Str("caller", dupe.Path).Str("keeper", keeper.Path).Str("action", action).
+					Msg("would clean duplicate")
+				c.cleaned++
+				continue
+			}
+			if err = c.apply(action, keeper, dupe); err != nil {
+				log.Error().Err(err).Str("caller", dupe.Path).Str("action", action).Msg("clean action failed")
+				c.failed++
+				continue
+			}
+			c.cleaned++
+			audit("clean", dupe.Path, action+", keeping "+keeper.Path)
+			if err = c.forget(dupe.Path, action); err != nil {
+				return err
+			}
+		}
+	}
+
+	ev := log.Info()
+	if c.planned != nil {
+		ev = ev.Interface("planned", c.planned)
+	}
+	ev.Str("action", c.action).Int("cleaned", c.cleaned).Int("skipped", c.skipped).
+		Int("failed", c.failed).Bool("canceled", ctx.Err() != nil).Bool("dry_run", c.dryRun).
+		Msg("clean finished")
+	if c.unrecorded > 0 {
+		log.Error().Int("unrecorded", c.unrecorded).Str("quarantine", c.quarantine).
+			Msg("some moved duplicates are missing from the quarantine manifest, quarantine purge won't delete them")
+	}
+	if c.undo != nil && c.cleaned > 0 {
+		log.Info().Str("path", c.undoPath).Msg("undo log written, see the undo command")
+	}
+	if err = DB.SyncAll(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// unrecoverable reports whether the action would clean dupe without a way to
+// undo it: destructively, without a snapshot, and with dupe not an exact copy
+// of keeper, unless nearDupes accepts that.
+func (c *cleaner) unrecoverable(keeper, dupe *Image) bool {
+	if !destructiveAction(c.action) || c.snapshot || c.nearDupes {
+		return false
+	}
+	return !identicalContent(keeper.Path, dupe.Path)
+}
+
+// verifyGroup returns the first member of g that can't be acted on along with
+// the reason, or "" if every member is still the file that was indexed.
+func verifyGroup(g *dupeGroup) (*Image, string) {
+	for _, member := range g.members {
+		if reason := unchanged(member); reason != "" {
+			return member, reason
+		}
+		if reason := reverify(member); reason != "" {
+			return member, reason
+		}
+	}
+	return nil, ""
+}
+
+// reverify reads img again and returns why its content doesn't match its
+// record, or "" if it does.
+func reverify(img *Image) string {
+	if len(img.Checksum) > 0 {
+		sum, err := withFile(img.Path, contentChecksum)
+		switch {
+		case err != nil:
+			return "can't be read: " + err.Error()
+		case !bytes.Equal(sum[:], img.Checksum):
+			return "has different content than when it was indexed"
+		}
+		return ""
+	}
+	want, err := imageHash(img)
+	if err != nil {
+		return "has a broken record: " + err.Error()
+	}
+	fresh := &Image{
+		Path:      img.Path,
+		Name:      filepath.Base(img.Path),
+		ModTime:   img.ModTime,
+		Size:      img.Size,
+		closeOnce: &sync.Once{},
+		b:         bufs.Get(),
+	}
+	if err = fresh.hashOnly(); err != nil {
+		return "can't be decoded anymore: " + err.Error()
+	}
+	got, err := imageHash(fresh)
+	switch {
+	case err != nil:
+		return "can't be hashed anymore: " + err.Error()
+	case got != want:
+		return "hashes differently than when it was indexed"
+	}
+	return ""
+}
+
+// unchanged returns why img can't be acted on, or "" if it still looks like
+// the file that was ingested.
+func unchanged(img *Image) string {
+	if strings.Contains(img.Path, pageSuffix) {
+		return "is a page of a multi-page file"
+	}
+	if img.Provisional {
+		return "is provisional"
+	}
+	fi, err := os.Lstat(img.Path)
+	switch {
+	case err != nil:
+		return "can't be read: " + err.Error()
+	case !fi.Mode().IsRegular():
+		return "is no longer a regular file"
+	case !fi.ModTime().Equal(img.ModTime) || fi.Size() != img.Size:
+		return "changed since it was ingested"
+	}
+	return ""
+}
+
+// forget drops the record of a cleaned duplicate, the next scan re-ingests
+// whatever is at its path now.
+func (c *cleaner) forget(path, action string) error {
+	return buryRecord(c.idx, path, "clean "+action)
+}
+
+// record writes the undo log entry for acting on the duplicate at path.
+func (c *cleaner) record(action, path, keeper, movedTo string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	e := undoEntry{Action: action, Path: path, Keeper: keeper, MovedTo: movedTo,
+		Mode: fi.Mode(), ModTime: fi.ModTime(), Snapshot: snapshotOf(c.snapshots, path)}
+	// only moved and recycled files are restored from themselves.
+	if movedTo == "" && action != actionRecycle {
+		e.NearDuplicate = !identicalContent(path, keeper)
+	}
+	return c.undo.record(e)
+}
+
+func (c *cleaner) apply(action string, keeper, dupe *Image) error {
+	if c.preserveTimes {
+		defer saveTimes(keeper.Path, filepath.Dir(dupe.Path)).restore()
+	}
+	switch action {
+	case actionDelete, actionHardlink, actionSymlink, actionReflink:
+		if err := c.record(action, dupe.Path, keeper.Path, ""); err != nil {
+			return err
+		}
+		switch action {
+		case actionDelete:
+			return os.Remove(dupe.Path)
+		case actionHardlink:
+			return replaceWithLink(keeper.Path, dupe.Path)
+		case actionReflink:
+			return replaceWithReflink(keeper.Path, dupe.Path)
+		}
+		return replaceWithSymlink(keeper.Path, dupe.Path)
+	case actionMove, actionRecycle:
+		attached := attachedSidecars(dupe.Path)
+		if err := c.remove(dupe.Path, keeper.Path); err != nil {
+			return err
+		}
+		for _, p := range attached {
+			if err := c.remove(p, keeper.Path); err != nil {
+				log.Warn().Err(err).Str("caller", p).Str("action", c.action).Msg("failed to take the sidecar along")
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown action %q", action)
+}
+
+// remove moves path into the quarantine or the Recycle Bin.
+func (c *cleaner) remove(path, keeper string) error {
+	if c.action == actionRecycle {
+		if err := c.record(c.action, path, keeper, ""); err != nil {
+			return err
+		}
+		return recycleFile(path)
+	}
+	dst := quarantinePath(c.quarantine, path)
+	if err := c.record(c.action, path, keeper, dst); err != nil {
+		return err
+	}
+	if err := moveFile(path, dst, c.preserveTimes); err != nil {
+		return err
+	}
+	// the duplicate is gone from path either way, so it's cleaned, and the
+	// manifest failure is reported on its own.
+	if err := recordQuarantined(c.quarantine, dst, path, keeper); err != nil {
+		log.Error().Err(err).Str("caller", path).Str("moved_to", dst).
+			Msg("failed to record the moved duplicate in the quarantine manifest")
+		c.unrecorded++
+	}
+	return nil
+}
+
+// quarantinePath returns where the move action puts path within the
+// quarantine directory root. Windows paths start with a volume, which can't
+// be part of another path as it is: C:\x moves to root\C\x, and the UNC
+// path \\server\share\x to root\UNC\server\share\x.
+func quarantinePath(root, path string) string {
+	vol := filepath.VolumeName(path)
+	rest := path[len(vol):]
+	vol = strings.TrimPrefix(strings.TrimPrefix(vol, `\\?\`), `\\.\`)
+	switch {
+	case vol == "":
+	case strings.HasPrefix(vol, `\\`):
+		vol = filepath.Join("UNC", vol[2:])
+	case strings.HasPrefix(vol, `UNC\`):
+		vol = filepath.Join("UNC", vol[4:])
+	default:
+		vol = strings.TrimSuffix(vol, ":")
+	}
+	return filepath.Join(root, vol, rest)
+}
+
+type fileTimes struct {
+	atime, mtime time.Time
+}
+
+type savedTimes map[string]fileTimes
+
+// saveTimes records the times of paths, skipping those that can't be read.
+func saveTimes(paths ...string) savedTimes {
+	saved := make(savedTimes, len(paths))
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil {
+			saved[p] = fileTimes{accessTime(fi), fi.ModTime()}
+		}
+	}
+	return saved
+}
+
+func (s savedTimes) restore() {
+	for p, t := range s {
+		if err := os.Chtimes(p, t.atime, t.mtime); err != nil {
+			log.Warn().Err(err).Str("caller", p).Msg("failed to restore file times")
+		}
+	}
+}
+
+// replaceWithLink atomically swaps dupe for a hardlink to keeper. The link
+// shares the keeper's inode, so whatever of the duplicate's own ownership,
+// permissions and extended attributes differs is reported as lost.
+func replaceWithLink(keeper, dupe string) error {
+	kfi, err := os.Stat(keeper)
+	if err != nil {
+		return err
+	}
+	dfi, err := os.Lstat(dupe)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(kfi, dfi) {
+		return nil
+	}
+	lost := linkMetadataLoss(dupe, keeper, dfi, kfi)
+	tmp := dupe + ".dupehunter-link"
+	if err = os.Link(keeper, tmp); err != nil {
+		return err
+	}
+	if err = replaceFile(tmp, dupe); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if len(lost) > 0 {
+		log.Warn().Str("caller", dupe).Strs("lost", lost).
+			Msg("hardlink carries the keeper's metadata, the duplicate's could not be preserved")
+	}
+	return nil
+}
+
+// replaceWithSymlink atomically swaps dupe for a symbolic link to keeper.
+func replaceWithSymlink(keeper, dupe string) error {
+	tmp := dupe + ".dupehunter-link"
+	if err := os.Symlink(keeper, tmp); err != nil {
+		return err
+	}
+	if err := replaceFile(tmp, dupe); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// moveFile renames src to dst, copying across filesystems. Copies take the
+// permissions, ownership and extended attributes (and with them ACLs) of src,
+// and its times with preserveTimes; whatever can't be carried over is reported.
+func moveFile(src, dst string, preserveTimes bool) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	err := os.Rename(src, dst)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if err = copyFile(src, dst, fi.Mode().Perm()); err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	lost := copyMetadata(src, dst, fi)
+	if preserveTimes {
+		if err = os.Chtimes(dst, accessTime(fi), fi.ModTime()); err != nil {
+			lost = append(lost, "times")
+		}
+	}
+	if len(lost) > 0 {
+		log.Warn().Str("caller", src).Strs("lost", lost).Msg("moved across filesystems, some metadata could not be preserved")
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// the umask may have narrowed perm on create.
+		err = os.Chmod(dst, perm)
+	}
+	return err
+}
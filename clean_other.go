@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+func replaceFile(src, dst string) error {
+	return os.Rename(src, dst)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// errorNotSameDevice is what renaming across volumes fails with on Windows.
+const errorNotSameDevice = syscall.Errno(17)
+
+func isCrossDevice(err error) bool {
+	return errors.Is(err, errorNotSameDevice) || errors.Is(err, syscall.EXDEV)
+}
+
+// replaceFile renames src over dst. Windows refuses to replace read-only
+// files, which duplicates copied off cameras and optical media often are, so
+// the attribute is cleared first; the replacement has its own attributes.
+func replaceFile(src, dst string) error {
+	if fi, err := os.Lstat(dst); err == nil && fi.Mode().Perm()&0o200 == 0 {
+		if err = os.Chmod(dst, fi.Mode().Perm()|0o200); err != nil {
+			return err
+		}
+	}
+	return os.Rename(src, dst)
+}
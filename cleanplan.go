@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// -action auto picks the action for each group by the filesystems it spans.
+// Duplicates on the keeper's filesystem are replaced with a reflink of the
+// keeper where the filesystem can clone files, which keeps their own
+// permissions and frees the same as a hardlink, or else with a hardlink.
+// A group spanning filesystems can only be linked symbolically, and where
+// even that isn't possible, e.g. without the privilege on Windows, the group
+// is only reported: moving its duplicates instead would copy them. Whether an
+// action works in a directory is found out by trying it on a probe file
+// there, once per directory. Dry runs write nothing, probes included, and
+// guess it from the type of the filesystem instead, see filesystemAllows.
+
+// planProbe is an action tried in a directory.
+type planProbe struct {
+	action, dir string
+}
+
+// planGroup returns the best action feasible for the removable duplicates of
+// g, actionNone if there is none.
+func (c *cleaner) planGroup(g *dupeGroup) string {
+	keeper := g.keeper().Path
+	kfi, err := os.Stat(keeper)
+	if err != nil {
+		return actionNone
+	}
+	device := deviceOf(keeper, kfi)
+	crossing := false
+	for _, dupe := range g.removable() {
+		fi, err := os.Lstat(dupe.Path)
+		if err != nil || deviceOf(dupe.Path, fi) != device {
+			crossing = true
+			break
+		}
+	}
+	candidates := []string{actionReflink, actionHardlink}
+	if crossing {
+		candidates = []string{actionSymlink}
+	}
+	for _, action := range candidates {
+		if c.feasible(action, keeper, g.removable()) {
+			return action
+		}
+	}
+	return actionNone
+}
+
+// deviceOf names the filesystem the file at path is on, by its device where
+// the platform tells it, or else by its volume.
+func deviceOf(path string, fi os.FileInfo) string {
+	if id, ok := fileID(fi); ok {
+		return strconv.FormatUint(id.dev, 10)
+	}
+	abs, _ := filepath.Abs(path)
+	return filepath.VolumeName(abs)
+}
+
+// feasible reports whether action works for keeper in the directories of
+// every one of dupes.
+func (c *cleaner) feasible(action, keeper string, dupes []*Image) bool {
+	if c.probed == nil {
+		c.probed = make(map[planProbe]bool)
+	}
+	for _, dupe := range dupes {
+		p := planProbe{action: action, dir: filepath.Dir(dupe.Path)}
+		ok, seen := c.probed[p]
+		if !seen {
+			if c.dryRun {
+				ok = filesystemAllows(action, p.dir)
+			} else {
+				ok = probeAction(action, keeper, p.dir)
+			}
+			c.probed[p] = ok
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// probeAction tries linking keeper into dir with action.
+func probeAction(action, keeper, dir string) bool {
+	f, err := os.CreateTemp(dir, ".dupehunter-probe-*")
+	if err != nil {
+		return false
+	}
+	probe := f.Name()
+	_ = f.Close()
+	_ = os.Remove(probe)
+	switch action {
+	case actionReflink:
+		err = reflinkFile(keeper, probe, 0o600)
+	case actionHardlink:
+		err = os.Link(keeper, probe)
+	case actionSymlink:
+		err = os.Symlink(keeper, probe)
+	}
+	_ = os.Remove(probe)
+	return err == nil
+}
+
+// replaceWithReflink atomically swaps dupe for a reflink of keeper, a file of
+// its own that shares the keeper's extents. Unlike a hardlink it takes the
+// permissions, ownership and extended attributes of the duplicate, whatever
+// of them can be carried over.
+func replaceWithReflink(keeper, dupe string) error {
+	dfi, err := os.Lstat(dupe)
+	if err != nil {
+		return err
+	}
+	tmp := dupe + ".dupehunter-link"
+	if err = reflinkFile(keeper, tmp, dfi.Mode().Perm()); err != nil {
+		return err
+	}
+	lost := copyMetadata(dupe, tmp, dfi)
+	if err = replaceFile(tmp, dupe); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if len(lost) > 0 {
+		log.Warn().Str("caller", dupe).Strs("lost", lost).Msg("reflink could not take all of the duplicate's metadata")
+	}
+	return nil
+}
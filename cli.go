@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// ErrUsage marks errors caused by invalid invocations. The offending message and
+// the usage of the command have already been printed when it is returned.
+var ErrUsage = errors.New("usage error")
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+// newFlagSet returns a flag set whose generated help shows the synopsis and
+// description of the command alongside its flags.
+func newFlagSet(name, synopsis, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		out := fs.Output()
+		_, _ = fmt.Fprintf(out, "usage: dupehunter %s\n", strings.TrimSpace(name+" "+synopsis))
+		if description != "" {
+			_, _ = fmt.Fprintf(out, "\n%s\n", description)
+		}
+		var hasFlags bool
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			_, _ = fmt.Fprintln(out, "\nflags:")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// parseFlags parses args into fs, wrapping anything but a help request in ErrUsage.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return fmt.Errorf("%w: %w", ErrUsage, err)
+	}
+	return nil
+}
+
+// parseInterspersed parses args into fs while allowing flags to follow positional
+// arguments, returning the positional arguments in order.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional = make([]string, 0, len(args))
+	for {
+		if err := parseFlags(fs, args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// usageError prints msg followed by the usage of fs and returns ErrUsage.
+func usageError(fs *flag.FlagSet, format string, a ...any) error {
+	msg := fmt.Sprintf(format, a...)
+	_, _ = fmt.Fprintln(fs.Output(), msg)
+	fs.Usage()
+	return fmt.Errorf("%w: %s", ErrUsage, msg)
+}
+
+func printCommands(w io.Writer, prefix string, cmds []command) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "\ncommands:")
+	for _, cmd := range cmds {
+		_, _ = fmt.Fprintf(tw, "  %s\t%s\n", strings.TrimSpace(prefix+" "+cmd.name), cmd.summary)
+	}
+	_ = tw.Flush()
+}
+
+// dispatch runs the command in cmds named by the first argument.
+func dispatch(fs *flag.FlagSet, cmds []command, args []string) error {
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usageError(fs, "missing command")
+	}
+	for _, cmd := range cmds {
+		if cmd.name == fs.Arg(0) {
+			return cmd.run(fs.Args()[1:])
+		}
+	}
+	return usageError(fs, "%s: %s", ErrUnknownCommand, fs.Arg(0))
+}
+
+// errDuplicatesFound ends runs writing an -output report listing duplicates.
+var errDuplicatesFound = errors.New("duplicates found")
+
+// exitDuplicates is the exit status of runs writing an -output report that
+// lists duplicates, for scripts to tell them from clean runs and failures.
+const exitDuplicates = 3
+
+// exitCode maps an error returned by a command to the process exit status.
+func exitCode(err error) int {
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, ErrUsage):
+		return 2
+	case errors.Is(err, errDuplicatesFound):
+		return exitDuplicates
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.tcp.direct/tcp.direct/database"
+	"git.tcp.direct/tcp.direct/database/loader"
+	"git.tcp.direct/tcp.direct/database/pogreb"
+	"github.com/bytedance/sonic"
+)
+
+// Collections are independent indexes, each a database of its own, e.g. a
+// "staging" area of new imports kept apart from the "library". The unnamed
+// collection is the index dupehunter has always used.
+
+// dbOverride is where -db keeps the main index instead.
+var dbOverride string
+
+// dataDir returns the directory holding the main index, the collections and
+// what is recorded next to them.
+func dataDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine home directory: %w", err)
+	}
+	return filepath.Join(home, ".local/share/dupehunter"), nil
+}
+
+func collectionPath(name string) (string, error) {
+	if name == "" && dbOverride != "" {
+		return dbOverride, nil
+	}
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return filepath.Join(dir, "db"), nil
+	}
+	return filepath.Join(dir, "collections", name), nil
+}
+
+func validCollectionName(name string) bool {
+	return name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+func collectionLabel(name string) string {
+	if name == "" {
+		return "the main index"
+	}
+	return "collection " + name
+}
+
+// scopeUnder drops the hashes, and records if given, outside of dir,
+// returning hashes.
+func scopeUnder(hashes map[string]uint64, records map[string]*Image, dir string) map[string]uint64 {
+	maps.DeleteFunc(hashes, func(p string, _ uint64) bool { return !withinDir(p, dir) })
+	if records != nil {
+		maps.DeleteFunc(records, func(p string, _ *Image) bool { return !withinDir(p, dir) })
+	}
+	return hashes
+}
+
+// loadRecords reads every record of an images store along with the hashes of
+// those that are images.
+func loadRecords(store database.Filer) (map[string]uint64, map[string]*Image, error) {
+	var (
+		hashes  = make(map[string]uint64)
+		records = make(map[string]*Image)
+	)
+	for _, k := range store.Keys() {
+		dat, err := store.Get(k)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch %s: %w", string(k), err)
+		}
+		log.Trace().Msgf("%s: %s", string(k), string(dat))
+		i := &Image{}
+		if err = sonic.Unmarshal(dat, i); err != nil {
+			return nil, nil, fmt.Errorf("json deserialize fail: %w", err)
+		}
+		records[i.Path] = i
+		if len(i.PHash) == 0 {
+			continue
+		}
+		h, err := imageHash(i)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load image hash for %s: %w", i.Path, err)
+		}
+		hashes[i.Path] = h
+	}
+	return hashes, records, nil
+}
+
+// loadCollection reads the records of another, existing collection.
+func loadCollection(name string) (map[string]uint64, map[string]*Image, error) {
+	dest, err := collectionPath(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = os.Stat(dest); errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("%s does not exist", collectionLabel(name))
+	}
+	keeper, err := loader.OpenKeeper(dest, &pogreb.WrappedOptions{AllowRecovery: true})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open %s: %w", collectionLabel(name), err)
+	}
+	defer func() { _ = keeper.CloseAll() }()
+	if err = keeper.Init("images", &pogreb.WrappedOptions{AllowRecovery: true}); err != nil &&
+		!errors.Is(err, pogreb.ErrStoreExists) {
+		return nil, nil, err
+	}
+	return loadRecords(keeper.With("images"))
+}
+
+func runCheck(args []string) error {
+	fs := newFlagSet("check", "[--against COLLECTION | --remote HOST] [--under DIR [--against-all]] [--time-budget DURATION]",
+		"Report near-duplicates in the index without ingesting anything.\n"+
+			"With --under, only the images within DIR are compared, among themselves or, with --against-all,\n"+
+			"with the whole index, which is quicker than checking everything when working through a folder.\n"+
+			"With --against, only pairs with one image in each collection are reported. Against a canonical\n"+
+			"collection (see db pin), its images are always kept and -action cleans the duplicates in this one.\n"+
+			"With --remote, the images also indexed by the dupehunter serving at HOST are reported, "+
+			"exchanging only hashes likely to match; the token goes in $"+remoteTokenEnv+".\n"+
+			"With --time-budget, the most promising images are compared first and whatever was found when\n"+
+			"the time is up is reported, marked as partial, for quick passes over huge libraries.")
+	against := fs.String("against", "", "compare the index against the other `collection` instead of itself")
+	remote := fs.String("remote", "", "compare the index against the one served at `host` (address or URL)")
+	under := fs.String("under", "", "only check the images within `directory`")
+	againstAll := fs.Bool("against-all", false, "with --under, compare them with the whole index rather than among themselves")
+	timeBudget := fs.Duration("time-budget", 0, "report what was found within `duration`, e.g. 10m, as partial results")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument: %s", fs.Arg(0))
+	}
+
+	cfg := rootConfig
+	if *remote != "" {
+		switch {
+		case *against != "":
+			return usageError(fs, "--against and --remote are two different checks, pick one")
+		case cfg.action != actionNone:
+			return usageError(fs, "-action can't clean another machine's images")
+		case *under != "":
+			return usageError(fs, "--under only scopes checks of the local index")
+		case window.active():
+			return usageError(fs, "-newer-than and -older-than only scope checks of the local index")
+		case *timeBudget != 0:
+			return usageError(fs, "--time-budget only bounds checks of the local index")
+		case cfg.maxDistance-1 > overlapMaxRadius:
+			return usageError(fs, "--remote compares within -d %d at most", overlapMaxRadius+1)
+		}
+		return checkRemote(*remote, cfg.maxDistance)
+	}
+	if *against != "" {
+		switch {
+		case !validCollectionName(*against):
+			return usageError(fs, "invalid collection name %q", *against)
+		case *against == cfg.collection:
+			return usageError(fs, "can't check %s against itself", collectionLabel(*against))
+		case cfg.action != actionNone && (!isCanonical(*against) || isCanonical(cfg.collection)):
+			// only the duplicates of this collection can be cleaned.
+			return usageError(fs, "-action can only clean across collections against a canonical one, see db pin")
+		}
+	}
+	switch {
+	case *timeBudget < 0:
+		return usageError(fs, "--time-budget must not be negative")
+	case *timeBudget > 0 && cfg.action != actionNone:
+		return usageError(fs, "-action can't clean partial results, the keeper of a group may not have been found")
+	}
+	if *againstAll && *under == "" {
+		return usageError(fs, "--against-all applies to --under")
+	}
+	if *under != "" {
+		dir, err := filepath.Abs(expandHome(*under))
+		if err != nil {
+			return err
+		}
+		cfg.under, cfg.againstAll = dir, *againstAll
+	}
+	cfg.against, cfg.compare = *against, *against != ""
+
+	budget.begin(*timeBudget)
+	sum, err := checkAll(cfg)
+	if cfg.f != nil {
+		_ = cfg.f.Sync()
+		_ = cfg.f.Close()
+	}
+	if err == nil && cfg.output != "" && sum.shown > 0 {
+		err = errDuplicatesFound
+	}
+	return err
+}
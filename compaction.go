@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rawpogreb "github.com/akrylysov/pogreb"
+)
+
+// pogreb compacts a store segment by segment, taking its lock for one
+// record at a time, so records are read and written all along and nothing
+// has to stop for it. serve --compact-every schedules compaction, within
+// --compact-window if given, e.g. at night; db compact runs it right away.
+// The daemon stays ready meanwhile, as it would be held off for nothing.
+
+// compacter is a store backend that compacts itself online.
+type compacter interface {
+	Compact() (rawpogreb.CompactionResult, error)
+}
+
+// compaction keeps two compactions from running at once.
+var compaction sync.Mutex
+
+// compactStores compacts every store whose backend supports it.
+func compactStores() error {
+	if !compaction.TryLock() {
+		return errors.New("compaction already running")
+	}
+	defer compaction.Unlock()
+	var (
+		errs      []error
+		compacted int
+	)
+	for _, name := range storeNames {
+		backend, ok := DB.With(name).Backend().(compacter)
+		if !ok {
+			// the memory backend has nothing to reclaim.
+			continue
+		}
+		compacted++
+		started := time.Now()
+		res, err := backend.Compact()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to compact %s: %w", name, err))
+			continue
+		}
+		log.Info().Str("store", name).Int("segments", res.CompactedSegments).
+			Int("records", res.ReclaimedRecords).Int("bytes", res.ReclaimedBytes).
+			Dur("elapsed", time.Since(started)).Msg("store compacted")
+	}
+	if compacted == 0 {
+		log.Info().Msg("the database backend has nothing to compact")
+	}
+	return errors.Join(errs...)
+}
+
+// compactionWindow is a daily span of local time, from and to being offsets
+// from midnight. A window ending before it starts spans midnight.
+type compactionWindow struct {
+	from, to time.Duration
+}
+
+// parseCompactionWindow parses "HH:MM-HH:MM".
+func parseCompactionWindow(s string) (*compactionWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, errors.New("expected HH:MM-HH:MM")
+	}
+	w := &compactionWindow{}
+	var err error
+	if w.from, err = parseClock(from); err != nil {
+		return nil, err
+	}
+	if w.to, err = parseClock(to); err != nil {
+		return nil, err
+	}
+	if w.from == w.to {
+		return nil, errors.New("window is empty")
+	}
+	return w, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	hh, mm, ok := strings.Cut(strings.TrimSpace(s), ":")
+	h, hErr := strconv.Atoi(hh)
+	m, mErr := strconv.Atoi(mm)
+	if !ok || hErr != nil || mErr != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// contains reports whether t falls within the window, always when there is none.
+func (w *compactionWindow) contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.from < w.to {
+		return clock >= w.from && clock < w.to
+	}
+	return clock >= w.from || clock < w.to
+}
+
+// scheduleCompaction compacts the stores every interval, waiting for the
+// window to open when one is given.
+func scheduleCompaction(every time.Duration, window *compactionWindow) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	last := time.Now()
+	for now := range ticker.C {
+		if now.Sub(last) < every || !window.contains(now) {
+			continue
+		}
+		if err := compactStores(); err != nil {
+			log.Error().Err(err).Msg("scheduled compaction failed")
+		}
+		last = now
+	}
+}
+
+func dbCompact(args []string) error {
+	fs := newFlagSet("db compact", "",
+		"Reclaim the space of removed and overwritten records, see serve --compact-every for doing it\n"+
+			"on a schedule.")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument: %s", fs.Arg(0))
+	}
+	return compactStores()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// -suggest-conversions adds a section to the -output report for the groups
+// whose keeper is a lossless original and whose duplicates include lossy
+// re-encodes of it, a PNG kept over JPEGs made from it say. For each such
+// keeper it estimates the size of a lossless WebP of it, which keeps every
+// pixel, and of an AVIF at about the quality of the JPEGs, which could stand
+// in for both. The estimates are rough averages, not measurements: nothing
+// is encoded, let alone converted.
+
+const (
+	// webpLosslessRatio is the size of a lossless WebP to that of the PNG
+	// it was made from. Sources less compressed than PNG shrink further, so
+	// it underestimates their savings.
+	webpLosslessRatio = 0.74
+	// avifRatio is the size of an AVIF to that of a JPEG of the same
+	// image at about the same quality.
+	avifRatio = 0.5
+)
+
+// losslessTypes are the types a keeper must be for a conversion suggestion.
+var losslessTypes = map[ImageType]bool{PNG: true, TIFF: true, BMP: true}
+
+type conversionSuggestion struct {
+	// Group is the ID of the group, see groupID.
+	Group  string `json:"group"`
+	Keeper string `json:"keeper"`
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+	// Lossy is how many of the duplicates are lossy re-encodes.
+	Lossy        int   `json:"lossy_duplicates"`
+	WebPLossless int64 `json:"webp_lossless"`
+	AVIF         int64 `json:"avif"`
+}
+
+type conversionSection struct {
+	Suggestions []conversionSuggestion `json:"suggestions"`
+	// the savings are of the keepers converted, the duplicates aside.
+	WebPSavings int64 `json:"webp_lossless_savings"`
+	AVIFSavings int64 `json:"avif_savings"`
+}
+
+// suggestConversions estimates the savings of converting the lossless
+// keepers of groups with lossy duplicates.
+func suggestConversions(groups []*dupeGroup) conversionSection {
+	section := conversionSection{Suggestions: make([]conversionSuggestion, 0)}
+	for _, g := range groups {
+		keeper := g.keeper()
+		if !losslessTypes[keeper.Type] || keeper.Size == 0 {
+			continue
+		}
+		var (
+			lossy int
+			// avif is estimated from the smallest JPEG, scaled to the
+			// dimensions of the keeper.
+			avif int64 = -1
+		)
+		for _, dupe := range g.duplicates() {
+			if dupe.Type != JPEG {
+				continue
+			}
+			lossy++
+			size := float64(dupe.Size)
+			if keeper.Width > 0 && keeper.Height > 0 && dupe.Width > 0 && dupe.Height > 0 {
+				size *= float64(keeper.Width*keeper.Height) / float64(dupe.Width*dupe.Height)
+			}
+			if estimate := int64(size * avifRatio); avif < 0 || estimate < avif {
+				avif = estimate
+			}
+		}
+		if lossy == 0 {
+			continue
+		}
+		s := conversionSuggestion{
+			Group:        groupID(g),
+			Keeper:       displayPath(keeper.Path),
+			Format:       keeper.Type.String(),
+			Size:         keeper.Size,
+			Lossy:        lossy,
+			WebPLossless: int64(float64(keeper.Size) * webpLosslessRatio),
+			AVIF:         min(avif, keeper.Size),
+		}
+		section.Suggestions = append(section.Suggestions, s)
+		section.WebPSavings += s.Size - s.WebPLossless
+		section.AVIFSavings += s.Size - s.AVIF
+	}
+	return section
+}
+
+// writeConversions writes section as the text of a report.
+func writeConversions(w io.Writer, section conversionSection) error {
+	if len(section.Suggestions) == 0 {
+		_, err := fmt.Fprintln(w, "no lossless keepers with lossy duplicates to convert")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "estimated conversions of lossless keepers with lossy duplicates")
+	_, _ = fmt.Fprintln(tw, "  GROUP\tFORMAT\tSIZE\tWEBP LOSSLESS\tAVIF\tKEEPER")
+	for _, s := range section.Suggestions {
+		_, _ = fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\t%s\n", s.Group, s.Format, formatBytes(s.Size),
+			formatBytes(s.WebPLossless), formatBytes(s.AVIF), s.Keeper)
+	}
+	_, _ = fmt.Fprintf(tw, "  saving\t\t\t%s\t%s\n", formatBytes(section.WebPSavings), formatBytes(section.AVIFSavings))
+	return tw.Flush()
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/corona10/goimagehash"
+)
+
+var ErrUnknownCommand = errors.New("unknown command")
+
+var dbCommands = []command{
+	{"ls", "list indexed records", func(args []string) error { return dbLs(args, os.Stdout) }},
+	{"rm", "remove records by path or pattern", func(args []string) error { return dbRm(args, os.Stdout) }},
+	{"backup", "write a checksummed snapshot of the index", dbBackup},
+	{"restore", "restore the index from a snapshot", dbRestore},
+	{"purge", "permanently remove the tombstones of removed records", dbPurge},
+	{"pin", "pin the collection as canonical, never proposing its images for deletion", dbPin(false)},
+	{"unpin", "stop treating the collection as canonical", dbPin(true)},
+	{"warm", "load the index and read the database through, e.g. at boot", dbWarm},
+	{"reindex", "rebuild the similarity index from the stored records", dbReindex},
+	{"compact", "reclaim the space of removed and overwritten records", dbCompact},
+	{"fsck", "verify the records against their checksums and repair corrupt ones", dbFsck},
+	{"recover", "salvage what can be read of a database that fails to open into a new one", dbRecover},
+	{"rehash", "hash the files of the records again, e.g. those of -stat-only scans", dbRehash},
+	{"export", "export the records, or only their hashes under salted identifiers", dbExport},
+	{"prune", "remove the records of files that are gone or changed since", func(args []string) error {
+		return dbPrune(args, os.Stdout)
+	}},
+	{"stats", "summarize the records and the size of the index", func(args []string) error {
+		return dbStats(args, os.Stdout)
+	}},
+	{"import", "import the records of a db export", dbImport},
+	{"overlap", "list the records that also appear in someone else's hash export", func(args []string) error {
+		return dbOverlap(args, os.Stdout)
+	}},
+}
+
+func runDB(args []string) error {
+	fs := newFlagSet("db", "<command> [flags]", "Inspect and maintain the image index.")
+	usage := fs.Usage
+	fs.Usage = func() {
+		usage()
+		printCommands(fs.Output(), "db", dbCommands)
+	}
+	return dispatch(fs, dbCommands, args)
+}
+
+// forEachRecord deserializes every record in the images store and hands it to fn.
+func forEachRecord(fn func(img *Image) error) error {
+	return imageStore.each(func(k, dat []byte) error {
+		img := &Image{}
+		if err := sonic.Unmarshal(dat, img); err != nil {
+			return fmt.Errorf("json deserialize fail for %s: %w", string(k), err)
+		}
+		return fn(img)
+	})
+}
+
+// matchFilter reports whether path matches the glob pattern. Patterns without
+// a path separator are matched against the base name, like find -name.
+func matchFilter(pattern, path string) bool {
+	if pattern == "" {
+		return true
+	}
+	if !strings.ContainsRune(pattern, filepath.Separator) {
+		path = filepath.Base(path)
+	}
+	ok, _ := filepath.Match(pattern, path)
+	return ok
+}
+
+func (img *Image) hashString() string {
+	if len(img.PHash) == 0 {
+		return ""
+	}
+	if extendedLayout(img.layout()) {
+		h, err := goimagehash.LoadExtImageHash(bytes.NewReader(img.PHash))
+		if err != nil {
+			return "invalid"
+		}
+		return h.ToString()
+	}
+	h, err := goimagehash.LoadImageHash(bytes.NewReader(img.PHash))
+	if err != nil {
+		return "invalid"
+	}
+	return h.ToString()
+}
+
+type listedRecord struct {
+	// Path is the display form of the path, PathBytes the path itself when
+	// it isn't valid UTF-8.
+	Path        string    `json:"path"`
+	PathBytes   []byte    `json:"path_bytes,omitempty"`
+	Type        string    `json:"type"`
+	ClaimedType string    `json:"claimed_type"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Hash        string    `json:"hash"`
+	Ingested    time.Time `json:"ingested"`
+	Origin      string    `json:"origin,omitempty"`
+	Provisional bool      `json:"provisional,omitempty"`
+	// Revisions counts the earlier hashes kept from before the file changed.
+	Revisions int `json:"revisions,omitempty"`
+	// Removed and RemovedReason are only set for tombstones.
+	Removed       *time.Time `json:"removed,omitempty"`
+	RemovedReason string     `json:"removed_reason,omitempty"`
+}
+
+func (img *Image) listed() listedRecord {
+	return listedRecord{
+		Path:        displayPath(img.Path),
+		PathBytes:   rawPath(img.Path),
+		Type:        img.Type.String(),
+		ClaimedType: img.claimed(),
+		Width:       img.Width,
+		Height:      img.Height,
+		Hash:        img.hashString(),
+		Ingested:    img.Ingested,
+		Origin:      img.Origin.String(),
+		Provisional: img.Provisional,
+		Revisions:   len(img.History),
+	}
+}
+
+func dbLs(args []string, w io.Writer) error {
+	fs := newFlagSet("db ls", "[--filter GLOB] [--mismatched] [--removed] [--format json|csv|table] [--fields LIST]",
+		"List indexed records with their type, dimensions, hash, and ingest time.")
+	filter := fs.String("filter", "", "only list records whose path (or base name) matches this `glob`")
+	mismatched := fs.Bool("mismatched", false, "only list records whose extension does not match their content")
+	removed := fs.Bool("removed", false, "list the tombstones of removed records instead, with when and why they were removed")
+	format := fs.String("format", "table", "output `format`: json, csv, or table")
+	fieldList := fs.String("fields", "", "only output these comma-separated `fields` with json and csv, e.g. "+
+		"path,size,hash; see db export --fields for the names")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument: %s", fs.Arg(0))
+	}
+
+	var (
+		tw     *tabwriter.Writer
+		cw     *csv.Writer
+		fields []recordField
+		enc    = sonic.ConfigDefault.NewEncoder(w)
+		err    error
+	)
+	if *fieldList != "" {
+		if *format == "table" {
+			return usageError(fs, "--fields only applies to --format json and csv")
+		}
+		if fields, err = parseFields(*fieldList); err != nil {
+			return usageError(fs, "invalid value for --fields: %s", err)
+		}
+	}
+
+	switch *format {
+	case "csv":
+		if fields == nil {
+			list := "path,type,width,height,hash,ingested,origin"
+			if *removed {
+				list += ",removed,removed_reason"
+			}
+			fields, _ = parseFields(list)
+		}
+		if cw, err = newFieldsCSV(w, fields); err != nil {
+			return err
+		}
+	case "table":
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		header := "PATH\tTYPE\tDIMENSIONS\tHASH\tINGESTED\tORIGIN"
+		if *removed {
+			header += "\tREMOVED\tREASON"
+		}
+		_, _ = fmt.Fprintln(tw, header)
+	case "json":
+	default:
+		return usageError(fs, "unknown format %q, expected json, csv, or table", *format)
+	}
+
+	list := func(img *Image, t *tombstone) error {
+		if !matchFilter(*filter, img.Path) || *mismatched && img.ClaimedType == img.Type {
+			return nil
+		}
+		switch {
+		case cw != nil:
+			return cw.Write(fieldsCSV(fields, img, t))
+		case fields != nil:
+			return writeFieldsJSON(w, fields, img, t)
+		}
+		rec := img.listed()
+		if t != nil {
+			removedAt := t.Removed
+			rec.Removed, rec.RemovedReason = &removedAt, t.Reason
+		}
+		if tw == nil {
+			return enc.Encode(rec)
+		}
+		ingested := "-"
+		if !rec.Ingested.IsZero() {
+			ingested = rec.Ingested.Format(time.RFC3339)
+		}
+		typ := rec.Type
+		if img.ClaimedType != img.Type {
+			typ += " (claims " + rec.ClaimedType + ")"
+		}
+		origin := rec.Origin
+		if origin == "" {
+			origin = "-"
+		}
+		line := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s", rec.Path, typ,
+			strconv.Itoa(rec.Width)+"x"+strconv.Itoa(rec.Height), rec.Hash, ingested, origin)
+		if t != nil {
+			line += "\t" + t.Removed.Format(time.RFC3339) + "\t" + t.Reason
+		}
+		_, err := fmt.Fprintln(tw, line)
+		return err
+	}
+	if *removed {
+		err = forEachTombstone(func(t *tombstone) error { return list(t.Record, t) })
+	} else {
+		err = forEachRecord(func(img *Image) error { return list(img, nil) })
+	}
+
+	if tw != nil {
+		if flushErr := tw.Flush(); flushErr != nil && err == nil {
+			err = flushErr
+		}
+	}
+	if cw != nil {
+		if cw.Flush(); cw.Error() != nil && err == nil {
+			err = cw.Error()
+		}
+	}
+
+	return err
+}
+
+// matchTarget reports whether the record at path is selected by target, which may be
+// a glob pattern, an exact path, or a directory whose whole subtree is selected.
+func matchTarget(target, path string) bool {
+	if strings.ContainsAny(target, "*?[") {
+		return matchFilter(target, path)
+	}
+	if abs, err := filepath.Abs(target); err == nil {
+		target = abs
+	}
+	return path == target || strings.HasPrefix(path, target+pageSuffix) ||
+		strings.HasPrefix(path, strings.TrimSuffix(target, string(filepath.Separator))+string(filepath.Separator))
+}
+
+func dbRm(args []string, w io.Writer) error {
+	fs := newFlagSet("db rm", "[--dry-run] <glob|path>...",
+		"Remove records by exact path, glob pattern, or directory (removing its whole subtree).")
+	dryRun := fs.Bool("dry-run", false, "only print the records that would be removed")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usageError(fs, "at least one path or glob pattern is required")
+	}
+
+	idx, err := getIndex()
+	if err != nil {
+		return err
+	}
+
+	var removed int
+	for _, k := range imageStore.Keys() {
+		path := string(k)
+		if !selectedBy(fs.Args(), path) {
+			continue
+		}
+		if *dryRun {
+			_, _ = fmt.Fprintf(w, "would remove: %s\n", path)
+			removed++
+			continue
+		}
+		if err := buryRecord(idx, path, "db rm"); err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(w, "removed: %s\n", path)
+		removed++
+	}
+
+	log.Info().Int("count", removed).Bool("dry_run", *dryRun).Msg("db rm finished")
+	return nil
+}
+
+func dbReindex(args []string) error {
+	fs := newFlagSet("db reindex", "", "Discard the similarity index and rebuild it from the stored records.")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument: %s", fs.Arg(0))
+	}
+	idx, err := rebuildIndex()
+	if err != nil {
+		return err
+	}
+	log.Info().Int("records", len(idx.byPath)).Msg("similarity index rebuilt")
+	return nil
+}
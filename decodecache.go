@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Copies of a file within one scan are decoded and hashed once: every image
+// hashed is remembered by its size, and an image of a size remembered already
+// is checksummed before it's decoded. If its content matches one of the
+// images of its size, it takes the type, dimensions, and hashes of that one
+// instead. The images it is compared with are checksummed only then, each
+// once, so that scans without copies of the same size read nothing twice.
+// -exact-prefilter does the same ahead of the scan for all of its paths, at
+// the cost of having all of them at hand.
+
+// decodedImage is the result of decoding and hashing an image of a scan.
+type decodedImage struct {
+	path    string
+	modTime time.Time
+
+	sumOnce sync.Once
+	sum     *[sha256.Size]byte
+
+	typ           ImageType
+	width, height int
+	hash          []byte
+	layout        string
+	center        *centerHash
+	grayscale     bool
+}
+
+// checksum returns the content checksum of the file of d, nil if it changed
+// since d was decoded or can't be read.
+func (d *decodedImage) checksum() *[sha256.Size]byte {
+	d.sumOnce.Do(func() {
+		if d.sum != nil {
+			return
+		}
+		fi, err := os.Stat(d.path)
+		if err != nil || !fi.ModTime().Equal(d.modTime) {
+			return
+		}
+		if sum, err := withFile(d.path, contentChecksum); err == nil {
+			d.sum = &sum
+		}
+	})
+	return d.sum
+}
+
+// decodeCache holds the images a scan decoded, by size.
+type decodeCache struct {
+	mu     sync.Mutex
+	bySize map[int64][]*decodedImage
+	reused atomic.Int64
+}
+
+var decodes = &decodeCache{}
+
+func (c *decodeCache) reset() {
+	c.mu.Lock()
+	c.bySize = make(map[int64][]*decodedImage)
+	c.mu.Unlock()
+	c.reused.Store(0)
+}
+
+// reuse gives img the result of an identical image decoded before, reporting
+// whether there was one. The opened file of img is closed if so, and the
+// checksum of its content is kept for remember either way.
+func (c *decodeCache) reuse(img *Image) bool {
+	c.mu.Lock()
+	same := c.bySize[img.Size]
+	c.mu.Unlock()
+	if len(same) == 0 {
+		return false
+	}
+	sum, err := contentChecksum(img.f)
+	if err != nil {
+		return false
+	}
+	img.content = &sum
+	for _, d := range same {
+		if other := d.checksum(); other == nil || !bytes.Equal(other[:], sum[:]) {
+			continue
+		}
+		img.Type, img.Width, img.Height, img.Grayscale = d.typ, d.width, d.height, d.grayscale
+		img.PHash, img.HashLayout, img.Center = d.hash, d.layout, d.center
+		img.reused = true
+		_ = img.f.Close()
+		c.reused.Add(1)
+		hotLog().Trace().Str("caller", img.Name).Str("copy_of", d.path).Msg("reusing the decode of an identical file")
+		return true
+	}
+	// decoding reads the file from where the checksum left it.
+	_, _ = img.f.Seek(0, io.SeekStart)
+	return false
+}
+
+// remember keeps the result of decoding and hashing img.
+func (c *decodeCache) remember(img *Image) {
+	if img.reused || img.Provisional || len(img.PHash) == 0 {
+		return
+	}
+	d := &decodedImage{path: img.Path, modTime: img.ModTime, sum: img.content,
+		typ: img.Type, width: img.Width, height: img.Height, hash: img.PHash, layout: img.HashLayout,
+		center: img.Center, grayscale: img.Grayscale}
+	c.mu.Lock()
+	if c.bySize != nil {
+		c.bySize[img.Size] = append(c.bySize[img.Size], d)
+	}
+	c.mu.Unlock()
+}
+
+func (c *decodeCache) summarize() {
+	if n := c.reused.Load(); n > 0 {
+		log.Info().Int64("files", n).Msg("reused the decodes of identical files")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// A dedupe report hands the duplicates to the filesystem instead of removing
+// them: btrfs and XFS can share the extents of identical files, as can ZFS
+// with block cloning, and each file stays where it is. Only byte-identical
+// files can share extents, so the report lists the sets of those within each
+// group, in the format of fdupes, which is what `duperemove --fdupes` reads:
+// one path per line, sets separated by a blank line. Hardlinks of one file
+// already share everything and are listed once.
+
+// writeDedupeReport writes the sets of byte-identical files within groups to
+// path and returns how many sets it found.
+func writeDedupeReport(path string, groups []*dupeGroup) (int, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		w    = bufio.NewWriter(f)
+		sets int
+	)
+	for _, g := range groups {
+		paths := make([]string, len(g.members))
+		for i, img := range g.members {
+			paths[i] = img.Path
+		}
+		for _, set := range findExactDupes(paths) {
+			if strings.Contains(strings.Join(set, ""), "\n") {
+				log.Warn().Str("caller", set[0]).Msg("can't list paths with newlines in a dedupe report")
+				continue
+			}
+			if _, err = w.WriteString(strings.Join(set, "\n") + "\n\n"); err != nil {
+				break
+			}
+			sets++
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return sets, err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dirMatch is a pair of directories whose images largely duplicate each other.
+type dirMatch struct {
+	a, b string
+	// shared counts the images of each directory that have a duplicate in the other.
+	sharedA, sharedB int
+	sizeA, sizeB     int
+}
+
+// similarity is the share of both directories' images that are duplicated in
+// the other one, in percent.
+func (m dirMatch) similarity() float64 {
+	return float64(m.sharedA+m.sharedB) * 100 / float64(m.sizeA+m.sizeB)
+}
+
+// findDirMatches compares directories by their images, directly contained
+// ones only, reporting pairs at least minSimilarity percent alike. Only
+// directories joined by a duplicate pair are considered.
+func findDirMatches(pairs *pairSet, sizes map[string]int, minSimilarity float64) []dirMatch {
+	// shared[[a, b]] holds the images in a with a duplicate in b, and vice versa.
+	shared := make(map[[2]string]map[string]struct{})
+	note := func(path, other string) {
+		key := [2]string{filepath.Dir(path), filepath.Dir(other)}
+		if shared[key] == nil {
+			shared[key] = make(map[string]struct{})
+		}
+		shared[key][path] = struct{}{}
+	}
+	pairs.each(func(pair dupePair) {
+		if filepath.Dir(pair.a) != filepath.Dir(pair.b) {
+			note(pair.a, pair.b)
+			note(pair.b, pair.a)
+		}
+	})
+
+	var matches = make([]dirMatch, 0)
+	for key, inA := range shared {
+		if key[0] > key[1] {
+			continue
+		}
+		m := dirMatch{
+			a: key[0], b: key[1],
+			sharedA: len(inA), sharedB: len(shared[[2]string{key[1], key[0]}]),
+			sizeA: sizes[key[0]], sizeB: sizes[key[1]],
+		}
+		if m.similarity() >= minSimilarity {
+			matches = append(matches, m)
+		}
+	}
+	sortDirMatches(matches)
+	return matches
+}
+
+// dirSizes counts the images directly contained in every directory.
+func dirSizes(records map[string]*Image) map[string]int {
+	sizes := make(map[string]int)
+	for p := range records {
+		sizes[filepath.Dir(p)]++
+	}
+	return sizes
+}
+
+func sortDirMatches(matches []dirMatch) {
+	sort.Slice(matches, func(i, j int) bool {
+		si, sj := matches[i].similarity(), matches[j].similarity()
+		if si != sj {
+			return si > sj
+		}
+		return matches[i].a < matches[j].a || matches[i].a == matches[j].a && matches[i].b < matches[j].b
+	})
+}
+
+// withinDir reports whether path is dir or lies beneath it.
+func withinDir(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// collapseDirMatches folds matches nested inside another match into it, so a
+// duplicated tree is reported once at its top. Matching directories of the
+// same name are first lifted into their parents while those hold no images of
+// their own, e.g. "Photos/2019" and "Backup/2019" into "Photos" and "Backup".
+func collapseDirMatches(matches []dirMatch, sizes map[string]int) []dirMatch {
+	lifted := make(map[[2]string]*dirMatch)
+	for _, m := range matches {
+		for {
+			pa, pb := filepath.Dir(m.a), filepath.Dir(m.b)
+			if filepath.Base(m.a) != filepath.Base(m.b) || pa == m.a || pb == m.b ||
+				withinDir(pa, pb) || withinDir(pb, pa) || sizes[pa] > 0 || sizes[pb] > 0 {
+				break
+			}
+			m.a, m.b = pa, pb
+		}
+		key := [2]string{m.a, m.b}
+		if prev, ok := lifted[key]; ok {
+			prev.sharedA += m.sharedA
+			prev.sharedB += m.sharedB
+			prev.sizeA += m.sizeA
+			prev.sizeB += m.sizeB
+			continue
+		}
+		lifted[key] = &dirMatch{a: m.a, b: m.b, sharedA: m.sharedA, sharedB: m.sharedB, sizeA: m.sizeA, sizeB: m.sizeB}
+	}
+
+	var collapsed = make([]dirMatch, 0, len(lifted))
+	for _, m := range lifted {
+		var nested bool
+		for _, outer := range lifted {
+			if outer != m && outer.covers(m.a, m.b) {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			collapsed = append(collapsed, *m)
+		}
+	}
+	sortDirMatches(collapsed)
+	return collapsed
+}
+
+// covers reports whether paths a and b lie on opposite sides of the match.
+func (m dirMatch) covers(a, b string) bool {
+	return withinDir(a, m.a) && withinDir(b, m.b) || withinDir(a, m.b) && withinDir(b, m.a)
+}
+
+// pairWithinDirMatch reports whether pair runs between the two sides of one of the matches.
+func pairWithinDirMatch(pair dupePair, matches []dirMatch) bool {
+	for _, m := range matches {
+		if m.covers(filepath.Dir(pair.a), filepath.Dir(pair.b)) {
+			return true
+		}
+	}
+	return false
+}
+
+func reportDirMatches(matches []dirMatch) {
+	for _, m := range matches {
+		log.Info().Str("similarity", strconv.FormatFloat(m.similarity(), 'f', 1, 64)+"%").
+			Int("shared_a", m.sharedA).Int("images_a", m.sizeA).
+			Int("shared_b", m.sharedB).Int("images_b", m.sizeB).
+			Msgf("duplicate directories: %s and %s", displayPath(m.a), displayPath(m.b))
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sync"
+)
+
+// fileKey identifies a file independent of the path it was reached by.
+type fileKey struct {
+	dev, ino uint64
+}
+
+// discoverySet remembers the files already handed out during one ingest run,
+// so a path given twice, or the same file reached through a symlink, another
+// root or a hard link, is only processed once.
+type discoverySet struct {
+	mu    sync.Mutex
+	paths map[string]struct{}
+	files map[fileKey]struct{}
+}
+
+var discovered = &discoverySet{}
+
+func (d *discoverySet) reset() {
+	d.mu.Lock()
+	d.paths = make(map[string]struct{})
+	d.files = make(map[fileKey]struct{})
+	d.mu.Unlock()
+}
+
+// claim reports whether path (already absolute) is seen for the first time
+// this run, marking it as seen.
+func (d *discoverySet) claim(path string, finfo fs.FileInfo) bool {
+	if canonical, err := filepath.EvalSymlinks(path); err == nil {
+		path = canonical
+	}
+	key, hasKey := fileID(finfo)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, seen := d.paths[path]; seen {
+		return false
+	}
+	if _, seen := d.files[key]; hasKey && seen {
+		return false
+	}
+	d.paths[path] = struct{}{}
+	if hasKey {
+		d.files[key] = struct{}{}
+	}
+	return true
+}
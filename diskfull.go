@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+// Once the disk under the database is full, every write after the first
+// failing one fails as well, so there's no point in decoding the rest of a
+// scan. The first ENOSPC cancels the scan instead: images waiting for a worker
+// are dropped, what was stored is synced, and the scan ends with an error
+// saying how far it got. Records that made it are skipped by the next scan of
+// the same paths, which thereby picks up where this one stopped.
+
+var errDiskFull = errors.New("no space left on the database's disk")
+
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+type diskFullStop struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	stored int
+	// first is the first record that didn't fit, err what storing it failed with.
+	first string
+	err   error
+	// unindexed is set if a record was stored but didn't make it into the
+	// similarity index, which a later scan wouldn't notice.
+	unindexed bool
+}
+
+var diskFull = &diskFullStop{}
+
+// begin starts watching a scan that cancel stops.
+func (d *diskFullStop) begin(cancel context.CancelFunc) {
+	d.mu.Lock()
+	d.cancel, d.stored, d.first, d.err, d.unindexed = cancel, 0, "", nil, false
+	d.mu.Unlock()
+}
+
+// noteStored counts a record written in full.
+func (d *diskFullStop) noteStored() {
+	d.mu.Lock()
+	d.stored++
+	d.mu.Unlock()
+}
+
+// check stops the scan if err says the disk is full. stored tells whether
+// the record itself made it, and only its index entry didn't.
+func (d *diskFullStop) check(path string, err error, stored bool) {
+	if !isDiskFull(err) {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.unindexed = d.unindexed || stored
+	if d.err != nil {
+		return
+	}
+	d.first, d.err = path, err
+	log.Error().Err(err).Str("caller", path).Msg("disk full, stopping the scan")
+	if d.cancel != nil {
+		d.cancel()
+	}
+}
+
+// end syncs what was stored if the scan was stopped, and returns the error
+// reporting how far it got.
+func (d *diskFullStop) end(total int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cancel = nil
+	if d.err == nil {
+		return nil
+	}
+	if err := DB.SyncAll(); err != nil {
+		log.Error().Err(err).Msg("failed to sync the database after running out of space")
+	}
+	ev := log.Error().Int("stored", d.stored).Int("paths", total).Str("first_unstored", d.first)
+	if d.unindexed {
+		ev.Msg("some records are missing from the similarity index, run dupehunter db reindex once space is freed")
+	} else {
+		ev.Msg("scan stopped, free some space and run it again to continue where it stopped")
+	}
+	return fmt.Errorf("%w: stored %d records of %d paths, %s was the first that didn't fit: %w",
+		errDiskFull, d.stored, total, d.first, d.err)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bytedance/sonic"
+)
+
+// The distance cache persists each record's neighborhood from previous checks
+// in the "distances" store, so repeated checks only query the index for
+// records that are new, changed, or were computed at a smaller radius.
+//
+// A pair is always present in the entry of whichever of its two records was
+// computed last, which is why a cache hit never needs to look for newcomers.
+
+// distanceCacheRadius is the minimum radius neighborhoods are cached at, so
+// that loosening the threshold a little doesn't invalidate the whole cache.
+const distanceCacheRadius = 16
+
+type cachedNeighbor struct {
+	Path     string `json:"p"`
+	Hash     uint64 `json:"h"`
+	Distance int    `json:"d"`
+}
+
+type distanceEntry struct {
+	Hash      uint64           `json:"h"`
+	Radius    int              `json:"r"`
+	Neighbors []cachedNeighbor `json:"n"`
+}
+
+type distanceCache struct {
+	entries      map[string]*distanceEntry
+	dirty        map[string]struct{}
+	hits, misses int
+}
+
+func loadDistanceCache() (*distanceCache, error) {
+	c := &distanceCache{entries: make(map[string]*distanceEntry), dirty: make(map[string]struct{})}
+	store := DB.With("distances")
+	for _, k := range store.Keys() {
+		dat, err := store.Get(k)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read distance cache: %w", err)
+		}
+		entry := &distanceEntry{}
+		if err = sonic.Unmarshal(dat, entry); err != nil {
+			// a broken entry is just a miss.
+			continue
+		}
+		c.entries[string(k)] = entry
+	}
+	return c, nil
+}
+
+// lookup returns the cached neighbors of path within radius, skipping any
+// neighbor that has since been removed or re-hashed. Lookups are safe for
+// concurrent use as long as nothing is updated meanwhile.
+func (c *distanceCache) lookup(path string, h uint64, radius int, hashes map[string]uint64) ([]indexMatch, bool) {
+	entry, ok := c.entries[path]
+	if !ok || entry.Hash != h || entry.Radius < radius {
+		return nil, false
+	}
+	matches := make([]indexMatch, 0, len(entry.Neighbors))
+	for _, n := range entry.Neighbors {
+		if current, exists := hashes[n.Path]; !exists || current != n.Hash || n.Distance > radius {
+			continue
+		}
+		matches = append(matches, indexMatch{path: n.Path, distance: n.Distance})
+	}
+	return matches, true
+}
+
+func (c *distanceCache) update(path string, h uint64, radius int, matches []indexMatch, hashes map[string]uint64) {
+	entry := &distanceEntry{Hash: h, Radius: radius, Neighbors: make([]cachedNeighbor, 0, len(matches))}
+	for _, m := range matches {
+		entry.Neighbors = append(entry.Neighbors, cachedNeighbor{Path: m.path, Hash: hashes[m.path], Distance: m.distance})
+	}
+	c.entries[path] = entry
+	c.dirty[path] = struct{}{}
+}
+
+// flush persists updated entries and drops those of records that no longer exist.
+func (c *distanceCache) flush(hashes map[string]uint64) error {
+	store := DB.With("distances")
+	for path := range c.dirty {
+		dat, err := sonic.Marshal(c.entries[path])
+		if err != nil {
+			return err
+		}
+		if err = store.Put([]byte(path), dat); err != nil {
+			return err
+		}
+	}
+	for path := range c.entries {
+		if _, ok := hashes[path]; ok {
+			continue
+		}
+		if err := store.Delete([]byte(path)); err != nil {
+			return err
+		}
+	}
+	log.Debug().Int("hits", c.hits).Int("misses", c.misses).Msg("distance cache")
+	return nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// doctor checks what a run depends on, the database, the directories it
+// writes to, the space left for it, the decoders, and the worker settings,
+// and prints the results along with the build and platform as a block to
+// paste into a bug report. It runs even when the database fails to open,
+// which is then what it reports.
+
+// minFreeSpace is the free space below which doctor warns about the disk
+// under the database.
+const minFreeSpace = 1 << 30
+
+// datastoreErr is why the database failed to open, for the commands that run
+// regardless, see toleratesBrokenDB.
+var datastoreErr error
+
+// toleratesBrokenDB reports whether args, the root arguments after the
+// flags, run a command that runs even when the database fails to open.
+func toleratesBrokenDB(args []string) bool {
+	return len(args) > 0 && args[0] == "doctor" || len(args) > 1 && args[0] == "db" && args[1] == "recover"
+}
+
+const (
+	doctorOK   = "ok"
+	doctorWarn = "warn"
+	doctorFail = "FAIL"
+)
+
+// doctorCheck is the outcome of one check.
+type doctorCheck struct {
+	status, name, detail string
+}
+
+func runDoctor(args []string) error {
+	fs := newFlagSet("doctor", "",
+		"Check the database, the directories dupehunter writes to, the disk space, the decoders, and the\n"+
+			"worker settings, and print the results with the build and platform, for bug reports.")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument: %s", fs.Arg(0))
+	}
+	return doctor(rootConfig, os.Stdout)
+}
+
+func doctor(cfg *config, w io.Writer) error {
+	var checks []doctorCheck
+	add := func(status, name, format string, args ...any) {
+		checks = append(checks, doctorCheck{status, name, fmt.Sprintf(format, args...)})
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, line := range doctorEnvironment(cfg) {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\n", line[0], line[1])
+	}
+	_, _ = fmt.Fprintln(tw)
+
+	doctorDatabase(cfg, add)
+	doctorWritable(add)
+	doctorDecoders(add)
+	doctorWorkers(cfg, add)
+	doctorTools(cfg, add)
+
+	var failed int
+	for _, c := range checks {
+		if c.status == doctorFail {
+			failed++
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\n", c.status, c.name, c.detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// doctorEnvironment describes the build and the platform.
+func doctorEnvironment(cfg *config) [][2]string {
+	version, revision, cgo := "(unknown)", "", "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				revision = s.Value
+			case "vcs.modified":
+				if s.Value == "true" {
+					revision += " (modified)"
+				}
+			case "CGO_ENABLED":
+				cgo = map[string]string{"0": "disabled", "1": "enabled"}[s.Value]
+			}
+		}
+	}
+	if revision != "" {
+		version += ", " + revision
+	}
+	confined := confinement
+	if confined == "" {
+		confined = "none"
+	}
+	return [][2]string{
+		{"dupehunter", version},
+		{"go", runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH + ", cgo " + cgo},
+		{"cpus", fmt.Sprintf("%d, GOMAXPROCS %d", runtime.NumCPU(), runtime.GOMAXPROCS(0))},
+		{"backend", cfg.backend},
+		{"hash", hashing.String() + ", layout " + hashLayout},
+		{"sandbox", confined},
+	}
+}
+
+func doctorDatabase(cfg *config, add func(status, name, format string, args ...any)) {
+	switch {
+	case datastorePath == "":
+		add(doctorOK, "database", "in memory, nothing persists")
+		return
+	case datastoreErr != nil:
+		add(doctorFail, "database", "%s fails to open: %s; db recover salvages what can be read of it",
+			datastorePath, datastoreErr)
+		return
+	}
+
+	var records, corrupt, unsealed int
+	for _, k := range imageStore.Keys() {
+		records++
+		switch checkRecord(k) {
+		case "":
+		case "unsealed":
+			unsealed++
+		default:
+			corrupt++
+		}
+	}
+	switch {
+	case corrupt > 0:
+		add(doctorFail, "database", "%s, %d records, %d corrupt; run db fsck --repair", datastorePath, records, corrupt)
+	case unsealed > 0:
+		add(doctorWarn, "database", "%s, %d records, %d without checksums; run db fsck --repair to seal them",
+			datastorePath, records, unsealed)
+	default:
+		add(doctorOK, "database", "%s, %d records", datastorePath, records)
+	}
+	if _, err := getIndex(); err != nil {
+		add(doctorFail, "index", "fails to load: %s; run db reindex", err)
+	} else {
+		add(doctorOK, "index", "loads")
+	}
+
+	if free, ok := freeSpace(datastorePath); ok {
+		status := doctorOK
+		if free < minFreeSpace {
+			status = doctorWarn
+		}
+		add(status, "disk space", "%s free under the database", formatBytes(int64(free)))
+	}
+}
+
+// doctorWritable checks that the directories runs write to take files.
+func doctorWritable(add func(status, name, format string, args ...any)) {
+	dirs := [][2]string{{"database dir", datastorePath}, {"working dir", "."}, {"temp dir", os.TempDir()}}
+	for _, d := range dirs {
+		if d[1] == "" {
+			continue
+		}
+		f, err := os.CreateTemp(d[1], ".dupehunter-doctor-*")
+		if err != nil {
+			add(doctorFail, d[0], "not writable: %s", err)
+			continue
+		}
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		add(doctorOK, d[0], "%s is writable", d[1])
+	}
+}
+
+// doctorDecoders decodes a small image in every format this build can write,
+// and lists those it only reads.
+func doctorDecoders(add func(status, name, format string, args ...any)) {
+	sample := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := range sample.Pix {
+		sample.Pix[i] = uint8(i)
+	}
+	encoders := []struct {
+		name   string
+		encode func(io.Writer, image.Image) error
+	}{
+		{"jpeg", func(w io.Writer, i image.Image) error { return jpeg.Encode(w, i, nil) }},
+		{"png", png.Encode},
+		{"gif", func(w io.Writer, i image.Image) error { return gif.Encode(w, i, nil) }},
+		{"bmp", bmp.Encode},
+		{"tiff", func(w io.Writer, i image.Image) error { return tiff.Encode(w, i, nil) }},
+	}
+	var broken []string
+	for _, e := range encoders {
+		var buf bytes.Buffer
+		if err := e.encode(&buf, sample); err != nil {
+			broken = append(broken, e.name+": "+err.Error())
+			continue
+		}
+		i, _, err := decImg(&buf)
+		if err == nil && i.Bounds().Dx() != 16 {
+			err = fmt.Errorf("decoded to %dx%d", i.Bounds().Dx(), i.Bounds().Dy())
+		}
+		if err == nil && color.RGBAModel.Convert(i.At(0, 0)) == nil {
+			err = fmt.Errorf("no pixels")
+		}
+		if err != nil {
+			broken = append(broken, e.name+": "+err.Error())
+		}
+	}
+	if len(broken) > 0 {
+		add(doctorFail, "decoders", "%s", strings.Join(broken, "; "))
+		return
+	}
+	add(doctorOK, "decoders", "jpeg, png, gif, bmp, and tiff decode; webp, ico, cur, and pdf are read too")
+}
+
+func doctorWorkers(cfg *config, add func(status, name, format string, args ...any)) {
+	if workers == nil || workers.Cap() != cfg.workers {
+		add(doctorFail, "worker pool", "not running with -workers %d", cfg.workers)
+	} else {
+		add(doctorOK, "worker pool", "%d workers", cfg.workers)
+	}
+	most := cfg.workers
+	if cfg.autoWorkers {
+		most = cfg.maxWorkers
+	}
+	if limit, ok := fileLimit(); ok {
+		status := doctorOK
+		if uint64(most+fdHeadroom) > limit {
+			status = doctorWarn
+		}
+		add(status, "open files", "limit %d for %d workers and %d other descriptors", limit, most, fdHeadroom)
+	}
+	if cfg.decodeLimit > runtime.NumCPU()*4 {
+		add(doctorWarn, "decode workers", "%d decoding at once on %d CPUs thrashes more than it helps",
+			cfg.decodeLimit, runtime.NumCPU())
+	}
+}
+
+// doctorTools lists the external programs the configured features run.
+func doctorTools(cfg *config, add func(status, name, format string, args ...any)) {
+	if !cfg.snapshot {
+		return
+	}
+	var found []string
+	for _, tool := range []string{"btrfs", "zfs", "lvcreate"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			found = append(found, tool)
+		}
+	}
+	if len(found) == 0 {
+		add(doctorWarn, "snapshots", "-snapshot is set, but neither btrfs, zfs, nor lvcreate is installed")
+		return
+	}
+	add(doctorOK, "snapshots", "%s installed", strings.Join(found, ", "))
+}
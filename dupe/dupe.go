@@ -0,0 +1,711 @@
+// Package dupe embeds dupehunter's near-duplicate image detection in other Go
+// programs, such as photo managers or upload services.
+//
+//	eng, err := dupe.New(dupe.Options{DBPath: "/var/lib/photos/dupes"})
+//	if err != nil {
+//		return err
+//	}
+//	defer eng.Close()
+//	eng.Ingest(ctx, "/srv/photos")
+//	matches, err := eng.Check(ctx)
+//
+// Uploads can be checked against the index as they come in, with
+// IngestReader, or MatchReader to leave the index alone; package
+// dupe/middleware does so for the multipart uploads of HTTP handlers.
+//
+// Files are told apart and decoded as the dupehunter command does: anything
+// that isn't an image by its leading bytes is skipped before decoding, icons
+// and cursors are decoded too, every page of a multi-page TIFF is indexed as
+// "path#page=N", and the EXIF capture time is recorded. With Options.Decoder,
+// images are decoded by the confined child processes of a dupehunter
+// executable, as its -isolate-decode does. Matches are looked up in a bucket
+// index of the hashes rather than by comparing every pair.
+//
+// An Engine keeps its own index, separate from the one the dupehunter command
+// maintains, since the two may be configured with different hashes.
+package dupe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.tcp.direct/kayos/dupehunter/internal/bucket"
+	"git.tcp.direct/kayos/dupehunter/internal/imaging"
+	"git.tcp.direct/tcp.direct/database"
+	"git.tcp.direct/tcp.direct/database/loader"
+	"git.tcp.direct/tcp.direct/database/pogreb"
+	"git.tcp.direct/tcp.direct/database/registry"
+	"github.com/bytedance/sonic"
+	"github.com/corona10/goimagehash"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// DefaultThreshold matches the dupehunter command's default for -d.
+const DefaultThreshold = 12
+
+const (
+	// defaultDecoderTimeout and decoderMemoryMB match the defaults of
+	// -isolate-timeout and -isolate-memory.
+	defaultDecoderTimeout = 30 * time.Second
+	decoderMemoryMB       = 1024
+
+	// pageSuffix separates a TIFF's path from the page number in record paths.
+	pageSuffix = "#page="
+)
+
+// ErrNotImage is reported for files that aren't images of a format there is
+// a decoder for.
+var ErrNotImage = errors.New("not an image")
+
+var hashes = map[string]func(image.Image) (*goimagehash.ImageHash, error){
+	"dhash": goimagehash.DifferenceHash,
+	"phash": goimagehash.PerceptionHash,
+	"ahash": goimagehash.AverageHash,
+}
+
+// Options configures an Engine. The zero value is usable: an in-memory index,
+// dhash, one worker per CPU and the default threshold.
+type Options struct {
+	// DBPath is the directory the index is kept in. Empty keeps the index in
+	// memory only, for the lifetime of the Engine.
+	DBPath string
+	// Hash is the perceptual hash, one of dhash (the default), phash or ahash.
+	Hash string
+	// Workers bounds how many images are decoded at once.
+	Workers int
+	// Threshold is the hamming distance (1-64) two hashes must be below to
+	// count as duplicates.
+	Threshold int
+	// Miniatures keeps a small grayscale copy of every image in the index,
+	// and hashes those instead of the originals. An Engine opened with
+	// another Hash later hashes the miniatures without decoding anything.
+	// It requires DBPath.
+	Miniatures bool
+	// Decoder is the path of a dupehunter executable to decode every image
+	// in, in a child process confined as by its -isolate-decode, so that a
+	// decoder crash or decompression bomb only takes down the child. It
+	// can't be combined with Miniatures, which need the decoded image.
+	Decoder string
+	// DecoderTimeout bounds how long a child may take, 30s when 0.
+	DecoderTimeout time.Duration
+
+	// OnIngest, if set, is called for every image added to or updated in the index.
+	OnIngest func(Record)
+	// OnMatch, if set, is called for every pair Check finds.
+	OnMatch func(Match)
+	// OnError, if set, is called for every file Ingest fails to index.
+	// Such files are otherwise skipped silently.
+	OnError func(path string, err error)
+}
+
+// Record is an indexed image, or a page of a multi-page TIFF, whose Path is
+// then that of the file followed by "#page=N".
+type Record struct {
+	Path    string    `json:"path"`
+	Hash    uint64    `json:"hash"`
+	Width   int       `json:"width"`
+	Height  int       `json:"height"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Captured is the EXIF capture time, zero when the image carries none.
+	Captured time.Time `json:"captured,omitempty"`
+}
+
+// Match is a pair of indexed images within the threshold, A sorting before B.
+type Match struct {
+	A, B     Record
+	Distance int
+}
+
+// Engine ingests images into an index and finds the near-duplicates in it.
+// Its methods are safe for concurrent use.
+type Engine struct {
+	opts  Options
+	hash  func(image.Image) (*goimagehash.ImageHash, error)
+	db    database.Keeper
+	store string
+
+	mu      sync.RWMutex
+	records map[string]Record
+	// index buckets the hashes of records, for queries within the threshold.
+	index *bucket.Index
+}
+
+// New validates opts and opens the index, loading any records it already holds.
+func New(opts Options) (*Engine, error) {
+	if opts.Hash == "" {
+		opts.Hash = "dhash"
+	}
+	hash, ok := hashes[opts.Hash]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash %q, expected dhash, phash or ahash", opts.Hash)
+	}
+	if opts.Workers < 1 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.Threshold == 0 {
+		opts.Threshold = DefaultThreshold
+	}
+	if opts.Threshold < 1 || opts.Threshold > 64 {
+		return nil, fmt.Errorf("invalid threshold %d: must be between 1 and 64", opts.Threshold)
+	}
+	if opts.Miniatures && opts.DBPath == "" {
+		return nil, errors.New("miniatures are only kept along with an index on disk, set DBPath")
+	}
+	if opts.Decoder != "" && opts.Miniatures {
+		return nil, errors.New("miniatures are made of decoded images, which a Decoder doesn't hand back")
+	}
+	if opts.DecoderTimeout == 0 {
+		opts.DecoderTimeout = defaultDecoderTimeout
+	}
+
+	e := &Engine{
+		opts: opts,
+		hash: hash,
+		// records of different hashes can't be compared, so each gets its own store.
+		store:   "records-" + opts.Hash,
+		records: make(map[string]Record),
+		index:   bucket.New(opts.Threshold - 1),
+	}
+	if opts.DBPath == "" {
+		return e, nil
+	}
+	if err := e.open(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Engine) open() error {
+	if err := os.MkdirAll(e.opts.DBPath, 0755); err != nil {
+		return err
+	}
+	var err error
+	if e.db, err = loader.OpenKeeper(e.opts.DBPath, &pogreb.WrappedOptions{AllowRecovery: true}); errors.Is(err, os.ErrNotExist) {
+		e.db, err = registry.GetKeeper("pogreb")(e.opts.DBPath, &pogreb.WrappedOptions{AllowRecovery: true})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", e.opts.DBPath, err)
+	}
+	stores := []string{e.store}
+	if e.opts.Miniatures {
+		stores = append(stores, miniatureStore)
+	}
+	for _, name := range stores {
+		if err = e.db.Init(name, &pogreb.WrappedOptions{AllowRecovery: true}); err != nil &&
+			!errors.Is(err, pogreb.ErrStoreExists) {
+			_ = e.db.CloseAll()
+			return err
+		}
+	}
+	store := e.db.With(e.store)
+	for _, k := range store.Keys() {
+		dat, err := store.Get(k)
+		if err != nil {
+			_ = e.db.CloseAll()
+			return fmt.Errorf("failed to fetch %s: %w", string(k), err)
+		}
+		var rec Record
+		if err = sonic.Unmarshal(dat, &rec); err != nil {
+			_ = e.db.CloseAll()
+			return fmt.Errorf("json deserialize fail for %s: %w", string(k), err)
+		}
+		e.records[rec.Path] = rec
+		e.index.Add(rec.Path, rec.Hash)
+	}
+	if e.opts.Miniatures {
+		if err := e.hashMiniatures(); err != nil {
+			_ = e.db.CloseAll()
+			return err
+		}
+	}
+	return nil
+}
+
+// Close syncs and closes the index.
+func (e *Engine) Close() error {
+	if e.db == nil {
+		return nil
+	}
+	return e.db.SyncAndCloseAll()
+}
+
+// Records returns every indexed image, in path order.
+func (e *Engine) Records() []Record {
+	e.mu.RLock()
+	recs := make([]Record, 0, len(e.records))
+	for _, rec := range e.records {
+		recs = append(recs, rec)
+	}
+	e.mu.RUnlock()
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Path < recs[j].Path })
+	return recs
+}
+
+// Ingest indexes the image at path, or every file below it if it is a
+// directory. Files whose size and modification time match their record are
+// not decoded again. Files that can't be indexed are reported to OnError;
+// the returned error is only set if path itself can't be read or ctx is done.
+func (e *Engine) Ingest(ctx context.Context, path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	var (
+		paths = make(chan string)
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < e.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range paths {
+				if err := e.ingestFile(p); err != nil && e.opts.OnError != nil {
+					e.opts.OnError(p, err)
+				}
+			}
+		}()
+	}
+
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == path {
+				return err
+			}
+			if e.opts.OnError != nil {
+				e.opts.OnError(p, err)
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		select {
+		case paths <- p:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(paths)
+	wg.Wait()
+
+	if e.db != nil {
+		if syncErr := e.db.SyncAll(); err == nil {
+			err = syncErr
+		}
+	}
+	return err
+}
+
+func (e *Engine) ingestFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	finfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	e.mu.RLock()
+	old, known := e.records[path]
+	if !known {
+		old, known = e.records[pagePath(path, 1)]
+	}
+	e.mu.RUnlock()
+	if known && old.Size == finfo.Size() && old.ModTime.Equal(finfo.ModTime()) {
+		return nil
+	}
+
+	var head [imaging.SniffLen]byte
+	n, err := f.ReadAt(head[:], 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	format := imaging.Sniff(head[:n], false)
+	if format == "" {
+		return ErrNotImage
+	}
+	captured := imaging.ReadExif(f, format).Captured
+
+	var pages []uint32
+	if format == "tiff" {
+		if pages, err = imaging.TIFFPages(f); err != nil || len(pages) < 2 {
+			pages = nil
+		}
+	}
+	if pages == nil {
+		rec, m, err := e.decodeFile(f, path, finfo, 0)
+		if err != nil {
+			return err
+		}
+		rec.Captured = captured
+		if err = e.putDecoded(rec, m); err == nil && known {
+			err = e.dropPages(path, 0)
+		}
+		return err
+	}
+	for i, ifd := range pages {
+		page := pagePath(path, i+1)
+		rec, m, err := e.decodeFile(f, page, finfo, ifd)
+		if err == nil {
+			rec.Captured = captured
+			err = e.putDecoded(rec, m)
+		}
+		if err != nil && e.opts.OnError != nil {
+			e.opts.OnError(page, err)
+		}
+	}
+	if known {
+		return e.dropPages(path, len(pages))
+	}
+	return nil
+}
+
+func pagePath(path string, page int) string {
+	return path + pageSuffix + strconv.Itoa(page)
+}
+
+// decodeFile hashes the image in f, or the page of the TIFF whose IFD starts
+// at ifd if set, into a record for path, along with its miniature if they are
+// kept.
+func (e *Engine) decodeFile(f *os.File, path string, finfo os.FileInfo, ifd uint32) (Record, *miniature, error) {
+	if e.opts.Miniatures {
+		if m, ok := e.cachedMiniature(path, finfo.Size(), finfo.ModTime()); ok {
+			rec, err := e.miniatureRecord(m, path)
+			return rec, nil, err
+		}
+	}
+	var (
+		rec Record
+		m   *miniature
+		err error
+	)
+	switch {
+	case e.opts.Decoder != "":
+		if _, err = f.Seek(0, io.SeekStart); err == nil {
+			rec, err = e.decodeIsolated(context.Background(), f, path, ifd)
+		}
+	case ifd != 0:
+		var img image.Image
+		if img, err = imaging.DecodeTIFFPage(f, finfo.Size(), ifd); err == nil {
+			rec, m, err = e.hashImage(img, path)
+		}
+	default:
+		rec, m, err = e.decode(io.NewSectionReader(f, 0, finfo.Size()), path)
+	}
+	if err != nil {
+		return Record{}, nil, err
+	}
+	rec.Size, rec.ModTime = finfo.Size(), finfo.ModTime()
+	return rec, m, nil
+}
+
+// dropPages removes the records of the pages of the TIFF at path past the
+// first pages of them, which it no longer has.
+func (e *Engine) dropPages(path string, pages int) error {
+	e.mu.RLock()
+	var stale []Record
+	for p, rec := range e.records {
+		if file, n, ok := strings.Cut(p, pageSuffix); ok && file == path {
+			if page, err := strconv.Atoi(n); err == nil && page > pages {
+				stale = append(stale, rec)
+			}
+		}
+	}
+	e.mu.RUnlock()
+	for _, rec := range stale {
+		if e.db != nil {
+			if err := e.db.With(e.store).Delete([]byte(rec.Path)); err != nil {
+				return err
+			}
+		}
+		e.mu.Lock()
+		delete(e.records, rec.Path)
+		e.index.Remove(rec.Path, rec.Hash)
+		e.mu.Unlock()
+	}
+	return nil
+}
+
+// decode hashes the image read from r into a record for path, along with its
+// miniature if they are kept.
+func (e *Engine) decode(r io.Reader, path string) (Record, *miniature, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return Record{}, nil, err
+	}
+	return e.hashImage(img, path)
+}
+
+// hashImage hashes img into a record for path, along with its miniature if
+// they are kept.
+func (e *Engine) hashImage(img image.Image, path string) (Record, *miniature, error) {
+	if e.opts.Miniatures {
+		m := newMiniature(img)
+		rec, err := e.miniatureRecord(m, path)
+		return rec, m, err
+	}
+	h, err := e.hash(img)
+	if err != nil {
+		return Record{}, nil, err
+	}
+	return Record{
+		Path:   path,
+		Hash:   h.GetHash(),
+		Width:  img.Bounds().Dx(),
+		Height: img.Bounds().Dy(),
+	}, nil, nil
+}
+
+// isolatedResult is the part of the answer of a decoder child the Engine uses.
+type isolatedResult struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Hash   []byte `json:"hash"`
+}
+
+// decodeIsolated hands the image read from r, or the page of the TIFF whose
+// IFD starts at ifd if set, which takes r to be a file, to a decoder child of
+// Options.Decoder, and returns its record for path.
+func (e *Engine) decodeIsolated(ctx context.Context, r io.Reader, path string, ifd uint32) (Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.opts.DecoderTimeout)
+	defer cancel()
+	cpuSeconds := int((e.opts.DecoderTimeout + time.Second - 1) / time.Second)
+	args := []string{imaging.DecoderCommand, "-memory", strconv.Itoa(decoderMemoryMB),
+		"-cpu", strconv.Itoa(cpuSeconds), "-hash", e.opts.Hash}
+	if ifd != 0 {
+		args = append(args, "-tiff-ifd", strconv.FormatUint(uint64(ifd), 10))
+	}
+	cmd := exec.CommandContext(ctx, e.opts.Decoder, args...)
+	cmd.Env = []string{}
+	cmd.Stdin = r
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return Record{}, fmt.Errorf("isolated decoder timed out after %s", e.opts.DecoderTimeout)
+		}
+		// only the first line, a crashing child dumps all of its goroutines.
+		if msg, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n"); msg != "" {
+			return Record{}, fmt.Errorf("isolated decoder: %w: %s", err, msg)
+		}
+		return Record{}, fmt.Errorf("isolated decoder: %w", err)
+	}
+	var res isolatedResult
+	if err := sonic.Unmarshal(stdout.Bytes(), &res); err != nil {
+		return Record{}, fmt.Errorf("isolated decoder returned garbage: %w", err)
+	}
+	h, err := goimagehash.LoadImageHash(bytes.NewReader(res.Hash))
+	if err != nil {
+		return Record{}, fmt.Errorf("isolated decoder returned garbage: %w", err)
+	}
+	return Record{Path: path, Hash: h.GetHash(), Width: res.Width, Height: res.Height}, nil
+}
+
+// putDecoded stores a freshly decoded record along with its miniature, if any,
+// which is current as of the record's size and modification time.
+func (e *Engine) putDecoded(rec Record, m *miniature) error {
+	if m != nil {
+		m.Size, m.ModTime = rec.Size, rec.ModTime
+		if err := e.putMiniature(rec.Path, m); err != nil {
+			return err
+		}
+	}
+	return e.put(rec)
+}
+
+// IngestReader indexes the image read from r under name, e.g. an upload's
+// ID, without it ever touching the disk, and returns the indexed images it
+// is within the threshold of, closest first. OnIngest is called like for
+// Ingest, OnMatch isn't. Its record's size is the number of bytes read and
+// its modification time the time it was ingested; a record of the same name
+// is replaced. Reading stops with ctx's error once ctx is done.
+func (e *Engine) IngestReader(ctx context.Context, name string, r io.Reader) ([]Match, error) {
+	rec, m, err := e.decodeReader(ctx, name, r)
+	if err != nil {
+		return nil, err
+	}
+	matches := e.matches(rec)
+	if err = e.putDecoded(rec, m); err != nil {
+		return nil, err
+	}
+	if e.db != nil {
+		err = e.db.SyncAll()
+	}
+	return matches, err
+}
+
+// MatchReader is IngestReader without the indexing: it returns the indexed
+// images the image read from r is within the threshold of, closest first,
+// leaving the index as it is. The image is named name in the matches.
+func (e *Engine) MatchReader(ctx context.Context, name string, r io.Reader) ([]Match, error) {
+	rec, _, err := e.decodeReader(ctx, name, r)
+	if err != nil {
+		return nil, err
+	}
+	return e.matches(rec), nil
+}
+
+// decodeReader hashes the image read from r into a record for name, sized by
+// the bytes read and timed now. Streams can't be read out of order, so only
+// the first page of a TIFF is hashed and the capture time isn't recorded.
+func (e *Engine) decodeReader(ctx context.Context, name string, r io.Reader) (Record, *miniature, error) {
+	if name == "" {
+		return Record{}, nil, errors.New("name must not be empty")
+	}
+	cr := &ctxReader{ctx: ctx, r: r}
+	br := bufio.NewReaderSize(cr, imaging.SniffLen)
+	// a short read leaves as much of the head as there is.
+	head, _ := br.Peek(imaging.SniffLen)
+	if imaging.Sniff(head, false) == "" {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return Record{}, nil, ctxErr
+		}
+		return Record{}, nil, ErrNotImage
+	}
+	var (
+		rec Record
+		m   *miniature
+		err error
+	)
+	if e.opts.Decoder != "" {
+		rec, err = e.decodeIsolated(ctx, br, name, 0)
+	} else {
+		rec, m, err = e.decode(br, name)
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return Record{}, nil, ctxErr
+		}
+		return Record{}, nil, err
+	}
+	rec.Size, rec.ModTime = cr.n, time.Now()
+	return rec, m, nil
+}
+
+// matches returns the pairs of rec and the other indexed images within the
+// threshold, closest first.
+func (e *Engine) matches(rec Record) []Match {
+	matches := make([]Match, 0)
+	e.mu.RLock()
+	for _, found := range e.index.Query(rec.Hash, e.opts.Threshold-1) {
+		other, ok := e.records[found.Path]
+		if !ok || other.Path == rec.Path {
+			continue
+		}
+		m := Match{A: rec, B: other, Distance: found.Distance}
+		if m.B.Path < m.A.Path {
+			m.A, m.B = m.B, m.A
+		}
+		matches = append(matches, m)
+	}
+	e.mu.RUnlock()
+	other := func(m Match) string {
+		if m.A.Path == rec.Path {
+			return m.B.Path
+		}
+		return m.A.Path
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return other(matches[i]) < other(matches[j])
+	})
+	return matches
+}
+
+// ctxReader fails reads once ctx is done, so a stalled upload doesn't hold
+// IngestReader up for longer than its caller is willing to wait, and counts
+// the bytes read.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+	n   int64
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// put stores rec and reports it to OnIngest.
+func (e *Engine) put(rec Record) error {
+	if e.db != nil {
+		dat, err := sonic.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if err = e.db.With(e.store).Put([]byte(rec.Path), dat); err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	if old, ok := e.records[rec.Path]; ok {
+		e.index.Remove(old.Path, old.Hash)
+	}
+	e.records[rec.Path] = rec
+	e.index.Add(rec.Path, rec.Hash)
+	e.mu.Unlock()
+	if e.opts.OnIngest != nil {
+		e.opts.OnIngest(rec)
+	}
+	return nil
+}
+
+// Check looks up the indexed images within the threshold of every indexed
+// image and returns the pairs, each once, in path order. OnMatch is called
+// for each pair as it is found.
+func (e *Engine) Check(ctx context.Context) ([]Match, error) {
+	recs := e.Records()
+	matches := make([]Match, 0)
+	for _, a := range recs {
+		if err := ctx.Err(); err != nil {
+			return matches, err
+		}
+		found := make([]Match, 0)
+		e.mu.RLock()
+		for _, f := range e.index.Query(a.Hash, e.opts.Threshold-1) {
+			// pairs are found from both ends, each is kept from its first.
+			if b, ok := e.records[f.Path]; ok && b.Path > a.Path {
+				found = append(found, Match{A: a, B: b, Distance: f.Distance})
+			}
+		}
+		e.mu.RUnlock()
+		sort.Slice(found, func(i, j int) bool { return found[i].B.Path < found[j].B.Path })
+		for _, m := range found {
+			matches = append(matches, m)
+			if e.opts.OnMatch != nil {
+				e.opts.OnMatch(m)
+			}
+		}
+	}
+	return matches, nil
+}
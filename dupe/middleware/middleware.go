@@ -0,0 +1,165 @@
+// Package middleware checks the images uploaded to an HTTP handler against a
+// dupe.Engine before the handler sees them.
+//
+//	eng, err := dupe.New(dupe.Options{DBPath: "/var/lib/uploads/dupes"})
+//	if err != nil {
+//		return err
+//	}
+//	http.Handle("/upload", middleware.Dedupe(eng, middleware.Options{Ingest: true})(uploadHandler))
+//
+// The wrapped handler finds what the uploads matched in the request context:
+//
+//	res, ok := middleware.FromContext(r.Context())
+//	if ok && res.Duplicate() {
+//		http.Error(w, "already uploaded", http.StatusConflict)
+//		return
+//	}
+//
+// Only multipart/form-data requests are looked at, others are passed on as
+// they are. The form is parsed by the middleware, so the handler reads the
+// files from r.MultipartForm or r.FormFile as usual.
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+
+	"git.tcp.direct/kayos/dupehunter/dupe"
+)
+
+// defaultMaxMemory is how much of a form is kept in memory by default, the
+// rest going to temporary files, as with http.Request.FormFile.
+const defaultMaxMemory = 32 << 20
+
+// Options configures Dedupe.
+type Options struct {
+	// Fields are the form fields whose files are checked, every field
+	// holding files when empty.
+	Fields []string
+	// MaxMemory is how much of the form is kept in memory, see
+	// http.Request.ParseMultipartForm. 0 means 32 MiB.
+	MaxMemory int64
+	// Ingest indexes the uploads as well, so later uploads match them. An
+	// upload is then indexed before the handler decides whether to keep it;
+	// without Ingest, handlers index the uploads they keep themselves, with
+	// Engine.IngestReader.
+	Ingest bool
+	// Name returns the name an upload is matched, and indexed, under. The
+	// default is "upload/" followed by a random ID and the file name.
+	Name func(r *http.Request, field string, fh *multipart.FileHeader) string
+}
+
+// Upload is an uploaded file and what it matched.
+type Upload struct {
+	Field    string
+	Filename string
+	// Name is what the upload was matched under, see Options.Name.
+	Name string
+	// Matches are the indexed images within the threshold of the upload,
+	// closest first.
+	Matches []dupe.Match
+	// Err is why the upload couldn't be checked, e.g. it isn't an image.
+	Err error
+}
+
+// Result is what the uploads of a request matched.
+type Result struct {
+	Uploads []Upload
+	// Err is why the form couldn't be parsed, in which case there are no
+	// uploads.
+	Err error
+}
+
+// Duplicate reports whether any upload matched an indexed image.
+func (res *Result) Duplicate() bool {
+	for _, u := range res.Uploads {
+		if len(u.Matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+// FromContext returns the result the middleware annotated ctx with, false if
+// it didn't, e.g. for requests other than multipart uploads.
+func FromContext(ctx context.Context) (*Result, bool) {
+	res, ok := ctx.Value(contextKey{}).(*Result)
+	return res, ok
+}
+
+// Dedupe returns middleware that checks the files of multipart uploads
+// against eng, annotating the request context with the Result.
+func Dedupe(eng *dupe.Engine, opts Options) func(http.Handler) http.Handler {
+	if opts.MaxMemory <= 0 {
+		opts.MaxMemory = defaultMaxMemory
+	}
+	if opts.Name == nil {
+		opts.Name = uploadName
+	}
+	fields := make(map[string]bool, len(opts.Fields))
+	for _, f := range opts.Fields {
+		fields[f] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil ||
+				mediaType != "multipart/form-data" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			res := &Result{}
+			if res.Err = r.ParseMultipartForm(opts.MaxMemory); res.Err == nil {
+				res.Uploads = checkUploads(r, eng, opts, fields)
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, res)))
+		})
+	}
+}
+
+// checkUploads checks the files of the parsed form of r, by field and in
+// the order they were sent.
+func checkUploads(r *http.Request, eng *dupe.Engine, opts Options, fields map[string]bool) []Upload {
+	names := make([]string, 0, len(r.MultipartForm.File))
+	for field := range r.MultipartForm.File {
+		if len(fields) == 0 || fields[field] {
+			names = append(names, field)
+		}
+	}
+	sort.Strings(names)
+
+	uploads := make([]Upload, 0)
+	for _, field := range names {
+		for _, fh := range r.MultipartForm.File[field] {
+			u := Upload{Field: field, Filename: fh.Filename, Name: opts.Name(r, field, fh)}
+			u.Matches, u.Err = checkFile(r.Context(), eng, opts.Ingest, u.Name, fh)
+			uploads = append(uploads, u)
+		}
+	}
+	return uploads
+}
+
+func checkFile(ctx context.Context, eng *dupe.Engine, ingest bool, name string, fh *multipart.FileHeader) ([]dupe.Match, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	if ingest {
+		return eng.IngestReader(ctx, name, f)
+	}
+	return eng.MatchReader(ctx, name, f)
+}
+
+// uploadName is the default Options.Name.
+func uploadName(_ *http.Request, _ string, fh *multipart.FileHeader) string {
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	return "upload/" + hex.EncodeToString(id[:]) + "/" + fh.Filename
+}
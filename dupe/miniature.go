@@ -0,0 +1,107 @@
+package dupe
+
+import (
+	"fmt"
+	"image"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"golang.org/x/image/draw"
+)
+
+// Miniatures are what an image looks like to the hashes: every one of them
+// scales the image down to a small grayscale square first, 8x8 to 32x32.
+// Keeping a slightly larger one of each image around makes switching hashes
+// a matter of hashing the miniatures, without decoding a single original.
+
+// miniatureSize is the side of a miniature in pixels.
+const miniatureSize = 64
+
+// miniatureStore is shared by every hash.
+const miniatureStore = "miniatures"
+
+type miniature struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Width and Height are the dimensions of the original.
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Pix    []byte `json:"pix"`
+}
+
+func newMiniature(img image.Image) *miniature {
+	gray := image.NewGray(image.Rect(0, 0, miniatureSize, miniatureSize))
+	draw.BiLinear.Scale(gray, gray.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return &miniature{Width: img.Bounds().Dx(), Height: img.Bounds().Dy(), Pix: gray.Pix}
+}
+
+func (m *miniature) image() image.Image {
+	return &image.Gray{Pix: m.Pix, Stride: miniatureSize, Rect: image.Rect(0, 0, miniatureSize, miniatureSize)}
+}
+
+// miniatureRecord hashes m into a record for path.
+func (e *Engine) miniatureRecord(m *miniature, path string) (Record, error) {
+	if len(m.Pix) != miniatureSize*miniatureSize {
+		return Record{}, fmt.Errorf("broken miniature of %s", path)
+	}
+	h, err := e.hash(m.image())
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{
+		Path:    path,
+		Hash:    h.GetHash(),
+		Width:   m.Width,
+		Height:  m.Height,
+		Size:    m.Size,
+		ModTime: m.ModTime,
+	}, nil
+}
+
+// cachedMiniature returns the miniature of path if it is still current.
+func (e *Engine) cachedMiniature(path string, size int64, modTime time.Time) (*miniature, bool) {
+	dat, err := e.db.With(miniatureStore).Get([]byte(path))
+	if err != nil {
+		return nil, false
+	}
+	m := &miniature{}
+	if sonic.Unmarshal(dat, m) != nil || m.Size != size || !m.ModTime.Equal(modTime) {
+		return nil, false
+	}
+	return m, true
+}
+
+func (e *Engine) putMiniature(path string, m *miniature) error {
+	dat, err := sonic.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return e.db.With(miniatureStore).Put([]byte(path), dat)
+}
+
+// hashMiniatures indexes the cached miniatures that have no record yet, which
+// are those of every image ingested with another hash before.
+func (e *Engine) hashMiniatures() error {
+	store := e.db.With(miniatureStore)
+	for _, k := range store.Keys() {
+		if _, ok := e.records[string(k)]; ok {
+			continue
+		}
+		dat, err := store.Get(k)
+		if err != nil {
+			return fmt.Errorf("failed to fetch the miniature of %s: %w", string(k), err)
+		}
+		m := &miniature{}
+		if err = sonic.Unmarshal(dat, m); err != nil {
+			return fmt.Errorf("json deserialize fail for the miniature of %s: %w", string(k), err)
+		}
+		rec, err := e.miniatureRecord(m, string(k))
+		if err != nil {
+			return err
+		}
+		if err = e.put(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// -embed-plugin has an external embedder, e.g. a CLIP model, turn every image
+// into a vector, so that checks also find images of the same scene that no
+// perceptual hash matches: another shot of it, a different crop, the same
+// slide photographed twice. These are reported as similar scenes besides the
+// duplicates, pairs both hashes and vectors match are left to the latter, and
+// clean actions never touch them. The embedder talks like a -hash-plugin:
+//
+//	> dupehunter-embedder 1
+//	< embedder NAME DIMENSIONS
+//	> embed /abs/path/to/image.jpg
+//	< ok 0.0132 -0.2201 ...
+//
+// replying with as many numbers as it said, in any scale as vectors are
+// normalized, or with error and why. Images are only embedded by the path of
+// their file, so pages and members of containers are left out. Vectors are
+// kept in the "embeddings" store under the record's path, along with NAME and
+// the ingestion of the record, and computed again once either changed.
+// Vectors are matched by cosine distance, 1 minus their cosine similarity,
+// through an index of random hyperplanes that, like -index hnsw, may miss a few
+// pairs for the sake of speed; small libraries are compared exhaustively.
+
+const (
+	embedPluginHello = "dupehunter-embedder 1"
+	maxEmbedDims     = 4096
+
+	// sceneExactLimit is the largest number of vectors compared pairwise.
+	sceneExactLimit = 4096
+	// sceneTables is the number of hyperplane tables vectors are bucketed in.
+	sceneTables = 16
+)
+
+// embedder is the running -embed-plugin, nil without one.
+var embedder *pluginProcess
+
+// embedding is the vector of a record, as the "embeddings" store keeps it.
+type embedding struct {
+	Layout   string    `json:"layout"`
+	Ingested time.Time `json:"ingested"`
+	Vector   []float32 `json:"vector"`
+}
+
+// embedPath has the embedder embed the image file at path, into a unit vector.
+func embedPath(path string) ([]float32, error) {
+	path, done, err := pluginPath(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	var v []float32
+	err = embedder.request("embed", path, func(reply string) error {
+		fields := strings.Fields(reply)
+		if len(fields) != embedder.size {
+			return fmt.Errorf("expected %d numbers, got %d", embedder.size, len(fields))
+		}
+		v = make([]float32, len(fields))
+		var norm float64
+		for i, f := range fields {
+			x, err := strconv.ParseFloat(f, 32)
+			if err != nil || math.IsNaN(x) || math.IsInf(x, 0) {
+				return fmt.Errorf("invalid number %q", f)
+			}
+			v[i], norm = float32(x), norm+x*x
+		}
+		if norm == 0 {
+			return errors.New("zero vector")
+		}
+		norm = math.Sqrt(norm)
+		for i := range v {
+			v[i] = float32(float64(v[i]) / norm)
+		}
+		return nil
+	})
+	return v, err
+}
+
+// embeddings returns the vectors of the image files among records, embedding
+// those without an up to date one. Vectors of records that are gone are
+// dropped along the way.
+func embeddings(records map[string]*Image) map[string][]float32 {
+	store := DB.With("embeddings")
+	for _, k := range store.Keys() {
+		if _, ok := records[string(k)]; !ok && !imageStore.Has(k) {
+			_ = store.Delete(k)
+		}
+	}
+	paths := make([]string, 0, len(records))
+	for p, img := range records {
+		if len(img.PHash) > 0 && !strings.Contains(p, pageSuffix) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	var (
+		layout           = embedder.layout()
+		vectors          = make(map[string][]float32, len(paths))
+		embedded, failed int
+	)
+	for _, p := range paths {
+		img, e := records[p], &embedding{}
+		if dat, err := store.Get([]byte(p)); err == nil && len(dat) > 0 && sonic.Unmarshal(dat, e) == nil &&
+			e.Layout == layout && e.Ingested.Equal(img.Ingested) && len(e.Vector) == embedder.size {
+			vectors[p] = e.Vector
+			continue
+		}
+		v, err := embedPath(p)
+		if err != nil {
+			log.Debug().Err(err).Str("caller", p).Msg("failed to embed")
+			failed++
+			continue
+		}
+		dat, err := sonic.Marshal(embedding{Layout: layout, Ingested: img.Ingested, Vector: v})
+		if err == nil {
+			err = store.Put([]byte(p), dat)
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("caller", p).Msg("failed to store embedding")
+		}
+		vectors[p] = v
+		embedded++
+	}
+	if embedded+failed > 0 {
+		log.Info().Int("embedded", embedded).Int("failed", failed).Str("embedder", layout).Msg("embedded images")
+	}
+	return vectors
+}
+
+// scenePair is two images whose vectors are within the -scene-distance.
+type scenePair struct {
+	a, b     string
+	distance float64
+}
+
+func dot(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+// cosineDistance measures unit vectors a and b apart, rounding errors aside
+// from 0 to 2.
+func cosineDistance(a, b []float32) float64 {
+	return min(max(1-dot(a, b), 0), 2)
+}
+
+// findSimilarScenes embeds the records and pairs those whose vectors are
+// within maxDistance of each other, other than those groups already hold
+// together.
+func findSimilarScenes(records map[string]*Image, groups []*dupeGroup, maxDistance float64) []scenePair {
+	vectors := embeddings(records)
+	paths := make([]string, 0, len(vectors))
+	for p := range vectors {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	groupOf := groupsOf(groups)
+
+	found := make([]scenePair, 0)
+	compare := func(i, j int) {
+		a, b := paths[i], paths[j]
+		if g := groupOf[a]; g != nil && g == groupOf[b] {
+			return
+		}
+		if d := cosineDistance(vectors[a], vectors[b]); d < maxDistance {
+			found = append(found, scenePair{a: a, b: b, distance: d})
+		}
+	}
+	if len(paths) <= sceneExactLimit {
+		for i := range paths {
+			for j := i + 1; j < len(paths); j++ {
+				compare(i, j)
+			}
+		}
+	} else {
+		// vectors sharing buckets in several tables are compared once.
+		seen := make(map[[2]int]bool)
+		for _, bucket := range sceneBuckets(paths, vectors) {
+			for x, i := range bucket {
+				for _, j := range bucket[x+1:] {
+					if !seen[[2]int{i, j}] {
+						seen[[2]int{i, j}] = true
+						compare(i, j)
+					}
+				}
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].distance != found[j].distance {
+			return found[i].distance < found[j].distance
+		}
+		return found[i].a+"\x00"+found[i].b < found[j].a+"\x00"+found[j].b
+	})
+	return found
+}
+
+// sceneBuckets buckets the vectors of paths, by index, by which side of
+// random hyperplanes they fall on, in sceneTables tables, such that vectors
+// close to each other likely share a bucket in at least one of them. The
+// planes are drawn from a fixed seed, so runs miss the same pairs.
+func sceneBuckets(paths []string, vectors map[string][]float32) [][]int {
+	// about 32 vectors to a bucket.
+	bits := min(max(int(math.Log2(float64(len(paths))))-5, 4), 24)
+	dims := len(vectors[paths[0]])
+	rng := rand.New(rand.NewSource(1))
+	var buckets [][]int
+	for t := 0; t < sceneTables; t++ {
+		planes := make([][]float32, bits)
+		for b := range planes {
+			planes[b] = make([]float32, dims)
+			for d := range planes[b] {
+				planes[b][d] = float32(rng.NormFloat64())
+			}
+		}
+		table := make(map[uint32][]int)
+		for i, p := range paths {
+			var key uint32
+			for b, plane := range planes {
+				if dot(vectors[p], plane) > 0 {
+					key |= 1 << b
+				}
+			}
+			table[key] = append(table[key], i)
+		}
+		for _, bucket := range table {
+			if len(bucket) > 1 {
+				buckets = append(buckets, bucket)
+			}
+		}
+	}
+	return buckets
+}
+
+func reportSimilarScenes(found []scenePair, maxDistance float64) {
+	for _, pair := range found {
+		log.Info().Str("distance", strconv.FormatFloat(pair.distance, 'f', 3, 64)).
+			Msgf("similar scene: %s and %s", displayPath(pair.a), displayPath(pair.b))
+	}
+	log.Info().Int("pairs", len(found)).Float64("scene_distance", maxDistance).Msg("similar scenes found")
+}
+
+// writeSimilarScenes writes found as the text of a report.
+func writeSimilarScenes(w io.Writer, found []scenePair) error {
+	if len(found) == 0 {
+		_, err := fmt.Fprintln(w, "no similar scenes")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "similar scenes")
+	for _, pair := range found {
+		_, _ = fmt.Fprintf(tw, "  distance %s\t%s\t%s\n", strconv.FormatFloat(pair.distance, 'f', 3, 64),
+			displayPath(pair.a), displayPath(pair.b))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/corona10/goimagehash"
+)
+
+// hashAlgorithms are the perceptual hashes evaluate can compare, and -hash
+// picks from.
+var hashAlgorithms = map[string]func(image.Image) (*goimagehash.ImageHash, error){
+	"dhash": goimagehash.DifferenceHash,
+	"phash": goimagehash.PerceptionHash,
+	"ahash": goimagehash.AverageHash,
+}
+
+type labeledPair struct {
+	a, b string
+	dupe bool
+}
+
+func parseLabel(s string) (dupe bool, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "true", "yes", "dup", "dupe", "duplicate", "same":
+		return true, true
+	case "0", "false", "no", "distinct", "different", "unique":
+		return false, true
+	}
+	return false, false
+}
+
+// readLabeledPairs reads path_a,path_b,label rows. Relative paths are resolved
+// against the directory of the CSV, and a header row is skipped.
+func readLabeledPairs(path string) ([]labeledPair, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	base := filepath.Dir(path)
+	resolve := func(p string) string {
+		p = strings.TrimSpace(p)
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(base, p)
+		}
+		return p
+	}
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 3
+	r.Comment = '#'
+	var pairs []labeledPair
+	for line := 1; ; line++ {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		dupe, ok := parseLabel(row[2])
+		if !ok {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("%s:%d: unknown label %q", path, line, row[2])
+		}
+		pairs = append(pairs, labeledPair{a: resolve(row[0]), b: resolve(row[1]), dupe: dupe})
+	}
+	return pairs, nil
+}
+
+// hashFile decodes path once and hashes it with every requested algorithm.
+func hashFile(path string, algorithms []string) (map[string]*goimagehash.ImageHash, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]*goimagehash.ImageHash, len(algorithms))
+	for _, name := range algorithms {
+		if hashes[name], err = hashAlgorithms[name](img); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return hashes, nil
+}
+
+type confusion struct {
+	tp, fp, fn int
+}
+
+func (c confusion) precision() float64 {
+	if c.tp+c.fp == 0 {
+		return 0
+	}
+	return float64(c.tp) / float64(c.tp+c.fp)
+}
+
+func (c confusion) recall() float64 {
+	if c.tp+c.fn == 0 {
+		return 0
+	}
+	return float64(c.tp) / float64(c.tp+c.fn)
+}
+
+func (c confusion) f1() float64 {
+	p, r := c.precision(), c.recall()
+	if p+r == 0 {
+		return 0
+	}
+	return 2 * p * r / (p + r)
+}
+
+func runEvaluate(args []string) error {
+	return evaluate(args, os.Stdout)
+}
+
+func evaluate(args []string, w io.Writer) error {
+	fs := newFlagSet("evaluate", "[--algorithms LIST] [-d DISTANCE] <labeled-pairs.csv>",
+		"Score hash algorithms against a labeled set of image pairs.\n\n"+
+			"Each CSV row is path_a,path_b,label where label is 1/dup or 0/distinct. A pair\n"+
+			"counts as a predicted duplicate when its distance is below -d, as in check.\n"+
+			"The best threshold per algorithm is reported alongside. gen-testdata writes such a set.")
+	algorithms := fs.String("algorithms", "dhash,phash,ahash", "comma separated `list` of algorithms to compare")
+	maxDistance := fs.Int("d", 12, "distance threshold to score at")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs, "exactly one labeled pairs file is required")
+	}
+	if *maxDistance < 1 || *maxDistance > 64 {
+		return usageError(fs, "-d must be between 1 and 64")
+	}
+	var names []string
+	for _, name := range strings.Split(*algorithms, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := hashAlgorithms[name]; !ok {
+			return usageError(fs, "unknown algorithm %q, expected dhash, phash or ahash", name)
+		}
+		names = append(names, name)
+	}
+
+	pairs, err := readLabeledPairs(positional[0])
+	if err != nil {
+		return err
+	}
+
+	hashes := make(map[string]map[string]*goimagehash.ImageHash)
+	for _, p := range pairs {
+		for _, path := range []string{p.a, p.b} {
+			if _, done := hashes[path]; done {
+				continue
+			}
+			h, err := hashFile(path, names)
+			if err != nil {
+				log.Warn().Err(err).Str("caller", path).Msg("skipping pairs with unreadable image")
+			}
+			hashes[path] = h
+		}
+	}
+
+	// scores[name][d] tallies predictions at threshold d, for every d at once.
+	var (
+		scores  = make(map[string]*[65]confusion, len(names))
+		scored  int
+		skipped int
+	)
+	for _, name := range names {
+		scores[name] = &[65]confusion{}
+	}
+	for _, p := range pairs {
+		ha, hb := hashes[p.a], hashes[p.b]
+		if ha == nil || hb == nil {
+			skipped++
+			continue
+		}
+		scored++
+		for _, name := range names {
+			distance, err := ha[name].Distance(hb[name])
+			if err != nil {
+				return err
+			}
+			for d := 1; d <= 64; d++ {
+				predicted := distance < d
+				switch {
+				case predicted && p.dupe:
+					scores[name][d].tp++
+				case predicted:
+					scores[name][d].fp++
+				case p.dupe:
+					scores[name][d].fn++
+				}
+			}
+		}
+	}
+	if scored == 0 {
+		return errors.New("no labeled pair could be scored")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "ALGORITHM\tPRECISION\tRECALL\tF1\tBEST -d\tBEST F1\n")
+	for _, name := range names {
+		at := scores[name][*maxDistance]
+		best := 1
+		for d := 2; d <= 64; d++ {
+			if scores[name][d].f1() > scores[name][best].f1() {
+				best = d
+			}
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%.3f\t%.3f\t%.3f\t%d\t%.3f\n",
+			name, at.precision(), at.recall(), at.f1(), best, scores[name][best].f1())
+	}
+	if err = tw.Flush(); err != nil {
+		return err
+	}
+	log.Info().Int("pairs", scored).Int("skipped", skipped).Int("d", *maxDistance).Msg("evaluate finished")
+	return nil
+}
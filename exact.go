@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/sha256"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/bytedance/sonic"
+)
+
+// The exact prefilter finds byte-identical files among the paths of a scan
+// before anything is decoded. Only files of the same size can be identical,
+// and among those, checksums of the first and last 64KiB rule out nearly all
+// the rest cheaply; the remaining candidates are confirmed by hashing them
+// completely. Of each set of identical images only one is decoded, the others
+// get a copy of its record.
+//
+// -rename-prefilter does the same for only the copies renamed in letter case
+// or extension, e.g. IMG_0001.JPG and img_0001.jpeg, which are all over
+// libraries that went between Windows and Linux. They are found by name
+// before anything is read, so it costs next to nothing where the exact
+// prefilter reads the start and end of every file of a size shared.
+
+const exactSampleSize = 64 * 1024
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+type exactFile struct {
+	path string
+	size int64
+}
+
+// sampleChecksum checksums the first and last exactSampleSize bytes of f,
+// which are all of it for small files.
+func sampleChecksum(f io.ReaderAt, size int64) (uint64, error) {
+	h := crc64.New(crcTable)
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, min(size, exactSampleSize))); err != nil {
+		return 0, err
+	}
+	if size > exactSampleSize {
+		tail := max(exactSampleSize, size-exactSampleSize)
+		if _, err := io.Copy(h, io.NewSectionReader(f, tail, size-tail)); err != nil {
+			return 0, err
+		}
+	}
+	return h.Sum64(), nil
+}
+
+func contentChecksum(f *trackedFile) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return sum, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// groupBy splits files into the groups of at least two that key agrees on,
+// dropping the files key fails for.
+func groupBy[K comparable](files []exactFile, key func(exactFile) (K, error)) [][]exactFile {
+	var (
+		byKey = make(map[K][]exactFile)
+		order = make([]K, 0)
+	)
+	for _, file := range files {
+		k, err := key(file)
+		if err != nil {
+			log.Debug().Err(err).Str("caller", file.path).Msg("exact prefilter: skipping file")
+			continue
+		}
+		if _, ok := byKey[k]; !ok {
+			order = append(order, k)
+		}
+		byKey[k] = append(byKey[k], file)
+	}
+	groups := make([][]exactFile, 0)
+	for _, k := range order {
+		if len(byKey[k]) > 1 {
+			groups = append(groups, byKey[k])
+		}
+	}
+	return groups
+}
+
+func withFile[K any](path string, fn func(f *trackedFile) (K, error)) (K, error) {
+	f, err := openTracked(path)
+	if err != nil {
+		var zero K
+		return zero, err
+	}
+	defer func() { _ = f.Close() }()
+	return fn(f)
+}
+
+// regularFiles returns the non-empty regular files among paths, made
+// absolute. A file given twice, or by two hard links, is one file.
+func regularFiles(paths []string) []exactFile {
+	var (
+		files = make([]exactFile, 0, len(paths))
+		seen  = make(map[string]struct{})
+		ids   = make(map[fileKey]struct{})
+	)
+	for _, p := range paths {
+		p, _ = filepath.Abs(p)
+		finfo, err := os.Stat(p)
+		if err != nil || !finfo.Mode().IsRegular() || finfo.Size() == 0 || skipOffline && offlineFile(finfo) {
+			continue
+		}
+		if _, dup := seen[p]; dup {
+			continue
+		}
+		seen[p] = struct{}{}
+		if id, ok := fileID(finfo); ok {
+			if _, dup := ids[id]; dup {
+				continue
+			}
+			ids[id] = struct{}{}
+		}
+		files = append(files, exactFile{path: p, size: finfo.Size()})
+	}
+	return files
+}
+
+// identicalSets returns the paths of groups, each sorted, and the groups in
+// order of their first path.
+func identicalSets(groups [][]exactFile) [][]string {
+	sets := make([][]string, len(groups))
+	for i, identical := range groups {
+		set := make([]string, len(identical))
+		for j, f := range identical {
+			set[j] = f.path
+		}
+		sort.Strings(set)
+		sets[i] = set
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i][0] < sets[j][0] })
+	return sets
+}
+
+// findExactDupes returns the sets of byte-identical regular files among paths,
+// each in path order.
+func findExactDupes(paths []string) [][]string {
+	var identical [][]exactFile
+	for _, sized := range groupBy(regularFiles(paths), func(f exactFile) (int64, error) { return f.size, nil }) {
+		for _, sampled := range groupBy(sized, func(f exactFile) (uint64, error) {
+			return withFile(f.path, func(file *trackedFile) (uint64, error) { return sampleChecksum(file, f.size) })
+		}) {
+			identical = append(identical, groupBy(sampled, func(f exactFile) ([sha256.Size]byte, error) {
+				return withFile(f.path, contentChecksum)
+			})...)
+		}
+	}
+	return identicalSets(identical)
+}
+
+// renameStem returns the base name of path without its extension and in lower
+// case, which is what a copy renamed only in letter case or extension shares
+// with the original, as happens a lot on the way between Windows and Linux,
+// wherever either was copied to. The checksums tell the copies from files
+// merely named alike.
+func renameStem(path string) string {
+	base := filepath.Base(path)
+	return strings.ToLower(strings.TrimSuffix(base, filepath.Ext(base)))
+}
+
+// findRenamedCopies is findExactDupes for the files sharing their renameStem
+// with another, which leaves so few to checksum that -rename-prefilter is
+// nearly free.
+func findRenamedCopies(paths []string) [][]string {
+	var identical [][]exactFile
+	for _, named := range groupBy(regularFiles(paths), func(f exactFile) (string, error) {
+		return renameStem(f.path), nil
+	}) {
+		for _, sized := range groupBy(named, func(f exactFile) (int64, error) { return f.size, nil }) {
+			identical = append(identical, groupBy(sized, func(f exactFile) ([sha256.Size]byte, error) {
+				return withFile(f.path, contentChecksum)
+			})...)
+		}
+	}
+	return identicalSets(identical)
+}
+
+// exactPrefilter reports the identical files among paths, or only the renamed
+// copies among them, and returns the paths left to decode, along with the
+// copies to give the records of the decoded originals to afterwards.
+func exactPrefilter(paths []string, renamedOnly bool) ([]string, map[string][]string) {
+	// copies get their records without going through NewImage.
+	paths = slices.DeleteFunc(paths, func(p string) bool {
+		abs, _ := filepath.Abs(p)
+		err := excludedFile(abs)
+		return err != nil && problems.note(abs, err)
+	})
+	find, found, name := findExactDupes, "exact duplicate found", "exact prefilter"
+	if renamedOnly {
+		find, found, name = findRenamedCopies, "renamed copy found", "rename prefilter"
+	}
+	sets := find(paths)
+	if len(sets) == 0 {
+		return paths, nil
+	}
+	var (
+		copies  = make(map[string][]string, len(sets))
+		skipped = make(map[string]struct{})
+	)
+	for _, set := range sets {
+		for _, p := range set[1:] {
+			log.Info().Msgf("%s: %s and %s", found, displayPath(set[0]), displayPath(p))
+			skipped[p] = struct{}{}
+		}
+		copies[set[0]] = set[1:]
+	}
+	remaining := make([]string, 0, len(paths)-len(skipped))
+	for _, p := range paths {
+		abs, _ := filepath.Abs(p)
+		if _, skip := skipped[abs]; skip {
+			continue
+		}
+		remaining = append(remaining, p)
+	}
+	log.Info().Int("sets", len(sets)).Int("skipped", len(skipped)).Msg(name + " finished")
+	return remaining, copies
+}
+
+// copyExactRecords stores a copy of each original's record for its identical
+// files, returning the copies that still have to be decoded because their
+// original was stored page by page.
+func copyExactRecords(copies map[string][]string, origin Origin) []string {
+	var leftover []string
+	for original, dupes := range copies {
+		dat, err := imageStore.Get([]byte(original))
+		if err != nil {
+			if imageStore.Has([]byte(pagePath(original, 1))) {
+				leftover = append(leftover, dupes...)
+			}
+			// otherwise the original wasn't an image, and neither are its copies.
+			continue
+		}
+		for _, p := range dupes {
+			finfo, err := os.Stat(p)
+			if err != nil {
+				log.Warn().Err(err).Str("caller", p).Msg("failed to stat exact duplicate")
+				continue
+			}
+			img := &Image{}
+			if err = sonic.Unmarshal(dat, img); err != nil {
+				log.Error().Err(err).Str("caller", original).Msg("unmarshal error")
+				break
+			}
+			img.Path, img.Name = p, finfo.Name()
+			img.ModTime, img.Size = finfo.ModTime(), finfo.Size()
+			img.ClaimedType = claimedImageType(p)
+			img.Origin = origin
+			if CheckExisting(img, imageStore) {
+				continue
+			}
+			img.b = bufs.Get()
+			if err = ingestImage(img); err != nil {
+				log.Warn().Err(err).Str("caller", p).Msg("failed to store exact duplicate")
+			}
+			img.release()
+		}
+	}
+	return leftover
+}
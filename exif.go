@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// EXIF metadata is a small TIFF structure embedded in the image. Only the
+// capture time is extracted, for keep policies that want the actual original,
+// and the software that last wrote the image, which tells edits from copies.
+// Whether there is any EXIF at all is kept too, as the copies social media
+// hand back are stripped of it, and so is where the photo was taken, which
+// reports group duplicate candidates by.
+
+// exifHeadLen is how much of the head of a file the exif stage reads in one
+// go, which holds the EXIF of nearly every JPEG and PNG. Offsets past it, as
+// of WebP, whose EXIF comes after the image data, are read from the file.
+const exifHeadLen = 64 << 10
+
+var heads = sync.Pool{New: func() any { return new([exifHeadLen]byte) }}
+
+// headReader serves reads from the head of a file read once, and those past
+// it from the file itself.
+type headReader struct {
+	head []byte
+	r    io.ReaderAt
+}
+
+func newHeadReader(r io.ReaderAt) *headReader {
+	return &headReader{r: r}
+}
+
+func (h *headReader) ReadAt(p []byte, off int64) (int, error) {
+	if h.head == nil {
+		buf := heads.Get().(*[exifHeadLen]byte)
+		n, err := h.r.ReadAt(buf[:], 0)
+		if err != nil && !errors.Is(err, io.EOF) {
+			heads.Put(buf)
+			return 0, err
+		}
+		h.head = buf[:n]
+	}
+	if off >= 0 && off+int64(len(p)) <= int64(len(h.head)) {
+		return copy(p, h.head[off:]), nil
+	}
+	return h.r.ReadAt(p, off)
+}
+
+// release returns the head to the pool.
+func (h *headReader) release() {
+	if h.head != nil {
+		heads.Put((*[exifHeadLen]byte)(h.head[:exifHeadLen]))
+		h.head = nil
+	}
+}
+
+// hasExif reports whether img carries EXIF. Records from before that was kept
+// only tell by the tags extracted from it.
+func (img *Image) hasExif() bool {
+	return img.Exif || !img.Captured.IsZero() || img.Software != ""
+}
+
+// strippedCopy returns which of the matching images a and b is a copy of the
+// other stripped of its EXIF, as social media serve them, nil if neither is.
+func strippedCopy(a, b *Image) *Image {
+	switch {
+	case len(a.PHash) == 0 || len(b.PHash) == 0:
+		return nil
+	case a.hasExif() && !b.hasExif():
+		return b
+	case b.hasExif() && !a.hasExif():
+		return a
+	}
+	return nil
+}
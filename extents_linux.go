@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// FIEMAP reports the extents of a file, flagging those shared with other
+// files: reflinked copies on btrfs and XFS, or blocks deduplicated later on.
+const (
+	fsIocFiemap         = 0xC020660B
+	fiemapFlagSync      = 0x1
+	fiemapExtentLast    = 0x1
+	fiemapExtentShared  = 0x2000
+	fiemapExtentsAtOnce = 64
+)
+
+type fiemapExtent struct {
+	Logical, Physical, Length uint64
+	_                         [2]uint64
+	Flags                     uint32
+	_                         [3]uint32
+}
+
+type fiemap struct {
+	Start, Length                        uint64
+	Flags, MappedExtents, ExtentCount, _ uint32
+	Extents                              [fiemapExtentsAtOnce]fiemapExtent
+}
+
+// sharedBytes returns how many bytes of the file at path are in extents it
+// shares with other files, which removing it doesn't free. Filesystems that
+// can't tell share nothing.
+func sharedBytes(path string) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer func() { _ = f.Close() }()
+
+	var (
+		shared int64
+		fm     fiemap
+		start  uint64
+	)
+	for {
+		fm = fiemap{Start: start, Length: ^uint64(0) - start, Flags: fiemapFlagSync, ExtentCount: fiemapExtentsAtOnce}
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&fm))); errno != 0 {
+			return shared
+		}
+		if fm.MappedExtents == 0 {
+			return shared
+		}
+		for _, ext := range fm.Extents[:fm.MappedExtents] {
+			if ext.Flags&fiemapExtentShared != 0 {
+				shared += int64(ext.Length)
+			}
+			if ext.Flags&fiemapExtentLast != 0 {
+				return shared
+			}
+			start = ext.Logical + ext.Length
+		}
+	}
+}
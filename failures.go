@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// Files that can't be ingested, because they aren't images or are corrupt,
+// are remembered in the "failures" store along with the modification time and
+// size they had. Until either changes, later scans skip them without opening
+// them again. Only failures the same file would run into again are
+// remembered: failures to read it, and timeouts of the isolated decoder, which
+// a busy machine or a flaky disk are as likely behind, are retried next scan.
+
+type failureEntry struct {
+	ModTime time.Time `json:"mtime"`
+	Size    int64     `json:"size"`
+	Reason  string    `json:"reason"`
+	Failed  time.Time `json:"failed"`
+}
+
+// retryFailed makes scans try known-bad files again.
+var retryFailed bool
+
+// knownBad reports whether path failed before and hasn't changed since.
+func knownBad(path string, finfo os.FileInfo) bool {
+	if retryFailed {
+		return false
+	}
+	dat, err := DB.With("failures").Get([]byte(path))
+	if err != nil {
+		return false
+	}
+	var entry failureEntry
+	if err = sonic.Unmarshal(dat, &entry); err != nil {
+		return false
+	}
+	return entry.ModTime.Equal(finfo.ModTime()) && entry.Size == finfo.Size()
+}
+
+// transientError is a failure that may not happen again on the same file.
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e transientError) Unwrap() error {
+	return e.err
+}
+
+// transientFailure reports whether err may not happen again on the same file:
+// a transientError, or a failure to read the file rather than to make sense
+// of what was read.
+func transientFailure(err error) bool {
+	var (
+		transient transientError
+		pathErr   *fs.PathError
+		errno     syscall.Errno
+	)
+	return errors.As(err, &transient) || errors.As(err, &pathErr) || errors.As(err, &errno)
+}
+
+// rememberFailure records that img couldn't be ingested as it is now, counting
+// it for the scan's summary under kind.
+func rememberFailure(img *Image, kind, reason string) {
+	problems.noteFailed(kind)
+	dat, err := sonic.Marshal(failureEntry{ModTime: img.ModTime, Size: img.Size, Reason: reason, Failed: time.Now()})
+	if err == nil {
+		err = DB.With("failures").Put([]byte(img.Path), dat)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("caller", img.Path).Msg("failed to remember failure")
+	}
+}
+
+// forgetFailure drops the failure of a file that has since been ingested.
+func forgetFailure(path string) {
+	store := DB.With("failures")
+	if !store.Has([]byte(path)) {
+		return
+	}
+	if err := store.Delete([]byte(path)); err != nil {
+		log.Warn().Err(err).Str("caller", path).Msg("failed to forget failure")
+	}
+}
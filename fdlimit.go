@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// fdHeadroom is the number of descriptors reserved for the database, logs,
+// and everything else that isn't an image being decoded.
+const fdHeadroom = 64
+
+func logOpenError(img *Image, err error) {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		log.Error().Err(err).Str("caller", img.Name).
+			Msg("ran out of file descriptors: raise the limit (ulimit -n) or lower -workers/-max-workers")
+		return
+	}
+	log.Warn().Caller().Err(err).Str("caller", img.Name).Msg("failed to open")
+}
+
+// checkFileLimit warns when the descriptor limit can't accommodate one open
+// image per worker on top of fdHeadroom.
+func checkFileLimit(maxWorkers int) {
+	limit, ok := fileLimit()
+	if !ok || uint64(maxWorkers+fdHeadroom) <= limit {
+		return
+	}
+	log.Warn().Uint64("limit", limit).Int("workers", maxWorkers).
+		Msg("open file limit is close to the worker count, expect \"too many open files\" errors; " +
+			"raise it with ulimit -n or lower the worker count")
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+func fileLimit() (uint64, bool) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, false
+	}
+	return uint64(rl.Cur), true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// --fields picks the fields of db ls and db export records, in the order
+// given, for consumers that want a compact payload and a schema that stays
+// put rather than whatever the Image struct holds this version. Their names
+// are those of db ls --format json.
+
+// recordField is a field of record outputs, valued for a record and, when
+// listing removed records, its tombstone.
+type recordField struct {
+	name  string
+	value func(img *Image, t *tombstone) any
+}
+
+var recordFields = []recordField{
+	{"path", func(img *Image, _ *tombstone) any { return img.Path }},
+	{"type", func(img *Image, _ *tombstone) any { return img.Type.String() }},
+	{"claimed_type", func(img *Image, _ *tombstone) any { return img.claimed() }},
+	{"size", func(img *Image, _ *tombstone) any { return img.Size }},
+	{"mtime", func(img *Image, _ *tombstone) any { return img.ModTime }},
+	{"width", func(img *Image, _ *tombstone) any { return img.Width }},
+	{"height", func(img *Image, _ *tombstone) any { return img.Height }},
+	{"hash", func(img *Image, _ *tombstone) any { return img.hashString() }},
+	{"checksum", func(img *Image, _ *tombstone) any { return hex.EncodeToString(img.Checksum) }},
+	{"captured", func(img *Image, _ *tombstone) any { return img.Captured }},
+	{"ingested", func(img *Image, _ *tombstone) any { return img.Ingested }},
+	{"origin", func(img *Image, _ *tombstone) any { return img.Origin.String() }},
+	{"provisional", func(img *Image, _ *tombstone) any { return img.Provisional }},
+	{"revisions", func(img *Image, _ *tombstone) any { return len(img.History) }},
+	{"removed", func(_ *Image, t *tombstone) any {
+		if t == nil {
+			return nil
+		}
+		return t.Removed
+	}},
+	{"removed_reason", func(_ *Image, t *tombstone) any {
+		if t == nil {
+			return ""
+		}
+		return t.Reason
+	}},
+}
+
+// parseFields looks up the comma-separated field names of list.
+func parseFields(list string) ([]recordField, error) {
+	var fields []recordField
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, f := range recordFields {
+			if f.name == name {
+				fields, found = append(fields, f), true
+				break
+			}
+		}
+		if !found {
+			names := make([]string, len(recordFields))
+			for i, f := range recordFields {
+				names[i] = f.name
+			}
+			return nil, fmt.Errorf("unknown field %q, expected some of %s", name, strings.Join(names, ","))
+		}
+	}
+	return fields, nil
+}
+
+// fieldNames returns the names of fields, for a CSV header.
+func fieldNames(fields []recordField) []string {
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.name
+	}
+	return names
+}
+
+// writeFieldsJSON writes the fields of a record as a JSON object, in order. A
+// path that isn't valid UTF-8 is given in path_bytes as well.
+func writeFieldsJSON(w io.Writer, fields []recordField, img *Image, t *tombstone) error {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range fields {
+		value := f.value(img, t)
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if f.name == "path" {
+			value = displayPath(img.Path)
+			if raw := rawPath(img.Path); raw != nil {
+				dat, _ := sonic.Marshal(raw)
+				b.WriteString(`"path_bytes":`)
+				b.Write(dat)
+				b.WriteByte(',')
+			}
+		}
+		dat, err := sonic.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", f.name, err)
+		}
+		b.WriteString(strconv.Quote(f.name))
+		b.WriteByte(':')
+		b.Write(dat)
+	}
+	b.WriteString("}\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// fieldsCSV renders the fields of a record as a CSV row. Paths are written
+// as they are, bytes and all.
+func fieldsCSV(fields []recordField, img *Image, t *tombstone) []string {
+	row := make([]string, len(fields))
+	for i, f := range fields {
+		switch v := f.value(img, t).(type) {
+		case nil:
+		case string:
+			row[i] = v
+		case time.Time:
+			if !v.IsZero() {
+				row[i] = v.Format(time.RFC3339)
+			}
+		default:
+			row[i] = fmt.Sprint(v)
+		}
+	}
+	return row
+}
+
+// newFieldsCSV returns a CSV writer with the header of fields written.
+func newFieldsCSV(w io.Writer, fields []recordField) (*csv.Writer, error) {
+	cw := csv.NewWriter(w)
+	return cw, cw.Write(fieldNames(fields))
+}
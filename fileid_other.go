@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+func fileID(fs.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
+
+func fileUsage(finfo fs.FileInfo) (uint64, int64) {
+	return 1, finfo.Size()
+}
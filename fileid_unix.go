@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+func fileID(finfo fs.FileInfo) (fileKey, bool) {
+	st, ok := finfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileKey{}, false
+	}
+	return fileKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// fileUsage returns how many links finfo's file has and the bytes allocated to it.
+func fileUsage(finfo fs.FileInfo) (links uint64, allocated int64) {
+	st, ok := finfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 1, finfo.Size()
+	}
+	return uint64(st.Nlink), int64(st.Blocks) * 512
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// freeSpace isn't known here.
+func freeSpace(string) (uint64, bool) {
+	return 0, false
+}
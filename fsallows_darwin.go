@@ -0,0 +1,20 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// filesystemAllows guesses from the type of the filesystem holding dir
+// whether action works there, if dir can be written at all: only APFS clones,
+// and FAT volumes don't link.
+func filesystemAllows(action, dir string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil || unix.Access(dir, unix.W_OK) != nil {
+		return false
+	}
+	switch unix.ByteSliceToString(st.Fstypename[:]) {
+	case "apfs":
+		return true
+	case "msdos", "exfat":
+		return false
+	}
+	return action != actionReflink
+}
@@ -0,0 +1,23 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// cloningFilesystems are the filesystem types that can reflink, though an XFS
+// may have been made without it.
+var cloningFilesystems = map[int64]bool{unix.BTRFS_SUPER_MAGIC: true, unix.XFS_SUPER_MAGIC: true}
+
+// linklessFilesystems are the filesystem types without hard or symbolic links.
+var linklessFilesystems = map[int64]bool{unix.MSDOS_SUPER_MAGIC: true, unix.EXFAT_SUPER_MAGIC: true}
+
+// filesystemAllows guesses from the type of the filesystem holding dir, and
+// whether dir can be written at all, whether action works there.
+func filesystemAllows(action, dir string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil || unix.Access(dir, unix.W_OK) != nil {
+		return false
+	}
+	if action == actionReflink {
+		return cloningFilesystems[int64(st.Type)]
+	}
+	return !linklessFilesystems[int64(st.Type)]
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+// filesystemAllows guesses whether action works in dir. Nothing reflinks
+// here, and whether Windows grants the privilege to symlink can only be found
+// out by trying, so links are taken to work.
+func filesystemAllows(action, _ string) bool {
+	return action != actionReflink
+}
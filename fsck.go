@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"git.tcp.direct/tcp.direct/database"
+	"github.com/bytedance/sonic"
+)
+
+// Every record written to the images store has the CRC-32C of its exact
+// bytes kept in the "checksums" store, under the same key. db fsck compares
+// them to find records that were corrupted or truncated behind our back,
+// e.g. by a power loss during pogreb's recovery, which would otherwise fail
+// a check halfway or, worse, match on a garbled hash. Corrupt records whose
+// files still exist are hashed again; the others are removed.
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+func recordChecksum(value []byte) []byte {
+	return binary.BigEndian.AppendUint32(nil, crc32.Checksum(value, checksumTable))
+}
+
+// sealedFiler keeps the checksums of the records written through it.
+type sealedFiler struct {
+	database.Filer
+}
+
+func (f sealedFiler) Put(key []byte, value []byte) error {
+	if err := f.Filer.Put(key, value); err != nil {
+		return err
+	}
+	return DB.With("checksums").Put(key, recordChecksum(value))
+}
+
+func (f sealedFiler) Delete(key []byte) error {
+	if err := f.Filer.Delete(key); err != nil {
+		return err
+	}
+	if sums := DB.With("checksums"); sums.Has(key) {
+		return sums.Delete(key)
+	}
+	return nil
+}
+
+// fsckProblem is what is wrong with a record, "unsealed" being a record from
+// before checksums were kept, which is sealed as it is once it decodes.
+type fsckProblem struct {
+	path, problem string
+}
+
+// checkRecord returns what is wrong with the record stored under key, if anything.
+func checkRecord(key []byte) string {
+	dat, err := imageStore.Get(key)
+	if err != nil {
+		return "unreadable: " + err.Error()
+	}
+	sum, sumErr := DB.With("checksums").Get(key)
+	if sumErr == nil && !bytes.Equal(sum, recordChecksum(dat)) {
+		return "checksum mismatch"
+	}
+	img := &Image{}
+	if err = sonic.Unmarshal(dat, img); err != nil {
+		return "undecodable: " + err.Error()
+	}
+	if img.Path != string(key) {
+		return "stored under the wrong key"
+	}
+	if len(img.PHash) > 0 {
+		if _, err = recordHash(img); err != nil {
+			return "unreadable hash: " + err.Error()
+		}
+	}
+	if sumErr != nil {
+		return "unsealed"
+	}
+	return ""
+}
+
+// repairRecord hashes the file of a corrupt record again, or removes the
+// record when the file is gone. It reports whether the file is to be hashed.
+func repairRecord(idx *bkTree, path string) (bool, error) {
+	if err := imageStore.Delete([]byte(path)); err != nil {
+		return false, fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	if err := idx.remove(path); err != nil {
+		return false, fmt.Errorf("failed to remove %s from the similarity index: %w", path, err)
+	}
+	audit("remove", path, "fsck: corrupt record")
+	file, _, _ := strings.Cut(path, pageSuffix)
+	_, err := os.Stat(file)
+	return err == nil, nil
+}
+
+func dbFsck(args []string) error {
+	fs := newFlagSet("db fsck", "[--repair]",
+		"Verify every record against its checksum and decode it, listing the corrupt ones. With --repair,\n"+
+			"corrupt records are hashed again from their files, or removed when the files are gone, and\n"+
+			"records from before checksums were kept are sealed as they are.")
+	repair := fs.Bool("repair", false, "repair what can be repaired")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument: %s", fs.Arg(0))
+	}
+	return fsck(*repair, os.Stdout)
+}
+
+func fsck(repair bool, w io.Writer) error {
+	var (
+		problems = make([]fsckProblem, 0)
+		checked  int
+	)
+	for _, k := range imageStore.Keys() {
+		checked++
+		if problem := checkRecord(k); problem != "" {
+			problems = append(problems, fsckProblem{path: string(k), problem: problem})
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].path < problems[j].path })
+
+	// checksums of records that are gone, e.g. when only the record was lost.
+	var orphans [][]byte
+	for _, k := range DB.With("checksums").Keys() {
+		if !imageStore.Has(k) {
+			orphans = append(orphans, k)
+		}
+	}
+
+	var (
+		corrupt, unsealed, sealed, removed int
+		rehash                             = make([]string, 0)
+		errs                               []error
+	)
+	idx, err := getIndex()
+	if repair && err != nil {
+		return fmt.Errorf("similarity index: %w", err)
+	}
+	for _, p := range problems {
+		if p.problem == "unsealed" {
+			if unsealed++; !repair {
+				continue
+			}
+			dat, err := imageStore.Get([]byte(p.path))
+			if err == nil {
+				err = DB.With("checksums").Put([]byte(p.path), recordChecksum(dat))
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to seal %s: %w", p.path, err))
+				continue
+			}
+			sealed++
+			continue
+		}
+		corrupt++
+		_, _ = fmt.Fprintf(w, "corrupt: %s: %s\n", displayPath(p.path), p.problem)
+		if !repair {
+			continue
+		}
+		again, err := repairRecord(idx, p.path)
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+		case again:
+			file, _, _ := strings.Cut(p.path, pageSuffix)
+			rehash = append(rehash, file)
+		default:
+			_, _ = fmt.Fprintf(w, "removed: %s: file is gone\n", displayPath(p.path))
+			removed++
+		}
+	}
+	if repair {
+		for _, k := range orphans {
+			if err := DB.With("checksums").Delete(k); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(rehash) > 0 {
+		slices.Sort(rehash)
+		rehash = slices.Compact(rehash)
+		rehashing = true
+		err := ingestPaths(context.Background(), rootConfig, rehash, newOrigin(rootConfig.source, "fsck"))
+		rehashing = false
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	log.Info().Int("records", checked).Int("corrupt", corrupt).Int("unsealed", unsealed).
+		Int("sealed", sealed).Int("rehashed", len(rehash)).Int("removed", removed).
+		Int("orphaned_checksums", len(orphans)).Bool("repair", repair).Msg("db fsck finished")
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if corrupt > 0 && !repair {
+		return fmt.Errorf("%d corrupt records, run db fsck --repair", corrupt)
+	}
+	return nil
+}
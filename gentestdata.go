@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+// gen-testdata writes a labeled corpus for evaluate: originals, variants of
+// each made by the edits copies of an image usually go through, labeled
+// duplicates of their original, and pairs of different originals labeled
+// distinct. The originals are the images of a directory or synthesized from
+// the seed, so that a seed always yields the same corpus.
+//
+// The corpus directory holds originals/NNNN.png, variants/NNNN-EDIT.EXT and
+// pairs.csv, the path_a,path_b,label rows evaluate reads, relative to it.
+
+// testdataEdit is an edit variants are made by.
+type testdataEdit struct {
+	name string
+	ext  string
+	edit func(image.Image) image.Image
+	// quality is that of the JPEG variants.
+	quality int
+}
+
+var testdataEdits = []testdataEdit{
+	{name: "half", ext: ".png", edit: func(i image.Image) image.Image { return scaleImage(i, 0.5) }},
+	{name: "thumb", ext: ".png", edit: func(i image.Image) image.Image { return scaleImage(i, 0.2) }},
+	{name: "q90", ext: ".jpg", quality: 90},
+	{name: "q40", ext: ".jpg", quality: 40},
+	{name: "crop", ext: ".png", edit: func(i image.Image) image.Image { return cropImage(i, 0.9) }},
+	{name: "rot90", ext: ".png", edit: rotateImage},
+	{name: "bright", ext: ".png", edit: func(i image.Image) image.Image { return brightenImage(i, 1.2) }},
+	{name: "dark", ext: ".png", edit: func(i image.Image) image.Image { return brightenImage(i, 0.8) }},
+}
+
+// testdataSize is the size of synthesized originals.
+var testdataSize = image.Pt(480, 360)
+
+func runGenTestdata(args []string) error {
+	fs := newFlagSet("gen-testdata", "[--from DIR] [--count N] [--seed N] [--distinct N] <out-dir>",
+		"Write a labeled corpus for evaluate: originals, variants of each (resized, re-encoded, cropped,\n"+
+			"rotated, brightened, and darkened) labeled duplicates of it, and pairs of different originals\n"+
+			"labeled distinct, listed in pairs.csv. Originals are synthesized from --seed unless --from\n"+
+			"names a directory of images to start from.")
+	from := fs.String("from", "", "`directory` of images to use as originals instead of synthesized ones")
+	count := fs.Int("count", 20, "`number` of originals, with --from 0 takes every image")
+	seed := fs.Int64("seed", 1, "`seed` the originals are synthesized from")
+	distinct := fs.Int("distinct", 3, "`number` of other originals each original is paired with as distinct")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return usageError(fs, "exactly one output directory is required")
+	}
+	switch {
+	case *count < 0 || *count == 0 && *from == "":
+		return usageError(fs, "--count must be at least 1")
+	case *distinct < 0:
+		return usageError(fs, "--distinct can't be negative")
+	}
+	out := args[0]
+	if entries, err := os.ReadDir(out); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s isn't empty, refusing to mix corpora", out)
+	}
+
+	var originals []image.Image
+	if *from != "" {
+		if originals, err = readTestdataOriginals(*from, *count); err != nil {
+			return err
+		}
+	} else {
+		rnd := rand.New(rand.NewSource(*seed))
+		for i := 0; i < *count; i++ {
+			originals = append(originals, synthesizeImage(rnd, testdataSize))
+		}
+	}
+	if len(originals) == 0 {
+		return fmt.Errorf("no images to use as originals in %s", *from)
+	}
+	for _, dir := range []string{"originals", "variants"} {
+		if err = os.MkdirAll(filepath.Join(out, dir), 0o755); err != nil {
+			return err
+		}
+	}
+
+	var rows [][]string
+	for i, orig := range originals {
+		name := fmt.Sprintf("%04d", i+1)
+		origPath := filepath.Join("originals", name+".png")
+		if err = writeTestdataImage(filepath.Join(out, origPath), orig, 0); err != nil {
+			return err
+		}
+		for _, e := range testdataEdits {
+			variant := orig
+			if e.edit != nil {
+				variant = e.edit(orig)
+			}
+			p := filepath.Join("variants", name+"-"+e.name+e.ext)
+			if err = writeTestdataImage(filepath.Join(out, p), variant, e.quality); err != nil {
+				return err
+			}
+			rows = append(rows, []string{origPath, p, "1"})
+		}
+	}
+	var (
+		negatives int
+		paired    = make(map[[2]int]bool)
+	)
+	for i := range originals {
+		for j := 1; j <= *distinct && j < len(originals); j++ {
+			other := (i + j) % len(originals)
+			if pair := [2]int{min(i, other), max(i, other)}; !paired[pair] {
+				paired[pair] = true
+				rows = append(rows, []string{
+					filepath.Join("originals", fmt.Sprintf("%04d.png", i+1)),
+					filepath.Join("originals", fmt.Sprintf("%04d.png", other+1)),
+					"0",
+				})
+				negatives++
+			}
+		}
+	}
+	if err = writeLabeledPairs(filepath.Join(out, "pairs.csv"), rows); err != nil {
+		return err
+	}
+	log.Info().Int("originals", len(originals)).Int("variants", len(originals)*len(testdataEdits)).
+		Int("distinct_pairs", negatives).Str("pairs", filepath.Join(out, "pairs.csv")).Msg("test corpus written")
+	return nil
+}
+
+// readTestdataOriginals decodes the images directly in dir, in name order,
+// up to count of them unless count is 0. Files that don't decode are skipped.
+func readTestdataOriginals(dir string, count int) ([]image.Image, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	var originals []image.Image
+	for _, e := range entries {
+		if count > 0 && len(originals) == count {
+			break
+		}
+		if !e.Type().IsRegular() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		i, _, err := image.Decode(f)
+		_ = f.Close()
+		if err != nil {
+			log.Debug().Err(err).Str("caller", e.Name()).Msg("skipping, not a decodable image")
+			continue
+		}
+		originals = append(originals, i)
+	}
+	return originals, nil
+}
+
+// writeTestdataImage encodes i to path, as a JPEG of quality when it is set
+// and as a PNG otherwise.
+func writeTestdataImage(path string, i image.Image, quality int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if quality > 0 {
+		err = jpeg.Encode(f, i, &jpeg.Options{Quality: quality})
+	} else {
+		err = png.Encode(f, i)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeLabeledPairs writes rows to path with the header evaluate skips.
+func writeLabeledPairs(path string, rows [][]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = csv.NewWriter(f).WriteAll(append([][]string{{"path_a", "path_b", "label"}}, rows...))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// synthesizeImage draws a gradient with a few random rectangles and discs on
+// it, different enough from any other seed's to tell them apart.
+func synthesizeImage(rnd *rand.Rand, size image.Point) image.Image {
+	randColor := func() color.NRGBA {
+		return color.NRGBA{R: uint8(rnd.Intn(256)), G: uint8(rnd.Intn(256)), B: uint8(rnd.Intn(256)), A: 255}
+	}
+	img := image.NewNRGBA(image.Rectangle{Max: size})
+	from, to := randColor(), randColor()
+	lerp := func(a, b uint8, t float64) uint8 { return uint8(float64(a) + (float64(b)-float64(a))*t) }
+	for y := 0; y < size.Y; y++ {
+		t := float64(y) / float64(size.Y-1)
+		c := color.NRGBA{R: lerp(from.R, to.R, t), G: lerp(from.G, to.G, t), B: lerp(from.B, to.B, t), A: 255}
+		for x := 0; x < size.X; x++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	for shapes := 4 + rnd.Intn(5); shapes > 0; shapes-- {
+		c := randColor()
+		x0, y0 := rnd.Intn(size.X), rnd.Intn(size.Y)
+		w, h := size.X/8+rnd.Intn(size.X/3), size.Y/8+rnd.Intn(size.Y/3)
+		disc := rnd.Intn(2) == 0
+		for y := max(0, y0-h); y < min(size.Y, y0+h); y++ {
+			for x := max(0, x0-w); x < min(size.X, x0+w); x++ {
+				dx, dy := float64(x-x0)/float64(w), float64(y-y0)/float64(h)
+				if !disc || dx*dx+dy*dy <= 1 {
+					img.SetNRGBA(x, y, c)
+				}
+			}
+		}
+	}
+	return img
+}
+
+func scaleImage(i image.Image, factor float64) image.Image {
+	b := i.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, max(1, int(float64(b.Dx())*factor)), max(1, int(float64(b.Dy())*factor))))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), i, b, draw.Src, nil)
+	return dst
+}
+
+// cropImage keeps the middle of i, the fraction of its width and height.
+func cropImage(i image.Image, fraction float64) image.Image {
+	b := i.Bounds()
+	w, h := int(float64(b.Dx())*fraction), int(float64(b.Dy())*fraction)
+	src := image.Rect(0, 0, w, h).Add(b.Min).Add(image.Pt((b.Dx()-w)/2, (b.Dy()-h)/2))
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), i, src.Min, draw.Src)
+	return dst
+}
+
+// rotateImage turns i by 90 degrees clockwise.
+func rotateImage(i image.Image) image.Image {
+	b := i.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(b.Max.Y-1-y, x-b.Min.X, i.At(x, y))
+		}
+	}
+	return dst
+}
+
+// brightenImage scales the channels of i by factor.
+func brightenImage(i image.Image, factor float64) image.Image {
+	b := i.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), i, b.Min, draw.Src)
+	scale := func(v uint8) uint8 { return uint8(min(255, float64(v)*factor)) }
+	for p := 0; p < len(dst.Pix); p += 4 {
+		dst.Pix[p], dst.Pix[p+1], dst.Pix[p+2] = scale(dst.Pix[p]), scale(dst.Pix[p+1]), scale(dst.Pix[p+2])
+	}
+	return dst
+}
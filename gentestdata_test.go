@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// corpusDistance is the default -d the corpus is grouped at.
+const corpusDistance = 12
+
+// ungroupedEdits are the edits dHash isn't meant to see through, whose
+// variants are left out of the groups rather than matched by chance.
+var ungroupedEdits = []string{"rot90"}
+
+// genCorpus writes a corpus of count originals to a temporary directory.
+func genCorpus(t *testing.T, count string, seed string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := runGenTestdata([]string{"--count", count, "--seed", seed, dir}); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// groupCorpus hashes the images of the corpus in dir and groups them as a
+// check at corpusDistance would, returning the groups as the sorted paths of
+// their members relative to dir.
+func groupCorpus(t *testing.T, dir string) [][]string {
+	t.Helper()
+	var paths []string
+	for _, sub := range []string{"originals", "variants"} {
+		matches, err := filepath.Glob(filepath.Join(dir, sub, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, slices.DeleteFunc(matches, func(p string) bool {
+			return slices.ContainsFunc(ungroupedEdits, func(e string) bool {
+				return strings.HasSuffix(strings.TrimSuffix(p, filepath.Ext(p)), "-"+e)
+			})
+		})...)
+	}
+	hashes := make(map[string]uint64, len(paths))
+	records := make(map[string]*Image, len(paths))
+	for _, p := range paths {
+		h, err := hashFile(p, []string{"dhash"})
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		rel, _ := filepath.Rel(dir, p)
+		hashes[rel], records[rel] = h["dhash"].GetHash(), &Image{Path: rel}
+	}
+	pairs := newPairSet(0)
+	for i, a := range paths {
+		for _, b := range paths[i+1:] {
+			ra, _ := filepath.Rel(dir, a)
+			rb, _ := filepath.Rel(dir, b)
+			if d := hashDistance(hashes[ra], hashes[rb]); d <= corpusDistance {
+				pairs.add(dupePair{a: ra, b: rb, distance: d})
+			}
+		}
+	}
+	var groups [][]string
+	for _, g := range groupPairs(pairs, records, nil) {
+		var members []string
+		for _, m := range g.members {
+			members = append(members, m.Path)
+		}
+		slices.Sort(members)
+		groups = append(groups, members)
+	}
+	return groups
+}
+
+func TestGenTestdataGroups(t *testing.T) {
+	dir := genCorpus(t, "6", "1")
+	var want [][]string
+	for _, name := range []string{"0001", "0002", "0003", "0004", "0005", "0006"} {
+		members := []string{filepath.Join("originals", name+".png")}
+		for _, e := range testdataEdits {
+			if !slices.Contains(ungroupedEdits, e.name) {
+				members = append(members, filepath.Join("variants", name+"-"+e.name+e.ext))
+			}
+		}
+		slices.Sort(members)
+		want = append(want, members)
+	}
+	got := groupCorpus(t, dir)
+	slices.SortFunc(got, func(a, b []string) int { return strings.Compare(a[0], b[0]) })
+	if len(got) != len(want) {
+		t.Fatalf("got %d groups, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if !slices.Equal(got[i], want[i]) {
+			t.Errorf("group %d:\n got %v\nwant %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestGenTestdataLabels(t *testing.T) {
+	dir := genCorpus(t, "4", "1")
+	pairs, err := readLabeledPairs(filepath.Join(dir, "pairs.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dupes, distinct int
+	for _, p := range pairs {
+		for _, path := range []string{p.a, p.b} {
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("pairs.csv names a missing file: %v", err)
+			}
+		}
+		sameOriginal := filepath.Base(p.a)[:4] == filepath.Base(p.b)[:4]
+		if p.dupe != sameOriginal {
+			t.Errorf("%s and %s labeled duplicate=%v", p.a, p.b, p.dupe)
+		}
+		if p.dupe {
+			dupes++
+		} else {
+			distinct++
+		}
+	}
+	// with 4 originals and the default --distinct 3, every pair of them.
+	if want := 4 * len(testdataEdits); dupes != want {
+		t.Errorf("got %d duplicate pairs, want %d", dupes, want)
+	}
+	if distinct != 6 {
+		t.Errorf("got %d distinct pairs, want 6", distinct)
+	}
+}
+
+func TestGenTestdataSeed(t *testing.T) {
+	a, b, c := genCorpus(t, "2", "7"), genCorpus(t, "2", "7"), genCorpus(t, "2", "8")
+	read := func(dir string) []byte {
+		dat, err := os.ReadFile(filepath.Join(dir, "originals", "0001.png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dat
+	}
+	if !bytes.Equal(read(a), read(b)) {
+		t.Error("the same seed synthesized different originals")
+	}
+	if bytes.Equal(read(a), read(c)) {
+		t.Error("different seeds synthesized the same original")
+	}
+}
+
+func TestGenTestdataRefusesNonEmpty(t *testing.T) {
+	dir := genCorpus(t, "1", "1")
+	if err := runGenTestdata([]string{"--count", "1", dir}); err == nil {
+		t.Error("gen-testdata wrote into a directory that already held a corpus")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Path arguments may be globs, like '~/Pictures/**/*.jpg', which dupehunter
+// expands itself: shells on Windows don't, and a whole library's worth of
+// paths may not fit on a command line anyway. Globs use the syntax of
+// -thresholds, where ** spans directories. An argument naming an existing
+// file is always taken literally.
+
+func isGlob(arg string) bool {
+	return strings.ContainsAny(arg, "*?")
+}
+
+// expandHome replaces a leading ~ with the home directory.
+func expandHome(arg string) string {
+	if arg != "~" && !strings.HasPrefix(arg, "~/") && !strings.HasPrefix(arg, `~\`) {
+		return arg
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return arg
+	}
+	return filepath.Join(home, arg[1:])
+}
+
+// globBase splits an absolute glob into the directory before its first
+// wildcard, which is where the search starts, and the number of path elements
+// that follow it, or -1 if ** lets matches be any number of them deep.
+func globBase(glob string) (string, int) {
+	elems := strings.Split(filepath.ToSlash(glob), "/")
+	for i, elem := range elems {
+		if !isGlob(elem) {
+			continue
+		}
+		depth := len(elems) - i
+		if strings.Contains(glob, "**") {
+			depth = -1
+		}
+		return filepath.FromSlash(strings.Join(elems[:i], "/") + "/"), depth
+	}
+	return glob, 0
+}
+
+// expandGlob returns the regular files matching glob, in lexical order.
+func expandGlob(glob string) ([]string, error) {
+	glob, err := filepath.Abs(expandHome(glob))
+	if err != nil {
+		return nil, err
+	}
+	re, err := globRegexp(glob)
+	if err != nil {
+		return nil, err
+	}
+	base, depth := globBase(glob)
+
+	matches := make([]string, 0)
+	err = filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == base {
+				return err
+			}
+			log.Warn().Err(err).Str("caller", p).Msg("failed to expand glob")
+			return nil
+		}
+		if d.IsDir() {
+			if !includeTrash && excluded.kind(p) != "" {
+				return filepath.SkipDir
+			}
+			rel, _ := filepath.Rel(base, p)
+			if depth >= 0 && rel != "." && strings.Count(filepath.ToSlash(rel), "/")+1 >= depth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && re.MatchString(filepath.ToSlash(p)) {
+			matches = append(matches, p)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return matches, nil
+	}
+	return matches, err
+}
+
+// expandArgs expands the globs among args, leaving the other arguments and
+// those naming existing files as they are.
+func expandArgs(args []string) ([]string, error) {
+	paths := make([]string, 0, len(args))
+	for _, arg := range args {
+		if _, err := os.Lstat(arg); err == nil {
+			paths = append(paths, arg)
+			continue
+		}
+		if !isGlob(arg) {
+			paths = append(paths, expandHome(arg))
+			continue
+		}
+		matches, err := expandGlob(arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			log.Warn().Str("glob", arg).Msg("no files match")
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
@@ -7,14 +7,17 @@ toolchain go1.22.4
 require (
 	git.tcp.direct/kayos/common v0.9.9
 	git.tcp.direct/tcp.direct/database v0.5.4
+	github.com/akrylysov/pogreb v0.10.2
 	github.com/bytedance/sonic v1.11.9
 	github.com/corona10/goimagehash v1.1.0
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/panjf2000/ants/v2 v2.10.0
 	github.com/rs/zerolog v1.33.0
+	golang.org/x/image v0.18.0
+	golang.org/x/sys v0.21.0
 )
 
 require (
-	github.com/akrylysov/pogreb v0.10.2 // indirect
 	github.com/bytedance/sonic/loader v0.1.1 // indirect
 	github.com/cloudwego/base64x v0.1.4 // indirect
 	github.com/cloudwego/iasm v0.2.0 // indirect
@@ -25,5 +28,4 @@ require (
 	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
 	golang.org/x/arch v0.0.0-20210923205945-b76863e36670 // indirect
 	golang.org/x/sync v0.3.0 // indirect
-	golang.org/x/sys v0.21.0 // indirect
 )
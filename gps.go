@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"git.tcp.direct/kayos/dupehunter/internal/imaging"
+)
+
+// Photos carrying GPS coordinates in their EXIF are recorded with where they
+// were taken. With -report-places, reports tell where each group of duplicate
+// candidates was shot and list the groups place by place. Groups taken within
+// placeRadius of each other share a place, and a group whose members were
+// captured at different times is a series of shots of the same subject, say a
+// dozen of the same monument, rather than copies of one photo. Reports leave
+// locations out otherwise, being handed around more freely than the photos.
+
+// placeRadius is how far apart in meters groups are still taken at the same
+// place.
+const placeRadius = 100
+
+// gpsPosition is a position in decimal degrees, north and east positive.
+type gpsPosition = imaging.Position
+
+// reportLocation is where the members of a group were taken.
+type reportLocation struct {
+	gpsPosition
+	// Place numbers the places groups were taken at, groups within
+	// placeRadius of each other sharing one.
+	Place int `json:"place"`
+	// Located is how many members carry a position.
+	Located int `json:"located"`
+	// Shots is how many distinct capture times the members have, more than
+	// one telling a series of shots apart from copies.
+	Shots int `json:"shots"`
+}
+
+// groupLocation returns where the located members of g were taken, on
+// average, nil if none of them carries a position.
+func groupLocation(g *dupeGroup) *reportLocation {
+	var (
+		loc      reportLocation
+		captures = make(map[time.Time]bool)
+	)
+	for _, m := range g.members {
+		if !m.Captured.IsZero() {
+			captures[m.Captured] = true
+		}
+		if m.GPS == nil {
+			continue
+		}
+		loc.Located++
+		loc.Lat += m.GPS.Lat
+		loc.Lon += m.GPS.Lon
+	}
+	if loc.Located == 0 {
+		return nil
+	}
+	loc.Lat /= float64(loc.Located)
+	loc.Lon /= float64(loc.Located)
+	loc.Shots = len(captures)
+	return &loc
+}
+
+// assignPlaces numbers the places of locations, in order, each joining the
+// first place within placeRadius of it.
+func assignPlaces(locations []*reportLocation) {
+	var places []gpsPosition
+	for _, loc := range locations {
+		if loc == nil {
+			continue
+		}
+		for i, p := range places {
+			if p.Distance(loc.gpsPosition) <= placeRadius {
+				loc.Place = i + 1
+				break
+			}
+		}
+		if loc.Place == 0 {
+			places = append(places, loc.gpsPosition)
+			loc.Place = len(places)
+		}
+	}
+}
+
+// groupsByPlace returns groups ordered by the places they were taken at,
+// numbered in the order they first come up, with the groups without a
+// position last, along with their locations in that order.
+func groupsByPlace(groups []*dupeGroup) ([]*dupeGroup, []*reportLocation) {
+	located := make([]*reportLocation, len(groups))
+	for i, g := range groups {
+		located[i] = groupLocation(g)
+	}
+	assignPlaces(located)
+	order := make([]int, len(groups))
+	for i := range order {
+		order[i] = i
+	}
+	place := func(i int) int {
+		if located[i] == nil {
+			return math.MaxInt
+		}
+		return located[i].Place
+	}
+	sort.SliceStable(order, func(a, b int) bool { return place(order[a]) < place(order[b]) })
+	var (
+		sorted    = make([]*dupeGroup, len(groups))
+		locations = make([]*reportLocation, len(groups))
+	)
+	for i, j := range order {
+		sorted[i], locations[i] = groups[j], located[j]
+	}
+	return sorted, locations
+}
+
+// describe returns the text of a report for loc.
+func (loc *reportLocation) describe() string {
+	s := fmt.Sprintf("at %s (place %d)", loc.gpsPosition, loc.Place)
+	if loc.Shots > 1 {
+		s += fmt.Sprintf(", %d shots taken at different times", loc.Shots)
+	}
+	return s
+}
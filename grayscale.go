@@ -0,0 +1,66 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// Images are noted as grayscale when they are hashed, so that matches of a
+// grayscale image with a color one, a scan, a filter, or a deliberate black
+// and white edit of the original, stand out: log lines and reports annotate
+// them, and -keep color prefers the color original. Records hashed before
+// this count as color.
+
+// grayscaleTolerance is how far apart, out of 0xffff, the channels of a pixel
+// may be for it to pass as gray, which leaves room for the chroma noise of
+// lossy formats.
+const grayscaleTolerance = 8 * 0x101
+
+// grayscaleSamples is the number of pixels along each side isGrayscale
+// looks at, at most.
+const grayscaleSamples = 64
+
+// isGrayscale reports whether i has no color, by its color model or by a
+// grid of its pixels.
+func isGrayscale(i image.Image) bool {
+	switch i.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		return true
+	}
+	b := i.Bounds()
+	stepX, stepY := max(b.Dx()/grayscaleSamples, 1), max(b.Dy()/grayscaleSamples, 1)
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			r, g, bl, _ := i.At(x, y).RGBA()
+			if max(r, g, bl)-min(r, g, bl) > grayscaleTolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// grayscaleCopy returns which of the matching images a and b is grayscale
+// while the other is in color, nil if neither or both are.
+func grayscaleCopy(a, b *Image) *Image {
+	switch {
+	case len(a.PHash) == 0 || len(b.PHash) == 0:
+		return nil
+	case a.Grayscale && !b.Grayscale:
+		return a
+	case b.Grayscale && !a.Grayscale:
+		return b
+	}
+	return nil
+}
+
+// keepColor prefers the members in color over grayscale ones.
+func keepColor(a, b *Image) int {
+	switch {
+	case !a.Grayscale && b.Grayscale:
+		return -1
+	case !b.Grayscale && a.Grayscale:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+type dupePair struct {
+	a, b     string
+	distance int
+}
+
+// dupeGroup is a set of records that are transitively within the distance
+// threshold of each other. The first member is the keeper.
+type dupeGroup struct {
+	members []*Image
+}
+
+func (g *dupeGroup) keeper() *Image {
+	return g.members[0]
+}
+
+func (g *dupeGroup) duplicates() []*Image {
+	return g.members[1:]
+}
+
+// groupID identifies g by the contents of its members, the hashes of images
+// and the checksums of other files, whatever order they were found in and
+// whichever is kept. Copies of a content already in the group don't change
+// it, so a group keeps its ID across runs until a different image joins it or
+// a member is cleaned.
+func groupID(g *dupeGroup) string {
+	contents := make([]string, 0, len(g.members))
+	for _, m := range g.members {
+		switch {
+		case len(m.PHash) > 0:
+			contents = append(contents, m.hashString())
+		case len(m.Checksum) > 0:
+			contents = append(contents, "c:"+hex.EncodeToString(m.Checksum))
+		default:
+			contents = append(contents, "f:"+m.Path)
+		}
+	}
+	slices.Sort(contents)
+	sum := sha256.Sum256([]byte(strings.Join(slices.Compact(contents), "\n")))
+	return hex.EncodeToString(sum[:6])
+}
+
+// removable returns the duplicates clean may act on, all but the edits.
+func (g *dupeGroup) removable() []*Image {
+	return slices.DeleteFunc(slices.Clone(g.duplicates()), func(m *Image) bool { return isEdit(g.keeper(), m) })
+}
+
+// edits returns the duplicates in the edits tier: variants of the keeper that
+// were edited rather than copied, which clean leaves for review.
+func (g *dupeGroup) edits() []*Image {
+	return slices.DeleteFunc(slices.Clone(g.duplicates()), func(m *Image) bool { return !isEdit(g.keeper(), m) })
+}
+
+// isEdit reports whether dupe looks like an edit of keeper: written by other
+// software, or scaled to other dimensions of the same aspect. A copy stripped
+// of its EXIF has lost the Software tag rather than been written by another.
+func isEdit(keeper, dupe *Image) bool {
+	switch {
+	case keeper.Software != dupe.Software && strippedCopy(keeper, dupe) != dupe:
+		return true
+	case keeper.Width != dupe.Width || keeper.Height != dupe.Height:
+		return sameAspect(keeper, dupe)
+	}
+	return false
+}
+
+// keeperLess orders group members by preference to be kept: the largest file,
+// then the oldest modification time, then the lexically first path.
+func keeperLess(a, b *Image) bool {
+	switch {
+	case a.Size != b.Size:
+		return a.Size > b.Size
+	case !a.ModTime.Equal(b.ModTime):
+		return a.ModTime.Before(b.ModTime)
+	default:
+		return a.Path < b.Path
+	}
+}
+
+// keepRule compares two group members, negative if a is preferred as keeper,
+// positive if b is, and zero if the rule doesn't care.
+type keepRule func(a, b *Image) int
+
+// keepOrder consults its rules in order, falling back to keeperLess when none
+// of them decides.
+type keepOrder []keepRule
+
+func (o keepOrder) less(a, b *Image) bool {
+	for _, rule := range o {
+		if c := rule(a, b); c != 0 {
+			return c < 0
+		}
+	}
+	return keeperLess(a, b)
+}
+
+// keepMatching prefers members whose path matches re.
+func keepMatching(re *regexp.Regexp) keepRule {
+	return func(a, b *Image) int {
+		am, bm := re.MatchString(a.Path), re.MatchString(b.Path)
+		switch {
+		case am && !bm:
+			return -1
+		case bm && !am:
+			return 1
+		}
+		return 0
+	}
+}
+
+// keepPolicies are the named rules selectable with -keep.
+var keepPolicies = map[string]keepRule{
+	"color":            keepColor,
+	"earliest-capture": keepEarliestCapture,
+	"exif":             keepExif,
+	"oldest":           keepOldest,
+	"newest":           keepNewest,
+	"largest":          keepLargest,
+	"shallowest-path":  keepShallowest,
+	"shortest-path":    keepShortestPath,
+	"shortest-name":    keepShortestName,
+}
+
+func keepPolicyNames() string {
+	names := make([]string, 0, len(keepPolicies))
+	for name := range keepPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// captureTime is when the photo was taken according to EXIF, or the
+// modification time for images without it.
+func (img *Image) captureTime() time.Time {
+	if !img.Captured.IsZero() {
+		return img.Captured
+	}
+	return img.ModTime
+}
+
+// keepEarliestCapture prefers the member captured first, so the original
+// survives even when copying gave it a newer mtime than its copies.
+func keepEarliestCapture(a, b *Image) int {
+	return a.captureTime().Compare(b.captureTime())
+}
+
+// keepExif prefers the members carrying EXIF over copies stripped of it. It
+// is consulted after the rules given, before keeperLess.
+func keepExif(a, b *Image) int {
+	switch {
+	case a.hasExif() && !b.hasExif():
+		return -1
+	case b.hasExif() && !a.hasExif():
+		return 1
+	}
+	return 0
+}
+
+// keepOldest prefers the member modified first.
+func keepOldest(a, b *Image) int {
+	return a.ModTime.Compare(b.ModTime)
+}
+
+// keepNewest prefers the member modified last, e.g. the one last edited.
+func keepNewest(a, b *Image) int {
+	return b.ModTime.Compare(a.ModTime)
+}
+
+// keepLargest prefers the largest file, which for near-duplicates tends to be
+// the one with the most detail.
+func keepLargest(a, b *Image) int {
+	return cmp.Compare(b.Size, a.Size)
+}
+
+// keepShortestPath prefers the member with the shortest path as a whole.
+func keepShortestPath(a, b *Image) int {
+	return len(a.Path) - len(b.Path)
+}
+
+// keepShallowest prefers the member fewest directories deep, since copies tend
+// to end up in nested backup and export folders.
+func keepShallowest(a, b *Image) int {
+	sep := string(filepath.Separator)
+	return strings.Count(a.Path, sep) - strings.Count(b.Path, sep)
+}
+
+// keepShortestName prefers the member with the shortest file name, since copies
+// tend to grow " (1)", "-copy" or "resized_" decorations.
+func keepShortestName(a, b *Image) int {
+	return len(filepath.Base(a.Path)) - len(filepath.Base(b.Path))
+}
+
+// groupPairs merges matching pairs into connected groups, ordering each group's
+// members so the keeper comes first, and the groups themselves by keeper path.
+// Members of canonical collections are kept over all others, and copies
+// stripped of their EXIF lose out unless order decides otherwise.
+func groupPairs(pairs *pairSet, records map[string]*Image, order keepOrder) []*dupeGroup {
+	order = append(append(keepOrder{keepCanonical}, order...), keepExif)
+	parent := make(map[string]string)
+	var find func(string) string
+	find = func(p string) string {
+		if parent[p] == p {
+			return p
+		}
+		parent[p] = find(parent[p])
+		return parent[p]
+	}
+	pairs.each(func(pair dupePair) {
+		for _, p := range []string{pair.a, pair.b} {
+			if _, ok := parent[p]; !ok {
+				parent[p] = p
+			}
+		}
+		parent[find(pair.a)] = find(pair.b)
+	})
+
+	byRoot := make(map[string]*dupeGroup)
+	for p := range parent {
+		root := find(p)
+		if byRoot[root] == nil {
+			byRoot[root] = &dupeGroup{}
+		}
+		byRoot[root].members = append(byRoot[root].members, records[p])
+	}
+
+	groups := make([]*dupeGroup, 0, len(byRoot))
+	for _, g := range byRoot {
+		sort.Slice(g.members, func(i, j int) bool { return order.less(g.members[i], g.members[j]) })
+		if g.keeper().canonical {
+			// canonical images are never duplicates, only keepers.
+			g.members = append(g.members[:1], slices.DeleteFunc(g.members[1:], func(m *Image) bool { return m.canonical })...)
+			if len(g.members) < 2 {
+				continue
+			}
+		}
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].keeper().Path < groups[j].keeper().Path })
+	return groups
+}
+
+// groupsOf maps the paths of the members of groups to their group.
+func groupsOf(groups []*dupeGroup) map[string]*dupeGroup {
+	of := make(map[string]*dupeGroup)
+	for _, g := range groups {
+		for _, m := range g.members {
+			of[m.Path] = g
+		}
+	}
+	return of
+}
+
+// selectGroups keeps the groups with at least minSize members that weren't
+// ignored, see resolveGroup, then pages through them: skipping offset groups
+// and keeping at most limit (0 for all).
+func selectGroups(groups []*dupeGroup, minSize, offset, limit int) []*dupeGroup {
+	var selected = make([]*dupeGroup, 0, len(groups))
+	for _, g := range groups {
+		if len(g.members) >= minSize && !groupIgnored(g) {
+			selected = append(selected, g)
+		}
+	}
+	selected = selected[min(offset, len(selected)):]
+	if limit > 0 && len(selected) > limit {
+		selected = selected[:limit]
+	}
+	return selected
+}
+
+// writePrint0 writes the path of every duplicate but the edits NUL-terminated,
+// suitable for xargs -0.
+func writePrint0(w io.Writer, groups []*dupeGroup) error {
+	for _, g := range groups {
+		for _, dupe := range g.removable() {
+			if _, err := io.WriteString(w, dupe.Path+"\x00"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
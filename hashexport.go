@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/corona10/goimagehash"
+)
+
+// A hash-only export lets two people find out which of their images they
+// both have without showing each other their libraries: it holds nothing but
+// the hash of every record, or the checksum of files that aren't images, each
+// under an identifier derived from the path with a secret salt. Only whoever
+// knows the salt can tell which file an identifier stands for, by exporting
+// again with the same salt; the hashes themselves reveal no more than what
+// the images look like at the resolution of the hash, 8x8 pixels unless -hash
+// says otherwise. db overlap compares an export someone else made against the
+// local index, record by record of the same hash layout.
+//
+// Version 1 exports held goimagehash's string form of 64 bit hashes, which
+// has no room for extended ones. Since version 2 every entry names its layout
+// and holds the 64 bit words of its hash in hex, 16 digits each.
+
+const (
+	hashExportFormat  = "dupehunter-hashes"
+	hashExportVersion = 2
+	hashExportSaltLen = 16
+)
+
+type hashExportHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+type hashExportEntry struct {
+	ID       string `json:"id"`
+	Layout   string `json:"layout,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// encodeHashWords is the form of hash words in exports.
+func encodeHashWords(words []uint64) string {
+	var b strings.Builder
+	for _, w := range words {
+		_, _ = fmt.Fprintf(&b, "%016x", w)
+	}
+	return b.String()
+}
+
+func decodeHashWords(s string) ([]uint64, error) {
+	if s == "" || len(s)%16 != 0 {
+		return nil, fmt.Errorf("invalid hash %q", s)
+	}
+	words := make([]uint64, 0, len(s)/16)
+	for i := 0; i < len(s); i += 16 {
+		w, err := strconv.ParseUint(s[i:i+16], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash %q", s)
+		}
+		words = append(words, w)
+	}
+	return words, nil
+}
+
+// legacyExportLayouts are the layouts of the kinds of hashes version 1
+// exports held.
+var legacyExportLayouts = map[goimagehash.Kind]string{
+	goimagehash.AHash: hashLibrary + "/ahash-64",
+	goimagehash.DHash: hashLibrary + "/dhash-64",
+	goimagehash.PHash: hashLibrary + "/phash-64",
+}
+
+// saltedID derives the identifier of path in an export salted with salt.
+func saltedID(salt []byte, path string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(path))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func dbExport(args []string) error {
+	fs := newFlagSet("db export", "[--fields LIST | --hashes-only [--salt HEX]] <file>",
+		"Export the records to file, one JSON object per line, whole or only the --fields given.\n\n"+
+			"With --hashes-only only the hashes are exported, under salted identifiers instead of paths, "+
+			"for comparing libraries with db overlap without revealing file names.")
+	hashesOnly := fs.Bool("hashes-only", false, "export only salted identifiers and hashes")
+	saltHex := fs.String("salt", "", "`hex` salt for the identifiers, random if not given")
+	fieldList := fs.String("fields", "", "only export these comma-separated `fields`, of "+
+		strings.Join(fieldNames(recordFields), ","))
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "exactly one destination file is required")
+	}
+	if *saltHex != "" && !*hashesOnly {
+		return usageError(fs, "--salt only applies to --hashes-only exports")
+	}
+	var fields []recordField
+	if *fieldList != "" {
+		if *hashesOnly {
+			return usageError(fs, "--fields and --hashes-only are exclusive, hashes-only exports have a fixed schema")
+		}
+		var err error
+		if fields, err = parseFields(*fieldList); err != nil {
+			return usageError(fs, "invalid value for --fields: %s", err)
+		}
+	}
+	dest := fs.Arg(0)
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("refusing to overwrite existing file: %s", dest)
+	}
+
+	var salt []byte
+	if *hashesOnly {
+		var err error
+		if *saltHex == "" {
+			salt = make([]byte, hashExportSaltLen)
+			_, err = rand.Read(salt)
+		} else {
+			salt, err = hex.DecodeString(*saltHex)
+		}
+		if err != nil || len(salt) < hashExportSaltLen {
+			return usageError(fs, "invalid value for --salt: expected at least %d hex-encoded bytes", hashExportSaltLen)
+		}
+	}
+
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	var (
+		w     = bufio.NewWriter(f)
+		enc   = sonic.ConfigDefault.NewEncoder(w)
+		count int
+	)
+	if *hashesOnly {
+		err = enc.Encode(hashExportHeader{Format: hashExportFormat, Version: hashExportVersion, Created: time.Now().UTC()})
+	}
+	if err == nil {
+		err = forEachRecord(func(img *Image) error {
+			if !*hashesOnly {
+				count++
+				if fields != nil {
+					return writeFieldsJSON(w, fields, img, nil)
+				}
+				return enc.Encode(img)
+			}
+			entry := hashExportEntry{ID: saltedID(salt, img.Path)}
+			switch {
+			case len(img.Checksum) > 0:
+				entry.Checksum = hex.EncodeToString(img.Checksum)
+			case len(img.PHash) > 0:
+				words, err := recordHash(img)
+				if err != nil {
+					return nil
+				}
+				entry.Layout, entry.Hash = img.layout(), encodeHashWords(words)
+			default:
+				return nil
+			}
+			count++
+			return enc.Encode(entry)
+		})
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dest)
+		return err
+	}
+	ev := log.Info().Str("path", dest).Int("records", count)
+	if *hashesOnly && *saltHex == "" {
+		ev = ev.Str("salt", hex.EncodeToString(salt))
+	}
+	ev.Msg("records exported")
+	if *hashesOnly && *saltHex == "" {
+		log.Info().Msg("keep the salt to tell which of your files the identifiers stand for, " +
+			"export again with --salt to recompute them")
+	}
+	return nil
+}
+
+// readHashExport reads a hash-only export into the hashes of its images, by
+// layout and identifier, and the identifiers of its other files, by checksum.
+func readHashExport(path string) (map[string]map[string][]uint64, map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var (
+		hashes    = make(map[string]map[string][]uint64)
+		checksums = make(map[string][]string)
+		scanner   = bufio.NewScanner(f)
+	)
+	// extended hashes make for long lines.
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		return nil, nil, fmt.Errorf("empty hash export")
+	}
+	var header hashExportHeader
+	if err = sonic.Unmarshal(scanner.Bytes(), &header); err != nil || header.Format != hashExportFormat {
+		return nil, nil, fmt.Errorf("not a hash export")
+	}
+	if header.Version < 1 || header.Version > hashExportVersion {
+		return nil, nil, fmt.Errorf("unsupported hash export version %d", header.Version)
+	}
+	for line := 2; scanner.Scan(); line++ {
+		var e hashExportEntry
+		if err = sonic.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, nil, fmt.Errorf("corrupt hash export line %d: %w", line, err)
+		}
+		if e.Checksum != "" {
+			checksums[e.Checksum] = append(checksums[e.Checksum], e.ID)
+			continue
+		}
+		layout, words, err := readExportHash(header.Version, e)
+		if err != nil {
+			return nil, nil, fmt.Errorf("corrupt hash export line %d: %w", line, err)
+		}
+		if hashes[layout] == nil {
+			hashes[layout] = make(map[string][]uint64)
+		}
+		hashes[layout][e.ID] = words
+	}
+	return hashes, checksums, scanner.Err()
+}
+
+// readExportHash returns the layout and the words of the hash of e, read from
+// an export of version.
+func readExportHash(version int, e hashExportEntry) (string, []uint64, error) {
+	if version > 1 {
+		if e.Layout == "" {
+			return "", nil, fmt.Errorf("hash of %s has no layout", e.ID)
+		}
+		words, err := decodeHashWords(e.Hash)
+		return e.Layout, words, err
+	}
+	h, err := goimagehash.ImageHashFromString(e.Hash)
+	if err != nil {
+		return "", nil, err
+	}
+	layout, ok := legacyExportLayouts[h.GetKind()]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown kind of hash %q", e.Hash)
+	}
+	return layout, []uint64{h.GetHash()}, nil
+}
+
+func dbOverlap(args []string, w io.Writer) error {
+	fs := newFlagSet("db overlap", "[-d DISTANCE] <export>",
+		"List the indexed records that also appear in a hash-only export made with db export --hashes-only, "+
+			"as \"path<TAB>identifier<TAB>distance\" lines.")
+	distance := fs.Int("d", 4, "pair records whose hamming `distance` is below this value (1-64)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "exactly one export file is required")
+	}
+	if *distance < 1 || *distance > 64 {
+		return usageError(fs, "invalid value %d for -d: must be between 1 and 64", *distance)
+	}
+	hashes, checksums, err := readHashExport(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	// indexes key the hashes by their first words, which differ in no more
+	// bits than the whole hashes do.
+	indexes := make(map[string]*bucketIndex, len(hashes))
+	for layout, byID := range hashes {
+		first := make(map[string]uint64, len(byID))
+		for id, words := range byID {
+			first[id] = words[0]
+		}
+		indexes[layout] = buildBuckets(first, *distance-1)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	err = forEachRecord(func(img *Image) error {
+		var matches []indexMatch
+		switch {
+		case len(img.Checksum) > 0:
+			for _, id := range checksums[hex.EncodeToString(img.Checksum)] {
+				matches = append(matches, indexMatch{path: id})
+			}
+		case len(img.PHash) > 0:
+			layout := img.layout()
+			words, err := recordHash(img)
+			if err != nil || indexes[layout] == nil {
+				return nil
+			}
+			for _, m := range indexes[layout].query(words[0], *distance-1) {
+				theirs := hashes[layout][m.path]
+				if len(theirs) != len(words) {
+					continue
+				}
+				m.distance = 0
+				for i := range words {
+					m.distance += hashDistance(words[i], theirs[i])
+				}
+				if m.distance < *distance {
+					matches = append(matches, m)
+				}
+			}
+		}
+		sort.Slice(matches, func(i, j int) bool { return matches[i].distance < matches[j].distance })
+		for _, m := range matches {
+			if _, err := fmt.Fprintf(tw, "%s\t%s\t%s\n", img.Path, m.path, strconv.Itoa(m.distance)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if flushErr := tw.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
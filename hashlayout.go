@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/corona10/goimagehash"
+)
+
+// Every record says which layout its PHash was computed under: the hashing
+// library, its algorithm, and how the bits are laid out. Distances between
+// hashes of different layouts are garbage rather than merely less accurate,
+// so after an upgrade that changes the layout, or a run with another -hash,
+// comparisons refuse to run on records of the old one until
+// db rehash --stale-layout brings them over.
+//
+// -hash picks goimagehash's average, difference, or perception hash, 64 bits
+// each, or with dimensions, e.g. phash:16x16, their extended variant of as
+// many bits. Indexes key extended hashes by their first 64 bits, which differ
+// in no more bits than the whole hash does, and matches are measured over the
+// whole hash. Remote checks only exchange 64 bit hashes and pass over
+// extended ones; hash-only exports carry the whole hash along with its
+// layout. -hash-plugin hashes with an external program instead, see plugin.go.
+
+// hashLibrary names the hashing library along with how hashImage feeds it. It
+// changes, by hand, with any update of goimagehash or of hashImage that
+// changes the bits a given image hashes to.
+const hashLibrary = "goimagehash-1.1"
+
+// hashAlgorithm is a hash -hash selects, or the -hash-plugin hashing instead.
+type hashAlgorithm struct {
+	name          string // ahash, dhash, or phash
+	width, height int    // of the extended variant, 0 for the 64 bit hash
+	plugin        *pluginProcess
+}
+
+// hashing is the algorithm this run hashes with, hashLayout its layout.
+var (
+	hashing    = hashAlgorithm{name: "dhash"}
+	hashLayout = hashing.layout()
+)
+
+// legacyHashLayout is what records from before layouts were recorded were
+// hashed under.
+const legacyHashLayout = "goimagehash-1.1/dhash-64"
+
+var extHashAlgorithms = map[string]func(image.Image, int, int) (*goimagehash.ExtImageHash, error){
+	"dhash": goimagehash.ExtDifferenceHash,
+	"phash": goimagehash.ExtPerceptionHash,
+	"ahash": goimagehash.ExtAverageHash,
+}
+
+// parseHashAlgorithm parses "NAME" or "NAME:WIDTHxHEIGHT".
+func parseHashAlgorithm(s string) (hashAlgorithm, error) {
+	name, dims, extended := strings.Cut(strings.ToLower(strings.TrimSpace(s)), ":")
+	a := hashAlgorithm{name: name}
+	if hashAlgorithms[name] == nil {
+		return a, fmt.Errorf("unknown hash %q, expected ahash, dhash, or phash", name)
+	}
+	if !extended {
+		return a, nil
+	}
+	w, h, ok := strings.Cut(dims, "x")
+	var wErr, hErr error
+	a.width, wErr = strconv.Atoi(w)
+	a.height, hErr = strconv.Atoi(h)
+	if !ok || wErr != nil || hErr != nil || a.width < 2 || a.height < 2 || a.width*a.height > 1024 {
+		return a, fmt.Errorf("invalid dimensions %q, expected WIDTHxHEIGHT of at most 1024 bits, e.g. 16x16", dims)
+	}
+	if bits := a.bits(); name == "phash" && bits&(bits-1) != 0 {
+		return a, fmt.Errorf("phash needs a power of two bits, not %d", bits)
+	}
+	return a, nil
+}
+
+func (a hashAlgorithm) String() string {
+	if a.plugin != nil {
+		return "plugin:" + a.plugin.name
+	}
+	if a.width == 0 {
+		return a.name
+	}
+	return fmt.Sprintf("%s:%dx%d", a.name, a.width, a.height)
+}
+
+// bits returns the size of the hashes.
+func (a hashAlgorithm) bits() int {
+	if a.plugin != nil {
+		return a.plugin.size
+	}
+	if a.width == 0 {
+		return 64
+	}
+	return a.width * a.height
+}
+
+func (a hashAlgorithm) layout() string {
+	if a.plugin != nil {
+		return hashPluginLayout + a.plugin.layout()
+	}
+	if a.width == 0 {
+		return hashLibrary + "/" + a.name + "-64"
+	}
+	return fmt.Sprintf("%s/ext-%s-%dx%d", hashLibrary, a.name, a.width, a.height)
+}
+
+// dump hashes i, decoded from the file at path if any, and writes the hash in
+// the form records keep it.
+func (a hashAlgorithm) dump(w io.Writer, path string, i image.Image) error {
+	if a.plugin != nil {
+		h, err := pluginHash(a.plugin, path, i)
+		if err != nil {
+			return err
+		}
+		return h.Dump(w)
+	}
+	if a.width == 0 {
+		h, err := hashAlgorithms[a.name](i)
+		if err != nil {
+			return err
+		}
+		return h.Dump(w)
+	}
+	h, err := extHashAlgorithms[a.name](i, a.width, a.height)
+	if err != nil {
+		return err
+	}
+	return h.Dump(w)
+}
+
+// extendedLayout reports whether records of layout hold an extended hash,
+// which plugin hashes are stored as.
+func extendedLayout(layout string) bool {
+	return strings.Contains(layout, "/ext-") || strings.HasPrefix(layout, hashPluginLayout)
+}
+
+// recordHash returns the hash of img in 64 bit words, the first of which
+// indexes key it by.
+func recordHash(img *Image) ([]uint64, error) {
+	return loadHash(img.layout(), img.PHash)
+}
+
+// loadHash reads a hash as records keep it, computed under layout, into 64
+// bit words.
+func loadHash(layout string, dat []byte) ([]uint64, error) {
+	if !extendedLayout(layout) {
+		h, err := goimagehash.LoadImageHash(bytes.NewReader(dat))
+		if err != nil {
+			return nil, err
+		}
+		return []uint64{h.GetHash()}, nil
+	}
+	h, err := goimagehash.LoadExtImageHash(bytes.NewReader(dat))
+	if err != nil {
+		return nil, err
+	}
+	if len(h.GetHash()) == 0 {
+		return nil, errors.New("empty hash")
+	}
+	return h.GetHash(), nil
+}
+
+// recordDistance measures the distance between the hashes of a and b over
+// all of their bits.
+func recordDistance(a, b *Image) (int, error) {
+	if a.layout() != b.layout() {
+		return 0, errHashLayout
+	}
+	ha, err := recordHash(a)
+	if err != nil {
+		return 0, err
+	}
+	hb, err := recordHash(b)
+	if err != nil {
+		return 0, err
+	}
+	if len(ha) != len(hb) {
+		return 0, errHashLayout
+	}
+	var distance int
+	for i := range ha {
+		distance += hashDistance(ha[i], hb[i])
+	}
+	return distance, nil
+}
+
+var errHashLayout = errors.New("records hashed under an incompatible layout")
+
+// layout returns the layout the record's PHash was computed under.
+func (img *Image) layout() string {
+	if img.HashLayout == "" {
+		return legacyHashLayout
+	}
+	return img.HashLayout
+}
+
+// staleLayout reports whether the record has a hash this build can't compare.
+func (img *Image) staleLayout() bool {
+	return len(img.PHash) > 0 && img.layout() != hashLayout
+}
+
+// checkHashLayouts refuses records whose hashes this build can't compare,
+// naming a few of them and how to fix them.
+func checkHashLayouts(records map[string]*Image) error {
+	var (
+		stale   = make([]string, 0)
+		layouts = make(map[string]bool)
+	)
+	for p, img := range records {
+		if img.staleLayout() {
+			stale = append(stale, p)
+			layouts[img.layout()] = true
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	sort.Strings(stale)
+	names := make([]string, 0, len(layouts))
+	for l := range layouts {
+		names = append(names, l)
+	}
+	sort.Strings(names)
+	examples := stale[:min(len(stale), 3)]
+	return fmt.Errorf("%w: %d records, e.g. %s, were hashed under %s rather than %s; "+
+		"pass the -hash they were hashed with or run db rehash --stale-layout", errHashLayout, len(stale),
+		strings.Join(examples, ", "), strings.Join(names, " and "), hashLayout)
+}
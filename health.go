@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// /healthz and /readyz answer the probes of container orchestrators, which
+// carry no token, so they are served without one and tell no more than
+// whether the daemon is usable. Health means the database can still be
+// written and the worker pool is running; readiness additionally means no
+// maintenance, like building the similarity index, is holding up requests.
+
+// maintenance tracks work that makes the daemon unready while it runs.
+var maintenance struct {
+	mu      sync.Mutex
+	running map[string]int
+}
+
+// beginMaintenance marks what as running until the returned func is called.
+func beginMaintenance(what string) func() {
+	maintenance.mu.Lock()
+	if maintenance.running == nil {
+		maintenance.running = make(map[string]int)
+	}
+	maintenance.running[what]++
+	maintenance.mu.Unlock()
+	return func() {
+		maintenance.mu.Lock()
+		if maintenance.running[what]--; maintenance.running[what] == 0 {
+			delete(maintenance.running, what)
+		}
+		maintenance.mu.Unlock()
+	}
+}
+
+// maintaining returns the maintenance running, if any.
+func maintaining() []string {
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+	running := make([]string, 0, len(maintenance.running))
+	for what := range maintenance.running {
+		running = append(running, what)
+	}
+	return running
+}
+
+type healthReport struct {
+	Status      string   `json:"status"`
+	Error       string   `json:"error,omitempty"`
+	Maintenance []string `json:"maintenance,omitempty"`
+}
+
+// checkHealth reports why the daemon can't serve requests at all, if it can't.
+func checkHealth() error {
+	if DB == nil {
+		return errors.New("database is not open")
+	}
+	for _, store := range storeNames {
+		if DB.With(store) == nil {
+			return fmt.Errorf("database store %s is not open", store)
+		}
+	}
+	// the memory backend has no directory to lose.
+	if dir := DB.Path(); dir != "" {
+		probe, err := os.CreateTemp(dir, ".healthz-*")
+		if err != nil {
+			return fmt.Errorf("database is not writable: %w", err)
+		}
+		_ = probe.Close()
+		_ = os.Remove(probe.Name())
+	}
+	if workers == nil || workers.IsClosed() {
+		return errors.New("worker pool is not running")
+	}
+	return nil
+}
+
+func serveHealth(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"use GET"})
+			return
+		}
+		if err := checkHealth(); err != nil {
+			log.Warn().Err(err).Str("path", r.URL.Path).Msg("health check failed")
+			writeJSON(w, http.StatusServiceUnavailable, healthReport{Status: "unhealthy", Error: err.Error()})
+			return
+		}
+		if running := maintaining(); ready && len(running) > 0 {
+			writeJSON(w, http.StatusServiceUnavailable, healthReport{Status: "unready", Maintenance: running})
+			return
+		}
+		writeJSON(w, http.StatusOK, healthReport{Status: "ok"})
+	}
+}
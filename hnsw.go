@@ -0,0 +1,214 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// hnswIndex is an in-memory Hierarchical Navigable Small World graph over the
+// 64-bit image hashes. Unlike the BK-tree it answers queries approximately:
+// neighbors the greedy graph search never reaches are silently missed, which
+// is the price for sub-linear queries on libraries of millions of images.
+// Raising ef widens the search and trades speed for recall.
+type hnswIndex struct {
+	m, mMax0       int
+	efConstruction int
+	ef             int
+	levelMult      float64
+	rng            *rand.Rand
+
+	entry    int
+	maxLevel int
+	nodes    []*hnswNode
+	byHash   map[uint64]int
+}
+
+type hnswNode struct {
+	hash  uint64
+	paths []string
+	links [][]int
+}
+
+const (
+	hnswM              = 16
+	hnswEfConstruction = 100
+	defaultHNSWEf      = 64
+)
+
+func newHNSW(ef int) *hnswIndex {
+	return &hnswIndex{
+		m:              hnswM,
+		mMax0:          hnswM * 2,
+		efConstruction: hnswEfConstruction,
+		ef:             ef,
+		levelMult:      1 / math.Log(hnswM),
+		// a fixed seed keeps the graph, and thereby any missed neighbors, stable between runs.
+		rng:    rand.New(rand.NewSource(1)),
+		entry:  -1,
+		byHash: make(map[uint64]int),
+	}
+}
+
+// buildHNSW indexes the given hashes in path order so builds are reproducible.
+func buildHNSW(hashes map[string]uint64, ef int) *hnswIndex {
+	paths := make([]string, 0, len(hashes))
+	for p := range hashes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	h := newHNSW(ef)
+	for _, p := range paths {
+		h.insert(p, hashes[p])
+	}
+	return h
+}
+
+type hnswCandidate struct {
+	id, dist int
+}
+
+// candidateHeap is a min-heap on distance, or a max-heap when far is set.
+type candidateHeap struct {
+	items []hnswCandidate
+	far   bool
+}
+
+func (c *candidateHeap) Len() int { return len(c.items) }
+func (c *candidateHeap) Less(i, j int) bool {
+	if c.far {
+		return c.items[i].dist > c.items[j].dist
+	}
+	return c.items[i].dist < c.items[j].dist
+}
+func (c *candidateHeap) Swap(i, j int) { c.items[i], c.items[j] = c.items[j], c.items[i] }
+func (c *candidateHeap) Push(x any)    { c.items = append(c.items, x.(hnswCandidate)) }
+func (c *candidateHeap) Pop() any {
+	x := c.items[len(c.items)-1]
+	c.items = c.items[:len(c.items)-1]
+	return x
+}
+
+func (h *hnswIndex) dist(q uint64, id int) int {
+	return hashDistance(q, h.nodes[id].hash)
+}
+
+// searchLayer returns up to ef nodes closest to q reachable from entries on layer.
+func (h *hnswIndex) searchLayer(q uint64, entries []int, ef, layer int) []hnswCandidate {
+	var (
+		visited    = make(map[int]struct{}, ef*4)
+		candidates = &candidateHeap{}
+		results    = &candidateHeap{far: true}
+	)
+	for _, e := range entries {
+		visited[e] = struct{}{}
+		c := hnswCandidate{id: e, dist: h.dist(q, e)}
+		heap.Push(candidates, c)
+		heap.Push(results, c)
+	}
+	for candidates.Len() > 0 {
+		c := heap.Pop(candidates).(hnswCandidate)
+		if c.dist > results.items[0].dist && results.Len() >= ef {
+			break
+		}
+		for _, n := range h.nodes[c.id].links[layer] {
+			if _, seen := visited[n]; seen {
+				continue
+			}
+			visited[n] = struct{}{}
+			d := h.dist(q, n)
+			if results.Len() < ef || d < results.items[0].dist {
+				heap.Push(candidates, hnswCandidate{id: n, dist: d})
+				heap.Push(results, hnswCandidate{id: n, dist: d})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+	sort.Slice(results.items, func(i, j int) bool { return results.items[i].dist < results.items[j].dist })
+	return results.items
+}
+
+func (h *hnswIndex) closest(found []hnswCandidate, n int) []int {
+	ids := make([]int, 0, n)
+	for _, c := range found {
+		if len(ids) == n {
+			break
+		}
+		ids = append(ids, c.id)
+	}
+	return ids
+}
+
+// shrink trims the links of node id on layer to the max closest ones.
+func (h *hnswIndex) shrink(id, layer, maxLinks int) {
+	links := h.nodes[id].links[layer]
+	if len(links) <= maxLinks {
+		return
+	}
+	hash := h.nodes[id].hash
+	sort.Slice(links, func(i, j int) bool { return h.dist(hash, links[i]) < h.dist(hash, links[j]) })
+	h.nodes[id].links[layer] = links[:maxLinks]
+}
+
+func (h *hnswIndex) insert(path string, hash uint64) {
+	if id, ok := h.byHash[hash]; ok {
+		h.nodes[id].paths = append(h.nodes[id].paths, path)
+		return
+	}
+
+	level := int(math.Floor(-math.Log(1-h.rng.Float64()) * h.levelMult))
+	id := len(h.nodes)
+	h.nodes = append(h.nodes, &hnswNode{hash: hash, paths: []string{path}, links: make([][]int, level+1)})
+	h.byHash[hash] = id
+
+	if h.entry < 0 {
+		h.entry, h.maxLevel = id, level
+		return
+	}
+
+	ep := []int{h.entry}
+	for l := h.maxLevel; l > level; l-- {
+		ep = h.closest(h.searchLayer(hash, ep, 1, l), 1)
+	}
+	for l := min(level, h.maxLevel); l >= 0; l-- {
+		found := h.searchLayer(hash, ep, h.efConstruction, l)
+		maxLinks := h.m
+		if l == 0 {
+			maxLinks = h.mMax0
+		}
+		neighbors := h.closest(found, h.m)
+		h.nodes[id].links[l] = append(h.nodes[id].links[l], neighbors...)
+		for _, n := range neighbors {
+			h.nodes[n].links[l] = append(h.nodes[n].links[l], id)
+			h.shrink(n, l, maxLinks)
+		}
+		ep = h.closest(found, len(found))
+	}
+	if level > h.maxLevel {
+		h.entry, h.maxLevel = id, level
+	}
+}
+
+// query returns the indexed paths within radius of hash that the graph search reaches.
+func (h *hnswIndex) query(hash uint64, radius int) []indexMatch {
+	if h.entry < 0 {
+		return nil
+	}
+	ep := []int{h.entry}
+	for l := h.maxLevel; l > 0; l-- {
+		ep = h.closest(h.searchLayer(hash, ep, 1, l), 1)
+	}
+	var matches = make([]indexMatch, 0)
+	for _, c := range h.searchLayer(hash, ep, max(h.ef, 1), 0) {
+		if c.dist > radius {
+			break
+		}
+		for _, p := range h.nodes[c.id].paths {
+			matches = append(matches, indexMatch{path: p, distance: c.dist})
+		}
+	}
+	return matches
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"slices"
+	"sync"
+
+	"github.com/bytedance/sonic"
+)
+
+// The similarity index is a BK-tree over the 64-bit image hashes, persisted
+// node by node in the "index" store and updated as images are ingested, so
+// check can query it for neighbors instead of comparing every pair.
+//
+// Nodes are keyed by their big-endian hash. Every distinct hash is one node,
+// holding the paths of all records that share it. Removing a path leaves its
+// node in place to keep routing intact.
+
+const indexVersion = 1
+
+var (
+	indexRootKey = []byte("root")
+	indexMetaKey = []byte("meta")
+)
+
+type bkNode struct {
+	Hash     uint64         `json:"h"`
+	Paths    []string       `json:"p,omitempty"`
+	Children map[int]uint64 `json:"c,omitempty"`
+}
+
+type indexMeta struct {
+	Version int `json:"version"`
+	// Snapshot is the ID of the snapshot matching the index, if any.
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+type bkTree struct {
+	mu      sync.RWMutex
+	hasRoot bool
+	root    uint64
+	// nodes and byPath hold the whole tree, or with snap the changes since
+	// it was taken.
+	nodes  map[uint64]*bkNode
+	byPath map[string]uint64
+	// snap is the snapshot the tree was loaded from. paged holds the nodes
+	// read off it so far and dropped the paths removed from its nodes.
+	snap    *indexSnapshot
+	paged   *sync.Map
+	dropped map[string]struct{}
+	// snapID is the snapshot the persisted index matches, "" once it
+	// changed since; dirty tells whether the tree changed since it was
+	// loaded or last snapshotted.
+	snapID string
+	dirty  bool
+	saveMu sync.Mutex
+	// batched holds the changed nodes not written yet while writes are
+	// batched, see batchWrites.
+	batched map[uint64]*bkNode
+}
+
+var (
+	index     *bkTree
+	indexErr  error
+	indexOnce sync.Once
+)
+
+// getIndex loads the persisted index on first use, building it from the
+// images store when it is missing or was written by an incompatible version.
+func getIndex() (*bkTree, error) {
+	indexOnce.Do(func() {
+		defer beginMaintenance("loading the similarity index")()
+		index, indexErr = loadIndex()
+	})
+	return index, indexErr
+}
+
+// saveIndexSnapshot snapshots the index if it changed since it was loaded.
+func saveIndexSnapshot() {
+	idx, err := getIndex()
+	if err != nil {
+		return
+	}
+	if err = idx.saveSnapshot(); err != nil {
+		log.Warn().Err(err).Msg("failed to snapshot the similarity index")
+	}
+}
+
+// rebuildIndex replaces the index with one freshly built from the images store.
+func rebuildIndex() (*bkTree, error) {
+	indexOnce.Do(func() {})
+	defer beginMaintenance("rebuilding the similarity index")()
+	index = newBKTree()
+	indexErr = index.rebuild()
+	return index, indexErr
+}
+
+func hashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func hashKey(h uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, h)
+}
+
+// imageHash returns the 64 bits of img's hash indexes key it by, all of them
+// but for extended hashes.
+func imageHash(img *Image) (uint64, error) {
+	h, err := recordHash(img)
+	if err != nil {
+		return 0, err
+	}
+	return h[0], nil
+}
+
+func newBKTree() *bkTree {
+	return &bkTree{nodes: make(map[uint64]*bkNode), byPath: make(map[string]uint64), paged: &sync.Map{}}
+}
+
+// node returns the node of hash h, read off the snapshot unless it changed
+// since. Callers hold t.mu.
+func (t *bkTree) node(h uint64) *bkNode {
+	if n, ok := t.nodes[h]; ok || t.snap == nil {
+		return n
+	}
+	if n, ok := t.paged.Load(h); ok {
+		return n.(*bkNode)
+	}
+	n := t.snap.node(h)
+	if n == nil {
+		return nil
+	}
+	paged, _ := t.paged.LoadOrStore(h, n)
+	return paged.(*bkNode)
+}
+
+// pathHash returns the hash path is indexed under. Callers hold t.mu.
+func (t *bkTree) pathHash(path string) (uint64, bool) {
+	if h, ok := t.byPath[path]; ok || t.snap == nil {
+		return h, ok
+	}
+	if _, ok := t.dropped[path]; ok {
+		return 0, false
+	}
+	return t.snap.pathHash(path)
+}
+
+// touch notes a change of the persisted index, which stops matching its
+// snapshot. Callers hold t.mu for writing.
+func (t *bkTree) touch() error {
+	t.dirty = true
+	if t.snapID == "" {
+		return nil
+	}
+	t.snapID = ""
+	dat, _ := sonic.Marshal(indexMeta{Version: indexVersion})
+	return DB.With("index").Put(indexMetaKey, dat)
+}
+
+// saveSnapshot writes a snapshot of t unless the current one still matches,
+// for the next start to map rather than load.
+func (t *bkTree) saveSnapshot() error {
+	path := snapshotPath()
+	if path == "" {
+		return nil
+	}
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+	// readers may go on, writers have to wait.
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.snapID != "" && !t.dirty {
+		return nil
+	}
+	hashes := make([]uint64, 0, len(t.nodes))
+	for h := range t.nodes {
+		hashes = append(hashes, h)
+	}
+	if t.snap != nil {
+		for i := 0; i < t.snap.nodes; i++ {
+			if h := t.snap.hash(i); t.nodes[h] == nil {
+				hashes = append(hashes, h)
+			}
+		}
+	}
+	slices.Sort(hashes)
+	id, err := writeIndexSnapshot(path, t, hashes)
+	if err != nil {
+		return fmt.Errorf("failed to write index snapshot: %w", err)
+	}
+	dat, _ := sonic.Marshal(indexMeta{Version: indexVersion, Snapshot: id})
+	store := DB.With("index")
+	if err = store.Put(indexMetaKey, dat); err != nil {
+		return err
+	}
+	// the daemon is usually stopped rather than closing the database.
+	if err = store.Sync(); err != nil {
+		return err
+	}
+	t.snapID, t.dirty = id, false
+	log.Debug().Str("path", path).Int("nodes", len(hashes)).Msg("index snapshot written")
+	return nil
+}
+
+func loadIndex() (*bkTree, error) {
+	store := DB.With("index")
+	t := newBKTree()
+
+	var meta indexMeta
+	if dat, err := store.Get(indexMetaKey); err == nil {
+		_ = sonic.Unmarshal(dat, &meta)
+	}
+	if meta.Version != indexVersion {
+		log.Info().Msg("building similarity index...")
+		return t, t.rebuild()
+	}
+	// cleared on the first change, whether the snapshot is used or not.
+	t.snapID = meta.Snapshot
+	if path := snapshotPath(); meta.Snapshot != "" && path != "" {
+		snap, err := openIndexSnapshot(path)
+		switch {
+		case err != nil:
+			log.Warn().Err(err).Msg("failed to map index snapshot, loading the index")
+		case snap.id != meta.Snapshot:
+			_ = snap.close()
+		default:
+			t.snap, t.dropped = snap, make(map[string]struct{})
+			t.root, t.hasRoot = snap.root, snap.hasRoot
+			if t.hasRoot && t.node(t.root) == nil {
+				return nil, errors.New("index root is missing, run db reindex")
+			}
+			log.Debug().Str("path", path).Int("nodes", snap.nodes).Msg("index snapshot mapped")
+			return t, nil
+		}
+	}
+
+	for _, k := range store.Keys() {
+		dat, err := store.Get(k)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index node: %w", err)
+		}
+		switch {
+		case bytes.Equal(k, indexMetaKey):
+			continue
+		case bytes.Equal(k, indexRootKey):
+			t.root, t.hasRoot = binary.BigEndian.Uint64(dat), true
+			continue
+		}
+		node := &bkNode{}
+		if err = sonic.Unmarshal(dat, node); err != nil {
+			return nil, fmt.Errorf("corrupt index node, run db reindex: %w", err)
+		}
+		t.nodes[node.Hash] = node
+		for _, p := range node.Paths {
+			t.byPath[p] = node.Hash
+		}
+	}
+	if t.hasRoot && t.nodes[t.root] == nil {
+		return nil, errors.New("index root is missing, run db reindex")
+	}
+	return t, nil
+}
+
+// rebuild discards the persisted index and re-inserts every record.
+func (t *bkTree) rebuild() error {
+	t.mu.Lock()
+	if err := t.touch(); err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	store := DB.With("index")
+	for _, k := range store.Keys() {
+		if err := store.Delete(k); err != nil {
+			t.mu.Unlock()
+			return err
+		}
+	}
+	t.hasRoot = false
+	t.nodes = make(map[uint64]*bkNode)
+	t.byPath = make(map[string]uint64)
+	if t.snap != nil {
+		_ = t.snap.close()
+		t.snap, t.paged, t.dropped = nil, &sync.Map{}, nil
+	}
+	t.mu.Unlock()
+
+	err := forEachRecord(func(img *Image) error {
+		if len(img.PHash) == 0 {
+			return nil
+		}
+		h, err := imageHash(img)
+		if err != nil {
+			log.Warn().Err(err).Str("caller", img.Path).Msg("skipping record with unreadable hash")
+			return nil
+		}
+		return t.insert(img.Path, h)
+	})
+	if err != nil {
+		return err
+	}
+
+	dat, _ := sonic.Marshal(indexMeta{Version: indexVersion})
+	return store.Put(indexMetaKey, dat)
+}
+
+func (t *bkTree) putNode(n *bkNode) error {
+	if err := t.touch(); err != nil {
+		return err
+	}
+	if t.batched != nil {
+		t.batched[n.Hash] = n
+		if len(t.batched) < indexWriteBatch {
+			return nil
+		}
+		return t.flushBatch()
+	}
+	dat, err := sonic.Marshal(n)
+	if err != nil {
+		return err
+	}
+	scanIO.written.Add(int64(len(dat)))
+	return DB.With("index").Put(hashKey(n.Hash), dat)
+}
+
+// batchWrites holds back the writes of changed nodes until endBatch, or until
+// indexWriteBatch of them piled up. The index is marked incomplete meanwhile,
+// so that a run cut short has the next one rebuild it.
+func (t *bkTree) batchWrites() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.touch(); err != nil {
+		return err
+	}
+	dat, _ := sonic.Marshal(indexMeta{})
+	if err := DB.With("index").Put(indexMetaKey, dat); err != nil {
+		return err
+	}
+	t.batched = make(map[uint64]*bkNode)
+	return nil
+}
+
+// flushBatch writes the nodes held back. Callers hold t.mu for writing.
+func (t *bkTree) flushBatch() error {
+	store := DB.With("index")
+	for h, n := range t.batched {
+		dat, err := sonic.Marshal(n)
+		if err != nil {
+			return err
+		}
+		scanIO.written.Add(int64(len(dat)))
+		if err = store.Put(hashKey(h), dat); err != nil {
+			return err
+		}
+		delete(t.batched, h)
+	}
+	return nil
+}
+
+// endBatch writes the nodes held back by batchWrites and marks the index
+// complete again.
+func (t *bkTree) endBatch() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.batched == nil {
+		return nil
+	}
+	if err := t.flushBatch(); err != nil {
+		return err
+	}
+	t.batched = nil
+	store := DB.With("index")
+	dat, _ := sonic.Marshal(indexMeta{Version: indexVersion})
+	if err := store.Put(indexMetaKey, dat); err != nil {
+		return err
+	}
+	return store.Sync()
+}
+
+// removeLocked drops path from whatever node currently holds it.
+func (t *bkTree) removeLocked(path string) error {
+	h, ok := t.pathHash(path)
+	if !ok {
+		return nil
+	}
+	delete(t.byPath, path)
+	if t.snap != nil {
+		t.dropped[path] = struct{}{}
+	}
+	node := t.node(h)
+	if node == nil {
+		return errors.New("index node is missing, run db reindex")
+	}
+	for i, p := range node.Paths {
+		if p == path {
+			node.Paths = append(node.Paths[:i], node.Paths[i+1:]...)
+			break
+		}
+	}
+	return t.putNode(node)
+}
+
+func (t *bkTree) remove(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.removeLocked(path)
+}
+
+// insert files path under hash h, moving it if it was indexed under another hash.
+func (t *bkTree) insert(path string, h uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if old, ok := t.pathHash(path); ok {
+		if old == h {
+			return nil
+		}
+		if err := t.removeLocked(path); err != nil {
+			return err
+		}
+	}
+	t.byPath[path] = h
+	delete(t.dropped, path)
+
+	if !t.hasRoot {
+		t.root, t.hasRoot = h, true
+		t.nodes[h] = &bkNode{Hash: h, Paths: []string{path}}
+		if err := t.touch(); err != nil {
+			return err
+		}
+		if err := DB.With("index").Put(indexRootKey, hashKey(h)); err != nil {
+			return err
+		}
+		return t.putNode(t.nodes[h])
+	}
+
+	if node := t.node(h); node != nil {
+		node.Paths = append(node.Paths, path)
+		hashCollisions.Add(1)
+		return t.putNode(node)
+	}
+
+	node := t.node(t.root)
+	for {
+		d := hashDistance(node.Hash, h)
+		child, ok := node.Children[d]
+		if ok {
+			if node = t.node(child); node == nil {
+				return errors.New("index node is missing, run db reindex")
+			}
+			continue
+		}
+		if node.Children == nil {
+			node.Children = make(map[int]uint64)
+		}
+		node.Children[d] = h
+		leaf := &bkNode{Hash: h, Paths: []string{path}}
+		t.nodes[h] = leaf
+		if err := t.putNode(leaf); err != nil {
+			return err
+		}
+		return t.putNode(node)
+	}
+}
+
+// similarityIndex answers neighborhood queries for check, which queries it
+// from several goroutines at once.
+type similarityIndex interface {
+	query(h uint64, radius int) []indexMatch
+}
+
+type indexMatch struct {
+	path     string
+	distance int
+}
+
+// query returns every indexed path whose hash is within radius of h.
+func (t *bkTree) query(h uint64, radius int) []indexMatch {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if !t.hasRoot {
+		return nil
+	}
+	var (
+		matches = make([]indexMatch, 0)
+		stack   = []uint64{t.root}
+	)
+	for len(stack) > 0 {
+		node := t.node(stack[len(stack)-1])
+		stack = stack[:len(stack)-1]
+		if node == nil {
+			continue
+		}
+		d := hashDistance(node.Hash, h)
+		if d <= radius {
+			for _, p := range node.Paths {
+				matches = append(matches, indexMatch{path: p, distance: d})
+			}
+		}
+		for cd, child := range node.Children {
+			if cd >= d-radius && cd <= d+radius {
+				stack = append(stack, child)
+			}
+		}
+	}
+	return matches
+}
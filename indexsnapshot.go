@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Loading the similarity index decodes every node in the "index" store, which
+// takes a while for a large library. serve therefore keeps a snapshot of the
+// tree in a flat file next to the database and maps it into memory on
+// startup, reading nodes off it as queries reach them and leaving the pages
+// nobody asked for on disk. Changes go to the store as always and are kept in
+// memory on top of the snapshot.
+//
+// The index meta records the ID of the snapshot the store matches. The first
+// change of the index clears it, so a snapshot left behind by a run that went
+// on to change the index, or by a database restored from a backup, is never
+// mistaken for a current one; the index is then loaded from the store, and the
+// daemon writes a new snapshot.
+//
+// The file is little-endian: a header, the node table of hash and body offset
+// pairs sorted by hash, the path table of path offset and hash pairs sorted by
+// path, and the body of the nodes, each its child count, children as distance
+// byte and hash, path count, and length-prefixed paths the path table points
+// into.
+
+const snapshotMagic = "dhbktre1"
+
+const (
+	snapshotHeaderSize = 64
+	snapshotEntrySize  = 16
+)
+
+type indexSnapshot struct {
+	id      string
+	hasRoot bool
+	root    uint64
+	nodes   int
+	paths   int
+	dat     []byte
+	unmap   func() error
+}
+
+// snapshotPath returns where the snapshot of the index of the open database
+// is kept, "" when it isn't kept on disk.
+func snapshotPath() string {
+	if DB.Path() == "" {
+		return ""
+	}
+	return DB.Path() + ".bktree"
+}
+
+// openIndexSnapshot maps the snapshot at path and checks its layout.
+func openIndexSnapshot(path string) (*indexSnapshot, error) {
+	dat, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &indexSnapshot{dat: dat, unmap: unmap}
+	if err = s.parse(); err != nil {
+		_ = unmap()
+		return nil, fmt.Errorf("corrupt index snapshot: %w", err)
+	}
+	return s, nil
+}
+
+func (s *indexSnapshot) parse() error {
+	if len(s.dat) < snapshotHeaderSize || string(s.dat[:8]) != snapshotMagic {
+		return errors.New("not an index snapshot")
+	}
+	le := binary.LittleEndian
+	s.id = hex.EncodeToString(s.dat[8:24])
+	s.hasRoot = le.Uint64(s.dat[24:]) != 0
+	s.root = le.Uint64(s.dat[32:])
+	nodes, paths := le.Uint64(s.dat[40:]), le.Uint64(s.dat[48:])
+	body := le.Uint64(s.dat[56:])
+	if nodes > uint64(len(s.dat)) || paths > uint64(len(s.dat)) ||
+		body != snapshotHeaderSize+(nodes+paths)*snapshotEntrySize || body > uint64(len(s.dat)) {
+		return errors.New("truncated")
+	}
+	s.nodes, s.paths = int(nodes), int(paths)
+	return nil
+}
+
+func (s *indexSnapshot) close() error {
+	return s.unmap()
+}
+
+// entry returns the two words of entry i of the table starting at off.
+func (s *indexSnapshot) entry(off, i int) (uint64, uint64) {
+	e := s.dat[off+i*snapshotEntrySize:]
+	return binary.LittleEndian.Uint64(e), binary.LittleEndian.Uint64(e[8:])
+}
+
+func (s *indexSnapshot) nodeTable() int { return snapshotHeaderSize }
+
+func (s *indexSnapshot) pathTable() int { return snapshotHeaderSize + s.nodes*snapshotEntrySize }
+
+// hash returns the hash of node i.
+func (s *indexSnapshot) hash(i int) uint64 {
+	h, _ := s.entry(s.nodeTable(), i)
+	return h
+}
+
+// node decodes the node of hash h, nil if there is none or it is corrupt.
+func (s *indexSnapshot) node(h uint64) *bkNode {
+	i := sort.Search(s.nodes, func(i int) bool { return s.hash(i) >= h })
+	if i == s.nodes || s.hash(i) != h {
+		return nil
+	}
+	_, off := s.entry(s.nodeTable(), i)
+	n, err := s.decode(h, off)
+	if err != nil {
+		log.Warn().Err(err).Msg("corrupt index snapshot node, run db reindex")
+		return nil
+	}
+	return n
+}
+
+func (s *indexSnapshot) decode(h, off uint64) (*bkNode, error) {
+	if off >= uint64(len(s.dat)) {
+		return nil, errors.New("node out of bounds")
+	}
+	r := bytes.NewReader(s.dat[off:])
+	n := &bkNode{Hash: h}
+	children, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if children > 0 {
+		n.Children = make(map[int]uint64, children)
+	}
+	for i := uint64(0); i < children; i++ {
+		var child [9]byte
+		if _, err = io.ReadFull(r, child[:]); err != nil {
+			return nil, err
+		}
+		n.Children[int(child[0])] = binary.LittleEndian.Uint64(child[1:])
+	}
+	paths, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < paths; i++ {
+		p, err := readSnapshotPath(r)
+		if err != nil {
+			return nil, err
+		}
+		n.Paths = append(n.Paths, p)
+	}
+	return n, nil
+}
+
+func readSnapshotPath(r *bytes.Reader) (string, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if size > uint64(r.Len()) {
+		return "", errors.New("path out of bounds")
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+// pathAt returns path i of the path table, which must lie within the
+// mapping.
+func (s *indexSnapshot) pathAt(i int) ([]byte, error) {
+	off, _ := s.entry(s.pathTable(), i)
+	if off >= uint64(len(s.dat)) {
+		return nil, errors.New("path out of bounds")
+	}
+	size, n := binary.Uvarint(s.dat[off:])
+	if n <= 0 || size > uint64(len(s.dat))-off-uint64(n) {
+		return nil, errors.New("path out of bounds")
+	}
+	start := off + uint64(n)
+	return s.dat[start : start+size], nil
+}
+
+// pathHash returns the hash path is indexed under in the snapshot, none if
+// the path table is corrupt.
+func (s *indexSnapshot) pathHash(path string) (uint64, bool) {
+	want := []byte(path)
+	var err error
+	i := sort.Search(s.paths, func(i int) bool {
+		p, pathErr := s.pathAt(i)
+		if pathErr != nil {
+			err = pathErr
+			return true
+		}
+		return bytes.Compare(p, want) >= 0
+	})
+	if i == s.paths {
+		return 0, false
+	}
+	var p []byte
+	if err == nil {
+		p, err = s.pathAt(i)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("corrupt index snapshot path, run db reindex")
+		return 0, false
+	}
+	if !bytes.Equal(p, want) {
+		return 0, false
+	}
+	_, h := s.entry(s.pathTable(), i)
+	return h, true
+}
+
+// writeIndexSnapshot writes the nodes of t, with their hashes in ascending
+// order, to a snapshot at path under a new ID, which it returns. Callers
+// hold t.mu.
+func writeIndexSnapshot(path string, t *bkTree, hashes []uint64) (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	type pathEntry struct {
+		path      string
+		off, hash uint64
+	}
+	var (
+		body    bytes.Buffer
+		nodeOff = make([]uint64, len(hashes))
+		paths   []pathEntry
+	)
+	for i, h := range hashes {
+		n := t.node(h)
+		nodeOff[i] = uint64(body.Len())
+		body.Write(binary.AppendUvarint(nil, uint64(len(n.Children))))
+		children := make([]int, 0, len(n.Children))
+		for d := range n.Children {
+			children = append(children, d)
+		}
+		slices.Sort(children)
+		for _, d := range children {
+			body.WriteByte(byte(d))
+			body.Write(binary.LittleEndian.AppendUint64(nil, n.Children[d]))
+		}
+		body.Write(binary.AppendUvarint(nil, uint64(len(n.Paths))))
+		for _, p := range n.Paths {
+			paths = append(paths, pathEntry{p, uint64(body.Len()), h})
+			body.Write(binary.AppendUvarint(nil, uint64(len(p))))
+			body.WriteString(p)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return strings.Compare(paths[i].path, paths[j].path) < 0 })
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = os.Remove(tmp) }()
+	var (
+		w        = bufio.NewWriter(f)
+		le       = binary.LittleEndian
+		bodyBase = uint64(snapshotHeaderSize + (len(hashes)+len(paths))*snapshotEntrySize)
+		hasRoot  uint64
+	)
+	if t.hasRoot {
+		hasRoot = 1
+	}
+	header := append([]byte(snapshotMagic), id[:]...)
+	for _, v := range []uint64{hasRoot, t.root, uint64(len(hashes)), uint64(len(paths)), bodyBase} {
+		header = le.AppendUint64(header, v)
+	}
+	_, _ = w.Write(header)
+	for i, h := range hashes {
+		_, _ = w.Write(le.AppendUint64(le.AppendUint64(nil, h), bodyBase+nodeOff[i]))
+	}
+	for _, p := range paths {
+		_, _ = w.Write(le.AppendUint64(le.AppendUint64(nil, bodyBase+p.off), p.hash))
+	}
+	_, _ = w.Write(body.Bytes())
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
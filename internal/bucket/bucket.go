@@ -0,0 +1,155 @@
+// Package bucket is a cheap exact pre-filter for near-duplicate 64-bit hashes
+// built on the pigeonhole principle: splitting the hashes into radius+1
+// segments, any two hashes within radius of each other must agree completely
+// on at least one segment. Only hashes sharing a segment with the query are
+// compared, and nothing has to be persisted or rebuilt between runs.
+package bucket
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// Match is an indexed path within the radius of a query.
+type Match struct {
+	Path     string
+	Distance int
+}
+
+// Index buckets hashes by each of their segments.
+type Index struct {
+	radius  int
+	shifts  []uint
+	masks   []uint64
+	buckets []map[uint64][]int
+	hashes  []uint64
+	paths   [][]string
+	ids     map[uint64]int
+}
+
+// New returns an empty index for queries within radius.
+func New(radius int) *Index {
+	segments := min(radius+1, 64)
+	b := &Index{radius: radius, buckets: make([]map[uint64][]int, segments), ids: make(map[uint64]int)}
+	var shift uint
+	for i := 0; i < segments; i++ {
+		width := uint(64 / segments)
+		if i < 64%segments {
+			width++
+		}
+		b.shifts = append(b.shifts, shift)
+		b.masks = append(b.masks, (uint64(1)<<width)-1)
+		b.buckets[i] = make(map[uint64][]int)
+		shift += width
+	}
+	return b
+}
+
+// Build indexes the hashes of paths for queries within radius.
+func Build(hashes map[string]uint64, radius int) *Index {
+	b := New(radius)
+	for path, h := range hashes {
+		b.Add(path, h)
+	}
+	return b
+}
+
+// Add indexes path under h.
+func (b *Index) Add(path string, h uint64) {
+	id, ok := b.ids[h]
+	if !ok {
+		id = len(b.hashes)
+		b.ids[h] = id
+		b.hashes = append(b.hashes, h)
+		b.paths = append(b.paths, nil)
+		for i := range b.buckets {
+			seg := b.Segment(h, i)
+			b.buckets[i][seg] = append(b.buckets[i][seg], id)
+		}
+	}
+	b.paths[id] = append(b.paths[id], path)
+}
+
+// Remove drops path from under h. The hash stays in its buckets, matching
+// nothing, should another path be added under it again.
+func (b *Index) Remove(path string, h uint64) {
+	id, ok := b.ids[h]
+	if !ok {
+		return
+	}
+	for i, p := range b.paths[id] {
+		if p == path {
+			b.paths[id] = append(b.paths[id][:i], b.paths[id][i+1:]...)
+			return
+		}
+	}
+}
+
+// Radius is the radius the index was built for.
+func (b *Index) Radius() int {
+	return b.radius
+}
+
+// Segments is how many segments hashes are split into.
+func (b *Index) Segments() int {
+	return len(b.buckets)
+}
+
+// Width is how many bits the i-th segment spans.
+func (b *Index) Width(i int) int {
+	return bits.OnesCount64(b.masks[i])
+}
+
+// Segment returns the i-th segment of h.
+func (b *Index) Segment(h uint64, i int) uint64 {
+	return (h >> b.shifts[i]) & b.masks[i]
+}
+
+// Values returns the distinct values of the i-th segment of the hashes
+// indexed, in ascending order.
+func (b *Index) Values(i int) []uint64 {
+	values := make([]uint64, 0, len(b.buckets[i]))
+	for v := range b.buckets[i] {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(a, c int) bool { return values[a] < values[c] })
+	return values
+}
+
+// Query returns the paths within radius of h. Radii beyond the one the index
+// was built for can't be answered exactly and are clamped.
+func (b *Index) Query(h uint64, radius int) []Match {
+	radius = min(radius, b.radius)
+	var (
+		seen    = make(map[int]struct{})
+		matches = make([]Match, 0)
+	)
+	for i := range b.buckets {
+		for _, id := range b.buckets[i][b.Segment(h, i)] {
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+			d := bits.OnesCount64(h ^ b.hashes[id])
+			if d > radius {
+				continue
+			}
+			for _, p := range b.paths[id] {
+				matches = append(matches, Match{Path: p, Distance: d})
+			}
+		}
+	}
+	return matches
+}
+
+// Crowding counts the distinct hashes other than h sharing a segment with
+// it, each once per segment shared. h is taken to be indexed, sharing every
+// segment with itself; for one that isn't the count is that many short, the
+// same for every such h.
+func (b *Index) Crowding(h uint64) int {
+	n := -len(b.buckets)
+	for i := range b.buckets {
+		n += len(b.buckets[i][b.Segment(h, i)])
+	}
+	return n
+}
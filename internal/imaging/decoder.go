@@ -0,0 +1,6 @@
+package imaging
+
+// DecoderCommand is the hidden argument that turns a dupehunter binary into a
+// decoder child, which reads an image from its stdin, confines itself, and
+// answers with its hash on stdout.
+const DecoderCommand = "__decode"
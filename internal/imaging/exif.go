@@ -0,0 +1,287 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// EXIF metadata is a small TIFF structure embedded in the image. Only the
+// capture time, the software that last wrote the image, and where the photo
+// was taken are extracted, and whether there is any EXIF at all.
+
+const (
+	exifTagSoftware           = 0x0131
+	exifTagExifIFD            = 0x8769
+	exifTagGPSIFD             = 0x8825
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+
+	exifTagGPSLatitudeRef  = 0x0001
+	exifTagGPSLatitude     = 0x0002
+	exifTagGPSLongitudeRef = 0x0003
+	exifTagGPSLongitude    = 0x0004
+
+	exifTimeLayout = "2006:01:02 15:04:05"
+
+	// earthRadius is the mean radius of the earth in meters.
+	earthRadius = 6371e3
+)
+
+// Exif is what is extracted from EXIF, zero values standing for missing tags.
+type Exif struct {
+	Present  bool
+	Captured time.Time
+	Software string
+	// GPS is where the photo was taken, nil when unknown.
+	GPS *Position
+}
+
+// ReadExif returns the EXIF metadata of the image in r, of the format as
+// Sniff names it.
+func ReadExif(r io.ReaderAt, format string) Exif {
+	var blob *io.SectionReader
+	switch format {
+	case "jpeg":
+		blob = findJPEGExif(r)
+	case "png":
+		blob = findChunk(r, 8, binary.BigEndian, true, "eXIf", "IDAT")
+	case "webp":
+		blob = findChunk(r, 12, binary.LittleEndian, false, "EXIF", "")
+	case "tiff":
+		blob = io.NewSectionReader(r, 0, 1<<62)
+	}
+	if blob == nil {
+		return Exif{}
+	}
+	return parseExif(blob)
+}
+
+// findJPEGExif walks the marker segments up to the image data looking for the
+// APP1 segment that carries EXIF.
+func findJPEGExif(r io.ReaderAt) *io.SectionReader {
+	var buf [10]byte
+	for off := int64(2); ; {
+		if _, err := r.ReadAt(buf[:4], off); err != nil || buf[0] != 0xff {
+			return nil
+		}
+		marker, length := buf[1], int64(binary.BigEndian.Uint16(buf[2:4]))
+		if marker == 0xda || marker == 0xd9 || length < 2 {
+			return nil
+		}
+		if marker == 0xe1 && length >= 8 {
+			if _, err := r.ReadAt(buf[:6], off+4); err == nil && bytes.Equal(buf[:6], []byte("Exif\x00\x00")) {
+				return io.NewSectionReader(r, off+10, length-8)
+			}
+		}
+		off += 2 + length
+	}
+}
+
+// findChunk walks length/type prefixed chunks starting at off until it finds
+// want or stop. PNG puts the length first and has a trailing CRC; RIFF puts
+// the type first and pads chunks to an even size.
+func findChunk(r io.ReaderAt, off int64, order binary.ByteOrder, png bool, want, stop string) *io.SectionReader {
+	var buf [8]byte
+	for {
+		if _, err := r.ReadAt(buf[:], off); err != nil {
+			return nil
+		}
+		length, typ := int64(order.Uint32(buf[4:])), string(buf[:4])
+		if png {
+			length, typ = int64(order.Uint32(buf[:4])), string(buf[4:])
+		}
+		switch typ {
+		case want:
+			blob := io.NewSectionReader(r, off+8, length)
+			// some writers keep the JPEG style prefix.
+			var prefix [6]byte
+			if _, err := blob.ReadAt(prefix[:], 0); err == nil && bytes.Equal(prefix[:], []byte("Exif\x00\x00")) {
+				blob = io.NewSectionReader(r, off+14, length-6)
+			}
+			return blob
+		case stop:
+			return nil
+		}
+		off += 8 + length
+		if png {
+			off += 4
+		} else {
+			off += length % 2
+		}
+	}
+}
+
+type exifReader struct {
+	r     io.ReaderAt
+	order binary.ByteOrder
+}
+
+// parseExif parses a TIFF structured EXIF blob for Software and
+// DateTimeOriginal.
+func parseExif(r io.ReaderAt) Exif {
+	var (
+		meta   Exif
+		header [8]byte
+	)
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return meta
+	}
+	e := &exifReader{r: r}
+	switch string(header[:4]) {
+	case "II*\x00":
+		e.order = binary.LittleEndian
+	case "MM\x00*":
+		e.order = binary.BigEndian
+	default:
+		return meta
+	}
+	meta.Present = true
+
+	ifd0 := e.entries(int64(e.order.Uint32(header[4:])))
+	if software, ok := ifd0[exifTagSoftware]; ok {
+		meta.Software = strings.TrimSpace(e.ascii(software))
+	}
+	meta.Captured, _ = e.captureTime(ifd0)
+	meta.GPS = e.position(ifd0)
+	return meta
+}
+
+// captureTime reads DateTimeOriginal from the EXIF IFD that ifd0 points to,
+// applying OffsetTimeOriginal when present and assuming local time otherwise.
+func (e *exifReader) captureTime(ifd0 map[uint16][]byte) (time.Time, bool) {
+	exifIFD, ok := ifd0[exifTagExifIFD]
+	if !ok {
+		return time.Time{}, false
+	}
+	tags := e.entries(int64(e.order.Uint32(exifIFD[8:])))
+	original, ok := tags[exifTagDateTimeOriginal]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	loc := time.Local
+	if offset, ok := tags[exifTagOffsetTimeOriginal]; ok {
+		if t, err := time.Parse("-07:00", e.ascii(offset)); err == nil {
+			loc = t.Location()
+		}
+	}
+	t, err := time.ParseInLocation(exifTimeLayout, e.ascii(original), loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// entries reads the IFD at off into its raw 12 byte entries, keyed by tag.
+func (e *exifReader) entries(off int64) map[uint16][]byte {
+	var count [2]byte
+	if _, err := e.r.ReadAt(count[:], off); err != nil {
+		return nil
+	}
+	n := int(e.order.Uint16(count[:]))
+	raw := make([]byte, n*12)
+	if _, err := e.r.ReadAt(raw, off+2); err != nil {
+		return nil
+	}
+	entries := make(map[uint16][]byte, n)
+	for i := 0; i < n; i++ {
+		entry := raw[i*12 : i*12+12]
+		entries[e.order.Uint16(entry)] = entry
+	}
+	return entries
+}
+
+// ascii returns the NUL-terminated string value of an ASCII entry.
+func (e *exifReader) ascii(entry []byte) string {
+	const asciiType = 2
+	if e.order.Uint16(entry[2:]) != asciiType {
+		return ""
+	}
+	count := e.order.Uint32(entry[4:])
+	if count > 64 {
+		return ""
+	}
+	val := entry[8 : 8+min(count, 4)]
+	if count > 4 {
+		val = make([]byte, count)
+		if _, err := e.r.ReadAt(val, int64(e.order.Uint32(entry[8:]))); err != nil {
+			return ""
+		}
+	}
+	return strings.TrimRight(string(val), "\x00 ")
+}
+
+// Position is a position in decimal degrees, north and east positive.
+type Position struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%.5f,%.5f", p.Lat, p.Lon)
+}
+
+// Distance returns the great-circle distance between p and q in meters.
+func (p Position) Distance(q Position) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat, dLon := rad(q.Lat-p.Lat), rad(q.Lon-p.Lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(p.Lat))*math.Cos(rad(q.Lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// position reads the GPS IFD that ifd0 points to, nil if it is missing or
+// holds no usable coordinates.
+func (e *exifReader) position(ifd0 map[uint16][]byte) *Position {
+	gpsIFD, ok := ifd0[exifTagGPSIFD]
+	if !ok {
+		return nil
+	}
+	tags := e.entries(int64(e.order.Uint32(gpsIFD[8:])))
+	lat, latOK := e.degrees(tags[exifTagGPSLatitude])
+	lon, lonOK := e.degrees(tags[exifTagGPSLongitude])
+	if !latOK || !lonOK || lat > 90 || lon > 180 {
+		return nil
+	}
+	if ref, ok := tags[exifTagGPSLatitudeRef]; ok && e.ascii(ref) == "S" {
+		lat = -lat
+	}
+	if ref, ok := tags[exifTagGPSLongitudeRef]; ok && e.ascii(ref) == "W" {
+		lon = -lon
+	}
+	// cameras without a fix write zeroes.
+	if lat == 0 && lon == 0 {
+		return nil
+	}
+	return &Position{Lat: lat, Lon: lon}
+}
+
+// degrees reads a GPS coordinate entry, three rationals of degrees, minutes
+// and seconds, as decimal degrees.
+func (e *exifReader) degrees(entry []byte) (float64, bool) {
+	const rationalType = 5
+	if entry == nil || e.order.Uint16(entry[2:]) != rationalType || e.order.Uint32(entry[4:]) != 3 {
+		return 0, false
+	}
+	var raw [24]byte
+	if _, err := e.r.ReadAt(raw[:], int64(e.order.Uint32(entry[8:]))); err != nil {
+		return 0, false
+	}
+	var deg float64
+	for i, scale := range []float64{1, 60, 3600} {
+		num, den := e.order.Uint32(raw[i*8:]), e.order.Uint32(raw[i*8+4:])
+		if den == 0 {
+			if num != 0 {
+				return 0, false
+			}
+			continue
+		}
+		deg += float64(num) / float64(den) / scale
+	}
+	return deg, true
+}
@@ -0,0 +1,172 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// Windows icons and cursors bundle several renditions of the same image, each
+// either a PNG or a headerless BMP (DIB) with an extra 1-bit transparency mask.
+// Only the largest rendition is decoded, since that's what a hash should see.
+
+func init() {
+	image.RegisterFormat("ico", "\x00\x00\x01\x00", decodeICO, decodeICOConfig)
+	image.RegisterFormat("cur", "\x00\x00\x02\x00", decodeICO, decodeICOConfig)
+}
+
+type icoEntry struct {
+	width, height int
+	bpp           int
+	size, offset  uint32
+}
+
+var errICOFormat = errors.New("ico: invalid format")
+
+// readICODir reads the directory of an icon and returns its largest entry
+// along with everything following the directory, which the offsets index into.
+func readICODir(r io.Reader) (icoEntry, []byte, error) {
+	dat, err := io.ReadAll(r)
+	if err != nil {
+		return icoEntry{}, nil, err
+	}
+	if len(dat) < 6 {
+		return icoEntry{}, nil, errICOFormat
+	}
+	count := int(binary.LittleEndian.Uint16(dat[4:]))
+	if count == 0 || len(dat) < 6+count*16 {
+		return icoEntry{}, nil, errICOFormat
+	}
+
+	var best icoEntry
+	for i := 0; i < count; i++ {
+		e := dat[6+i*16:]
+		entry := icoEntry{
+			width:  int(e[0]),
+			height: int(e[1]),
+			bpp:    int(binary.LittleEndian.Uint16(e[6:])),
+			size:   binary.LittleEndian.Uint32(e[8:]),
+			offset: binary.LittleEndian.Uint32(e[12:]),
+		}
+		// a zero dimension means 256 pixels.
+		if entry.width == 0 {
+			entry.width = 256
+		}
+		if entry.height == 0 {
+			entry.height = 256
+		}
+		if uint64(entry.offset)+uint64(entry.size) > uint64(len(dat)) {
+			continue
+		}
+		area, bestArea := entry.width*entry.height, best.width*best.height
+		if area > bestArea || area == bestArea && entry.bpp > best.bpp {
+			best = entry
+		}
+	}
+	if best.size == 0 {
+		return icoEntry{}, nil, errICOFormat
+	}
+	return best, dat, nil
+}
+
+func decodeICOConfig(r io.Reader) (image.Config, error) {
+	entry, _, err := readICODir(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: entry.width, Height: entry.height}, nil
+}
+
+func decodeICO(r io.Reader) (image.Image, error) {
+	entry, dat, err := readICODir(r)
+	if err != nil {
+		return nil, err
+	}
+	data := dat[entry.offset : entry.offset+entry.size]
+	if bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return png.Decode(bytes.NewReader(data))
+	}
+	return decodeDIB(data)
+}
+
+// decodeDIB decodes an uncompressed icon bitmap: a BITMAPINFOHEADER, a color
+// table for paletted depths, the bottom-up pixel rows, then the AND mask. The
+// header height covers both the pixels and the mask, so it is twice the image's.
+func decodeDIB(data []byte) (image.Image, error) {
+	if len(data) < 40 {
+		return nil, errICOFormat
+	}
+	headerSize := int(binary.LittleEndian.Uint32(data))
+	w := int(int32(binary.LittleEndian.Uint32(data[4:])))
+	h := int(int32(binary.LittleEndian.Uint32(data[8:]))) / 2
+	bpp := int(binary.LittleEndian.Uint16(data[14:]))
+	compression := binary.LittleEndian.Uint32(data[16:])
+	colors := int(binary.LittleEndian.Uint32(data[32:]))
+	if headerSize < 40 || headerSize > len(data) || w <= 0 || h <= 0 || w > 1024 || h > 1024 {
+		return nil, errICOFormat
+	}
+	// BI_BITFIELDS is how 32-bit icons commonly spell plain BGRA.
+	if compression != 0 && !(compression == 3 && bpp == 32) {
+		return nil, fmt.Errorf("ico: unsupported bitmap compression %d", compression)
+	}
+
+	var palette []color.NRGBA
+	switch bpp {
+	case 1, 4, 8:
+		if colors == 0 {
+			colors = 1 << bpp
+		}
+		off := headerSize
+		if colors > 1<<bpp || off+colors*4 > len(data) {
+			return nil, errICOFormat
+		}
+		for i := 0; i < colors; i++ {
+			c := data[off+i*4:]
+			palette = append(palette, color.NRGBA{R: c[2], G: c[1], B: c[0], A: 0xff})
+		}
+		headerSize += colors * 4
+	case 24, 32:
+	default:
+		return nil, fmt.Errorf("ico: unsupported bit depth %d", bpp)
+	}
+
+	stride := (w*bpp + 31) / 32 * 4
+	maskStride := (w + 31) / 32 * 4
+	pixels := data[headerSize:]
+	if len(pixels) < stride*h {
+		return nil, io.ErrUnexpectedEOF
+	}
+	mask := pixels[stride*h:]
+	hasMask := bpp < 32 && len(mask) >= maskStride*h
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		row := pixels[(h-1-y)*stride:]
+		for x := 0; x < w; x++ {
+			var c color.NRGBA
+			switch bpp {
+			case 32:
+				c = color.NRGBA{R: row[x*4+2], G: row[x*4+1], B: row[x*4], A: row[x*4+3]}
+			case 24:
+				c = color.NRGBA{R: row[x*3+2], G: row[x*3+1], B: row[x*3], A: 0xff}
+			default:
+				bit := x * bpp
+				idx := int(row[bit/8]>>(8-bpp-bit%8)) & (1<<bpp - 1)
+				if idx >= len(palette) {
+					return nil, errICOFormat
+				}
+				c = palette[idx]
+			}
+			if hasMask && mask[(h-1-y)*maskStride+x/8]&(0x80>>(x%8)) != 0 {
+				c.A = 0
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,46 @@
+// Package imaging holds the decoding that the dupehunter command and package
+// dupe share: telling images from other files by their leading bytes, the
+// decoders of formats the standard library lacks, the pages of multi-page
+// TIFFs, and the EXIF metadata images carry.
+package imaging
+
+import "bytes"
+
+// SniffLen matches what http.DetectContentType considers, which is also plenty
+// for every image signature we know.
+const SniffLen = 512
+
+var signatures = []struct {
+	magic  []byte
+	format string
+}{
+	{[]byte("\xff\xd8\xff"), "jpeg"},
+	{[]byte("\x89PNG\r\n\x1a\n"), "png"},
+	{[]byte("GIF87a"), "gif"},
+	{[]byte("GIF89a"), "gif"},
+	{[]byte("II*\x00"), "tiff"},
+	{[]byte("MM\x00*"), "tiff"},
+	{[]byte("\x00\x00\x01\x00"), "ico"},
+	{[]byte("\x00\x00\x02\x00"), "cur"},
+	{[]byte("BM"), "bmp"},
+	{[]byte("%PDF-"), "pdf"},
+}
+
+// Sniff identifies the image format from the leading bytes of a file, by the
+// name image.Decode gives it, "" for anything there is no decoder for. PDFs
+// are only told apart if pdf is set, as they need a decoder of their own.
+func Sniff(head []byte, pdf bool) string {
+	for _, sig := range signatures {
+		if sig.format == "pdf" && !pdf {
+			continue
+		}
+		if bytes.HasPrefix(head, sig.magic) {
+			return sig.format
+		}
+	}
+	// RIFF containers carry their length before the form type.
+	if len(head) >= 12 && bytes.Equal(head[:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WEBP")) {
+		return "webp"
+	}
+	return ""
+}
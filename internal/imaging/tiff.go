@@ -0,0 +1,85 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+
+	"golang.org/x/image/tiff"
+)
+
+// golang.org/x/image/tiff only ever decodes the first page of a TIFF, so each
+// page is decoded from a view of the file whose header points at that page's
+// IFD instead.
+
+// maxTIFFPages bounds the IFD chain walk, which a corrupt file could loop.
+const maxTIFFPages = 4096
+
+// TIFFPages returns the offsets of every IFD, i.e. of every page, in a TIFF.
+func TIFFPages(r io.ReaderAt) ([]uint32, error) {
+	var header [8]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch string(header[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("tiff: malformed header")
+	}
+
+	var (
+		pages []uint32
+		seen  = make(map[uint32]struct{})
+		buf   [4]byte
+	)
+	for off := order.Uint32(header[4:]); off != 0; {
+		if _, loop := seen[off]; loop || len(pages) == maxTIFFPages {
+			break
+		}
+		seen[off] = struct{}{}
+		pages = append(pages, off)
+		if _, err := r.ReadAt(buf[:2], int64(off)); err != nil {
+			return nil, err
+		}
+		entries := int64(order.Uint16(buf[:2]))
+		if _, err := r.ReadAt(buf[:], int64(off)+2+entries*12); err != nil {
+			// a missing next pointer just ends the chain.
+			break
+		}
+		off = order.Uint32(buf[:])
+	}
+	return pages, nil
+}
+
+// tiffPageReader presents a TIFF as if the IFD at ifd were its first.
+type tiffPageReader struct {
+	r      io.ReaderAt
+	header [8]byte
+}
+
+func (t *tiffPageReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := t.r.ReadAt(p, off)
+	if off < int64(len(t.header)) {
+		copy(p[:n], t.header[off:])
+	}
+	return n, err
+}
+
+// DecodeTIFFPage decodes the page whose IFD starts at ifd.
+func DecodeTIFFPage(r io.ReaderAt, size int64, ifd uint32) (image.Image, error) {
+	pr := &tiffPageReader{r: r}
+	if _, err := r.ReadAt(pr.header[:], 0); err != nil {
+		return nil, err
+	}
+	order := binary.ByteOrder(binary.LittleEndian)
+	if pr.header[0] == 'M' {
+		order = binary.BigEndian
+	}
+	order.PutUint32(pr.header[4:], ifd)
+	return tiff.Decode(io.NewSectionReader(pr, 0, size))
+}
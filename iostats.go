@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// On metered or remote storage, what a scan reads is what it costs. Every
+// scan therefore ends with what it took: the files it opened and the bytes it
+// read from them, how many files it skipped as unchanged since their record
+// was written, and what it wrote to the database. Files are read through a
+// trackedFile, the database is written through guardedStore and the index.
+// Isolated decoders read the files themselves, which count by their size.
+
+// ioStats counts the I/O of a scan.
+type ioStats struct {
+	opened, read, unchanged, written atomic.Int64
+}
+
+var scanIO = &ioStats{}
+
+func (s *ioStats) reset() {
+	s.opened.Store(0)
+	s.read.Store(0)
+	s.unchanged.Store(0)
+	s.written.Store(0)
+}
+
+func (s *ioStats) summarize() {
+	opened, unchanged := s.opened.Load(), s.unchanged.Load()
+	if opened+unchanged == 0 {
+		return
+	}
+	hitRate := strconv.FormatFloat(100*float64(unchanged)/float64(opened+unchanged), 'f', 1, 64) + "%"
+	log.Info().Int64("files_opened", opened).Str("read", formatBytes(s.read.Load())).
+		Int64("unchanged", unchanged).Str("unchanged_rate", hitRate).
+		Str("db_written", formatBytes(s.written.Load())).Msg("scan I/O")
+}
+
+// trackedFile is a file of a scan, counting what is read from it.
+type trackedFile struct {
+	*os.File
+}
+
+func openTracked(path string) (*trackedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	scanIO.opened.Add(1)
+	return &trackedFile{f}, nil
+}
+
+func (f *trackedFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	scanIO.read.Add(int64(n))
+	return n, err
+}
+
+func (f *trackedFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	scanIO.read.Add(int64(n))
+	return n, err
+}
+
+// WriteTo copies through Read, which the one of os.File would bypass.
+func (f *trackedFile) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, struct{ io.Reader }{f})
+}
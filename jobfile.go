@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/bytedance/sonic"
+)
+
+// A job document describes a run as JSON instead of flags, for orchestration
+// systems that would rather not assemble long command lines, e.g.
+//
+//	{"roots": ["/srv/photos/**/*.jpg"], "threshold": 8,
+//	 "filters": {"min_group_size": 3}, "output": {"manifest": "/tmp/run.json"},
+//	 "action": {"type": "move", "quarantine": "/srv/quarantine"}}
+//
+// Every field is optional and sets the flag of the same meaning, roots are
+// the paths to ingest; flags given on the command line take precedence over
+// the document.
+
+type jobDocument struct {
+	Roots       []string `json:"roots"`
+	Threshold   *int     `json:"threshold"`
+	Hash        *string  `json:"hash"`
+	HashPlugin  *string  `json:"hash_plugin"`
+	CenterWt    *string  `json:"center_weight"`
+	Watermark   *int     `json:"watermark_margin"`
+	EmbedPlugin *string  `json:"embed_plugin"`
+	PluginLimit *string  `json:"plugin_timeout"`
+	SceneDist   *float64 `json:"scene_distance"`
+	Thresholds  *string  `json:"thresholds"`
+	Adaptive    *bool    `json:"adaptive_threshold"`
+	Collection  *string  `json:"collection"`
+	Source      *string  `json:"source"`
+	MaxFiles    *int     `json:"max_files"`
+	MaxDuration *string  `json:"max_duration"`
+	StatOnly    *bool    `json:"stat_only"`
+	SkipOffline *bool    `json:"skip_offline"`
+	HashLater   *bool    `json:"hash_later"`
+	Bulk        *bool    `json:"bulk"`
+	Workers     *int     `json:"workers"`
+	Seed        *int     `json:"seed"`
+	Filters     struct {
+		IgnoreZero     *bool    `json:"ignore_zero"`
+		MinGroupSize   *int     `json:"min_group_size"`
+		MaxGroups      *int     `json:"max_groups"`
+		GroupOffset    *int     `json:"group_offset"`
+		DirSimilarity  *float64 `json:"dir_similarity"`
+		KeepMatch      *string  `json:"keep_match"`
+		Keep           *string  `json:"keep"`
+		AllFiles       *bool    `json:"all_files"`
+		PDF            *bool    `json:"pdf"`
+		Archives       *bool    `json:"archives"`
+		Mail           *bool    `json:"mail"`
+		ExactPrefilter *bool    `json:"exact_prefilter"`
+		RenameFilter   *bool    `json:"rename_prefilter"`
+		RetryFailed    *bool    `json:"retry_failed"`
+		IncludeTrash   *bool    `json:"include_trash"`
+		Extensions     *string  `json:"extensions"`
+		Exclude        []string `json:"exclude"`
+		MinSize        *string  `json:"min_size"`
+		MaxSize        *string  `json:"max_size"`
+		FollowSymlinks *bool    `json:"follow_symlinks"`
+		MaxDepth       *int     `json:"max_depth"`
+		NewerThan      *string  `json:"newer_than"`
+		OlderThan      *string  `json:"older_than"`
+		TimeBy         *string  `json:"time_by"`
+	} `json:"filters"`
+	Output struct {
+		Print0         *bool   `json:"print0"`
+		SuggestRenames *bool   `json:"suggest_renames"`
+		Manifest       *string `json:"manifest"`
+		Treemap        *string `json:"treemap"`
+		DedupeReport   *string `json:"dedupe_report"`
+		Sidecars       *bool   `json:"sidecars"`
+		DeniedList     *string `json:"denied_list"`
+		TruncatedList  *string `json:"truncated_list"`
+		Report         *string `json:"report"`
+		ReportFile     *string `json:"report_file"`
+		Conversions    *bool   `json:"suggest_conversions"`
+		Places         *bool   `json:"report_places"`
+		KeepResults    *string `json:"keep_results"`
+		Simulate       *bool   `json:"simulate_policies"`
+	} `json:"output"`
+	Action struct {
+		Type          *string `json:"type"`
+		Quarantine    *string `json:"quarantine"`
+		PreserveTimes *bool   `json:"preserve_times"`
+		DryRun        *bool   `json:"dry_run"`
+		UndoLog       *string `json:"undo_log"`
+		Snapshot      *bool   `json:"snapshot"`
+		HaveSnapshot  *bool   `json:"i_have_a_snapshot"`
+		NearDupes     *bool   `json:"clean_near_duplicates"`
+	} `json:"action"`
+}
+
+var jobDecoder = sonic.Config{DisallowUnknownFields: true}.Froze()
+
+// readJob reads the job document at path, or from stdin for -.
+func readJob(path string) (*jobDocument, error) {
+	var (
+		dat []byte
+		err error
+	)
+	if path == "-" {
+		dat, err = io.ReadAll(os.Stdin)
+	} else {
+		dat, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc := &jobDocument{}
+	if err = jobDecoder.Unmarshal(dat, doc); err != nil {
+		return nil, fmt.Errorf("invalid job document: %w", err)
+	}
+	return doc, nil
+}
+
+// apply sets the flags of fs the document sets and the command line doesn't.
+func (doc *jobDocument) apply(fs *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	f, out, act := doc.Filters, doc.Output, doc.Action
+	for _, jf := range []struct {
+		flag  string
+		value any
+	}{
+		{"d", doc.Threshold}, {"hash", doc.Hash}, {"hash-plugin", doc.HashPlugin}, {"center-weight", doc.CenterWt},
+		{"watermark-margin", doc.Watermark},
+		{"embed-plugin", doc.EmbedPlugin}, {"plugin-timeout", doc.PluginLimit}, {"scene-distance", doc.SceneDist},
+		{"thresholds", doc.Thresholds}, {"adaptive-threshold", doc.Adaptive},
+		{"collection", doc.Collection}, {"source", doc.Source},
+		{"max-files", doc.MaxFiles}, {"max-duration", doc.MaxDuration}, {"stat-only", doc.StatOnly},
+		{"skip-offline", doc.SkipOffline},
+		{"hash-later", doc.HashLater}, {"bulk", doc.Bulk}, {"workers", doc.Workers}, {"seed", doc.Seed},
+		{"ignore-zero", f.IgnoreZero}, {"min-group-size", f.MinGroupSize},
+		{"max-groups", f.MaxGroups}, {"group-offset", f.GroupOffset},
+		{"dir-similarity", f.DirSimilarity}, {"keep-match", f.KeepMatch}, {"keep", f.Keep},
+		{"all-files", f.AllFiles}, {"pdf", f.PDF}, {"archives", f.Archives}, {"mail", f.Mail},
+		{"exact-prefilter", f.ExactPrefilter}, {"rename-prefilter", f.RenameFilter},
+		{"retry-failed", f.RetryFailed},
+		{"include-trash", f.IncludeTrash}, {"ext", f.Extensions}, {"exclude", f.Exclude},
+		{"min-size", f.MinSize}, {"max-size", f.MaxSize}, {"follow-symlinks", f.FollowSymlinks},
+		{"max-depth", f.MaxDepth}, {"newer-than", f.NewerThan}, {"older-than", f.OlderThan}, {"time-by", f.TimeBy},
+		{"print0", out.Print0}, {"suggest-renames", out.SuggestRenames},
+		{"manifest", out.Manifest}, {"treemap", out.Treemap},
+		{"dedupe-report", out.DedupeReport}, {"sidecars", out.Sidecars},
+		{"denied-list", out.DeniedList}, {"truncated-list", out.TruncatedList},
+		{"output", out.Report}, {"out", out.ReportFile}, {"suggest-conversions", out.Conversions},
+		{"report-places", out.Places}, {"keep-results", out.KeepResults}, {"simulate-policies", out.Simulate},
+		{"action", act.Type}, {"quarantine", act.Quarantine}, {"preserve-times", act.PreserveTimes},
+		{"dry-run", act.DryRun}, {"undo-log", act.UndoLog}, {"snapshot", act.Snapshot},
+		{"i-have-a-snapshot", act.HaveSnapshot}, {"clean-near-duplicates", act.NearDupes},
+	} {
+		var values []string
+		switch v := jf.value.(type) {
+		case *int:
+			if v == nil {
+				continue
+			}
+			values = []string{strconv.Itoa(*v)}
+		case *float64:
+			if v == nil {
+				continue
+			}
+			values = []string{strconv.FormatFloat(*v, 'f', -1, 64)}
+		case *bool:
+			if v == nil {
+				continue
+			}
+			values = []string{strconv.FormatBool(*v)}
+		case *string:
+			if v == nil {
+				continue
+			}
+			values = []string{*v}
+		case []string:
+			// a repeatable flag, set once per value.
+			values = v
+		}
+		if explicit[jf.flag] {
+			continue
+		}
+		for _, value := range values {
+			if err := fs.Set(jf.flag, value); err != nil {
+				return fmt.Errorf("invalid job document: -%s: %w", jf.flag, err)
+			}
+		}
+	}
+	return nil
+}
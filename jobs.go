@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Scans and clean-ups submitted through the API become jobs, run one after
+// another in submission order. Each job keeps the log lines emitted while it
+// ran, and can be canceled whether it's still queued or already running.
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+)
+
+const (
+	// maxPendingJobs bounds the queue, submissions beyond it are refused.
+	maxPendingJobs = 256
+	// maxFinishedJobs is how many finished jobs are kept for inspection.
+	maxFinishedJobs = 100
+	maxJobLogLines  = 1000
+)
+
+var errQueueFull = errors.New("job queue is full")
+
+type job struct {
+	id, kind string
+	run      func(ctx context.Context) (any, error)
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mu                         sync.Mutex
+	state                      string
+	created, started, finished time.Time
+	err                        error
+	result                     any
+	log                        []string
+}
+
+type jobView struct {
+	ID       string     `json:"id"`
+	Kind     string     `json:"kind"`
+	State    string     `json:"state"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Result   any        `json:"result,omitempty"`
+	Log      []string   `json:"log,omitempty"`
+}
+
+func (j *job) view(withLog bool) jobView {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	v := jobView{ID: j.id, Kind: j.kind, State: j.state, Created: j.created, Result: j.result}
+	if !j.started.IsZero() {
+		started := j.started
+		v.Started = &started
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		v.Finished = &finished
+	}
+	if j.err != nil {
+		v.Error = j.err.Error()
+	}
+	if withLog {
+		v.Log = append([]string(nil), j.log...)
+	}
+	return v
+}
+
+func (j *job) finish(state string, result any, err error) {
+	j.mu.Lock()
+	j.state, j.result, j.err, j.finished = state, result, err, time.Now()
+	j.mu.Unlock()
+}
+
+type jobQueue struct {
+	mu      sync.Mutex
+	next    int
+	jobs    map[string]*job
+	order   []string
+	current *job
+	pending chan *job
+	// exclusive is held while a job runs, it shares the similarity index and
+	// the worker pool with other API requests.
+	exclusive *sync.Mutex
+}
+
+func newJobQueue(exclusive *sync.Mutex) *jobQueue {
+	q := &jobQueue{
+		jobs:      make(map[string]*job),
+		pending:   make(chan *job, maxPendingJobs),
+		exclusive: exclusive,
+	}
+	go q.work()
+	return q
+}
+
+func (q *jobQueue) submit(kind string, run func(ctx context.Context) (any, error)) (*job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.next++
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		id: strconv.Itoa(q.next), kind: kind, run: run, ctx: ctx, cancel: cancel,
+		state: jobQueued, created: time.Now(),
+	}
+	select {
+	case q.pending <- j:
+	default:
+		cancel()
+		return nil, errQueueFull
+	}
+	q.jobs[j.id] = j
+	q.order = append(q.order, j.id)
+	q.prune()
+	return j, nil
+}
+
+// prune forgets the oldest finished jobs beyond maxFinishedJobs.
+func (q *jobQueue) prune() {
+	var finished int
+	for i := len(q.order) - 1; i >= 0; i-- {
+		j := q.jobs[q.order[i]]
+		j.mu.Lock()
+		done := j.state != jobQueued && j.state != jobRunning
+		j.mu.Unlock()
+		if !done {
+			continue
+		}
+		if finished++; finished > maxFinishedJobs {
+			delete(q.jobs, j.id)
+			q.order = append(q.order[:i], q.order[i+1:]...)
+		}
+	}
+}
+
+func (q *jobQueue) work() {
+	for j := range q.pending {
+		if j.ctx.Err() != nil {
+			// canceled while queued.
+			continue
+		}
+		q.exclusive.Lock()
+		q.mu.Lock()
+		q.current = j
+		q.mu.Unlock()
+		j.mu.Lock()
+		j.state, j.started = jobRunning, time.Now()
+		j.mu.Unlock()
+
+		log.Info().Str("job", j.id).Str("kind", j.kind).Msg("job started")
+		result, err := j.run(j.ctx)
+		switch {
+		case j.ctx.Err() != nil:
+			j.finish(jobCanceled, result, nil)
+		case err != nil:
+			j.finish(jobFailed, result, err)
+		default:
+			j.finish(jobSucceeded, result, nil)
+		}
+		log.Info().Str("job", j.id).Str("state", j.view(false).State).Msg("job finished")
+
+		q.mu.Lock()
+		q.current = nil
+		q.mu.Unlock()
+		q.exclusive.Unlock()
+		j.cancel()
+	}
+}
+
+func (q *jobQueue) get(id string) *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.jobs[id]
+}
+
+func (q *jobQueue) list() []jobView {
+	q.mu.Lock()
+	jobs := make([]*job, 0, len(q.order))
+	for _, id := range q.order {
+		jobs = append(jobs, q.jobs[id])
+	}
+	q.mu.Unlock()
+	views := make([]jobView, 0, len(jobs))
+	for _, j := range jobs {
+		views = append(views, j.view(false))
+	}
+	return views
+}
+
+// cancel stops a job. Queued jobs are canceled right away, running ones stop
+// at the next file.
+func (q *jobQueue) cancel(j *job) {
+	j.mu.Lock()
+	queued := j.state == jobQueued
+	if queued {
+		j.state, j.finished = jobCanceled, time.Now()
+	}
+	j.mu.Unlock()
+	j.cancel()
+}
+
+// Run records log lines emitted while a job runs in that job's log.
+func (q *jobQueue) Run(_ *zerolog.Event, level zerolog.Level, msg string) {
+	q.mu.Lock()
+	j := q.current
+	q.mu.Unlock()
+	if j == nil || msg == "" {
+		return
+	}
+	j.mu.Lock()
+	if len(j.log) < maxJobLogLines {
+		j.log = append(j.log, time.Now().Format(time.TimeOnly)+" "+level.String()+" "+msg)
+	}
+	j.mu.Unlock()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// image/jpeg refuses 12-bit precision, arithmetic coding, and CMYK files
+// without Adobe metadata, all of which are common in print workflows. Rather
+// than dropping those, they are converted by whichever external decoder is
+// installed, which writes a netpbm image we can read back.
+//
+// Isolated decoders can't exec anything, so with -isolate-decode these files
+// are still skipped.
+
+var jpegFallbacks = [][]string{
+	{"djpeg", "-pnm"},
+	{"magick", "jpeg:-", "ppm:-"},
+	{"convert", "jpeg:-", "ppm:-"},
+}
+
+var (
+	availableFallbacks     [][]string
+	availableFallbacksOnce sync.Once
+)
+
+func findJPEGFallbacks() [][]string {
+	availableFallbacksOnce.Do(func() {
+		for _, argv := range jpegFallbacks {
+			if path, err := exec.LookPath(argv[0]); err == nil {
+				availableFallbacks = append(availableFallbacks, append([]string{path}, argv[1:]...))
+			}
+		}
+	})
+	return availableFallbacks
+}
+
+// decodeJPEGFallback retries a JPEG that image/jpeg rejected as unsupported
+// with the external decoders. It returns decodeErr untouched for anything else.
+func decodeJPEGFallback(f *trackedFile, decodeErr error) (image.Image, error) {
+	var unsupported jpeg.UnsupportedError
+	if !errors.As(decodeErr, &unsupported) {
+		return nil, decodeErr
+	}
+	fallbacks := findJPEGFallbacks()
+	if len(fallbacks) == 0 {
+		return nil, fmt.Errorf("%w (install libjpeg-turbo or ImageMagick to decode it)", decodeErr)
+	}
+	finfo, err := f.Stat()
+	if err != nil {
+		return nil, decodeErr
+	}
+
+	var errs = []error{decodeErr}
+	for _, argv := range fallbacks {
+		cmd := exec.Command(argv[0], argv[1:]...)
+		cmd.Stdin = io.NewSectionReader(f, 0, finfo.Size())
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err = cmd.Run(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w: %s", argv[0], err, bytes.TrimSpace(stderr.Bytes())))
+			continue
+		}
+		img, err := decodePNM(&stdout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", argv[0], err))
+			continue
+		}
+		log.Debug().Str("caller", f.Name()).Str("decoder", argv[0]).Str("reason", string(unsupported)).
+			Msg("decoded jpeg with external decoder")
+		return img, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// decodePNM reads a binary graymap (P5) or pixmap (P6) of up to 16 bits per sample.
+func decodePNM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	var header [3]int // width, height, maxval
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+	if magic[0] != 'P' || magic[1] != '5' && magic[1] != '6' {
+		return nil, fmt.Errorf("pnm: unsupported format %q", magic)
+	}
+	for i := range header {
+		if err := skipPNMSpace(br); err != nil {
+			return nil, err
+		}
+		var digits []byte
+		for {
+			c, err := br.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if c < '0' || c > '9' {
+				// exactly one whitespace byte separates the header from the raster.
+				break
+			}
+			digits = append(digits, c)
+		}
+		n, err := strconv.Atoi(string(digits))
+		if err != nil {
+			return nil, fmt.Errorf("pnm: bad header: %w", err)
+		}
+		header[i] = n
+	}
+	w, h, maxval := header[0], header[1], header[2]
+	if w <= 0 || h <= 0 || maxval <= 0 || maxval > 65535 {
+		return nil, errors.New("pnm: bad header")
+	}
+
+	channels, depth := 1, 1
+	if magic[1] == '6' {
+		channels = 3
+	}
+	if maxval > 255 {
+		depth = 2
+	}
+	row := make([]byte, w*channels*depth)
+	sample := func(i int) uint16 {
+		var v uint32
+		if depth == 2 {
+			v = uint32(row[i*2])<<8 | uint32(row[i*2+1])
+		} else {
+			v = uint32(row[i])
+		}
+		return uint16(v * 0xffff / uint32(maxval))
+	}
+
+	rect := image.Rect(0, 0, w, h)
+	var (
+		gray *image.Gray16
+		rgb  *image.RGBA64
+		img  image.Image
+	)
+	if channels == 1 {
+		gray = image.NewGray16(rect)
+		img = gray
+	} else {
+		rgb = image.NewRGBA64(rect)
+		img = rgb
+	}
+	for y := 0; y < h; y++ {
+		if _, err := io.ReadFull(br, row); err != nil {
+			return nil, err
+		}
+		for x := 0; x < w; x++ {
+			if gray != nil {
+				gray.SetGray16(x, y, color.Gray16{Y: sample(x)})
+				continue
+			}
+			rgb.SetRGBA64(x, y, color.RGBA64{R: sample(x * 3), G: sample(x*3 + 1), B: sample(x*3 + 2), A: 0xffff})
+		}
+	}
+	return img, nil
+}
+
+func skipPNMSpace(br *bufio.Reader) error {
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case c == '#':
+			if _, err = br.ReadString('\n'); err != nil {
+				return err
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		default:
+			return br.UnreadByte()
+		}
+	}
+}
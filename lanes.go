@@ -0,0 +1,64 @@
+package main
+
+import "sync"
+
+// The worker pool is shared by bulk ingest and interactive requests. Work is
+// handed to it through two lanes, and whenever a worker frees up, waiting
+// interactive work goes first, so a single query doesn't sit behind every
+// file of a large scan.
+
+type laneScheduler struct {
+	mu          sync.Mutex
+	ready       *sync.Cond
+	interactive []func()
+	bulk        []func()
+}
+
+var lanes *laneScheduler
+
+func startLanes() {
+	lanes = &laneScheduler{}
+	lanes.ready = sync.NewCond(&lanes.mu)
+	go lanes.dispatch()
+}
+
+// submit queues task in the interactive or the bulk lane.
+func (l *laneScheduler) submit(task func(), interactive bool) {
+	l.mu.Lock()
+	if interactive {
+		l.interactive = append(l.interactive, task)
+	} else {
+		l.bulk = append(l.bulk, task)
+	}
+	l.mu.Unlock()
+	l.ready.Signal()
+}
+
+// queued returns how many tasks wait in each lane.
+func (l *laneScheduler) queued() (interactive, bulk int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.interactive), len(l.bulk)
+}
+
+// dispatch hands queued tasks to the pool, blocking while all workers are busy,
+// and only then picking the next task so interactive work can overtake.
+func (l *laneScheduler) dispatch() {
+	for {
+		l.mu.Lock()
+		for len(l.interactive) == 0 && len(l.bulk) == 0 {
+			l.ready.Wait()
+		}
+		var task func()
+		if len(l.interactive) > 0 {
+			task, l.interactive = l.interactive[0], l.interactive[1:]
+		} else {
+			task, l.bulk = l.bulk[0], l.bulk[1:]
+		}
+		l.mu.Unlock()
+
+		if err := workers.Submit(task); err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+	}
+}
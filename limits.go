@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Scheduled scans can be bounded with -max-files and -max-duration, say to
+// hash at most 50k new files a night. Once a limit is reached, no more files
+// are taken up; running out of time also drops the files waiting for a
+// worker, the same way a full disk stops a scan. What was stored is kept, and
+// since the next scan skips the files already indexed, it carries on with the
+// ones left over. Only new and changed files count towards -max-files. The
+// check phase runs as usual on everything indexed so far.
+
+const (
+	limitFiles    = "max-files"
+	limitDuration = "max-duration"
+)
+
+type scanLimits struct {
+	mu       sync.Mutex
+	cancel   context.CancelFunc
+	timer    *time.Timer
+	maxFiles int
+	admitted int
+	// reached is the limit that stopped the scan, if any.
+	reached string
+}
+
+var limits = &scanLimits{}
+
+// begin starts bounding a scan that cancel stops, by maxFiles files and
+// maxDuration, either of which 0 leaves unbounded.
+func (l *scanLimits) begin(cancel context.CancelFunc, maxFiles int, maxDuration time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cancel, l.maxFiles, l.admitted, l.reached = cancel, maxFiles, 0, ""
+	if maxDuration > 0 {
+		l.timer = time.AfterFunc(maxDuration, func() { l.stop(limitDuration) })
+	}
+}
+
+// admit takes up another new file, reporting false if that's one too many.
+func (l *scanLimits) admit() bool {
+	l.mu.Lock()
+	if l.maxFiles == 0 || l.admitted < l.maxFiles {
+		l.admitted++
+		l.mu.Unlock()
+		return true
+	}
+	l.mu.Unlock()
+	l.stop(limitFiles)
+	return false
+}
+
+// stop ends the scan at limit, canceling it if time is up.
+func (l *scanLimits) stop(limit string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.reached != "" || l.cancel == nil {
+		return
+	}
+	l.reached = limit
+	log.Warn().Str("limit", limit).Int("files", l.admitted).Msg("scan limit reached, stopping the scan")
+	if limit == limitDuration {
+		l.cancel()
+	}
+}
+
+// exhausted reports whether a limit was reached, and no more paths should be
+// taken up.
+func (l *scanLimits) exhausted() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reached != ""
+}
+
+// end stops bounding the scan and returns the limit that stopped it, or "".
+func (l *scanLimits) end() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.cancel = nil
+	if l.reached != "" {
+		log.Info().Str("limit", l.reached).Int("files", l.admitted).
+			Msg("the next scan of the same paths picks up the files left over")
+	}
+	return l.reached
+}
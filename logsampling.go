@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Some messages are logged once per file or per pair, which on a large scan
+// is a flood: writing it out slows the scan down, and nobody reads it. The
+// trace events of the decode and compare paths go through hotLog, which lets
+// a burst through every second and only one in a thousand beyond that. The
+// per-file progress messages go through progressLog, which logs every one of
+// them unless -log-every thins them out.
+
+var (
+	hotSampler zerolog.Sampler = &zerolog.BurstSampler{
+		Burst:       20,
+		Period:      time.Second,
+		NextSampler: &zerolog.BasicSampler{N: 1000},
+	}
+	// progressSampler is nil while every progress message is logged.
+	progressSampler zerolog.Sampler
+)
+
+// hotLog returns the logger of the trace events of hot paths.
+func hotLog() *zerolog.Logger {
+	l := log.Sample(hotSampler)
+	return &l
+}
+
+// progressLog returns the logger of per-file progress messages.
+func progressLog() *zerolog.Logger {
+	if progressSampler == nil {
+		return &log
+	}
+	l := log.Sample(progressSampler)
+	return &l
+}
+
+// logEvery logs every nth progress message, all of them for 1.
+func logEvery(n int) {
+	if n > 1 {
+		progressSampler = &zerolog.BasicSampler{N: uint32(n)}
+	}
+}
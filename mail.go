@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// With -mail the images in mail and web page exports are ingested like the
+// members of a zip archive, each as its own record keyed "path#page=N",
+// numbered in the order they appear: the attached and inline images of .eml
+// messages and .mhtml pages, which are both MIME, including those of the
+// messages forwarded as attachments, and the images inlined into their HTML
+// as data: URIs, which is all there is of them in a saved .html page. Parts
+// that aren't images are left out, whatever -all-files says. Every image is
+// hashed as soon as it's found, under the same limits as archive members, so
+// that no more than one of them is held in memory at a time.
+
+// mailImages makes scans ingest the images in mail exports, see -mail.
+var mailImages bool
+
+const (
+	// maxMailDepth bounds the nesting of multiparts and forwarded messages.
+	maxMailDepth = 16
+	// maxMailText is the largest HTML part searched for data: URIs.
+	maxMailText = 64 << 20
+)
+
+var (
+	mailExts = map[string]bool{".eml": true, ".mht": true, ".mhtml": true, ".html": true, ".htm": true}
+
+	dataURIImage = regexp.MustCompile(`data:image/[\w.+-]+;base64,([A-Za-z0-9+/=\s]+)`)
+)
+
+// isMailExport tells whether path is, by its extension, one -mail opens.
+func isMailExport(path string) bool {
+	return mailExts[strings.ToLower(filepath.Ext(path))]
+}
+
+// mailWalker hashes the images of the mail export img.
+type mailWalker struct {
+	img    *Image
+	found  int
+	hashed []*Image
+	// errs are the parts that couldn't be read, which don't stop the walk.
+	errs []error
+}
+
+func (w *mailWalker) full() bool {
+	return len(w.hashed) == maxArchiveMembers
+}
+
+// add hashes the image dat found in the export, named by the file name it was
+// attached as if any, into the next member.
+func (w *mailWalker) add(name string, dat []byte) {
+	w.found++
+	n := len(w.hashed) + 1
+	member := &Image{
+		ClaimedType: claimedImageType(name),
+		Name:        pagePath(w.img.Name, n),
+		Path:        pagePath(w.img.Path, n),
+		ModTime:     w.img.ModTime,
+		Origin:      w.img.Origin,
+		Size:        w.img.Size,
+		b:           w.img.b,
+	}
+	if _, err := hashArchiveMember(member, dat); err != nil {
+		log.Warn().Err(err).Str("caller", w.img.Name).Str("part", name).Msg("failed to decode embedded image")
+		return
+	}
+	w.hashed = append(w.hashed, member)
+}
+
+// message walks a MIME message, or a saved page that isn't one.
+func (w *mailWalker) message(r io.Reader, depth int) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		w.errs = append(w.errs, err)
+		return
+	}
+	w.part(textproto.MIMEHeader(msg.Header), msg.Body, depth)
+}
+
+// part walks the part with header h and body r.
+func (w *mailWalker) part(h textproto.MIMEHeader, r io.Reader, depth int) {
+	if w.full() {
+		return
+	}
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if depth == maxMailDepth || params["boundary"] == "" {
+			return
+		}
+		mr := multipart.NewReader(r, params["boundary"])
+		for !w.full() {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				w.errs = append(w.errs, err)
+				return
+			}
+			w.part(p.Header, p, depth+1)
+		}
+		return
+	case mediaType == "message/rfc822":
+		if depth < maxMailDepth {
+			w.message(r, depth+1)
+		}
+		return
+	}
+	// parts of a multipart come with quoted-printable decoded already.
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	dat, err := io.ReadAll(io.LimitReader(r, max(maxArchiveMember, maxMailText)+1))
+	if err != nil {
+		w.errs = append(w.errs, err)
+		return
+	}
+	switch {
+	case mediaType == "text/html":
+		if len(dat) <= maxMailText {
+			w.html(dat)
+		}
+	case len(dat) > maxArchiveMember:
+		w.errs = append(w.errs, fmt.Errorf("part is larger than %s", formatBytes(maxArchiveMember)))
+	case sniffImageType(dat[:min(len(dat), sniffLen)]) != NULL:
+		name := params["name"]
+		if _, dparams, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil && dparams["filename"] != "" {
+			name = dparams["filename"]
+		}
+		w.add(name, dat)
+	}
+}
+
+// html collects the images inlined into a page as data: URIs.
+func (w *mailWalker) html(page []byte) {
+	for _, m := range dataURIImage.FindAllSubmatch(page, -1) {
+		if w.full() {
+			return
+		}
+		enc := bytes.Join(bytes.Fields(m[1]), nil)
+		dat := make([]byte, base64.StdEncoding.DecodedLen(len(enc)))
+		n, err := base64.StdEncoding.Decode(dat, enc)
+		if err != nil {
+			w.errs = append(w.errs, fmt.Errorf("data: URI: %w", err))
+			continue
+		}
+		if dat = dat[:n]; sniffImageType(dat[:min(len(dat), sniffLen)]) != NULL {
+			w.add("", dat)
+		}
+	}
+}
+
+// ingestMail ingests every image in the mail export img as its own record.
+func (img *Image) ingestMail(start time.Time) {
+	w := &mailWalker{img: img}
+	r := io.NewSectionReader(img.f, 0, img.Size)
+	switch strings.ToLower(filepath.Ext(img.Path)) {
+	case ".html", ".htm":
+		page, err := io.ReadAll(io.LimitReader(r, maxMailText+1))
+		switch {
+		case err != nil:
+			w.errs = append(w.errs, err)
+		case len(page) > maxMailText:
+			w.errs = append(w.errs, fmt.Errorf("page is larger than %s", formatBytes(maxMailText)))
+		default:
+			w.html(page)
+		}
+	default:
+		w.message(r, 0)
+	}
+	if w.full() {
+		log.Warn().Str("caller", img.Name).Msgf("too many images, only ingesting the first %d", maxArchiveMembers)
+	}
+	if err := errors.Join(w.errs...); err != nil {
+		log.Warn().Err(err).Str("caller", img.Name).Msg("failed to read some parts of the export")
+	}
+	_ = img.f.Close()
+	if img.storeMembers(start, w.hashed, "mail export") {
+		log.Debug().Str("caller", img.Name).Int("images", w.found).Int("ingested", len(w.hashed)).
+			Msg("ingested mail export")
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"image"
@@ -10,8 +12,13 @@ import (
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,17 +31,21 @@ import (
 	"git.tcp.direct/tcp.direct/database/registry"
 	"github.com/bytedance/sonic"
 	"github.com/bytedance/sonic/encoder"
-	"github.com/corona10/goimagehash"
 	"github.com/panjf2000/ants/v2"
 	"github.com/rs/zerolog"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
 var (
-	DB         database.Keeper
-	log        zerolog.Logger
-	Collection []*Image
-	workers    *ants.Pool
-	bufs       = pool.NewBufferFactory()
+	DB           database.Keeper
+	log          zerolog.Logger
+	Collection   []*Image
+	collectionMu sync.Mutex
+	workers      *ants.Pool
+	bufs         = pool.NewBufferFactory()
+	readers      = sync.Pool{New: func() any { return bufio.NewReaderSize(nil, 64*1024) }}
 )
 
 type ImageType uint8
@@ -53,6 +64,12 @@ const (
 	JPEG
 	PNG
 	GIF
+	WEBP
+	TIFF
+	ICO
+	CUR
+	BMP
+	PDF
 )
 
 var imageTypeToString = map[ImageType]string{
@@ -60,6 +77,12 @@ var imageTypeToString = map[ImageType]string{
 	JPEG: "jpeg",
 	PNG:  "png",
 	GIF:  "gif",
+	WEBP: "webp",
+	TIFF: "tiff",
+	ICO:  "ico",
+	CUR:  "cur",
+	BMP:  "bmp",
+	PDF:  "pdf",
 }
 
 var stringToImageType = map[string]ImageType{
@@ -67,6 +90,12 @@ var stringToImageType = map[string]ImageType{
 	"jpeg": JPEG,
 	"png":  PNG,
 	"gif":  GIF,
+	"webp": WEBP,
+	"tiff": TIFF,
+	"ico":  ICO,
+	"cur":  CUR,
+	"bmp":  BMP,
+	"pdf":  PDF,
 }
 
 func parseImageType(s string) (ImageType, error) {
@@ -77,34 +106,90 @@ func parseImageType(s string) (ImageType, error) {
 	return NULL, ErrUnknownImageType
 }
 
+// Image is a file being ingested or the record of one, stored as a
+// storedImage.
 type Image struct {
-	Type    ImageType
-	Name    string
-	Path    string
-	ModTime time.Time
-	Size    int64
-	PHash   []byte
+	Type ImageType
+	// ClaimedType is what the file extension says, which downloads often get wrong.
+	ClaimedType ImageType
+	Name        string
+	Path        string
+	ModTime     time.Time
+	// Captured is the EXIF capture time, zero when the image doesn't carry one.
+	Captured time.Time
+	// Software is the EXIF Software tag, the program that last wrote the image.
+	Software string
+	// Exif tells that the image carries EXIF metadata, see hasExif.
+	Exif bool
+	// GPS is where the photo was taken according to EXIF, nil when unknown.
+	GPS      *gpsPosition
+	Size     int64
+	Width    int
+	Height   int
+	Ingested time.Time
+	Origin   Origin
+	PHash    []byte
+	// HashLayout is the layout PHash was computed under, see hashLayout.
+	HashLayout string
+	// Center is the hash of the center of the image, see -center-weight.
+	Center *centerHash
+	// Grayscale tells that the image has no color, see isGrayscale.
+	Grayscale bool
+	// Checksum is the SHA-256 of files that aren't images, indexed with
+	// -all-files. They have no PHash and only match identical files.
+	Checksum []byte
+
+	// Provisional records were hashed while the file was still changing, and
+	// are re-processed on the next scan instead of being trusted.
+	Provisional bool
+	// Unhashed records were taken by -stat-only scans, without a PHash.
+	Unhashed bool
+	// History holds the hashes the file had before it changed, newest last.
+	History []revision
+
+	// replaces tells that an out of date record of the file exists, and
+	// stored which records its re-ingest wrote.
+	replaces bool
+	stored   []string
+	// canonical tells that the record is from a canonical collection.
+	canonical bool
+	// archive tells that the file is a zip archive whose members are
+	// ingested instead, see -archives.
+	archive bool
+	// mail tells the same of a mail export and its images, see -mail.
+	mail bool
+	// content is the checksum of the file, if the decode cache took it, and
+	// reused tells that the image took the result of an identical one.
+	content *[sha256.Size]byte
+	reused  bool
 
 	fin       chan struct{}
 	closeOnce *sync.Once
 	b         *pool.Buffer
-	f         *os.File
+	f         *trackedFile
 	i         image.Image
+	span      *span
 }
 
 func init() {
-	log = zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, NoColor: false}).With().Timestamp().Logger()
+	// workers log concurrently, each event is written out whole.
+	log = zerolog.New(zerolog.ConsoleWriter{Out: zerolog.SyncWriter(os.Stdout), NoColor: false}).
+		With().Timestamp().Logger()
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	startDatastore()
-	startWorkerPool()
 }
 
-func startDatastore() {
-	home, err := os.UserHomeDir()
+// startDatastore opens the database of collection, or an empty one in memory,
+// returning the error of a database that exists but fails to open.
+func startDatastore(backend, collection string) error {
+	if backend == backendMemory {
+		DB = newMemKeeper()
+		return initStores()
+	}
+	dest, err := collectionPath(collection)
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed to determine home directory")
+		log.Fatal().Err(err).Send()
 	}
-	dest := filepath.Join(home, ".local/share/dupehunter/db")
+	datastorePath = dest
 	destStat, statErr := os.Stat(dest)
 	if errors.Is(statErr, os.ErrNotExist) {
 		if err = os.MkdirAll(dest, 0755); err != nil {
@@ -131,18 +216,31 @@ func startDatastore() {
 		}
 	}
 	if DB == nil {
-		log.Fatal().Err(err).Caller().Msg("failed to open database")
+		if err == nil {
+			err = errors.New("nil keeper")
+		}
+		return err
 	}
-	if //goland:noinspection GoNilness
-	err = DB.Init("images", &pogreb.WrappedOptions{AllowRecovery: true}); err != nil &&
-		!errors.Is(err, pogreb.ErrStoreExists) {
-		log.Panic().Caller().Msg(err.Error())
+	return initStores()
+}
+
+// storeNames are the stores every database is created with.
+var storeNames = []string{"images", "index", "distances", "failures", "tombstones", "pending", "checksums", "ignored", "audit", "embeddings"}
+
+func initStores() error {
+	for _, store := range storeNames {
+		if //goland:noinspection GoNilness
+		err := DB.Init(store, &pogreb.WrappedOptions{AllowRecovery: true}); err != nil &&
+			!errors.Is(err, pogreb.ErrStoreExists) {
+			return fmt.Errorf("store %s: %w", store, err)
+		}
 	}
+	return nil
 }
 
-func startWorkerPool() {
+func startWorkerPool(size int) {
 	var poolErr error
-	if workers, poolErr = ants.NewPool(25,
+	if workers, poolErr = ants.NewPool(size,
 		ants.WithPanicHandler(func(i interface{}) {
 			log.Error().Caller(1).Stack().Interface("panic", i).Msg("Worker panic!")
 		}),
@@ -150,6 +248,7 @@ func startWorkerPool() {
 	); poolErr != nil {
 		log.Fatal().Caller().Str("caller", "worker pool").Msg(poolErr.Error())
 	}
+	startLanes()
 }
 
 func NewImage(path string, finChan chan struct{}) (*Image, error) {
@@ -161,20 +260,39 @@ func NewImage(path string, finChan chan struct{}) (*Image, error) {
 	if finfo.IsDir() {
 		return nil, errors.New("target is a directory: " + path)
 	}
+	if kind := skipKind(path, finfo); kind != "" {
+		return nil, &skippedFileError{path: path, kind: kind}
+	}
+	if err = excludedFile(path); err != nil {
+		return nil, err
+	}
+	if !discovered.claim(path, finfo) {
+		return nil, &skippedFileError{path: path, kind: "repeated"}
+	}
+	if knownBad(path, finfo) {
+		return nil, &skippedFileError{path: path, kind: "known-bad"}
+	}
+	if window.active() && !window.byCaptured && !window.selects(&Image{ModTime: finfo.ModTime()}) {
+		// -time-by captured has to wait for the EXIF of the file.
+		return nil, &skippedFileError{path: path, kind: "outside-window"}
+	}
 	i := &Image{
-		Path:      path,
-		Name:      finfo.Name(),
-		Type:      NULL,
-		ModTime:   finfo.ModTime(),
-		Size:      finfo.Size(),
-		closeOnce: &sync.Once{},
-		b:         bufs.Get(),
-		fin:       finChan,
+		Path:        path,
+		Name:        finfo.Name(),
+		Type:        NULL,
+		ClaimedType: claimedImageType(path),
+		ModTime:     finfo.ModTime(),
+		Size:        finfo.Size(),
+		closeOnce:   &sync.Once{},
+		b:           bufs.Get(),
+		fin:         finChan,
 	}
 
-	if CheckExisting(i, DB.With("images")) {
-		return nil, errors.New("file already in database: " + i.Name)
+	if CheckExisting(i, imageStore) {
+		scanIO.unchanged.Add(1)
+		return nil, &skippedFileError{path: path, kind: "indexed"}
 	}
+	i.replaces = imageStore.Has([]byte(path)) || imageStore.Has([]byte(pagePath(path, 1)))
 
 	return i, nil
 }
@@ -184,7 +302,9 @@ var ErrAlreadyClosed = errors.New("image already closed")
 func (img *Image) Close() error {
 	closedTwice := ErrAlreadyClosed
 	img.closeOnce.Do(func() {
-		bufs.MustPut(img.b)
+		if img.b != nil {
+			bufs.MustPut(img.b)
+		}
 		close(img.fin)
 		closedTwice = nil
 	})
@@ -192,6 +312,17 @@ func (img *Image) Close() error {
 	return closedTwice
 }
 
+// release drops the decoded pixel data and returns the pooled buffer, leaving
+// only the metadata that gets persisted.
+func (img *Image) release() {
+	img.span.end()
+	img.i = nil
+	if img.b != nil {
+		bufs.MustPut(img.b)
+		img.b = nil
+	}
+}
+
 func (img *Image) Read(p []byte) (n int, err error) {
 	n = copy(p, img.PHash)
 	if n != len(img.PHash) {
@@ -201,10 +332,14 @@ func (img *Image) Read(p []byte) (n int, err error) {
 }
 
 func CheckExisting(img *Image, db database.Filer) (ok bool) {
-	if has := db.Has([]byte(img.Path)); !has {
-		return false
+	key := []byte(img.Path)
+	if !db.Has(key) {
+		// multi-page containers are only stored page by page.
+		if key = []byte(pagePath(img.Path, 1)); !db.Has(key) {
+			return false
+		}
 	}
-	existing, dbErr := db.Get([]byte(img.Path))
+	existing, dbErr := db.Get(key)
 	if dbErr != nil {
 		log.Error().Err(dbErr).Caller().Msg("database error")
 		return true
@@ -214,15 +349,21 @@ func CheckExisting(img *Image, db database.Filer) (ok bool) {
 		log.Error().Err(jErr).Caller().Msg("unmarshal error")
 		return true
 	}
-	if recall.ModTime == img.ModTime && recall.Size == img.Size {
+	if recall.Provisional || rehashing || (recall.Unhashed && !statOnly) {
+		return false
+	}
+	if centerWeight > 0 && len(recall.PHash) > 0 && !recall.hasCenter() {
+		return false
+	}
+	if recall.ModTime.Equal(img.ModTime) && recall.Size == img.Size {
 		return true
 	}
 	return false
 }
 
 func processFile(img *Image) (err error) {
-	var f *os.File
-	f, err = os.Open(img.Path)
+	var f *trackedFile
+	f, err = openTracked(img.Path)
 	if err != nil {
 		return err
 	}
@@ -250,122 +391,594 @@ func (img *Image) decodeImage() (err error) {
 			err = errors.Join(errs...)
 		}
 	}()
-	img.i, img.Type, err = decImg(img.f)
+	cr := &countingReader{r: img.f}
+	br := readers.Get().(*bufio.Reader)
+	br.Reset(cr)
+	defer func() {
+		br.Reset(nil)
+		readers.Put(br)
+	}()
+	if img.i, img.Type, err = decImg(br); err != nil {
+		if img.i, err = decodeJPEGFallback(img.f, err); err == nil {
+			img.Type = JPEG
+			return nil
+		}
+		return classifyDecodeError(img.f, cr.n, err)
+	}
+	if img.Type == GIF {
+		err = checkDecodedGIF(img.f)
+	}
 	return err
 }
 
-func ingestImage(img *Image) error {
-	if img == nil {
-		return errors.New("not an image")
-	}
-
-	phash, hashErr := goimagehash.DifferenceHash(img.i)
-	if hashErr != nil {
+// hashImage computes the perceptual hash of the decoded image, then drops the pixel data.
+func hashImage(img *Image) error {
+	_ = img.b.Reset()
+	if hashErr := hashing.dump(img.b, img.Path, img.i); hashErr != nil {
 		return hashErr
 	}
-	dumpErr := phash.Dump(img.b)
-	if dumpErr != nil {
-		return dumpErr
+	img.Width, img.Height, img.Grayscale = img.i.Bounds().Dx(), img.i.Bounds().Dy(), isGrayscale(img.i)
+	center, err := hashCenter(img.i)
+	if err != nil {
+		return err
 	}
-	img.PHash = make([]byte, img.b.Len())
+	img.i, img.Center = nil, center
+	img.PHash, img.HashLayout = make([]byte, img.b.Len()), hashLayout
 	n, rErr := img.b.Read(img.PHash)
 	if (n == 0 || n < img.b.Len()) && rErr == nil {
 		rErr = io.ErrShortWrite
 	}
-	if rErr != nil {
-		return rErr
+	return rErr
+}
+
+// revalidate re-stats the file after hashing and reports whether it changed
+// since it was first examined, adopting the new modification time and size.
+func (img *Image) revalidate() (changed bool, err error) {
+	finfo, err := os.Stat(img.Path)
+	if err != nil {
+		return false, err
+	}
+	changed = !finfo.ModTime().Equal(img.ModTime) || finfo.Size() != img.Size
+	img.ModTime, img.Size = finfo.ModTime(), finfo.Size()
+	return changed, nil
+}
+
+func ingestImage(img *Image) error {
+	if img == nil {
+		return errors.New("not an image")
+	}
+
+	prev, prevDat := recallRecord(img.Path)
+	img.History = nil
+	switch {
+	case prev != nil && prev.Unhashed:
+		// there was no hash to keep, and the file was found where it was recorded.
+		img.History, img.Origin = prev.History, prev.Origin
+	case prev != nil:
+		img.History = prev.revisions()
 	}
 	_ = img.b.Reset()
+	img.Ingested = time.Now()
 	if err := encoder.NewStreamEncoder(img.b).Encode(&img); err != nil {
 		return fmt.Errorf("json encoder: %w", err)
 	}
 
-	if err := DB.With("images").
-		Put([]byte(img.Path), bytes.TrimSuffix(img.b.Bytes(), []byte("\n"))); err != nil {
+	if err := imageStore.Put([]byte(img.Path), bytes.TrimSuffix(img.b.Bytes(), []byte("\n"))); err != nil {
+		diskFull.check(img.Path, err, false)
 		return err
 	}
+	if prev != nil {
+		audit("update", img.Path, "")
+	} else {
+		audit("ingest", img.Path, "")
+	}
 
-	log.Info().Str("caller", img.Name).RawJSON("data", img.b.Bytes()).Msg("done!")
-
-	return nil
-}
+	ingestedTypes.note(img.Type)
+	if len(img.PHash) == 0 && (prev == nil || len(prev.PHash) == 0) {
+		diskFull.noteStored()
+		progressLog().Info().Str("caller", img.Name).RawJSON("data", img.b.Bytes()).Msg("done!")
+		return nil
+	}
 
-func (img *Image) FinalProcessing() {
-	err := img.decodeImage()
+	idx, err := getIndex()
 	if err != nil {
-		log.Warn().Caller().Err(err).Str("caller", img.Name).Msg("failed to ingest")
-		img.fin <- struct{}{}
-		return
+		rollback(idx, img.Path, prev, prevDat)
+		return fmt.Errorf("similarity index: %w", err)
 	}
-	if img.Type == NULL {
-		log.Trace().Caller().Str("caller", img.Name).Msg("skipping null imagetype")
-		img.fin <- struct{}{}
-		return
+	if len(img.PHash) == 0 {
+		// the file isn't an image anymore, its old hash must not match.
+		if err = idx.remove(img.Path); err != nil {
+			rollback(idx, img.Path, prev, prevDat)
+			return fmt.Errorf("similarity index: %w", err)
+		}
+		diskFull.noteStored()
+		progressLog().Info().Str("caller", img.Name).RawJSON("data", img.b.Bytes()).Msg("done!")
+		return nil
 	}
-	err = ingestImage(img)
+	h, err := imageHash(img)
 	if err != nil {
-		log.Debug().Caller().Str("caller", img.Name).Msg("failed to ingest: " + err.Error())
-		img.fin <- struct{}{}
-		return
+		rollback(idx, img.Path, prev, prevDat)
+		return err
 	}
-	Collection = append(Collection, img)
-	img.fin <- struct{}{}
+	if err = idx.insert(img.Path, h); err != nil {
+		diskFull.check(img.Path, err, true)
+		rollback(idx, img.Path, prev, prevDat)
+		return fmt.Errorf("similarity index: %w", err)
+	}
+	diskFull.noteStored()
+	if rootConfig != nil && rootConfig.alertNow {
+		alertMatches(idx, img, h)
+	}
+
+	progressLog().Info().Str("caller", img.Name).RawJSON("data", img.b.Bytes()).Msg("done!")
+
+	return nil
 }
 
-func process(filePath string, finChan chan struct{}) {
-	log.Debug().Msgf("processing: %s", filePath)
-	img, err := NewImage(filePath, finChan)
-	if err != nil {
-		log.Warn().Caller().Str("caller", filePath).Msg(err.Error())
+func process(ctx context.Context, filePath string, finChan chan struct{}, origin Origin) {
+	if ctx.Err() != nil {
 		finChan <- struct{}{}
 		return
 	}
-	err = processFile(img)
+	progressLog().Debug().Msgf("processing: %s", filePath)
+	sp := tracing.start(nil, "file")
+	sp.set("file.path", filePath)
+	var (
+		img *Image
+		err error
+	)
+	tracing.trace(sp, "discover", func() { img, err = NewImage(filePath, finChan) })
 	if err != nil {
-		log.Warn().Caller().Str("caller", filePath).Msg(err.Error())
+		if !problems.note(filePath, err) {
+			log.Warn().Caller().Str("caller", filePath).Msg(err.Error())
+		}
+		if !statOnly {
+			dequeueHash(filePath)
+		}
+		sp.fail(err)
+		sp.end()
 		finChan <- struct{}{}
 		return
 	}
-	err = workers.Submit(img.FinalProcessing)
-	if err != nil {
-		log.Fatal().Msg(err.Error())
+	img.Origin = origin
+	img.span = sp
+	if !limits.admit() {
+		img.release()
+		finChan <- struct{}{}
+		return
 	}
+	lanes.submit(func() {
+		// images still waiting for a worker are dropped once the scan is canceled.
+		if ctx.Err() != nil {
+			img.release()
+			completed.Add(1)
+			finChan <- struct{}{}
+			return
+		}
+		img.FinalProcessing()
+	}, false)
 }
 
-func processArgs(args []string) {
-	var processed = 0
-	var finChan = make(chan struct{})
-	for i, arg := range args {
-		if i == 0 {
-			continue
+// maxPendingPaths bounds the paths taken from a source ahead of the workers,
+// so memory stays flat however many paths there are.
+const maxPendingPaths = 4096
+
+// pathSource yields the paths of a scan one at a time, false once it is done.
+type pathSource func() (string, bool)
+
+func slicePaths(paths []string) pathSource {
+	var i int
+	return func() (string, bool) {
+		if i == len(paths) {
+			return "", false
+		}
+		i++
+		return paths[i-1], true
+	}
+}
+
+// stdinPaths streams the lines of stdin as paths, as they arrive.
+func stdinPaths() pathSource {
+	scanner := bufio.NewScanner(os.Stdin)
+	return func() (string, bool) {
+		if scanner.Scan() {
+			return scanner.Text(), true
 		}
-		go process(arg, finChan)
+		if err := scanner.Err(); err != nil {
+			log.Error().Err(err).Msg("failed to read paths from stdin")
+		}
+		return "", false
+	}
+}
+
+// drainPaths reads every path of next.
+func drainPaths(next pathSource) []string {
+	paths := make([]string, 0)
+	for p, ok := next(); ok; p, ok = next() {
+		paths = append(paths, p)
 	}
-mainLoop:
-	for {
-		select {
-		case <-finChan:
+	return paths
+}
+
+// processPaths processes the paths of next, keeping at most maxPendingPaths
+// of them between the source and the end of processing.
+func processPaths(ctx context.Context, next pathSource, origin Origin) {
+	var (
+		// never blocks, there are no more than maxPendingPaths in flight.
+		finChan            = make(chan struct{}, maxPendingPaths)
+		started, processed int
+	)
+	discovered.reset()
+	for ctx.Err() == nil && !limits.exhausted() {
+		if started-processed == maxPendingPaths {
+			<-finChan
 			processed++
-		default:
-			if processed >= len(args)-1 {
-				if processed > 0 {
-					log.Info().Int("processed", processed).Msg("finished")
+			progress.advance()
+			continue
+		}
+		p, ok := next()
+		if !ok {
+			break
+		}
+		go process(ctx, p, finChan, origin)
+		started++
+	}
+	for ; processed < started; processed++ {
+		<-finChan
+		progress.advance()
+	}
+	if processed > 0 {
+		log.Info().Int("processed", processed).Msg("finished")
+	}
+	_ = DB.SyncAll()
+}
+
+// findPairs loads every record and queries the similarity index for the pairs
+// within the distance threshold, each reported once in path order.
+func findPairs(cfg *config) (*pairSet, map[string]*Image, error) {
+	hashes, records, err := loadRecords(imageStore)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = checkHashLayouts(records); err != nil {
+		return nil, nil, err
+	}
+	if isCanonical(cfg.collection) {
+		markCanonical(records)
+	}
+	if window.active() {
+		hashes = window.scope(hashes, records)
+	}
+	// -under queries only the records of a subtree, matching them against the
+	// rest of the index too with -against-all.
+	queried := hashes
+	if cfg.under != "" {
+		queried = scopeUnder(maps.Clone(hashes), nil, cfg.under)
+		if !cfg.againstAll {
+			hashes = scopeUnder(hashes, records, cfg.under)
+		}
+	}
+
+	var (
+		idx       similarityIndex
+		cache     *distanceCache
+		radius    = cfg.searchRadius()
+		pairs     = newPairSet(cfg.spillPairs)
+		filePairs []dupePair
+		indexed   = hashes
+		// the approximate index may find a pair from one end only, so what it
+		// found is remembered rather than left to path order.
+		pairsFound map[[2]string]struct{}
+	)
+	// so may a check out of time, which leaves hashes unqueried, and a
+	// comparison, whose index holds the other collection rather than the
+	// paths queried, which a path in both collections may be either end of.
+	if cfg.index == "hnsw" || cfg.compare || budget.active() {
+		pairsFound = make(map[[2]string]struct{})
+	}
+	// the pairs of two canonical images are dropped.
+	add := func(p dupePair) {
+		if !records[p.a].canonical || !records[p.b].canonical {
+			pairs.add(p)
+		}
+	}
+
+	// the approximate index must not leak its misses into the exact cache,
+	// and the cache only knows neighbors within the whole collection and
+	// their distances over 64 bits.
+	queryRadius, extended := radius, extendedLayout(hashLayout)
+	if cfg.distanceCache && cfg.index != "hnsw" && !cfg.compare && !extended && cfg.under == "" && !window.active() &&
+		!budget.active() {
+		queryRadius = max(radius, distanceCacheRadius)
+		if cache, err = loadDistanceCache(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	switch {
+	case cfg.compare:
+		// only the other collection is indexed, so every match crosses over.
+		other, otherRecords, err := loadCollection(cfg.against)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = checkHashLayouts(otherRecords); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", collectionLabel(cfg.against), err)
+		}
+		if isCanonical(cfg.against) || cfg.ephemeral {
+			markCanonical(otherRecords)
+		}
+		if cfg.under != "" && !cfg.againstAll {
+			other = scopeUnder(other, otherRecords, cfg.under)
+		}
+		if window.active() {
+			other = window.scope(other, otherRecords)
+		}
+		filePairs = checksumPairs(records, otherRecords)
+		for p, r := range otherRecords {
+			if records[p] == nil {
+				records[p] = r
+			}
+		}
+		idx, indexed = buildBuckets(other, queryRadius), other
+	case cfg.index == "hnsw":
+		log.Warn().Int("ef", cfg.hnswEf).
+			Msg("hnsw index is approximate, some duplicates may be missed; raise -hnsw-ef for better recall")
+		idx = buildHNSW(hashes, cfg.hnswEf)
+	case cfg.index == "buckets":
+		idx = buildBuckets(hashes, queryRadius)
+	case budget.active():
+		// prioritize weighs hashes by the buckets they share.
+		idx = buildBuckets(hashes, queryRadius)
+	default:
+		bk, err := getIndex()
+		if err != nil {
+			return nil, nil, fmt.Errorf("similarity index: %w", err)
+		}
+		idx = bk
+	}
+	if !cfg.compare {
+		filePairs = checksumPairs(records, nil)
+	}
+	if cfg.under != "" {
+		filePairs = slices.DeleteFunc(filePairs, func(p dupePair) bool {
+			return !withinDir(p.a, cfg.under) && !withinDir(p.b, cfg.under)
+		})
+	}
+
+	paths := make([]string, 0, len(queried))
+	for k := range queried {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+
+	// records sharing a hash share their neighbors, so only the first path of
+	// every hash is queried, for all of them.
+	var (
+		unique = make([]string, 0, len(paths))
+		first  = make(map[uint64]int, len(paths))
+		resOf  = make([]int, len(paths))
+	)
+	for i, k := range paths {
+		r, ok := first[queried[k]]
+		if !ok {
+			r = len(unique)
+			first[queried[k]] = r
+			unique = append(unique, k)
+		}
+		resOf[i] = r
+	}
+	if budget.active() {
+		buckets, _ := idx.(*bucketIndex)
+		prioritize(unique, hashes, buckets)
+		for r, k := range unique {
+			first[queried[k]] = r
+		}
+		for i, k := range paths {
+			resOf[i] = first[queried[k]]
+		}
+	}
+	log.Debug().Int("records", len(paths)).Int("hashes", len(unique)).Msg("querying the distinct hashes")
+
+	progress.begin(phaseCheck, len(unique))
+	defer progress.end()
+	results := queryShards(unique, cfg.shards, func(k string) ([]indexMatch, bool) {
+		if budget.spent() {
+			return nil, false
+		}
+		if cache != nil {
+			if matches, cached := cache.lookup(k, hashes[k], radius, hashes); cached {
+				return matches, true
+			}
+		}
+		// first words can't be further apart than 64 bits, extended hashes can.
+		return idx.query(hashes[k], min(queryRadius, 64)), false
+	})
+	for i, k := range paths {
+		r := resOf[i]
+		matches := results[r].matches
+		if cache != nil && unique[r] == k {
+			if results[r].cached {
+				cache.hits++
+			} else {
+				cache.misses++
+				cache.update(k, hashes[k], queryRadius, matches, hashes)
+			}
+		}
+		for _, match := range matches {
+			l, distance := match.path, match.distance
+			if l == k || records[l] == nil {
+				continue
+			}
+			if extended {
+				// the index only measured the first words.
+				if distance, err = recordDistance(records[k], records[l]); err != nil {
+					continue
 				}
-				break mainLoop
 			}
-			time.Sleep(10 * time.Millisecond)
+			if distance >= cfg.pairThreshold(records[k], records[l]) {
+				continue
+			}
+			// pairs are found from both ends, report each once in path order.
+			key := [2]string{min(k, l), max(k, l)}
+			if pairsFound == nil {
+				if _, both := queried[l]; both && l < k {
+					continue
+				}
+			} else if _, seen := pairsFound[key]; seen {
+				continue
+			} else {
+				pairsFound[key] = struct{}{}
+			}
+			hotLog().Trace().Msgf("%s vs %s: %d", key[0], key[1], distance)
+			if cfg.ignoreZero && distance == 0 {
+				continue
+			}
+			add(dupePair{a: key[0], b: key[1], distance: distance})
 		}
 	}
-	_ = DB.SyncAll()
+	budget.end(len(unique))
+	if centerWeight > 0 && !budget.exhausted() {
+		for _, pair := range centerPairs(cfg, paths, indexed, records, idx, min(radius, 64)) {
+			add(pair)
+		}
+	}
+
+	// files that aren't images only match identical ones.
+	for _, pair := range filePairs {
+		if !cfg.ignoreZero {
+			add(pair)
+		}
+	}
+
+	if cache != nil {
+		if err := cache.flush(hashes); err != nil {
+			pairs.close()
+			return nil, nil, fmt.Errorf("distance cache: %w", err)
+		}
+	}
+	pairs.queried, pairs.indexed = queried, indexed
+	return pairs, records, nil
+}
+
+// ingestPaths decodes, hashes and stores the images at paths, then reports
+// the slowest and problematic files.
+func ingestPaths(ctx context.Context, cfg *config, paths []string, origin Origin) error {
+	return ingestStream(ctx, cfg, slicePaths(paths), len(paths), origin)
 }
 
-func checkAll(cfg *config) error {
+// ingestStream is ingestPaths for the paths of next, total of them if known
+// in advance or 0. Paths are taken from next as workers free up, except with
+// the exact prefilter, which needs all of them at hand.
+func ingestStream(ctx context.Context, cfg *config, next pathSource, total int, origin Origin) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	diskFull.begin(cancel)
+	limits.begin(cancel, cfg.maxFiles, cfg.maxDuration)
+	ingestedTypes.reset()
+	scanIO.reset()
+	hashCollisions.Store(0)
+	decodes.reset()
+	sp := tracing.startBatch("ingest")
+	defer sp.end()
+
 	var (
-		images     = make(map[string]*goimagehash.ImageHash)
-		dupesFound = make(map[string]struct{})
+		copies  map[string][]string
+		pending = total
 	)
+	if cfg.exactPrefilter || cfg.renameFilter {
+		paths := drainPaths(next)
+		total = len(paths)
+		paths, copies = exactPrefilter(paths, !cfg.exactPrefilter)
+		next, pending = slicePaths(paths), len(paths)
+	}
+	var read int
+	counted := func() (string, bool) {
+		p, ok := next()
+		if ok {
+			read++
+		}
+		return p, ok
+	}
+	progress.begin(phaseIngest, pending)
+	defer progress.end()
+	if cfg.isolateDecode && sandbox == nil {
+		var err error
+		if sandbox, err = newDecodeSandbox(cfg.isolateMemory, cfg.isolateLimit); err != nil {
+			return err
+		}
+	}
+	var t *tuner
+	if cfg.autoWorkers {
+		checkFileLimit(cfg.maxWorkers)
+		t = newTuner(workers, cfg.maxWorkers)
+		t.start()
+	} else {
+		checkFileLimit(cfg.workers)
+	}
+	var idx *bkTree
+	if bulkMode {
+		var err error
+		if idx, err = getIndex(); err == nil {
+			err = idx.batchWrites()
+		}
+		if err != nil {
+			return fmt.Errorf("similarity index: %w", err)
+		}
+		defer reportBulkProgress()()
+	}
+	processPaths(ctx, counted, origin)
+	if copies != nil && ctx.Err() == nil {
+		if leftover := copyExactRecords(copies, origin); len(leftover) > 0 {
+			processPaths(ctx, slicePaths(leftover), origin)
+		}
+	}
+	if idx != nil {
+		if err := idx.endBatch(); err != nil {
+			diskFull.check("similarity index", err, true)
+			log.Error().Err(err).Msg("failed to write the similarity index, run dupehunter db reindex")
+		}
+	}
+	if total == 0 {
+		total = read
+	}
+	limits.end()
+	if t != nil {
+		t.close()
+	}
+	timings.summarize()
+	ingestedTypes.summarize()
+	scanIO.summarize()
+	decodes.summarize()
+	offlineFiles.summarize()
+	if err := problems.summarize(cfg.deniedList, cfg.truncatedList); err != nil {
+		log.Error().Err(err).Msg("failed to write problem list")
+	}
+	expireTombstones()
+	sp.set("ingest.files", strconv.Itoa(total))
+	err := diskFull.end(total)
+	sp.fail(err)
+	return err
+}
+
+// checkSummary counts what a check found.
+type checkSummary struct {
+	records, pairs, groups, shown, collapsed, edits int
+	// duplicates are the members of the groups shown besides their keepers.
+	duplicates int
+	// reclaimable and reclaimableActual are the bytes removing the
+	// duplicates shown, other than the edits, frees by their sizes and on disk.
+	reclaimable, reclaimableActual int64
+	// partial is set when --time-budget ran out before every hash was queried.
+	partial bool
+}
 
+func checkAll(cfg *config) (checkSummary, error) {
+	var sum checkSummary
 	if cfg.outFile != "" {
+		if err := pruneResults(filepath.Dir(cfg.outFile), cfg.keepResults); err != nil {
+			log.Warn().Err(err).Msg("failed to apply -keep-results")
+		}
 		st, sterr := os.Stat(cfg.outFile)
 		if sterr == nil || !errors.Is(sterr, os.ErrNotExist) {
 			abs, _ := filepath.Abs(cfg.outFile)
@@ -377,7 +990,7 @@ func checkAll(cfg *config) error {
 				Str("path_abs", abs).
 				Interface("stat", st).
 				Err(sterr).Send()
-			return sterr // unreachable
+			return sum, sterr // unreachable
 		}
 
 		var err error
@@ -386,118 +999,1084 @@ func checkAll(cfg *config) error {
 		}
 	}
 
-	for _, k := range DB.With("images").Keys() {
-		dat, err := DB.With("images").Get(k)
-		if err != nil {
-			log.Fatal().Err(err).Send()
-		}
-		log.Trace().Msgf("%s: %s", string(k), string(dat))
-		i := &Image{}
-		if err = sonic.Unmarshal(dat, i); err != nil {
-			return fmt.Errorf("json deserialize fail: %w", err)
+	sp := tracing.startBatch("check")
+	defer sp.end()
+	match := tracing.start(sp, "match")
+	pairs, records, err := findPairs(cfg)
+	match.set("match.records", strconv.Itoa(len(records)))
+	match.set("match.pairs", strconv.Itoa(pairs.len()))
+	match.fail(err)
+	match.end()
+	if err != nil {
+		sp.fail(err)
+		return sum, err
+	}
+	defer pairs.close()
+	sidecars.reset()
+
+	groups := groupPairs(pairs, records, cfg.keepOrder)
+	shown := selectGroups(groups, cfg.minGroupSize, cfg.groupOffset, cfg.maxGroups)
+	if cfg.f != nil && budget.exhausted() {
+		if _, err := fmt.Fprintln(cfg.f, "# partial results, the time budget ran out before every image was compared"); err != nil {
+			log.Fatal().Err(err).Msg("failed to write to log file")
 		}
-		dhash, err := goimagehash.LoadImageHash(i)
-		if err != nil {
-			return fmt.Errorf("failed to load image hash for %s: %w", i.Path, err)
+	}
+
+	var dirMatches []dirMatch
+	if cfg.dirSimilarity > 0 {
+		sizes := dirSizes(records)
+		dirMatches = findDirMatches(pairs, sizes, cfg.dirSimilarity)
+		if cfg.collapseDirs {
+			dirMatches = collapseDirMatches(dirMatches, sizes)
 		}
-		images[i.Path] = dhash
 	}
 
-	for k, v := range images {
-		for l, b := range images {
-			if l == k {
-				continue
+	var (
+		collapsed int
+		logPaths  pathQuoter
+	)
+	// pairs are only reported for the groups that made the selection, group by group.
+	pairs.eachGroupPairs(shown, groupsOf(shown), func(_ *dupeGroup, groupPairs []dupePair) {
+		sortPairs(groupPairs)
+		for _, pair := range groupPairs {
+			if cfg.collapseDirs && pairWithinDirMatch(pair, dirMatches) {
+				collapsed++
+			} else {
+				ev := log.Info().Int("distance", pair.distance).
+					Str("relation", relation(records[pair.a], records[pair.b]))
+				if from := records[pair.a].Origin.String(); from != "" {
+					ev = ev.Str("from_a", from)
+				}
+				if from := records[pair.b].Origin.String(); from != "" {
+					ev = ev.Str("from_b", from)
+				}
+				if stripped := strippedCopy(records[pair.a], records[pair.b]); stripped != nil {
+					ev = ev.Str("exif_stripped", displayPath(stripped.Path))
+				}
+				if gray := grayscaleCopy(records[pair.a], records[pair.b]); gray != nil {
+					ev = ev.Str("grayscale", displayPath(gray.Path))
+				}
+				ev.Msgf("duplicate found: %s and %s", displayPath(pair.a), displayPath(pair.b))
 			}
-			if _, ok := dupesFound[l]; ok {
-				continue
+			if cfg.f != nil {
+				if _, err := fmt.Fprintf(cfg.f, "%s\t%s\n", logPaths.path(pair.a), logPaths.path(pair.b)); err != nil {
+					log.Fatal().Err(err).Msg("failed to write to log file")
+				}
 			}
-			distance, err := v.Distance(b)
-			if err != nil {
-				return fmt.Errorf("failed to calculate distance between %s and %s: %w", k, l, err)
+		}
+	})
+
+	reportDirMatches(dirMatches)
+
+	var archives []archiveVerdict
+	if archiveImages {
+		archives = duplicatedArchives(pairs, records)
+		reportArchives(archives)
+	}
+
+	var (
+		scenes     []scenePair
+		watermarks []watermarkPair
+	)
+	if embedder != nil {
+		scenes = findSimilarScenes(records, groups, cfg.sceneDistance)
+		reportSimilarScenes(scenes, cfg.sceneDistance)
+	}
+	if cfg.watermarkMargin > 0 {
+		watermarks = findWatermarkVariants(cfg, pairs, records, groups, cfg.watermarkMargin)
+		reportWatermarkVariants(watermarks)
+	}
+	if cfg.f != nil {
+		// commented out, so that the file still lists only duplicates.
+		for _, pair := range watermarks {
+			if _, err := fmt.Fprintf(cfg.f, "# watermark variant\t%s\t%s\n", logPaths.path(pair.a), logPaths.path(pair.b)); err != nil {
+				log.Fatal().Err(err).Msg("failed to write to log file")
 			}
-			log.Trace().Msgf("%s vs %s: %d", k, l, distance)
-			if distance < cfg.maxDistance && !(cfg.ignoreZero && distance == 0) {
-				log.Info().Int("distance", distance).Msgf("duplicate found: %s and %s", k, l)
-				if cfg.f != nil {
-					if _, err = fmt.Fprintf(cfg.f, "%s\t%s\n", k, l); err != nil {
-						log.Fatal().Err(err).Msg("failed to write to log file")
-					}
-				}
-				dupesFound[k] = struct{}{}
-				dupesFound[l] = struct{}{}
+		}
+		for _, pair := range scenes {
+			if _, err := fmt.Fprintf(cfg.f, "# similar scene\t%s\t%s\n", logPaths.path(pair.a), logPaths.path(pair.b)); err != nil {
+				log.Fatal().Err(err).Msg("failed to write to log file")
 			}
 		}
 	}
+	logPaths.warn("results file")
 
-	return nil
-}
+	if cfg.treemap != "" {
+		if err := writeTreemap(cfg.treemap, shown); err != nil {
+			return sum, fmt.Errorf("failed to write treemap: %w", err)
+		}
+		log.Info().Str("path", cfg.treemap).Msg("treemap written")
+	}
+	if cfg.sidecars {
+		n, err := writeSidecars(shown)
+		if err != nil {
+			return sum, err
+		}
+		log.Info().Int("directories", n).Msg("keeper decisions written to sidecars")
+	}
+	if cfg.dedupeReport != "" {
+		sets, err := writeDedupeReport(cfg.dedupeReport, shown)
+		if err != nil {
+			return sum, fmt.Errorf("failed to write dedupe report: %w", err)
+		}
+		log.Info().Str("path", cfg.dedupeReport).Int("sets", sets).Msg("dedupe report written")
+	}
 
-func processStdin() []string {
-	var args = make([]string, 0)
-	bufIn := bufio.NewScanner(os.Stdin)
-	for bufIn.Scan() {
-		args = append(args, bufIn.Text())
+	sum = checkSummary{records: len(records), pairs: pairs.len(), groups: len(groups), shown: len(shown),
+		collapsed: collapsed, partial: budget.exhausted()}
+	for _, g := range shown {
+		sum.edits += len(g.edits())
+		sum.duplicates += len(g.duplicates())
+	}
+	sum.reclaimable, sum.reclaimableActual = reclaimable(shown)
+	log.Info().Int("groups", len(groups)).Int("shown", len(shown)).Int("pairs", pairs.len()).
+		Int("collapsed", collapsed).Int("edits", sum.edits).
+		Int64("reclaimable", sum.reclaimable).Int64("reclaimable_actual", sum.reclaimableActual).
+		Bool("approximate", cfg.index == "hnsw" && !cfg.compare).Bool("partial", sum.partial).
+		Msg("check finished")
+	if cfg.simulate {
+		reportPolicySimulations(simulatePolicies(shown), shown)
 	}
-	return args
+
+	if cfg.action != actionNone {
+		c := &cleaner{action: cfg.action, quarantine: cfg.quarantine, preserveTimes: cfg.preserveTimes,
+			dryRun: cfg.dryRun, undoPath: cfg.undoLog, snapshot: cfg.snapshot, vouched: cfg.haveSnapshot,
+			nearDupes: cfg.nearDupes}
+		if err := c.clean(context.Background(), shown); err != nil {
+			return sum, err
+		}
+	}
+
+	switch {
+	case cfg.print0:
+		return sum, writePrint0(os.Stdout, shown)
+	case cfg.renames:
+		return sum, writeRenames(os.Stdout, shown)
+	case cfg.output != "":
+		if err := writeReportTo(cfg.reportFile, cfg.output, shown, reportExtras{conversions: cfg.conversions, archives: archives,
+			partial: sum.partial, budgeted: budget.bounded(), places: cfg.places, watermarks: watermarks,
+			scenes: scenes}); err != nil {
+			return sum, fmt.Errorf("failed to write report: %w", err)
+		}
+	}
+
+	return sum, pairs.failed()
 }
 
 type config struct {
-	maxDistance int
-	ignoreZero  bool
-	outFile     string
-	f           *os.File
+	maxDistance   int
+	adaptive      bool
+	spillPairs    int
+	thresholdFile string
+	thresholds    thresholdRules
+	ignoreZero    bool
+	print0        bool
+	renames       bool
+	conversions   bool
+	places        bool
+	output        string
+	reportFile    string
+	dirSimilarity float64
+	collapseDirs  bool
+	treemap       string
+	dedupeReport  string
+	sidecars      bool
+	alertNow      bool
+	watch         bool
+	watchSettle   time.Duration
+	alertEvents   *os.File
+	action        string
+	quarantine    string
+	dryRun        bool
+	undoLog       string
+	preserveTimes bool
+	snapshot      bool
+	haveSnapshot  bool
+	nearDupes     bool
+	deniedList    string
+	truncatedList string
+	minGroupSize  int
+	keepMatch     string
+	keep          string
+	keepOrder     keepOrder
+	// simulate reports what clean would do under every keep policy.
+	simulate      bool
+	maxGroups     int
+	groupOffset   int
+	index         string
+	distanceCache bool
+	hnswEf        int
+	shards        int
+	workers       int
+	autoWorkers   bool
+	maxWorkers    int
+	isolateDecode bool
+	isolateMemory int
+	readLimit     int
+	exifLimit     int
+	decodeLimit   int
+	hashLimit     int
+	persistLimit  int
+	isolateLimit  time.Duration
+	pluginLimit   time.Duration
+	maxFiles      int
+	maxDuration   time.Duration
+	source        string
+	backend       string
+	noStore       bool
+	ephemeral     bool
+	sample        sampleRate
+	sceneDistance float64
+	centerWeight  centerShare
+	// watermarkMargin is how far beyond their threshold near misses are
+	// compared again with the watermark zones masked, 0 not to.
+	watermarkMargin int
+	exactPrefilter  bool
+	renameFilter    bool // the exact prefilter for renamed copies only
+	collection      string
+	against         string // with compare, "" is the main index
+	compare         bool
+	under           string // with check, the subtree checked
+	againstAll      bool   // with under, match the subtree against the whole index
+	manifest        string
+	summary         *os.File
+	outFile         string
+	keepResults     resultsRetention
+	f               *os.File
+}
+
+// rootConfig holds the validated root flags once main has parsed them.
+var rootConfig *config
+
+var rootCommands = []command{
+	{"audit", "list the changes made to the index and the files in it", runAudit},
+	{"check", "report duplicates without ingesting, optionally against another collection", runCheck},
+	{"db", "inspect and maintain the image index", runDB},
+	{"doctor", "check the database, disk, decoders, and settings, printing a report for bug reports", runDoctor},
+	{"evaluate", "compare hash algorithms on labeled image pairs", runEvaluate},
+	{"gen-testdata", "write a labeled corpus of originals and edited copies for evaluate", runGenTestdata},
+	{"hash-pending", "hash the files queued by -hash-later scans", runHashPending},
+	{"query", "list the indexed images closest to an image", runQuery},
+	{"quarantine", "purge duplicates moved aside by -action move", runQuarantine},
+	{"results", "list and remove the pair results of past check runs", runResults},
+	{"roots", "register directories under names to scan them with -root", runRoots},
+	{"serve", "serve an authenticated HTTP API for listing, ingesting, and cleaning", runServe},
+	{"undo", "walk back the clean actions recorded in an undo log", runUndo},
+}
+
+// fail logs err unless it is a usage error (which has already been reported) and exits.
+func fail(err error) {
+	code := exitCode(err)
+	if code == 1 {
+		log.Error().Err(err).Send()
+	}
+	os.Exit(code)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == sandboxCommand {
+		os.Exit(runSandboxedDecode(os.Args[2:]))
+	}
+
 	var cfg = &config{
-		maxDistance: 12,
-		ignoreZero:  false,
-		outFile:     "dupehunter_" + strconv.Itoa(int(time.Now().UnixMilli())) + ".log",
+		maxDistance:   12,
+		sceneDistance: 0.1,
+		spillPairs:    1_000_000,
+		minGroupSize:  2,
+		ignoreZero:    false,
+		index:         "bktree",
+		distanceCache: true,
+		hnswEf:        defaultHNSWEf,
+		shards:        runtime.NumCPU(),
+		workers:       25,
+		maxWorkers:    256,
+		decodeLimit:   runtime.NumCPU(),
+		hashLimit:     runtime.NumCPU(),
+		persistLimit:  1, // the database serializes writes anyway.
+		isolateMemory: 1024,
+		isolateLimit:  30 * time.Second,
+		pluginLimit:   time.Minute,
+		watchSettle:   2 * time.Second,
+		action:        actionNone,
+		preserveTimes: true,
+		backend:       backendPogreb,
+		outFile:       resultsPath(time.Now()),
 	}
 
-	var (
-		osArgs = make([]string, 0, len(os.Args))
-		skOne  = make(chan struct{}, 1)
-	)
+	fs := newFlagSet("", "[flags] [<file>... | -]\n       dupehunter [flags] <command> [flags]",
+		"Ingest the given images into the index, then report near-duplicates across the whole index.\n"+
+			"With - as the only argument, paths are read from stdin, one per line. Quoted globs like\n"+
+			"'~/Pictures/**/*.jpg' are expanded by dupehunter, ** matching any number of directories.")
+	fs.IntVar(&cfg.maxDistance, "d", cfg.maxDistance,
+		"report pairs whose hamming `distance` is below this value (1 to the bits of -hash, 64 by default)")
+	hashName := fs.String("hash", hashing.String(), "hash images with this `algorithm`: ahash, dhash, or phash, "+
+		"64 bits each, or their extended variant with dimensions, e.g. phash:16x16 for 256 bits; records "+
+		"hashed otherwise are only compared once db rehash --stale-layout brings them over")
+	embedPluginCmd := fs.String("embed-plugin", "", "also match images by the vectors `command` embeds "+
+		"them into, split at spaces, reporting similar scenes besides duplicates, see embed.go")
+	fs.Float64Var(&cfg.sceneDistance, "scene-distance", cfg.sceneDistance,
+		"report similar scenes whose vectors are below this cosine `distance` apart, from 0 to 2")
+	fs.Var(&cfg.centerWeight, "center-weight", "also hash the central `share` of each side of every image, "+
+		"e.g. 80%, matching copies that only differ by borders, watermarks, or chrome around the edges")
+	fs.IntVar(&cfg.watermarkMargin, "watermark-margin", cfg.watermarkMargin, "compare pairs up to `bits` "+
+		"beyond their threshold again with the bottom strip and top corners masked, reporting those that "+
+		"match as probable watermark variants")
+	hashPluginCmd := fs.String("hash-plugin", "", "hash images by running `command`, split at spaces, "+
+		"instead of -hash, talking to it over stdin and stdout as described in plugin.go")
+	fs.DurationVar(&cfg.pluginLimit, "plugin-timeout", cfg.pluginLimit, "time -hash-plugin and -embed-plugin "+
+		"may take to answer each request before they are restarted")
+	fs.StringVar(&cfg.thresholdFile, "thresholds", cfg.thresholdFile,
+		"read per-directory thresholds overriding -d from `file`, one \"GLOB DISTANCE\" rule per line, "+
+			"e.g. \"scans/** 6\"; the first matching rule applies and pairs use the stricter of their two")
+	fs.BoolVar(&cfg.adaptive, "adaptive-threshold", cfg.adaptive,
+		"scale -d with the resolution of each pair: tighter for icons and thumbnails, looser for large photos")
+	fs.BoolVar(&cfg.ignoreZero, "ignore-zero", cfg.ignoreZero, "do not report exact (zero distance) matches")
+	fs.BoolVar(&cfg.print0, "print0", cfg.print0,
+		"write the paths of duplicates (every group member but the keeper) to stdout, NUL-separated")
+	fs.BoolVar(&cfg.renames, "suggest-renames", cfg.renames,
+		"write \"path<TAB>proposed path\" lines to stdout renaming each keeper to "+
+			"YYYY-MM-DD_HHMMSS_<hash8>.<ext> after its capture time; nothing is renamed")
+	fs.StringVar(&cfg.output, "output", cfg.output,
+		"write the groups of duplicates found as a `format` of text, json, or csv report to stdout "+
+			"or -out, the log going to stderr; the run exits with status 3 when there are any")
+	fs.StringVar(&cfg.reportFile, "out", cfg.reportFile, "write the -output report to `file` instead of stdout")
+	fs.BoolVar(&cfg.conversions, "suggest-conversions", cfg.conversions,
+		"add a section to the text or json -output report estimating what converting lossless keepers "+
+			"with lossy duplicates to WebP or AVIF would save; nothing is converted")
+	fs.BoolVar(&cfg.places, "report-places", cfg.places,
+		"put where the photos were taken, by their EXIF GPS coordinates, in the -output report, and order "+
+			"its groups by place; off as reports are shared where the locations of photos shouldn't be")
+	fs.IntVar(&cfg.minGroupSize, "min-group-size", cfg.minGroupSize,
+		"only report groups with at least `n` members")
+	fs.IntVar(&cfg.spillPairs, "spill-pairs", cfg.spillPairs,
+		"hold at most `n` pairs in memory, spilling them to a temporary file beyond that (0 for no limit)")
+	fs.IntVar(&cfg.maxGroups, "max-groups", cfg.maxGroups,
+		"report at most `n` groups (0 for all); page through the rest with -group-offset")
+	fs.IntVar(&cfg.groupOffset, "group-offset", cfg.groupOffset,
+		"skip the first `n` groups that pass -min-group-size")
+	fs.StringVar(&cfg.keepMatch, "keep-match", cfg.keepMatch,
+		"keep the group member whose path matches this `regex`, e.g. /originals/; "+
+			"ties and groups without a match fall back to the largest, then oldest, then first path")
+	fs.Float64Var(&cfg.dirSimilarity, "dir-similarity", cfg.dirSimilarity,
+		"also report pairs of directories whose images are at least this `percent` duplicates "+
+			"of each other, e.g. a backup of a photo folder (0 disables)")
+	fs.BoolVar(&cfg.collapseDirs, "collapse-dirs", cfg.collapseDirs,
+		"with -dir-similarity, report duplicated trees once at their top directory and leave out "+
+			"the individual pairs between them (the log file still lists every pair)")
+	fs.StringVar(&cfg.treemap, "treemap", cfg.treemap,
+		"write an HTML treemap of where the duplicated bytes live to `file`")
+	fs.StringVar(&cfg.dedupeReport, "dedupe-report", cfg.dedupeReport,
+		"write the byte-identical files of each group to `file` in fdupes format, for filesystem-level "+
+			"deduplication like `duperemove --fdupes` instead of removing anything")
+	fs.BoolVar(&cfg.alertNow, "alert-immediately", cfg.alertNow,
+		"report the matches of every image as soon as it is indexed, ahead of the check phase, "+
+			"for watching directories as files arrive")
+	fs.BoolVar(&cfg.watch, "watch", cfg.watch,
+		"keep running after the scan, ingesting the files arriving in the directory arguments and "+
+			"reporting their matches as with -alert-immediately, until interrupted")
+	fs.DurationVar(&cfg.watchSettle, "watch-settle", cfg.watchSettle,
+		"with -watch, take a file once it hasn't been written to for this `duration`")
+	alertEvents := fs.String("alert-events", "",
+		"with -alert-immediately, append a JSON line to `file` (or FIFO) for every ingested image that "+
+			"has copies indexed already, with their count and paths, for automation to reject or reroute it")
+	fs.BoolVar(&cfg.sidecars, "sidecars", cfg.sidecars,
+		"record which members are kept in a "+sidecarName+" in each of their directories, and keep "+
+			"the members recorded as keepers there over any other rule")
+	fs.StringVar(&cfg.action, "action", cfg.action,
+		"clean `action` for the duplicates of the reported groups: none, delete, hardlink or symlink "+
+			"(replace them with links to the keeper), auto (the best link each group's filesystems allow: "+
+			"reflink, hardlink, symlink, or none), move (into the -quarantine directory, or DIR with "+
+			"move=DIR), or recycle (into the Recycle Bin, on Windows); keepers are never touched")
+	fs.BoolVar(&cfg.dryRun, "dry-run", cfg.dryRun,
+		"with -action, only report what would be done to each duplicate")
+	fs.Var(&cfg.keepResults, "keep-results",
+		"remove the pair results of past checks from the working directory at the start of each, keeping the "+
+			"last `N` runs or those younger than an age like 90d (default keep all), see the results command")
+	fs.StringVar(&cfg.undoLog, "undo-log", cfg.undoLog,
+		"`file` -action records what it does in, for the undo command (default a new file in "+
+			"~/.local/share/dupehunter/undo)")
+	fs.StringVar(&cfg.quarantine, "quarantine", cfg.quarantine,
+		"`directory` the move action mirrors duplicates' paths into, see the quarantine purge command")
+	fs.BoolVar(&cfg.preserveTimes, "preserve-times", cfg.preserveTimes,
+		"keep the access and modification times of keepers, moved duplicates, and their directories when cleaning")
+	fs.BoolVar(&cfg.snapshot, "snapshot", cfg.snapshot,
+		"snapshot the Btrfs, ZFS, or LVM filesystems of the duplicates before -action delete, hardlink, or "+
+			"symlink, cleaning nothing if one can't be; the undo log names the snapshots")
+	fs.BoolVar(&cfg.haveSnapshot, "i-have-a-snapshot", cfg.haveSnapshot,
+		"vouch that the duplicates are backed up otherwise, which -action delete, hardlink, symlink, and auto "+
+			"require without -snapshot; with it, let it go on cleaning those on filesystems it can't snapshot")
+	fs.BoolVar(&cfg.nearDupes, "clean-near-duplicates", cfg.nearDupes,
+		"let -action delete, hardlink, symlink, or auto clean duplicates whose content differs from their "+
+			"keeper's, which undo can't bring back from a copy of the keeper; -snapshot lets them be cleaned too, "+
+			"its snapshot holding them")
+	fs.StringVar(&cfg.keep, "keep", cfg.keep,
+		"comma-separated keep `policies` consulted after -keep-match: "+keepPolicyNames())
+	fs.BoolVar(&cfg.simulate, "simulate-policies", cfg.simulate,
+		"report how many files and bytes clean would remove under each keep policy, in how many groups "+
+			"each keeps another member than -keep does, and how many groups the policies disagree on, "+
+			"to pick -keep by; nothing is cleaned, -action only goes along with -dry-run")
+	fs.StringVar(&cfg.index, "index", cfg.index,
+		"similarity `index` used by check: bktree (exact, persisted), buckets (exact, built per run "+
+			"from hash segments), or hnsw (approximate, for huge libraries)")
+	fs.BoolVar(&cfg.distanceCache, "distance-cache", cfg.distanceCache,
+		"reuse neighbor distances computed by previous checks for unchanged records")
+	fs.IntVar(&cfg.hnswEf, "hnsw-ef", cfg.hnswEf,
+		"search breadth of the hnsw index; higher values find more duplicates but are slower")
+	fs.IntVar(&cfg.shards, "check-shards", cfg.shards,
+		"split the comparison of check between `n` tasks searching in parallel")
+	fs.IntVar(&cfg.workers, "workers", cfg.workers, "number of concurrent decode `workers`")
+	fs.BoolVar(&cfg.autoWorkers, "auto-workers", cfg.autoWorkers,
+		"resize the worker pool during scans depending on whether decoding is CPU or IO bound")
+	fs.IntVar(&cfg.maxWorkers, "max-workers", cfg.maxWorkers, "upper bound for -auto-workers")
+	fs.IntVar(&cfg.readLimit, "read-workers", cfg.readLimit,
+		"images opened and sniffed at once (0 for as many as there are workers)")
+	fs.IntVar(&cfg.exifLimit, "exif-workers", cfg.exifLimit,
+		"images whose EXIF is extracted at once (0 for as many as there are workers)")
+	fs.IntVar(&cfg.decodeLimit, "decode-workers", cfg.decodeLimit,
+		"images decoded at once (0 for as many as there are workers)")
+	fs.IntVar(&cfg.hashLimit, "hash-workers", cfg.hashLimit,
+		"images hashed at once (0 for as many as there are workers)")
+	fs.IntVar(&cfg.persistLimit, "persist-workers", cfg.persistLimit,
+		"records written to the database at once (0 for as many as there are workers)")
+	fs.IntVar(&cfg.maxFiles, "max-files", cfg.maxFiles,
+		"stop ingesting after `n` new or changed files (0 for no limit); the next scan picks up the rest")
+	fs.DurationVar(&cfg.maxDuration, "max-duration", cfg.maxDuration,
+		"stop ingesting after this `duration` (0 for no limit); the next scan picks up the rest")
+	fs.BoolVar(&cfg.exactPrefilter, "exact-prefilter", cfg.exactPrefilter,
+		"before decoding, find byte-identical files among the given paths (images or not) by size and "+
+			"checksums, and decode only one of each set of identical images")
+	fs.BoolVar(&cfg.renameFilter, "rename-prefilter", cfg.renameFilter,
+		"before decoding, find the copies among the given paths named alike but for letter case or extension, "+
+			"e.g. IMG_1.JPG and backup/img_1.jpeg, and decode only one of each; a quick subset of -exact-prefilter")
+	fs.BoolVar(&cfg.isolateDecode, "isolate-decode", cfg.isolateDecode,
+		"decode images in resource-limited child processes, for files from untrusted sources")
+	fs.IntVar(&cfg.isolateMemory, "isolate-memory", cfg.isolateMemory,
+		"address space limit of isolated decoders in `MiB`")
+	fs.DurationVar(&cfg.isolateLimit, "isolate-timeout", cfg.isolateLimit,
+		"time an isolated decoder may take per image")
+	fs.StringVar(&cfg.backend, "backend", cfg.backend,
+		"database `backend`: pogreb (the index persisted under ~/.local/share/dupehunter) or memory "+
+			"(no index nor results file is written, only the given files are compared; "+
+			"files other flags ask for, like -treemap, -denied-list or -truncated-list, still are)")
+	fs.StringVar(&cfg.collection, "collection", cfg.collection,
+		"use the index of the `collection` with this name, kept apart from the main index under "+
+			"~/.local/share/dupehunter/collections")
+	fs.Func("db", "keep the main index in the directory at `path` instead of ~/.local/share/dupehunter/db",
+		func(s string) error {
+			if s == "" {
+				return errors.New("empty path")
+			}
+			abs, err := filepath.Abs(expandHome(s))
+			if err != nil {
+				return err
+			}
+			dbOverride = abs
+			return nil
+		})
+	fs.BoolVar(&cfg.noStore, "no-store", cfg.noStore,
+		"only hash and compare the given files: an alias of -backend memory that can't be combined "+
+			"with -action or commands, leaving the index and the files compared alone")
+	fs.Func("seed", "make runs over the same files reproducible: draw -sample from this `integer`, and report "+
+		"the pairs of every group in path order, so that identical inputs give identical reports", setSeed)
+	fs.Var(&cfg.sample, "sample",
+		"only hash a random `share` of the files, e.g. 5%, into memory like -no-store, and estimate how many "+
+			"of all of them are duplicates from those in the share")
+	fs.BoolVar(&cfg.ephemeral, "ephemeral-collection", cfg.ephemeral,
+		"index the given files, e.g. - for a list on stdin, into a temporary collection dropped on exit and "+
+			"report only their duplicates in the library (the main index or -collection), which is left untouched")
+	fs.IntVar(&timings.n, "slowest", timings.n, "report the `n` slowest files to decode and hash (0 disables)")
+	fs.StringVar(&cfg.source, "source", cfg.source,
+		"`label` the images ingested by this run are recorded with, e.g. \"camera import\", shown in reports")
+	fs.BoolVar(&allFiles, "all-files", allFiles,
+		"also index files that aren't images by their content checksum, reporting identical ones as duplicates")
+	fs.BoolVar(&pdfImages, "pdf", pdfImages,
+		"also hash PDFs by the first image embedded in them, e.g. scanned pages")
+	fs.BoolVar(&archiveImages, "archives", archiveImages,
+		"also ingest the members of zip archives, reporting the archives fully duplicated on disk")
+	fs.BoolVar(&mailImages, "mail", mailImages,
+		"also ingest the images attached to and inlined into .eml messages, .mhtml pages, and .html pages")
+	fs.BoolVar(&retryFailed, "retry-failed", retryFailed,
+		"retry files that failed to ingest before, even though they haven't changed since")
+	fs.BoolVar(&includeTrash, "include-trash", includeTrash,
+		"also ingest files in trash directories, in quarantine directories of -action move, and in the Btrfs "+
+			"snapshots of -snapshot")
+	fs.Func("ext", "only ingest files with these comma-separated `extensions`, e.g. jpg,png", walkFilters.addExts)
+	fs.Func("exclude", "skip files and directories matching `glob`, e.g. '*.tmp' or '**/cache', repeatable",
+		walkFilters.addExclude)
+	fs.Var(&walkFilters.minSize, "min-size", "skip files smaller than `size`, e.g. 10K")
+	fs.Var(&walkFilters.maxSize, "max-size", "skip files larger than `size`, e.g. 50M")
+	fs.BoolVar(&walkFilters.followSymlinks, "follow-symlinks", walkFilters.followSymlinks,
+		"follow symbolic links when walking directories, which skips them otherwise")
+	fs.IntVar(&walkFilters.maxDepth, "max-depth", walkFilters.maxDepth,
+		"walk at most `n` directories below each directory argument, 0 for only the files directly in it "+
+			"(-1 for no limit)")
+	fs.Var(&window.newer, "newer-than", "only ingest and check the images modified (or captured, see -time-by) after "+
+		"`time`, a date like 2023-01-01, an RFC 3339 time, or an age like 30d")
+	fs.Var(&window.older, "older-than", "only ingest and check the images modified (or captured) before `time`")
+	fs.Func("time-by", "select images for -newer-than and -older-than by `mtime` or EXIF capture time (captured), "+
+		"those without one going by mtime (default mtime)", window.setTimeBy)
+	fs.BoolVar(&skipOffline, "skip-offline", skipOffline,
+		"skip the files not stored locally, cloud placeholders and HSM stubs, instead of recalling them by reading. "+
+			"Windows and macOS flag them; elsewhere, and on macOS besides, files of 64KiB or more without any "+
+			"blocks allocated are taken for them, which FUSE and network filesystems may report for every file, "+
+			"so a filesystem all of whose files were skipped is warned about")
+	fs.BoolVar(&statOnly, "stat-only", statOnly,
+		"only record the size, modification time, and header dimensions of files, hashing nothing and "+
+			"checking nothing, for a fast first inventory; db rehash --missing hashes them later")
+	fs.BoolVar(&hashLater, "hash-later", hashLater,
+		"scan like -stat-only and queue the files recorded for hash-pending to hash, e.g. overnight")
+	fs.DurationVar(&tombstoneRetention, "tombstone-retention", tombstoneRetention,
+		"keep the tombstones of removed records for `duration` before scans purge them, 0 to leave none")
+	fs.StringVar(&cfg.deniedList, "denied-list", cfg.deniedList,
+		"write the paths skipped due to permission errors to `file`")
+	fs.StringVar(&cfg.truncatedList, "truncated-list", cfg.truncatedList,
+		"write the paths of truncated (partially downloaded) images to `file`")
+	fs.StringVar(&cfg.manifest, "manifest", cfg.manifest,
+		"write a JSON manifest of the scan to `file`: its paths, settings, counts, durations and problems")
+	summaryFD := fs.Int("summary-fd", 0,
+		"write the manifest as a single JSON line to the already open file `descriptor`, e.g. 3, "+
+			"once the scan is done, keeping it apart from the log")
+	jobPath := fs.String("job", "",
+		"read the run's paths and settings from the JSON job document in `file`, - for stdin; "+
+			"flags on the command line take precedence. -watch and serve reload it on SIGHUP")
+	var rootNames []string
+	fs.Func("root", "scan the directory registered as `name` with roots add, with the flags kept with it; "+
+		"flags on the command line take precedence, repeatable", func(name string) error {
+		rootNames = append(rootNames, name)
+		return nil
+	})
+	pprofAddr := fs.String("pprof", "", "serve net/http/pprof on this `address`, e.g. :6060")
+	cpuProfile := fs.String("cpuprofile", "", "write a CPU profile to `file`")
+	memProfile := fs.String("memprofile", "", "write a heap profile to `file` on exit")
+	traceTo := fs.String("trace", "",
+		"export OpenTelemetry spans of the pipeline stages to `exporter`: otlp for the collector at "+
+			"$OTEL_EXPORTER_OTLP_ENDPOINT (default http://localhost:4318), or file:PATH for OTLP/JSON lines")
+	verbose := fs.Bool("v", false, "enable trace logging; the trace events logged per file or pair are sampled")
+	status := fs.Bool("status", false,
+		"show progress, files per second, queued work, and the images hashing alike a record before them on a "+
+			"status line at the bottom of the terminal instead of logging every file, or log them every 10s "+
+			"without a terminal")
+	logEveryN := fs.Int("log-every", 1, "log only every `n`th of the per-file progress messages")
+	bulk := fs.Bool("bulk", false,
+		"favor throughput on huge scans: no per-file or debug messages nor console colors, counters every "+
+			bulkReportEvery.String()+" instead, and batched similarity index writes; records are still written "+
+			"as each file is hashed")
+	usage := fs.Usage
+	fs.Usage = func() {
+		usage()
+		printCommands(fs.Output(), "", rootCommands)
+	}
 
-	defer close(skOne)
+	if err := parseFlags(fs, os.Args[1:]); err != nil {
+		fail(err)
+	}
+	rootSettings = recordFlags(fs, os.Args[1:])
 
-	for i, arg := range os.Args {
-		select {
-		case <-skOne:
-			continue
-		default:
+	var cmd *command
+	for i := range rootCommands {
+		if fs.NArg() > 0 && rootCommands[i].name == fs.Arg(0) {
+			cmd = &rootCommands[i]
+		}
+	}
+
+	var paths []string
+	if cmd == nil {
+		var err error
+		if paths, err = parseInterspersed(fs, fs.Args()); err != nil {
+			fail(err)
+		}
+	}
+	explicit := flagsSet(fs)
+	baseline := commandLineBaseline(cfg)
+	if *jobPath != "" {
+		switch {
+		case cmd != nil && cmd.name != "serve":
+			fail(usageError(fs, "-job describes a scan, it can't be combined with the %s command", cmd.name))
+		case len(paths) > 0:
+			fail(usageError(fs, "-job takes the paths to ingest from the document's roots, not from arguments"))
+		}
+		doc, err := readJob(*jobPath)
+		if err == nil && cmd != nil && len(doc.Roots) > 0 {
+			err = usageError(fs, "serve ingests what it is asked to, a -job document configuring it has no roots")
+		}
+		if err == nil {
+			err = doc.apply(fs)
+		}
+		if err != nil {
+			fail(err)
+		}
+		paths = doc.Roots
+	}
+	if len(rootNames) > 0 {
+		switch {
+		case cmd != nil:
+			fail(usageError(fs, "-root names a scan, it can't be combined with the %s command", cmd.name))
+		case *jobPath != "":
+			fail(usageError(fs, "-root and -job both describe the scan, pick one"))
+		}
+		roots, err := lookupRoots(rootNames)
+		if err == nil {
+			var rootPaths []string
+			rootPaths, err = applyRoots(fs, roots)
+			paths = append(paths, rootPaths...)
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	// the root flags also configure commands that work like a run, e.g. serve.
+	if algorithm, err := parseHashAlgorithm(*hashName); err != nil {
+		fail(usageError(fs, "invalid value %q for -hash: %s", *hashName, err))
+	} else {
+		hashing, hashLayout = algorithm, algorithm.layout()
+	}
+	if cfg.pluginLimit <= 0 {
+		fail(usageError(fs, "invalid value %s for -plugin-timeout: must be positive", cfg.pluginLimit))
+	}
+	if *hashPluginCmd != "" {
+		switch {
+		case flagsSet(fs)["hash"]:
+			fail(usageError(fs, "-hash-plugin hashes instead of -hash, give only one of them"))
+		case cfg.isolateDecode:
+			fail(usageError(fs, "-hash-plugin can't be combined with -isolate-decode, which hashes in the sandbox"))
+		}
+		plugin, err := startPlugin(*hashPluginCmd, hashPluginHello, "hasher", maxPluginHashBits, cfg.pluginLimit)
+		if err != nil {
+			fail(fmt.Errorf("-hash-plugin: %w", err))
+		}
+		hashing = hashAlgorithm{plugin: plugin}
+		hashLayout = hashing.layout()
+	}
+	centerWeight = float64(cfg.centerWeight)
+	switch {
+	case cfg.watermarkMargin < 0:
+		fail(usageError(fs, "invalid value %d for -watermark-margin: must not be negative", cfg.watermarkMargin))
+	case cfg.watermarkMargin > 0 && cfg.isolateDecode:
+		fail(usageError(fs, "-watermark-margin decodes images again in-process, it can't be combined with -isolate-decode"))
+	}
+	if cfg.sceneDistance <= 0 || cfg.sceneDistance > 2 {
+		fail(usageError(fs, "invalid value %g for -scene-distance: must be above 0 and at most 2", cfg.sceneDistance))
+	}
+	if *embedPluginCmd != "" {
+		var err error
+		if embedder, err = startPlugin(*embedPluginCmd, embedPluginHello, "embedder", maxEmbedDims, cfg.pluginLimit); err != nil {
+			fail(fmt.Errorf("-embed-plugin: %w", err))
+		}
+	}
+	if cfg.maxDistance < 1 || cfg.maxDistance > hashing.bits() {
+		fail(usageError(fs, "invalid value %d for -d: must be between 1 and %d", cfg.maxDistance, hashing.bits()))
+	}
+	if cfg.thresholdFile != "" {
+		rules, err := loadThresholdRules(cfg.thresholdFile)
+		if err != nil {
+			fail(usageError(fs, "invalid -thresholds file: %s", err))
+		}
+		cfg.thresholds = rules
+	}
+	if cfg.dirSimilarity < 0 || cfg.dirSimilarity > 100 {
+		fail(usageError(fs, "invalid value %v for -dir-similarity: must be between 0 and 100", cfg.dirSimilarity))
+	}
+	if dir, ok := strings.CutPrefix(cfg.action, actionMove+"="); ok {
+		cfg.action, cfg.quarantine = actionMove, dir
+	}
+	switch cfg.action {
+	case actionNone, actionDelete, actionHardlink, actionSymlink, actionAuto:
+	case actionMove:
+		if cfg.quarantine == "" {
+			fail(usageError(fs, "-action move needs a -quarantine directory, or use move=DIR"))
+		}
+		abs, err := filepath.Abs(cfg.quarantine)
+		if err != nil {
+			fail(err)
 		}
-		if arg == "-d" && len(os.Args)+1 > i {
-			mdInt, intErr := strconv.Atoi(os.Args[i+1])
-			if intErr != nil {
-				log.Fatal().Err(intErr).Msgf("failed to parse max distance %s", os.Args[i+1])
+		cfg.quarantine = abs
+	case actionRecycle:
+		if !canRecycle {
+			fail(usageError(fs, "-action recycle needs the Recycle Bin of 64-bit Windows"))
+		}
+	default:
+		fail(usageError(fs, "invalid value %q for -action: expected none, delete, hardlink, symlink, "+
+			"auto, move, move=DIR, or recycle", cfg.action))
+	}
+	if (cfg.dryRun || cfg.undoLog != "") && cfg.action == actionNone {
+		fail(usageError(fs, "-dry-run and -undo-log apply to -action"))
+	}
+	if destructiveAction(cfg.action) && !cfg.dryRun && !cfg.snapshot && !cfg.haveSnapshot {
+		fail(usageError(fs, "-action %s deletes or replaces duplicates: give -snapshot to snapshot their "+
+			"filesystems first, or -i-have-a-snapshot if they are backed up otherwise", cfg.action))
+	}
+	if cfg.simulate && cfg.action != actionNone && !cfg.dryRun {
+		fail(usageError(fs, "-simulate-policies only reports, it takes -dry-run to be combined with -action"))
+	}
+	if cfg.dedupeReport != "" && cfg.action != actionNone {
+		fail(usageError(fs, "-dedupe-report leaves the duplicates to the filesystem, it can't be combined with -action"))
+	}
+	if *traceTo != "" && *traceTo != "otlp" && !strings.HasPrefix(*traceTo, "file:") {
+		fail(usageError(fs, "invalid value %q for -trace: expected otlp or file:PATH", *traceTo))
+	}
+	if cfg.collapseDirs && cfg.dirSimilarity == 0 {
+		fail(usageError(fs, "-collapse-dirs needs -dir-similarity"))
+	}
+	if cfg.print0 && cfg.renames {
+		fail(usageError(fs, "-print0 and -suggest-renames both write to stdout, pick one"))
+	}
+	if cfg.output != "" && !slices.Contains(reportFormats, cfg.output) {
+		fail(usageError(fs, "invalid value %q for -output: expected text, json, or csv", cfg.output))
+	}
+	switch {
+	case cfg.reportFile != "" && cfg.output == "":
+		fail(usageError(fs, "-out needs -output"))
+	case cfg.output != "" && (cfg.print0 || cfg.renames):
+		fail(usageError(fs, "-output can't be combined with -print0 or -suggest-renames"))
+	case cfg.conversions && (cfg.output == "" || cfg.output == "csv"):
+		fail(usageError(fs, "-suggest-conversions needs -output text or json"))
+	}
+	if cfg.minGroupSize < 2 {
+		fail(usageError(fs, "invalid value %d for -min-group-size: must be at least 2", cfg.minGroupSize))
+	}
+	if cfg.maxGroups < 0 || cfg.groupOffset < 0 {
+		fail(usageError(fs, "-max-groups and -group-offset must not be negative"))
+	}
+	if cfg.sidecars {
+		cfg.keepOrder = append(cfg.keepOrder, keepDecided)
+	}
+	if cfg.keepMatch != "" {
+		re, err := regexp.Compile(cfg.keepMatch)
+		if err != nil {
+			fail(usageError(fs, "invalid value %q for -keep-match: %s", cfg.keepMatch, err))
+		}
+		cfg.keepOrder = append(cfg.keepOrder, keepMatching(re))
+	}
+	if cfg.keep != "" {
+		for _, name := range strings.Split(cfg.keep, ",") {
+			rule, ok := keepPolicies[strings.TrimSpace(name)]
+			if !ok {
+				fail(usageError(fs, "invalid value %q for -keep: expected %s", name, keepPolicyNames()))
 			}
-			cfg.maxDistance = mdInt
-			skOne <- struct{}{}
-			continue
+			cfg.keepOrder = append(cfg.keepOrder, rule)
 		}
-		if arg == "-v" {
-			zerolog.SetGlobalLevel(zerolog.TraceLevel)
-			continue
+	}
+	switch cfg.index {
+	case "bktree", "buckets", "hnsw":
+	default:
+		fail(usageError(fs, "invalid value %q for -index: expected bktree, buckets, or hnsw", cfg.index))
+	}
+	if cfg.hnswEf < 1 {
+		fail(usageError(fs, "invalid value %d for -hnsw-ef: must be at least 1", cfg.hnswEf))
+	}
+	if cfg.workers < 1 {
+		fail(usageError(fs, "invalid value %d for -workers: must be at least 1", cfg.workers))
+	}
+	if cfg.maxWorkers < cfg.workers {
+		fail(usageError(fs, "invalid value %d for -max-workers: must be at least -workers", cfg.maxWorkers))
+	}
+	if cfg.readLimit < 0 || cfg.exifLimit < 0 || cfg.decodeLimit < 0 || cfg.hashLimit < 0 || cfg.persistLimit < 0 {
+		fail(usageError(fs, "-read-workers, -exif-workers, -decode-workers, -hash-workers and -persist-workers "+
+			"must not be negative"))
+	}
+	if cfg.shards < 1 {
+		fail(usageError(fs, "invalid value %d for -check-shards: must be at least 1", cfg.shards))
+	}
+	if cfg.isolateMemory < 64 {
+		fail(usageError(fs, "invalid value %d for -isolate-memory: must be at least 64", cfg.isolateMemory))
+	}
+	if tombstoneRetention < 0 {
+		fail(usageError(fs, "invalid value %v for -tombstone-retention: must not be negative", tombstoneRetention))
+	}
+	if cfg.maxFiles < 0 || cfg.maxDuration < 0 {
+		fail(usageError(fs, "-max-files and -max-duration must not be negative"))
+	}
+	if walkFilters.maxSize > 0 && walkFilters.minSize > walkFilters.maxSize {
+		fail(usageError(fs, "-min-size must not exceed -max-size"))
+	}
+	if walkFilters.maxDepth < -1 {
+		fail(usageError(fs, "invalid value %d for -max-depth: must be -1 or more", walkFilters.maxDepth))
+	}
+	if !window.newer.t.IsZero() && !window.older.t.IsZero() && !window.newer.t.Before(window.older.t) {
+		fail(usageError(fs, "-newer-than must be before -older-than, or the window is empty"))
+	}
+	if *logEveryN < 1 {
+		fail(usageError(fs, "invalid value %d for -log-every: must be at least 1", *logEveryN))
+	}
+	if *bulk && *verbose {
+		fail(usageError(fs, "-bulk drops the per-file messages -v asks for, pick one"))
+	}
+	if cfg.isolateLimit <= 0 {
+		fail(usageError(fs, "invalid value %s for -isolate-timeout: must be positive", cfg.isolateLimit))
+	}
+	if !validCollectionName(cfg.collection) {
+		fail(usageError(fs, "invalid value %q for -collection: must not contain path separators", cfg.collection))
+	}
+	if dbOverride != "" && cfg.collection != "" {
+		fail(usageError(fs, "-db only moves the main index, it can't be combined with -collection"))
+	}
+	if cfg.manifest != "" && cmd != nil {
+		fail(usageError(fs, "-manifest only applies to scans, not to the %s command", cmd.name))
+	}
+	if *summaryFD != 0 {
+		switch {
+		case cmd != nil:
+			fail(usageError(fs, "-summary-fd only applies to scans, not to the %s command", cmd.name))
+		case *summaryFD < 2:
+			fail(usageError(fs, "invalid value %d for -summary-fd: stdin and stdout are taken", *summaryFD))
+		case *summaryFD == 2 && (cfg.print0 || cfg.renames || (cfg.output != "" && cfg.reportFile == "")):
+			fail(usageError(fs, "-summary-fd 2 would mix the summary into the log, which goes to stderr here"))
 		}
-		if arg == "--ignore-zero" {
-			cfg.ignoreZero = true
-			continue
+		cfg.summary = os.NewFile(uintptr(*summaryFD), "summary")
+		if _, err := cfg.summary.Stat(); err != nil {
+			fail(usageError(fs, "invalid value %d for -summary-fd: %s", *summaryFD, err))
+		}
+	}
+	if cfg.watch {
+		switch {
+		case cmd != nil:
+			fail(usageError(fs, "-watch only applies to scans, not to the %s command", cmd.name))
+		case !hasDirectory(paths):
+			fail(usageError(fs, "-watch needs the directories to watch"))
+		case statOnly || cfg.noStore || cfg.ephemeral:
+			fail(usageError(fs, "-watch indexes what arrives, it can't be combined with "+
+				"-stat-only, -hash-later, -no-store, or -ephemeral-collection"))
+		case cfg.action != actionNone || cfg.print0 || cfg.renames || cfg.output != "":
+			fail(usageError(fs, "-watch reports matches as they arrive, it can't be combined with "+
+				"-action or the reports of the check phase"))
+		case cfg.watchSettle <= 0:
+			fail(usageError(fs, "invalid value %s for -watch-settle: must be positive", cfg.watchSettle))
+		}
+		cfg.alertNow = true
+	}
+	if *alertEvents != "" {
+		if !cfg.alertNow {
+			fail(usageError(fs, "-alert-events needs -alert-immediately or -watch"))
+		}
+		f, err := os.OpenFile(*alertEvents, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			fail(usageError(fs, "invalid value %q for -alert-events: %s", *alertEvents, err))
+		}
+		cfg.alertEvents = f
+	}
+	if cfg.noStore {
+		switch {
+		case cmd != nil:
+			fail(usageError(fs, "-no-store only applies to scans, not to the %s command", cmd.name))
+		case cfg.action != actionNone:
+			fail(usageError(fs, "-no-store only reports duplicates, it can't be combined with -action"))
+		case len(paths) == 0:
+			fail(usageError(fs, "-no-store needs the files to compare"))
 		}
-		osArgs = append(osArgs, arg)
+		cfg.backend = backendMemory
 	}
+	if cfg.sample > 0 {
+		switch {
+		case cmd != nil:
+			fail(usageError(fs, "-sample only applies to scans, not to the %s command", cmd.name))
+		case cfg.action != actionNone:
+			fail(usageError(fs, "-sample only estimates, it can't be combined with -action"))
+		case cfg.watch || statOnly || hashLater || cfg.ephemeral:
+			fail(usageError(fs, "-sample can't be combined with -watch, -stat-only, -hash-later, "+
+				"or -ephemeral-collection"))
+		case len(paths) == 0:
+			fail(usageError(fs, "-sample needs the files or directories to sample, or - to read them from stdin"))
+		}
+		cfg.backend = backendMemory
+	}
+	if statOnly || hashLater {
+		mode := "-stat-only"
+		if hashLater {
+			mode = "-hash-later"
+		}
+		switch {
+		case cmd != nil:
+			fail(usageError(fs, "%s only applies to scans, not to the %s command", mode, cmd.name))
+		case cfg.action != actionNone:
+			fail(usageError(fs, "%s records files without hashing them, it can't be combined with -action", mode))
+		case cfg.noStore || cfg.ephemeral:
+			fail(usageError(fs, "%s records files for later, "+
+				"it can't be combined with -no-store or -ephemeral-collection", mode))
+		case archiveImages:
+			fail(usageError(fs, "%s records files without opening them, it can't be combined with -archives", mode))
+		case mailImages:
+			fail(usageError(fs, "%s records files without opening them, it can't be combined with -mail", mode))
+		}
+		statOnly = true
+	}
+	if cfg.ephemeral {
+		switch {
+		case cmd != nil:
+			fail(usageError(fs, "-ephemeral-collection only applies to scans, not to the %s command", cmd.name))
+		case cfg.action != actionNone:
+			fail(usageError(fs, "-ephemeral-collection only reports duplicates, it can't be combined with -action"))
+		case cfg.noStore:
+			fail(usageError(fs, "-no-store compares the files among themselves and "+
+				"-ephemeral-collection against the library, pick one"))
+		case len(paths) == 0:
+			fail(usageError(fs, "-ephemeral-collection needs the files to check, e.g. - to read them from stdin"))
+		}
+		// the library is only read, the files go into memory.
+		cfg.against, cfg.compare = cfg.collection, true
+		cfg.backend = backendMemory
+	}
+	switch cfg.backend {
+	case backendPogreb:
+	case backendMemory:
+		cfg.outFile = ""
+	default:
+		fail(usageError(fs, "invalid value %q for -backend: expected pogreb or memory", cfg.backend))
+	}
+
+	rootConfig = cfg
+	auditAs("cli", "dupehunter "+strings.Join(os.Args[1:], " "))
+	live = &liveConfig{cfg: cfg, jobPath: *jobPath, explicit: explicit, rootless: cmd != nil, base: baseline}
 
-	if len(osArgs) == 2 && os.Args[1] == "-" {
-		processArgs(processStdin())
+	if *verbose {
+		zerolog.SetGlobalLevel(zerolog.TraceLevel)
+	}
+	logEvery(*logEveryN)
+	logOut := os.Stdout
+	if cfg.print0 || cfg.renames || (cfg.output != "" && cfg.reportFile == "") {
+		// stdout belongs to the path list or report.
+		logOut = os.Stderr
+	}
+	if *bulk {
+		enableBulk()
+	}
+	if logOut != os.Stdout || bulkMode {
+		log = log.Output(zerolog.ConsoleWriter{Out: zerolog.SyncWriter(logOut), NoColor: bulkMode})
+	}
+	if *status {
+		w, stopStatus := enableStatus(logOut, *verbose)
+		defer stopStatus()
+		log = log.Output(zerolog.ConsoleWriter{Out: zerolog.SyncWriter(w), NoColor: bulkMode || !isTerminal(logOut)})
 	}
 
-	if len(osArgs) > 0 {
-		processArgs(osArgs)
+	stopProfiling, err := startProfiling(*pprofAddr, *cpuProfile, *memProfile)
+	if err != nil {
+		fail(err)
 	}
+	if *traceTo != "" {
+		if tracing, err = newTracer(*traceTo); err != nil {
+			fail(err)
+		}
+		stop := stopProfiling
+		stopProfiling = func() {
+			tracing.shutdown()
+			stop()
+		}
+	}
+	defer stopProfiling()
 
-	if err := checkAll(cfg); err != nil {
-		log.Fatal().Err(err).Send()
+	if datastoreErr = startDatastore(cfg.backend, cfg.collection); datastoreErr != nil {
+		if !toleratesBrokenDB(fs.Args()) {
+			log.Fatal().Err(datastoreErr).Msg("failed to open the database, db recover salvages what can be read of it")
+		}
+		log.Warn().Err(datastoreErr).Msg("failed to open the database")
+	}
+	startWorkerPool(cfg.workers)
+	setStageLimits(cfg.readLimit, cfg.exifLimit, cfg.decodeLimit, cfg.hashLimit, cfg.persistLimit)
+
+	if cmd != nil {
+		cmdErr := cmd.run(fs.Args()[1:])
+		// doctor and db recover run without a database that failed to open,
+		// and recover leaves none behind when it can't create a new one.
+		if DB != nil {
+			if err := DB.SyncAndCloseAll(); err != nil {
+				log.Fatal().Err(err).Msg("failed to sync and close all databases")
+			}
+		}
+		if cmdErr != nil {
+			stopProfiling()
+			fail(cmdErr)
+		}
+		return
+	}
+
+	via := "arguments"
+	switch {
+	case *jobPath != "":
+		via = "job"
+	case len(rootNames) > 0:
+		via = "root:" + strings.Join(rootNames, ",")
+	}
+	var stream pathSource
+	if len(paths) == 1 && paths[0] == "-" && *jobPath == "" {
+		paths, via = nil, "stdin"
+	} else if paths, err = expandArgs(paths); err != nil {
+		fail(err)
+	}
+
+	manifest := newScanManifest(cfg, paths, via)
+	switch {
+	case via == "stdin":
+		stream = manifest.track(stdinPaths())
+	case walkFilters.active() || hasDirectory(paths):
+		stream = manifest.track(walkPaths(paths))
+	case cfg.sample > 0:
+		stream = manifest.track(slicePaths(paths))
+	}
+	var sampler *pathSampler
+	if cfg.sample > 0 {
+		sampler = newPathSampler(cfg.sample)
+		stream = sampler.wrap(stream)
+	}
+	writeManifest := func(scanErr error) {
+		manifest.finish(scanErr)
+		if cfg.manifest != "" {
+			manifest.write(cfg.manifest)
+		}
+		if cfg.summary != nil {
+			manifest.send(cfg.summary)
+		}
+	}
+
+	if len(paths) > 0 || stream != nil {
+		started := time.Now()
+		if stream != nil {
+			err = ingestStream(context.Background(), cfg, stream, 0, newOrigin(cfg.source, via))
+		} else {
+			err = ingestPaths(context.Background(), cfg, paths, newOrigin(cfg.source, via))
+		}
+		manifest.ingested(started)
+		if err != nil {
+			writeManifest(err)
+			if errors.Is(err, errDiskFull) {
+				// checking would only fail writing the distance cache.
+				_ = DB.SyncAndCloseAll()
+				stopProfiling()
+				fail(err)
+			}
+			log.Fatal().Err(err).Send()
+		}
+	}
+
+	var (
+		found    bool
+		watchErr error
+	)
+	switch {
+	case cfg.watch:
+		// the arrivals are checked as they are indexed.
+		watchErr = watchPaths(context.Background(), cfg, paths)
+		writeManifest(watchErr)
+	case statOnly:
+		// nothing was hashed to compare.
+		writeManifest(nil)
+		if hashLater {
+			log.Info().Msg("inventory taken, run hash-pending to hash it")
+		} else {
+			log.Info().Msg("inventory taken, hash it with db rehash --missing")
+		}
+	default:
+		started := time.Now()
+		sum, err := checkAll(cfg)
+		manifest.checked(sum, started)
+		writeManifest(err)
+		if err != nil {
+			log.Fatal().Err(err).Send()
+		}
+		if sampler != nil {
+			sampler.report(sum)
+		}
+		found = cfg.output != "" && sum.shown > 0
 	}
 
 	if err := DB.SyncAndCloseAll(); err != nil {
@@ -507,4 +2086,12 @@ func main() {
 		_ = cfg.f.Sync()
 		_ = cfg.f.Close()
 	}
+	if watchErr != nil {
+		stopProfiling()
+		fail(watchErr)
+	}
+	if found {
+		stopProfiling()
+		fail(errDuplicatesFound)
+	}
 }
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/bytedance/sonic"
+)
+
+// db prune, db stats and db import look after an index that has drifted from
+// the disks it describes: records of files deleted or replaced since, the
+// size of it all, and moving it to another machine by way of db export.
+
+// prunable is a record db prune removes, and why.
+type prunable struct {
+	path, reason string
+}
+
+// collectionRoots returns the roots registered for collection.
+func collectionRoots(collection string) ([]scanRoot, error) {
+	roots, err := readRoots()
+	if err != nil {
+		return nil, err
+	}
+	kept := make([]scanRoot, 0, len(roots))
+	for _, r := range roots {
+		if r.Collection == collection {
+			kept = append(kept, r)
+		}
+	}
+	return kept, nil
+}
+
+// pruneReason returns why the record img is stale, "" if it isn't, and
+// whether its file is within a root that is offline.
+func pruneReason(img *Image, roots []scanRoot, outsideRoots bool) (reason string, offline bool) {
+	if remoteRecord(img.Path) {
+		// stored by /v1/records:batch, there is no file to check.
+		return "", false
+	}
+	file, _, _ := strings.Cut(img.Path, pageSuffix)
+	var root *scanRoot
+	for i := range roots {
+		if withinDir(file, roots[i].Path) {
+			root = &roots[i]
+			break
+		}
+	}
+	if root != nil {
+		if _, err := os.Stat(root.Path); err != nil {
+			return "", true
+		}
+	}
+	if outsideRoots && root == nil {
+		return "outside roots", false
+	}
+	finfo, err := os.Lstat(file)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return "missing", false
+	case err != nil:
+		// can't tell, e.g. for lack of permission.
+		return "", false
+	case !finfo.Mode().IsRegular():
+		return "not a regular file", false
+	case !finfo.ModTime().Equal(img.ModTime) || finfo.Size() != img.Size:
+		return "changed", false
+	}
+	return "", false
+}
+
+func dbPrune(args []string, w io.Writer) error {
+	fs := newFlagSet("db prune", "[--dry-run] [--outside-roots]",
+		"Remove the records of files that no longer exist or changed since they were ingested, leaving\n"+
+			"tombstones; the next scan of a changed file ingests it again. Records within a registered root\n"+
+			"(see roots) whose directory is missing are kept, as it may just not be mounted.")
+	dryRun := fs.Bool("dry-run", false, "only print the records that would be removed")
+	outsideRoots := fs.Bool("outside-roots", false,
+		"also remove the records outside of the roots registered for the collection")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument: %s", fs.Arg(0))
+	}
+	collection := rootConfig.collection
+	roots, err := collectionRoots(collection)
+	if err != nil {
+		return fmt.Errorf("failed to read the roots: %w", err)
+	}
+	if *outsideRoots && len(roots) == 0 {
+		return usageError(fs, "no roots are registered for %s, see roots add", collectionLabel(collection))
+	}
+
+	var (
+		stale   []prunable
+		offline int
+	)
+	err = forEachRecord(func(img *Image) error {
+		reason, off := pruneReason(img, roots, *outsideRoots)
+		if off {
+			offline++
+		}
+		if reason != "" {
+			stale = append(stale, prunable{img.Path, reason})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].path < stale[j].path })
+
+	idx, err := getIndex()
+	if err != nil {
+		return err
+	}
+	reasons := make(map[string]int)
+	for _, p := range stale {
+		if *dryRun {
+			_, _ = fmt.Fprintf(w, "would prune: %s (%s)\n", displayPath(p.path), p.reason)
+		} else {
+			if err = buryRecord(idx, p.path, "db prune: "+p.reason); err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(w, "pruned: %s (%s)\n", displayPath(p.path), p.reason)
+		}
+		reasons[p.reason]++
+	}
+	if offline > 0 {
+		log.Warn().Int("records", offline).Msg("kept the records of roots that are offline")
+	}
+	log.Info().Int("count", len(stale)).Interface("reasons", reasons).Bool("dry_run", *dryRun).
+		Msg("db prune finished")
+	return nil
+}
+
+// dbStatistics is what db stats reports.
+type dbStatistics struct {
+	Path        string         `json:"path,omitempty"`
+	Records     int            `json:"records"`
+	Images      int            `json:"images"`
+	Files       int            `json:"files"`
+	Unhashed    int            `json:"unhashed"`
+	Provisional int            `json:"provisional"`
+	StaleLayout int            `json:"stale_layout"`
+	Types       map[string]int `json:"types"`
+	Tombstones  int            `json:"tombstones"`
+	Failures    int            `json:"failures"`
+	Pending     int            `json:"pending"`
+	Bytes       int64          `json:"bytes"`
+}
+
+func dbStats(args []string, w io.Writer) error {
+	fs := newFlagSet("db stats", "[--json]",
+		"Summarize the index: its records by kind and type, the bookkeeping kept besides them, and\n"+
+			"the size of the database on disk.")
+	asJSON := fs.Bool("json", false, "write the statistics as a JSON object")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument: %s", fs.Arg(0))
+	}
+
+	stats := dbStatistics{Path: DB.Path(), Types: make(map[string]int)}
+	err := forEachRecord(func(img *Image) error {
+		stats.Records++
+		switch {
+		case img.Unhashed:
+			stats.Unhashed++
+		case len(img.PHash) > 0:
+			stats.Images++
+		default:
+			stats.Files++
+		}
+		if img.Provisional {
+			stats.Provisional++
+		}
+		if img.staleLayout() {
+			stats.StaleLayout++
+		}
+		stats.Types[img.Type.String()]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	stats.Tombstones = len(DB.With("tombstones").Keys())
+	stats.Failures = len(DB.With("failures").Keys())
+	stats.Pending = len(DB.With("pending").Keys())
+	if stats.Path != "" {
+		stats.Bytes = dirSize(stats.Path)
+	}
+
+	if *asJSON {
+		dat, err := sonic.Marshal(stats)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(dat, '\n'))
+		return err
+	}
+	types := make([]string, 0, len(stats.Types))
+	for t := range stats.Types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if stats.Path != "" {
+		_, _ = fmt.Fprintf(tw, "database\t%s\n", stats.Path)
+	}
+	_, _ = fmt.Fprintf(tw, "records\t%d\n", stats.Records)
+	_, _ = fmt.Fprintf(tw, "  images\t%d\n", stats.Images)
+	_, _ = fmt.Fprintf(tw, "  other files\t%d\n", stats.Files)
+	_, _ = fmt.Fprintf(tw, "  not hashed yet\t%d\n", stats.Unhashed)
+	_, _ = fmt.Fprintf(tw, "  provisional\t%d\n", stats.Provisional)
+	_, _ = fmt.Fprintf(tw, "  stale layout\t%d\n", stats.StaleLayout)
+	for _, t := range types {
+		_, _ = fmt.Fprintf(tw, "type %s\t%d\n", t, stats.Types[t])
+	}
+	_, _ = fmt.Fprintf(tw, "tombstones\t%d\n", stats.Tombstones)
+	_, _ = fmt.Fprintf(tw, "failures\t%d\n", stats.Failures)
+	_, _ = fmt.Fprintf(tw, "pending hashes\t%d\n", stats.Pending)
+	if stats.Path != "" {
+		_, _ = fmt.Fprintf(tw, "size on disk\t%s\n", formatBytes(stats.Bytes))
+	}
+	return tw.Flush()
+}
+
+// dirSize returns the total size of the files within dir.
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if finfo, err := d.Info(); err == nil {
+				size += finfo.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// pathRewrite replaces the prefix from of imported paths with to.
+type pathRewrite struct {
+	from, to string
+}
+
+func (r pathRewrite) apply(path string) (string, bool) {
+	if !withinDir(path, r.from) && !strings.HasPrefix(path, r.from+pageSuffix) {
+		return path, false
+	}
+	return r.to + path[len(r.from):], true
+}
+
+func dbImport(args []string) error {
+	fs := newFlagSet("db import", "[--replace] [--merge-strategy STRATEGY] [--rewrite OLD=NEW]... <file>",
+		"Import the records of a db export (of whole records, not --fields or --hashes-only), e.g. to\n"+
+			"move the index to another machine; - reads from stdin. Records of paths already indexed are\n"+
+			"kept unless --replace is given. Paths differing from one indexed or imported before only in\n"+
+			"case, the same file on a case-insensitive filesystem, are reported and settled by\n"+
+			"--merge-strategy.")
+	replace := fs.Bool("replace", false, "replace the records of paths already indexed")
+	strategy := mergeBoth
+	fs.Func("merge-strategy", "settle the records of paths differing only in case by `STRATEGY`, one of "+
+		mergeStrategyNames()+" (default "+mergeBoth+")", func(s string) error {
+		if _, ok := mergeStrategies[s]; !ok {
+			return fmt.Errorf("unknown strategy %q, expected one of %s", s, mergeStrategyNames())
+		}
+		strategy = s
+		return nil
+	})
+	var rewrites []pathRewrite
+	fs.Func("rewrite", "replace the path prefix `OLD=NEW` of imported records, e.g. for another mount point, "+
+		"repeatable", func(s string) error {
+		from, to, ok := strings.Cut(s, "=")
+		if !ok || from == "" || to == "" {
+			return errors.New("expected OLD=NEW")
+		}
+		rewrites = append(rewrites, pathRewrite{filepath.Clean(from), filepath.Clean(to)})
+		return nil
+	})
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return usageError(fs, "exactly one export file is required")
+	}
+
+	var r io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		r = f
+	}
+	idx, err := getIndex()
+	if err != nil {
+		return err
+	}
+
+	var (
+		scanner                                  = bufio.NewScanner(r)
+		folds                                    = caseFolds()
+		imported, skipped, rewritten, collisions int
+	)
+	// records carry their revisions, and can be long.
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		dat := scanner.Bytes()
+		if len(bytes.TrimSpace(dat)) == 0 {
+			continue
+		}
+		var header hashExportHeader
+		if line == 1 && sonic.Unmarshal(dat, &header) == nil && header.Format != "" {
+			return errors.New("hash exports are for db overlap, they hold no records to import")
+		}
+		img := &Image{}
+		if err = sonic.Unmarshal(dat, img); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		// whole records carry every field of Image, --fields exports name
+		// theirs in lowercase. Records from before layouts were recorded
+		// lack HashLayout and are taken as hashed under the legacy layout.
+		if _, err = sonic.Get(dat, "PHash"); img.Path == "" || err != nil {
+			return fmt.Errorf("line %d: not a whole record, only exports without --fields can be imported", line)
+		}
+		for _, rw := range rewrites {
+			var ok bool
+			if img.Path, ok = rw.apply(img.Path); ok {
+				rewritten++
+				break
+			}
+		}
+		key := []byte(img.Path)
+		if imageStore.Has(key) && !*replace {
+			skipped++
+			continue
+		}
+		if other, ok := folds[foldPath(img.Path)]; ok && other != img.Path {
+			collisions++
+			importing, replacing, err := settleCollision(strategy, img, other)
+			if err != nil {
+				return err
+			}
+			log.Warn().Str("caller", img.Path).Str("collides_with", other).Str("strategy", strategy).
+				Bool("imported", importing).Msg("paths differ only in case")
+			if !importing {
+				skipped++
+				continue
+			}
+			if replacing {
+				if err = buryRecord(idx, other, "import: replaced by "+img.Path); err != nil {
+					return err
+				}
+			}
+		}
+		if dat, err = sonic.Marshal(img); err != nil {
+			return err
+		}
+		if err = imageStore.Put(key, dat); err != nil {
+			return fmt.Errorf("failed to import %s: %w", img.Path, err)
+		}
+		audit("import", img.Path, "")
+		if h, hashErr := imageHash(img); hashErr == nil {
+			err = idx.insert(img.Path, h)
+		} else {
+			err = idx.remove(img.Path)
+		}
+		if err != nil {
+			return fmt.Errorf("similarity index: %w", err)
+		}
+		forgetTombstone(img.Path)
+		folds[foldPath(img.Path)] = img.Path
+		imported++
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	log.Info().Int("imported", imported).Int("skipped", skipped).Int("rewritten", rewritten).
+		Int("case_collisions", collisions).Msg("db import finished")
+	return DB.SyncAll()
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// A manifest records what a scan was asked to do and how it went: the command
+// line, the settings in effect, and the counts, timings and problems that are
+// otherwise spread through the log. It's meant to be attached to bug reports,
+// and to redo a scan with the same settings. The same document, on a single
+// line, is the summary -summary-fd hands to wrappers.
+
+const manifestVersion = 1
+
+type scanManifest struct {
+	Version  int       `json:"version"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Command  []string  `json:"command"`
+	// Roots are the directories the scanned paths were found in.
+	Roots     []string          `json:"roots"`
+	Via       string            `json:"via,omitempty"`
+	Filters   manifestFilters   `json:"filters"`
+	Settings  manifestSettings  `json:"settings"`
+	Counts    manifestCounts    `json:"counts"`
+	Durations manifestDurations `json:"durations"`
+	Errors    manifestErrors    `json:"errors"`
+
+	// streamed holds the directories of streamed paths, see track.
+	streamed map[string]struct{}
+}
+
+type manifestFilters struct {
+	MaxDistance    int      `json:"max_distance"`
+	Thresholds     string   `json:"thresholds,omitempty"`
+	Adaptive       bool     `json:"adaptive_threshold"`
+	IgnoreZero     bool     `json:"ignore_zero"`
+	MinGroupSize   int      `json:"min_group_size"`
+	MaxGroups      int      `json:"max_groups"`
+	GroupOffset    int      `json:"group_offset"`
+	KeepMatch      string   `json:"keep_match,omitempty"`
+	Keep           string   `json:"keep,omitempty"`
+	AllFiles       bool     `json:"all_files"`
+	PDF            bool     `json:"pdf"`
+	Archives       bool     `json:"archives"`
+	Mail           bool     `json:"mail"`
+	ExactPrefilter bool     `json:"exact_prefilter"`
+	RenameFilter   bool     `json:"rename_prefilter"`
+	RetryFailed    bool     `json:"retry_failed"`
+	IncludeTrash   bool     `json:"include_trash"`
+	Extensions     []string `json:"extensions,omitempty"`
+	Exclude        []string `json:"exclude,omitempty"`
+	MinSize        int64    `json:"min_size,omitempty"`
+	MaxSize        int64    `json:"max_size,omitempty"`
+	FollowSymlinks bool     `json:"follow_symlinks"`
+	MaxDepth       int      `json:"max_depth"`
+	NewerThan      string   `json:"newer_than,omitempty"`
+	OlderThan      string   `json:"older_than,omitempty"`
+	TimeBy         string   `json:"time_by,omitempty"`
+}
+
+type manifestSettings struct {
+	Hash          string  `json:"hash"`
+	Index         string  `json:"index"`
+	HNSWEf        int     `json:"hnsw_ef,omitempty"`
+	DistanceCache bool    `json:"distance_cache"`
+	Backend       string  `json:"backend"`
+	Collection    string  `json:"collection,omitempty"`
+	Workers       int     `json:"workers"`
+	AutoWorkers   bool    `json:"auto_workers"`
+	MaxWorkers    int     `json:"max_workers,omitempty"`
+	MaxFiles      int     `json:"max_files,omitempty"`
+	MaxDuration   string  `json:"max_duration,omitempty"`
+	CheckShards   int     `json:"check_shards"`
+	IsolateDecode bool    `json:"isolate_decode"`
+	StatOnly      bool    `json:"stat_only,omitempty"`
+	HashLater     bool    `json:"hash_later,omitempty"`
+	DirSimilarity float64 `json:"dir_similarity,omitempty"`
+	Action        string  `json:"action"`
+	DryRun        bool    `json:"dry_run"`
+	Source        string  `json:"source,omitempty"`
+	// StageLimits are those of read, decode, hash and persist, in the order
+	// they were in before the exif stage, whose limit is ExifLimit.
+	StageLimits [4]int `json:"stage_limits"`
+	ExifLimit   int    `json:"exif_limit"`
+}
+
+type manifestCounts struct {
+	Paths     int `json:"paths"`
+	Hashed    int `json:"hashed"`
+	Stored    int `json:"stored"`
+	Records   int `json:"records"`
+	Pairs     int `json:"pairs"`
+	Groups    int `json:"groups"`
+	Shown     int `json:"shown"`
+	Collapsed int `json:"collapsed"`
+	// Edits counts the duplicates shown that are edits of their keeper.
+	Edits int `json:"edits"`
+	// Reclaimable is what removing the duplicates shown frees by their
+	// sizes, ReclaimableActual on disk, leaving out hardlinks and reflinks.
+	Reclaimable       int64 `json:"reclaimable"`
+	ReclaimableActual int64 `json:"reclaimable_actual"`
+	// Partial marks the counts of a check whose --time-budget ran out.
+	Partial bool `json:"partial,omitempty"`
+	// Types counts the records stored by image type.
+	Types map[string]int `json:"types,omitempty"`
+}
+
+type manifestDurations struct {
+	Ingest string `json:"ingest,omitempty"`
+	Check  string `json:"check,omitempty"`
+	Total  string `json:"total"`
+}
+
+type manifestErrors struct {
+	Denied     int `json:"denied"`
+	Truncated  int `json:"truncated"`
+	Mismatched int `json:"mismatched"`
+	// Failures counts the files that failed to ingest by why, see -retry-failed.
+	Failures map[string]int `json:"failures,omitempty"`
+	Skipped  map[string]int `json:"skipped,omitempty"`
+	// Limited is the limit that stopped the ingest early, see -max-files.
+	Limited string `json:"limited,omitempty"`
+	// Failed is the error the scan ended with, if any.
+	Failed string `json:"failed,omitempty"`
+}
+
+func newScanManifest(cfg *config, paths []string, via string) *scanManifest {
+	return &scanManifest{
+		Version: manifestVersion,
+		Started: time.Now(),
+		Command: os.Args[1:],
+		Roots:   scanRoots(paths),
+		Via:     via,
+		Filters: manifestFilters{
+			MaxDistance:    cfg.maxDistance,
+			Thresholds:     cfg.thresholdFile,
+			Adaptive:       cfg.adaptive,
+			IgnoreZero:     cfg.ignoreZero,
+			MinGroupSize:   cfg.minGroupSize,
+			MaxGroups:      cfg.maxGroups,
+			GroupOffset:    cfg.groupOffset,
+			KeepMatch:      cfg.keepMatch,
+			Keep:           cfg.keep,
+			AllFiles:       allFiles,
+			PDF:            pdfImages,
+			Archives:       archiveImages,
+			Mail:           mailImages,
+			ExactPrefilter: cfg.exactPrefilter,
+			RenameFilter:   cfg.renameFilter,
+			RetryFailed:    retryFailed,
+			IncludeTrash:   includeTrash,
+			Extensions:     walkFilters.extensions(),
+			Exclude:        walkFilters.excludes,
+			MinSize:        int64(walkFilters.minSize),
+			MaxSize:        int64(walkFilters.maxSize),
+			FollowSymlinks: walkFilters.followSymlinks,
+			MaxDepth:       walkFilters.maxDepth,
+			NewerThan:      window.newer.String(),
+			OlderThan:      window.older.String(),
+			TimeBy:         window.timeBy(),
+		},
+		Settings: manifestSettings{
+			Hash:          hashing.String(),
+			Index:         cfg.index,
+			HNSWEf:        cfg.hnswEf,
+			DistanceCache: cfg.distanceCache,
+			StatOnly:      statOnly,
+			HashLater:     hashLater,
+			Backend:       cfg.backend,
+			Collection:    cfg.collection,
+			Workers:       cfg.workers,
+			AutoWorkers:   cfg.autoWorkers,
+			MaxWorkers:    cfg.maxWorkers,
+			MaxFiles:      cfg.maxFiles,
+			MaxDuration:   durationString(cfg.maxDuration),
+			CheckShards:   cfg.shards,
+			IsolateDecode: cfg.isolateDecode,
+			DirSimilarity: cfg.dirSimilarity,
+			Action:        cfg.action,
+			DryRun:        cfg.dryRun,
+			Source:        cfg.source,
+			StageLimits:   [4]int{cfg.readLimit, cfg.decodeLimit, cfg.hashLimit, cfg.persistLimit},
+			ExifLimit:     cfg.exifLimit,
+		},
+		Counts: manifestCounts{Paths: len(paths)},
+	}
+}
+
+// scanRoots returns the directories of paths, leaving out those within
+// another one.
+func scanRoots(paths []string) []string {
+	dirs := make(map[string]struct{})
+	for _, p := range paths {
+		p, _ = filepath.Abs(p)
+		if finfo, err := os.Stat(p); err != nil || !finfo.IsDir() {
+			p = filepath.Dir(p)
+		}
+		dirs[p] = struct{}{}
+	}
+	return outermost(dirs)
+}
+
+// outermost returns the directories of dirs not within another one of them.
+func outermost(dirs map[string]struct{}) []string {
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+	roots := make([]string, 0, len(sorted))
+	for _, dir := range sorted {
+		if n := len(roots); n > 0 {
+			last := roots[n-1]
+			if dir == last || strings.HasPrefix(dir, strings.TrimSuffix(last, string(filepath.Separator))+string(filepath.Separator)) {
+				continue
+			}
+		}
+		roots = append(roots, dir)
+	}
+	return roots
+}
+
+// track counts the paths streamed from next and notes their directories as
+// they pass, which are far fewer to keep than the paths themselves.
+func (m *scanManifest) track(next pathSource) pathSource {
+	m.streamed = make(map[string]struct{})
+	m.Counts.Paths = 0
+	return func() (string, bool) {
+		p, ok := next()
+		if ok {
+			m.Counts.Paths++
+			abs, _ := filepath.Abs(p)
+			m.streamed[filepath.Dir(abs)] = struct{}{}
+		}
+		return p, ok
+	}
+}
+
+// ingested takes the counts of the ingest phase, which took since started.
+func (m *scanManifest) ingested(started time.Time) {
+	m.Durations.Ingest = time.Since(started).String()
+	if m.streamed != nil {
+		m.Roots = outermost(m.streamed)
+	}
+	timings.mu.Lock()
+	m.Counts.Hashed = timings.count
+	timings.mu.Unlock()
+	diskFull.mu.Lock()
+	m.Counts.Stored = diskFull.stored
+	diskFull.mu.Unlock()
+	problems.mu.Lock()
+	m.Errors.Denied, m.Errors.Truncated = len(problems.denied), len(problems.truncated)
+	m.Errors.Mismatched = problems.mismatched
+	m.Errors.Skipped, m.Errors.Failures = copyCounts(problems.skipped), copyCounts(problems.failed)
+	problems.mu.Unlock()
+	m.Counts.Types = ingestedTypes.snapshot()
+	limits.mu.Lock()
+	m.Errors.Limited = limits.reached
+	limits.mu.Unlock()
+}
+
+// checked takes the results of the check phase, which took since started.
+func (m *scanManifest) checked(sum checkSummary, started time.Time) {
+	m.Durations.Check = time.Since(started).String()
+	m.Counts.Records, m.Counts.Pairs = sum.records, sum.pairs
+	m.Counts.Groups, m.Counts.Shown, m.Counts.Collapsed = sum.groups, sum.shown, sum.collapsed
+	m.Counts.Edits = sum.edits
+	m.Counts.Reclaimable, m.Counts.ReclaimableActual = sum.reclaimable, sum.reclaimableActual
+	m.Counts.Partial = sum.partial
+}
+
+// finish completes the manifest with the error the scan ended with, if any.
+func (m *scanManifest) finish(scanErr error) {
+	m.Finished = time.Now()
+	m.Durations.Total = m.Finished.Sub(m.Started).String()
+	if scanErr != nil {
+		m.Errors.Failed = scanErr.Error()
+	}
+}
+
+func (m *scanManifest) write(path string) {
+	dat, err := sonic.ConfigStd.MarshalIndent(m, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, append(dat, '\n'), 0o644)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("failed to write the scan manifest")
+		return
+	}
+	log.Info().Str("path", path).Msg("scan manifest written")
+}
+
+// send writes the manifest to f as a single line and closes f.
+func (m *scanManifest) send(f *os.File) {
+	dat, err := sonic.Marshal(m)
+	if err == nil {
+		_, err = f.Write(append(dat, '\n'))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write the summary")
+	}
+}
+
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func copyCounts(counts map[string]int) map[string]int {
+	if len(counts) == 0 {
+		return nil
+	}
+	c := make(map[string]int, len(counts))
+	for k, n := range counts {
+		c[k] = n
+	}
+	return c
+}
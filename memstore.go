@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"git.tcp.direct/tcp.direct/database"
+	"git.tcp.direct/tcp.direct/database/pogreb"
+)
+
+const (
+	backendPogreb = "pogreb"
+	backendMemory = "memory"
+)
+
+// memKeeper is a database.Keeper that never touches the disk, for one-shot
+// runs whose index is thrown away on exit (-backend memory).
+type memKeeper struct {
+	mu     sync.Mutex
+	stores map[string]*memStore
+}
+
+var errMemoryKeyNotFound = errors.New("key not found")
+
+func newMemKeeper() *memKeeper {
+	return &memKeeper{stores: make(map[string]*memStore)}
+}
+
+func (k *memKeeper) Path() string { return "" }
+
+func (k *memKeeper) Init(name string, _ ...any) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.stores[name]; ok {
+		return pogreb.ErrStoreExists
+	}
+	k.stores[name] = &memStore{m: make(map[string][]byte)}
+	return nil
+}
+
+func (k *memKeeper) With(name string) database.Filer {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, ok := k.stores[name]
+	if !ok {
+		return nil
+	}
+	return s
+}
+
+func (k *memKeeper) WithNew(name string, options ...any) database.Filer {
+	_ = k.Init(name, options...)
+	return k.With(name)
+}
+
+func (k *memKeeper) Destroy(name string) error {
+	k.mu.Lock()
+	delete(k.stores, name)
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *memKeeper) Discover() ([]string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	names := make([]string, 0, len(k.stores))
+	for name := range k.stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (k *memKeeper) AllStores() map[string]database.Filer {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	all := make(map[string]database.Filer, len(k.stores))
+	for name, s := range k.stores {
+		all[name] = s
+	}
+	return all
+}
+
+func (k *memKeeper) Close(name string) error { return k.Destroy(name) }
+
+func (k *memKeeper) CloseAll() error {
+	k.mu.Lock()
+	k.stores = make(map[string]*memStore)
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *memKeeper) SyncAll() error         { return nil }
+func (k *memKeeper) SyncAndCloseAll() error { return k.CloseAll() }
+
+type memStore struct {
+	mu sync.RWMutex
+	m  map[string][]byte
+}
+
+func (s *memStore) Backend() any { return s.m }
+
+func (s *memStore) Has(key []byte) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.m[string(key)]
+	return ok
+}
+
+func (s *memStore) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.m[string(key)]
+	if !ok {
+		return nil, errMemoryKeyNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (s *memStore) Put(key []byte, value []byte) error {
+	s.mu.Lock()
+	s.m[string(key)] = append([]byte(nil), value...)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memStore) Delete(key []byte) error {
+	s.mu.Lock()
+	delete(s.m, string(key))
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memStore) Close() error { return nil }
+func (s *memStore) Sync() error  { return nil }
+
+func (s *memStore) Keys() [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([][]byte, 0, len(s.m))
+	for k := range s.m {
+		keys = append(keys, []byte(k))
+	}
+	return keys
+}
+
+func (s *memStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.m)
+}
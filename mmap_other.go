@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// mapFile reads the file at path whole, there being no mmap to page it in.
+func mapFile(path string) ([]byte, func() error, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dat, func() error { return nil }, nil
+}
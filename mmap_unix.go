@@ -0,0 +1,30 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file at path into memory read-only, its pages read in as
+// they are touched.
+func mapFile(path string) ([]byte, func() error, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = f.Close() }()
+	finfo, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if finfo.Size() == 0 {
+		return nil, func() error { return nil }, nil
+	}
+	dat, err := syscall.Mmap(int(f.Fd()), 0, int(finfo.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dat, func() error { return syscall.Munmap(dat) }, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/fs"
+	"sort"
+	"sync"
+)
+
+// Files of cloud sync clients and hierarchical storage can be placeholders,
+// whose data lives on a server or tape and is fetched the moment the file is
+// read: OneDrive's and Dropbox's online-only files, HSM stubs. A scan reading
+// every image of such a folder recalls all of them, gigabytes of downloads or
+// hours of tape. With -skip-offline, files whose attributes say they're not
+// stored locally are skipped, and counted as offline, before a byte of them is
+// read. What tells them apart depends on the platform, see offlineFile.
+//
+// Where the only sign is a file without blocks allocated, FUSE and network
+// filesystems that don't report blocks look like nothing but placeholders.
+// The skips are therefore counted per filesystem, and a scan that skipped
+// every file of one warns that the heuristic likely misread it.
+
+// skipOffline is set by -skip-offline.
+var skipOffline bool
+
+// offlineMinSize is the size from which a file without any blocks allocated
+// is taken for a stub rather than one stored inline, in its inode.
+const offlineMinSize = 64 << 10
+
+// offlineTally counts the files -skip-offline weighed and skipped on each
+// filesystem, by deviceOf.
+type offlineTally struct {
+	mu      sync.Mutex
+	seen    map[string]int
+	skipped map[string]int
+	// example is a path on each filesystem, to name it by.
+	example map[string]string
+}
+
+var offlineFiles = &offlineTally{}
+
+// skips reports whether the file at path is offline, counting it.
+func (t *offlineTally) skips(path string, finfo fs.FileInfo) bool {
+	offline := offlineFile(finfo)
+	dev := deviceOf(path, finfo)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.seen == nil {
+		t.seen, t.skipped, t.example = make(map[string]int), make(map[string]int), make(map[string]string)
+	}
+	if _, ok := t.example[dev]; !ok {
+		t.example[dev] = path
+	}
+	t.seen[dev]++
+	if offline {
+		t.skipped[dev]++
+	}
+	return offline
+}
+
+// summarize warns of the filesystems every file of which was skipped, and
+// starts counting afresh.
+func (t *offlineTally) summarize() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	devs := make([]string, 0, len(t.seen))
+	for dev := range t.seen {
+		devs = append(devs, dev)
+	}
+	sort.Strings(devs)
+	for _, dev := range devs {
+		if n := t.seen[dev]; n == t.skipped[dev] {
+			log.Warn().Str("caller", t.example[dev]).Str("device", dev).Int("skipped", n).
+				Msg("-skip-offline skipped every file on this filesystem; if they are stored locally, " +
+					"it likely doesn't report allocated blocks, and the scan should run without -skip-offline")
+		}
+	}
+	t.seen, t.skipped, t.example = nil, nil, nil
+}
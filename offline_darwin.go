@@ -0,0 +1,21 @@
+//go:build darwin
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// sfDataless flags the files of File Provider clients, iCloud Drive, Dropbox
+// and OneDrive among them, whose data isn't downloaded.
+const sfDataless = 0x40000000
+
+// offlineFile reports whether finfo's file is a placeholder without its data.
+func offlineFile(finfo fs.FileInfo) bool {
+	st, ok := finfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return st.Flags&sfDataless != 0 || st.Blocks == 0 && finfo.Size() >= offlineMinSize
+}
@@ -0,0 +1,9 @@
+//go:build !unix && !windows
+
+package main
+
+import "io/fs"
+
+func offlineFile(fs.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,19 @@
+//go:build unix && !darwin
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// offlineFile reports whether finfo's file has no blocks allocated for its
+// data, as the stubs HSM leaves of migrated files and the placeholders of
+// FUSE sync clients have.
+func offlineFile(finfo fs.FileInfo) bool {
+	st, ok := finfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return st.Blocks == 0 && finfo.Size() >= offlineMinSize
+}
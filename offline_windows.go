@@ -0,0 +1,24 @@
+//go:build windows
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+const (
+	fileAttributeOffline            = 0x1000
+	fileAttributeRecallOnOpen       = 0x40000
+	fileAttributeRecallOnDataAccess = 0x400000
+)
+
+// offlineFile reports whether finfo's file is offline or recalled when read,
+// by its attributes, as cloud placeholders and HSM stubs are.
+func offlineFile(finfo fs.FileInfo) bool {
+	attrs, ok := finfo.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return false
+	}
+	return attrs.FileAttributes&(fileAttributeOffline|fileAttributeRecallOnOpen|fileAttributeRecallOnDataAccess) != 0
+}
@@ -0,0 +1,30 @@
+package main
+
+import "time"
+
+// Origin records how a record entered the index, so reports can tell the
+// duplicate from a chat export apart from the one out of the camera import.
+type Origin struct {
+	// Source is the label the ingest was given with -source or through the API.
+	Source string `json:"Source"`
+	// Via is how the paths were handed over: arguments, stdin, or api:<token>.
+	Via string `json:"Via"`
+	// Session is when the run or API request that ingested the record started.
+	Session time.Time `json:"Session"`
+}
+
+func newOrigin(source, via string) Origin {
+	return Origin{Source: source, Via: via, Session: time.Now().Truncate(time.Second)}
+}
+
+// String describes the origin for reports by its label, falling back to how
+// and when it was ingested. Records from before origins were kept have none.
+func (o Origin) String() string {
+	switch {
+	case o.Source != "":
+		return o.Source
+	case o.Via != "":
+		return o.Via + " " + o.Session.Format(time.RFC3339)
+	}
+	return ""
+}
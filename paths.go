@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Paths are whatever bytes the filesystem hands out, which needn't be valid
+// UTF-8, e.g. names written under a Latin-1 locale, and may hold control
+// characters. Store keys are those bytes as they are, and so is the output of
+// -print0. JSON strings can't carry invalid UTF-8 without either breaking the
+// document or replacing it, so records, exports, and db ls --format json
+// keep such a path in path_bytes, base64 encoded, and its display form in the
+// path field. Display forms escape what isn't printable, for people and
+// tables; they never stand in for the path.
+//
+// Outputs with a path per line, or per field of one, which scripts read —
+// the text report, the results file of pairs, and -suggest-renames — can't
+// write such a path as it is: a newline in a name would split it into two
+// paths, the second of which a script could delete. They write it as a
+// quoted Go string instead, as they do any path starting with a double
+// quote, so that a line whose path starts with one is unquoted and any other
+// is taken as it is. A warning points to -print0 and -output json, which
+// carry every path unambiguously.
+
+// displayPath renders path with invalid UTF-8 and control characters escaped
+// as in Go strings, e.g. \xff or \n, leaving any other Unicode alone.
+func displayPath(path string) string {
+	if utf8.ValidString(path) && !strings.ContainsFunc(path, unicode.IsControl) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); {
+		r, size := utf8.DecodeRuneInString(path[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			_, _ = fmt.Fprintf(&b, `\x%02x`, path[i])
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case unicode.IsControl(r):
+			_, _ = fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteString(path[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// pathQuoter quotes the paths of a line-oriented output that need it,
+// counting them.
+type pathQuoter struct {
+	quoted int
+}
+
+// path returns path as it is, or quoted as a Go string if it holds control
+// characters or invalid UTF-8, or starts with a double quote.
+func (q *pathQuoter) path(path string) string {
+	if utf8.ValidString(path) && !strings.ContainsFunc(path, unicode.IsControl) && !strings.HasPrefix(path, `"`) {
+		return path
+	}
+	q.quoted++
+	return strconv.Quote(path)
+}
+
+// warn tells that output quoted paths, if it did.
+func (q *pathQuoter) warn(output string) {
+	if q.quoted == 0 {
+		return
+	}
+	log.Warn().Int("paths", q.quoted).Str("output", output).
+		Msg("paths that would be ambiguous as they are were written quoted as Go strings; " +
+			"use -print0 or -output json to read them as they are")
+}
+
+// rawPath returns the bytes of path when a JSON string can't hold them, nil
+// when it can.
+func rawPath(path string) []byte {
+	if utf8.ValidString(path) {
+		return nil
+	}
+	return []byte(path)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// PDFs aren't rendered; instead the first image embedded in them is decoded,
+// which for the scanned documents and photos that end up as PDFs is the page
+// itself. Images in a PDF are stream objects whose dictionary says
+// /Subtype /Image. JPEG streams (DCTDecode) are complete JPEG files, and
+// deflated 8-bit gray or RGB samples (FlateDecode without a predictor) are
+// simple enough to unpack. Anything else, like JBIG2 or JPEG 2000, is skipped.
+// The sizes in a PDF are the file's word, so PDFs over maxPDFSize and images
+// over maxMemberPixels, as for the members of containers, are refused rather
+// than allocated for.
+
+// maxPDFSize is the largest PDF read to look for an image in.
+const maxPDFSize = 1 << 30
+
+// pdfImages makes scans decode the images embedded in PDFs, see -pdf.
+var pdfImages bool
+
+func init() {
+	image.RegisterFormat("pdf", "%PDF-", decodePDF, decodePDFConfig)
+}
+
+var (
+	errPDFNoImage = errors.New("pdf: no embedded image that can be decoded")
+	errPDFTooBig  = errors.New("pdf: file too large to look for an image in")
+
+	pdfSubtypeImage = regexp.MustCompile(`/Subtype\s*/Image\b`)
+	pdfImageMask    = regexp.MustCompile(`/ImageMask\s+true\b`)
+	pdfFilter       = regexp.MustCompile(`/Filter\s*(?:/(\w+)|\[\s*/(\w+)\s*\])`)
+	pdfLength       = regexp.MustCompile(`/Length\s+(\d+)(\s+\d+\s+R)?`)
+	pdfWidth        = regexp.MustCompile(`/Width\s+(\d+)`)
+	pdfHeight       = regexp.MustCompile(`/Height\s+(\d+)`)
+	pdfBits         = regexp.MustCompile(`/BitsPerComponent\s+(\d+)`)
+	pdfColorSpace   = regexp.MustCompile(`/ColorSpace\s*/(\w+)`)
+)
+
+// pdfStream is a stream object along with its dictionary.
+type pdfStream struct {
+	dict, data []byte
+}
+
+func (s pdfStream) int(re *regexp.Regexp) int {
+	m := re.FindSubmatch(s.dict)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(string(m[1]))
+	return n
+}
+
+// nextPDFStream finds the first stream object in dat, returning it along
+// with the rest of dat following it.
+func nextPDFStream(dat []byte) (pdfStream, []byte, bool) {
+	for {
+		i := bytes.Index(dat, []byte("stream"))
+		if i < 0 {
+			return pdfStream{}, nil, false
+		}
+		if i >= 3 && string(dat[i-3:i]) == "end" {
+			dat = dat[i+len("stream"):]
+			continue
+		}
+		dictStart := bytes.LastIndex(dat[:i], []byte("obj"))
+		if dictStart < 0 {
+			dictStart = 0
+		}
+		s := pdfStream{dict: dat[dictStart:i]}
+		rest := dat[i+len("stream"):]
+		switch {
+		case bytes.HasPrefix(rest, []byte("\r\n")):
+			rest = rest[2:]
+		case bytes.HasPrefix(rest, []byte("\n")), bytes.HasPrefix(rest, []byte("\r")):
+			rest = rest[1:]
+		}
+		// the length may be an indirect reference, then only endstream tells.
+		if m := pdfLength.FindSubmatch(s.dict); m != nil && m[2] == nil {
+			if n, err := strconv.Atoi(string(m[1])); err == nil && n <= len(rest) {
+				s.data = rest[:n]
+				return s, rest[n:], true
+			}
+		}
+		end := bytes.Index(rest, []byte("endstream"))
+		if end < 0 {
+			return pdfStream{}, nil, false
+		}
+		s.data = bytes.TrimRight(rest[:end], "\r\n")
+		return s, rest[end:], true
+	}
+}
+
+// decodePDFImage decodes an image stream, reporting false for the kinds we
+// can't decode.
+func decodePDFImage(s pdfStream) (image.Image, bool) {
+	// chains of several filters don't match, we can't unpack those.
+	m := pdfFilter.FindSubmatch(s.dict)
+	if m == nil {
+		return nil, false
+	}
+	switch string(m[1]) + string(m[2]) {
+	case "DCTDecode":
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(s.data))
+		if err != nil || int64(cfg.Width)*int64(cfg.Height) > maxMemberPixels {
+			return nil, false
+		}
+		img, err := jpeg.Decode(bytes.NewReader(s.data))
+		return img, err == nil
+	case "FlateDecode":
+		if bytes.Contains(s.dict, []byte("/DecodeParms")) || s.int(pdfBits) != 8 {
+			return nil, false
+		}
+		return inflatePDFImage(s)
+	}
+	return nil, false
+}
+
+func inflatePDFImage(s pdfStream) (image.Image, bool) {
+	w, h := s.int(pdfWidth), s.int(pdfHeight)
+	if w <= 0 || h <= 0 || w > maxMemberPixels || h > maxMemberPixels || int64(w)*int64(h) > maxMemberPixels {
+		return nil, false
+	}
+	var channels int
+	switch m := pdfColorSpace.FindSubmatch(s.dict); {
+	case m == nil:
+		return nil, false
+	case string(m[1]) == "DeviceGray":
+		channels = 1
+	case string(m[1]) == "DeviceRGB":
+		channels = 3
+	default:
+		return nil, false
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(s.data))
+	if err != nil {
+		return nil, false
+	}
+	pix := make([]byte, w*h*channels)
+	if _, err = io.ReadFull(io.LimitReader(zr, int64(len(pix))), pix); err != nil {
+		return nil, false
+	}
+	if channels == 1 {
+		return &image.Gray{Pix: pix, Stride: w, Rect: image.Rect(0, 0, w, h)}, true
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < w*h; i++ {
+		img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2], img.Pix[i*4+3] = pix[i*3], pix[i*3+1], pix[i*3+2], 0xff
+	}
+	return img, true
+}
+
+func decodePDF(r io.Reader) (image.Image, error) {
+	dat, err := io.ReadAll(io.LimitReader(r, maxPDFSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(dat) > maxPDFSize {
+		return nil, errPDFTooBig
+	}
+	for {
+		s, rest, ok := nextPDFStream(dat)
+		if !ok {
+			return nil, errPDFNoImage
+		}
+		dat = rest
+		if !pdfSubtypeImage.Match(s.dict) || pdfImageMask.Match(s.dict) {
+			continue
+		}
+		if img, ok := decodePDFImage(s); ok {
+			return img, nil
+		}
+	}
+}
+
+func decodePDFConfig(r io.Reader) (image.Config, error) {
+	img, err := decodePDF(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: img.ColorModel(), Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// -hash-later splits a scan in two, so discovery can run while the storage
+// is busy anyway and hashing when it isn't, e.g. overnight: it takes the
+// inventory of a -stat-only scan and queues every file it recorded in the
+// "pending" store, which hash-pending works through later, oldest first,
+// for as long as --max-duration allows. Files leave the queue once they are
+// processed, by hash-pending or by any other scan that hashes them.
+
+// hashLater makes scans queue the files they record for hash-pending.
+var hashLater bool
+
+type pendingEntry struct {
+	Queued time.Time `json:"queued"`
+}
+
+// enqueueHash queues path for hash-pending.
+func enqueueHash(path string) {
+	dat, err := sonic.Marshal(pendingEntry{Queued: time.Now()})
+	if err == nil {
+		err = DB.With("pending").Put([]byte(path), dat)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("caller", path).Msg("failed to queue for hashing")
+	}
+}
+
+// dequeueHash drops path from the queue once it has been processed.
+func dequeueHash(path string) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	store := DB.With("pending")
+	if store == nil || !store.Has([]byte(path)) {
+		return
+	}
+	if err := store.Delete([]byte(path)); err != nil {
+		log.Warn().Err(err).Str("caller", path).Msg("failed to dequeue")
+	}
+}
+
+// pendingPaths returns the queued paths, oldest first.
+func pendingPaths() []string {
+	var (
+		store  = DB.With("pending")
+		paths  = make([]string, 0)
+		queued = make(map[string]time.Time)
+	)
+	for _, k := range store.Keys() {
+		dat, err := store.Get(k)
+		if err != nil {
+			continue
+		}
+		var e pendingEntry
+		if err = sonic.Unmarshal(dat, &e); err != nil {
+			log.Warn().Err(err).Str("caller", string(k)).Msg("unreadable queue entry, hashing it anyway")
+		}
+		paths = append(paths, string(k))
+		queued[string(k)] = e.Queued
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if !queued[paths[i]].Equal(queued[paths[j]]) {
+			return queued[paths[i]].Before(queued[paths[j]])
+		}
+		return paths[i] < paths[j]
+	})
+	return paths
+}
+
+func runHashPending(args []string) error {
+	cfg := *rootConfig
+	fs := newFlagSet("hash-pending", "[--max-duration DURATION] [--max-files N]",
+		"Hash the files queued by -hash-later scans, oldest first. Those left over once a limit is\n"+
+			"reached stay queued for the next run.")
+	fs.DurationVar(&cfg.maxDuration, "max-duration", cfg.maxDuration,
+		"stop hashing after `duration`, e.g. 6h, 0 for no limit")
+	fs.IntVar(&cfg.maxFiles, "max-files", cfg.maxFiles, "stop hashing after `n` files, 0 for no limit")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument: %s", fs.Arg(0))
+	}
+	if cfg.maxDuration < 0 || cfg.maxFiles < 0 {
+		return usageError(fs, "--max-duration and --max-files can't be negative")
+	}
+
+	paths := pendingPaths()
+	if len(paths) == 0 {
+		log.Info().Msg("no files pending hashing")
+		return nil
+	}
+	statOnly, hashLater = false, false
+	err := ingestPaths(context.Background(), &cfg, paths, newOrigin(cfg.source, "hash-pending"))
+	log.Info().Int("queued", len(paths)).Int("remaining", len(DB.With("pending").Keys())).
+		Msg("hash-pending finished")
+	return err
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"git.tcp.direct/kayos/dupehunter/internal/imaging"
+)
+
+// Ingest runs every image through five stages: read (open the file and sniff
+// its type), exif (extract its metadata from the head of the file), decode,
+// hash, and persist. Workers from the pool carry an image through all of
+// them, but each stage admits only as many images at once as its own limit
+// allows, so an image that finished reading waits for a decode slot while the
+// next one is being read. The pool size bounds how many images wait between
+// stages.
+
+// maxRevalidations bounds how often a file that keeps changing underneath us
+// (e.g. a download in progress) is re-processed before it's stored as provisional.
+const maxRevalidations = 2
+
+// stageLimit admits a bounded number of images into a stage, or any number
+// when nil.
+type stageLimit chan struct{}
+
+func newStageLimit(n int) stageLimit {
+	if n < 1 {
+		return nil
+	}
+	return make(stageLimit, n)
+}
+
+func (l stageLimit) do(fn func()) {
+	if l != nil {
+		l <- struct{}{}
+		defer func() { <-l }()
+	}
+	fn()
+}
+
+var stages struct {
+	read, exif, decode, hash, persist stageLimit
+}
+
+// setStageLimits applies the limits given on the command line, 0 meaning
+// unlimited (bounded only by the pool).
+func setStageLimits(read, exif, decode, hash, persist int) {
+	stages.read = newStageLimit(read)
+	stages.exif = newStageLimit(exif)
+	stages.decode = newStageLimit(decode)
+	stages.hash = newStageLimit(hash)
+	stages.persist = newStageLimit(persist)
+}
+
+func (img *Image) FinalProcessing() {
+	// runs last, once the deferred cleanup below is done.
+	defer img.recoverPanic()
+	defer completed.Add(1)
+	defer img.release()
+	defer func() { img.fin <- struct{}{} }()
+	defer img.retireStale()
+	if !statOnly {
+		defer dequeueHash(img.Path)
+	}
+	start := time.Now()
+
+	var (
+		sniffed ImageType
+		ok      bool
+	)
+	stages.read.do(img.traced("read", func() { sniffed, ok = img.readStage() }))
+	if !ok {
+		return
+	}
+	if stages.exif.do(img.traced("exif", func() { ok = img.exifStage(sniffed) })); !ok {
+		return
+	}
+	img.span.set("file.type", sniffed.String())
+	if statOnly {
+		img.statStage(sniffed)
+		stages.persist.do(img.traced("persist", func() { img.persistStage(start) }))
+		if hashLater && len(img.stored) > 0 {
+			enqueueHash(img.Path)
+		}
+		return
+	}
+	if img.archive {
+		img.ingestArchive(start)
+		return
+	}
+	if img.mail {
+		img.ingestMail(start)
+		return
+	}
+	if sniffed == NULL {
+		// only -all-files lets other files through, to be matched by checksum.
+		if stages.hash.do(img.traced("hash", func() { ok = img.checksumStage() })); ok {
+			stages.persist.do(img.traced("persist", func() { img.persistStage(start) }))
+		}
+		return
+	}
+	if sniffed == TIFF && img.ingestPages(start) {
+		return
+	}
+	for attempt := 0; ; attempt++ {
+		if stages.decode.do(img.traced("decode", func() { ok = img.decodeStage() })); !ok {
+			return
+		}
+		var changed bool
+		if stages.hash.do(img.traced("hash", func() { changed, ok = img.hashStage() })); !ok {
+			return
+		}
+		if !changed {
+			break
+		}
+		if attempt == maxRevalidations {
+			log.Warn().Str("caller", img.Name).Msg("file keeps changing, storing provisional record")
+			img.Provisional = true
+			break
+		}
+		log.Debug().Str("caller", img.Name).Msg("file changed while hashing, re-processing")
+		if err := processFile(img); err != nil {
+			if !problems.note(img.Path, err) {
+				logOpenError(img, err)
+			}
+			return
+		}
+	}
+	decodes.remember(img)
+	stages.persist.do(img.traced("persist", func() { img.persistStage(start) }))
+}
+
+// recoverPanic recovers from a panic processing img, which would otherwise
+// take the path of the file to the pool's panic handler, if not the process
+// with it. The file is reported and remembered as a failure, so later scans
+// skip it until it changes.
+func (img *Image) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if img.f != nil {
+		_ = img.f.Close()
+	}
+	log.Error().Str("caller", img.Path).Interface("panic", r).Str("stack", string(debug.Stack())).
+		Msg("processing the file panicked, skipping it until it changes")
+	problems.notePanic(img.Path)
+	rememberFailure(img, "panic", fmt.Sprint("panic: ", r))
+}
+
+// traced runs a stage of img within a span of its own, timed from when the
+// stage admitted the image.
+func (img *Image) traced(name string, fn func()) func() {
+	if img.span == nil {
+		return fn
+	}
+	return func() { tracing.trace(img.span, name, fn) }
+}
+
+// readStage opens the file and sniffs its content, reporting the type and
+// whether the image should go on to be decoded. The file is only opened once
+// a worker picks it up, so queued images don't hold descriptors while they wait.
+func (img *Image) readStage() (ImageType, bool) {
+	if err := processFile(img); err != nil {
+		if !problems.note(img.Path, err) {
+			logOpenError(img, err)
+		}
+		return NULL, false
+	}
+	sniffed, contentType, sniffErr := img.sniff()
+	if sniffErr == nil && sniffed == NULL && archiveImages && isArchive(contentType) {
+		img.archive = true
+		return NULL, true
+	}
+	if sniffErr == nil && sniffed == NULL && mailImages && isMailExport(img.Path) {
+		img.mail = true
+		return NULL, true
+	}
+	if sniffErr == nil && sniffed == NULL && allFiles {
+		return NULL, true
+	}
+	if sniffErr != nil || sniffed == NULL {
+		if sniffErr != nil {
+			log.Warn().Caller().Err(sniffErr).Str("caller", img.Name).Msg("failed to read file")
+			problems.noteFailed("read-error")
+		} else {
+			log.Debug().Str("caller", img.Name).Str("content_type", contentType).Msg("skipping, not an image")
+			rememberFailure(img, "not-image", "not an image: "+contentType)
+		}
+		_ = img.f.Close()
+		return NULL, false
+	}
+	return sniffed, true
+}
+
+// exifStage extracts the EXIF metadata of the opened image from the head of
+// the file, reporting whether the image should go on to be decoded, which it
+// shouldn't when its capture time is outside of the time window.
+func (img *Image) exifStage(sniffed ImageType) bool {
+	if sniffed == NULL {
+		return true
+	}
+	head := newHeadReader(img.f)
+	meta := imaging.ReadExif(head, sniffed.String())
+	head.release()
+	img.Captured, img.Software, img.Exif, img.GPS = meta.Captured, meta.Software, meta.Present, meta.GPS
+	if window.active() && !window.selects(img) {
+		// its record, if any, is left as it is.
+		problems.note(img.Path, &skippedFileError{path: img.Path, kind: "outside-window"})
+		img.replaces = false
+		_ = img.f.Close()
+		return false
+	}
+	return true
+}
+
+// decodeStage decodes the opened file, in an isolated child when configured,
+// which also hashes it, unless an identical image was decoded before. The
+// file is closed either way.
+func (img *Image) decodeStage() bool {
+	if img.reused = decodes.reuse(img); img.reused {
+		return true
+	}
+	var err error
+	if sandbox != nil {
+		err = sandbox.decode(img)
+	} else {
+		err = img.decodeImage()
+	}
+	switch {
+	case errors.Is(err, ErrTruncated):
+		problems.noteTruncated(img.Path)
+		log.Warn().Err(err).Str("caller", img.Name).Msg("image is truncated, not ingesting it")
+		rememberFailure(img, "truncated", err.Error())
+		return false
+	case err != nil && transientFailure(err):
+		log.Warn().Caller().Err(err).Str("caller", img.Name).Msg("failed to ingest, retrying next scan")
+		problems.noteFailed("transient-error")
+		return false
+	case err != nil:
+		log.Warn().Caller().Err(err).Str("caller", img.Name).Msg("failed to ingest")
+		rememberFailure(img, "decode-error", err.Error())
+		return false
+	case img.Type == NULL:
+		hotLog().Trace().Caller().Str("caller", img.Name).Msg("skipping null imagetype")
+		rememberFailure(img, "unknown-type", "unknown image type")
+		return false
+	}
+	return true
+}
+
+// hashStage hashes the decoded image and re-stats the file, reporting whether
+// it changed meanwhile and whether the image should go on.
+func (img *Image) hashStage() (changed, ok bool) {
+	// isolated decoders hand back the finished hash, as do identical images.
+	if sandbox == nil && !img.reused {
+		if err := hashImage(img); err != nil {
+			log.Debug().Caller().Str("caller", img.Name).Msg("failed to hash: " + err.Error())
+			if transientFailure(err) {
+				problems.noteFailed("hash-error")
+			} else {
+				rememberFailure(img, "hash-error", err.Error())
+			}
+			return false, false
+		}
+	}
+	changed, err := img.revalidate()
+	if err != nil {
+		log.Warn().Caller().Err(err).Str("caller", img.Name).Msg("failed to revalidate")
+		return false, false
+	}
+	return changed, true
+}
+
+// persistStage stores the record and adds it to the collection.
+func (img *Image) persistStage(start time.Time) {
+	problems.noteMismatch(img)
+	timings.record(img, time.Since(start))
+	if err := ingestImage(img); err != nil {
+		log.Debug().Caller().Str("caller", img.Name).Msg("failed to ingest: " + err.Error())
+		return
+	}
+	img.stored = append(img.stored, img.Path)
+	forgetFailure(img.Path)
+	forgetTombstone(img.Path)
+	collectionMu.Lock()
+	Collection = append(Collection, img)
+	collectionMu.Unlock()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corona10/goimagehash"
+)
+
+// -hash-plugin hands the hashing to an external program, in whatever
+// language, e.g. a Python script binarizing the embeddings of an ONNX model,
+// in place of the built-in -hash algorithms. The program is started once and
+// kept running, talking one line at a time over its stdin and stdout, and
+// inherits stderr for its own logging:
+//
+//	> dupehunter-hasher 1
+//	< hasher NAME BITS
+//	> hash /abs/path/to/image.jpg
+//	< ok 8f3a...
+//	> hash /tmp/dupehunter-123.png
+//	< error unsupported color model
+//
+// After the handshake, where NAME says which model and version the hashes
+// come from, [A-Za-z0-9._-] only, and BITS how wide they are, 1 to 1024,
+// every image is sent as the absolute path of a file to hash. Images that
+// aren't a file of their own, like the pages of a TIFF or the members of an
+// archive, are decoded and written to a temporary PNG. The plugin answers
+// with the hash in hex, the first bit first, padded with zero bits to whole
+// digits, or with error and why it can't hash it. Hashes are compared by
+// their hamming distance like extended ones, and recorded under the layout
+// plugin/NAME-BITS, so a plugin changing what its hashes mean changes its
+// NAME. When stdin closes the plugin is done. A plugin that crashes, breaks
+// the protocol, or takes longer than -plugin-timeout to reply is restarted for
+// the next image. -embed-plugin talks much the same, see embed.go.
+
+const (
+	hashPluginHello = "dupehunter-hasher 1"
+	// hashPluginLayout prefixes the layouts of plugin hashes.
+	hashPluginLayout  = "plugin/"
+	maxPluginHashBits = 1024
+)
+
+var pluginName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// pluginProcess is a running plugin, answering one request at a time: a
+// -hash-plugin, or an -embed-plugin.
+type pluginProcess struct {
+	argv []string
+	// greeting opens the handshake, to which the plugin replies with its role,
+	// name and size, the latter at most maxSize.
+	greeting, role string
+	maxSize        int
+	name           string
+	size           int
+	// timeout bounds each exchange, the handshake included.
+	timeout time.Duration
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// startPlugin runs command, split at spaces, and shakes hands with it.
+func startPlugin(command, greeting, role string, maxSize int, timeout time.Duration) (*pluginProcess, error) {
+	p := &pluginProcess{argv: strings.Fields(command), greeting: greeting, role: role, maxSize: maxSize, timeout: timeout}
+	if len(p.argv) == 0 {
+		return nil, errors.New("no command given")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p, p.start()
+}
+
+// start runs the plugin and shakes hands with it, with p.mu held.
+func (p *pluginProcess) start() error {
+	cmd := exec.Command(p.argv[0], p.argv[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd, p.stdin, p.stdout = cmd, stdin, bufio.NewReader(stdout)
+	reply, err := p.exchange(p.greeting)
+	if err == nil {
+		err = p.hello(reply)
+	}
+	if err != nil {
+		p.stop()
+		return fmt.Errorf("%s: handshake: %w", p.argv[0], err)
+	}
+	return nil
+}
+
+// hello checks the plugin's reply to the handshake, which must not change
+// over restarts.
+func (p *pluginProcess) hello(reply string) error {
+	fields := strings.Fields(reply)
+	if len(fields) != 3 || fields[0] != p.role {
+		return fmt.Errorf("expected \"%s NAME SIZE\", got %q", p.role, reply)
+	}
+	size, err := strconv.Atoi(fields[2])
+	switch {
+	case !pluginName.MatchString(fields[1]):
+		return fmt.Errorf("invalid name %q, expected letters, digits, and ._- only", fields[1])
+	case err != nil || size < 1 || size > p.maxSize:
+		return fmt.Errorf("invalid size %q, expected 1 to %d", fields[2], p.maxSize)
+	case p.name != "" && (fields[1] != p.name || size != p.size):
+		return fmt.Errorf("restarted as %s of size %d rather than %s of %d", fields[1], size, p.name, p.size)
+	}
+	p.name, p.size = fields[1], size
+	return nil
+}
+
+// layout names what the plugin produces, NAME-SIZE.
+func (p *pluginProcess) layout() string {
+	return p.name + "-" + strconv.Itoa(p.size)
+}
+
+// exchange sends line and reads the reply to it, giving up after p.timeout.
+// The caller stops a plugin it failed to exchange with, which ends the
+// abandoned write or read.
+func (p *pluginProcess) exchange(line string) (string, error) {
+	type result struct {
+		reply string
+		err   error
+	}
+	stdin, stdout := p.stdin, p.stdout
+	done := make(chan result, 1)
+	go func() {
+		if _, err := io.WriteString(stdin, line+"\n"); err != nil {
+			done <- result{err: err}
+			return
+		}
+		reply, err := stdout.ReadString('\n')
+		done <- result{reply, err}
+	}()
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	var res result
+	select {
+	case res = <-done:
+	case <-timer.C:
+		return "", fmt.Errorf("no reply within %s", p.timeout)
+	}
+	if res.err == io.EOF {
+		res.err = errors.New("plugin exited")
+	}
+	if res.err != nil {
+		return "", res.err
+	}
+	return strings.TrimRight(res.reply, "\r\n"), nil
+}
+
+// stop kills the plugin, to be started again for the next request.
+func (p *pluginProcess) stop() {
+	_ = p.stdin.Close()
+	_ = p.cmd.Process.Kill()
+	_ = p.cmd.Wait()
+	p.cmd = nil
+}
+
+// request sends verb and path to the plugin and hands what follows the ok of
+// its reply to parse. A plugin that fails to reply, or with something parse
+// refuses, is stopped.
+func (p *pluginProcess) request(verb, path string, parse func(string) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return err
+		}
+	}
+	reply, err := p.exchange(verb + " " + path)
+	if err != nil {
+		p.stop()
+		return fmt.Errorf("%s plugin: %w", p.role, err)
+	}
+	switch verdict, rest, _ := strings.Cut(reply, " "); verdict {
+	case "ok":
+		if err = parse(rest); err != nil {
+			p.stop()
+			return fmt.Errorf("%s plugin: %w", p.role, err)
+		}
+		return nil
+	case "error":
+		return fmt.Errorf("%s plugin: %s", p.role, rest)
+	}
+	p.stop()
+	return fmt.Errorf("%s plugin: unexpected reply %q", p.role, reply)
+}
+
+// pluginPath returns the absolute path to send a plugin for the image at
+// path, decoded to i. With path empty or not a file of its own, i is written
+// to a temporary PNG, which done removes.
+func pluginPath(path string, i image.Image) (_ string, done func(), err error) {
+	if path == "" || strings.Contains(path, pageSuffix) || strings.ContainsAny(path, "\r\n") {
+		if i == nil {
+			return "", nil, errors.New("not a file of its own")
+		}
+		tmp, err := writeTempPNG(i)
+		if err != nil {
+			return "", nil, err
+		}
+		return tmp, func() { _ = os.Remove(tmp) }, nil
+	}
+	abs, err := filepath.Abs(path)
+	return abs, func() {}, err
+}
+
+// pluginHash has the -hash-plugin p hash the image at path, decoded to i.
+func pluginHash(p *pluginProcess, path string, i image.Image) (*goimagehash.ExtImageHash, error) {
+	path, done, err := pluginPath(path, i)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	var h *goimagehash.ExtImageHash
+	err = p.request("hash", path, func(reply string) (err error) {
+		h, err = parsePluginHash(reply, p.size)
+		return err
+	})
+	return h, err
+}
+
+// parsePluginHash reads a hash of bits in hex into 64 bit words, the first
+// bits in the first.
+func parsePluginHash(s string, bits int) (*goimagehash.ExtImageHash, error) {
+	if len(s) != (bits+3)/4 {
+		return nil, fmt.Errorf("expected %d hex digits for %d bits, got %q", (bits+3)/4, bits, s)
+	}
+	words := make([]uint64, (bits+63)/64)
+	for i := 0; i < len(s); i++ {
+		d, err := strconv.ParseUint(s[i:i+1], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex digit %q", s[i])
+		}
+		words[i/16] |= d << (60 - 4*(i%16))
+	}
+	return goimagehash.NewExtImageHash(words, goimagehash.Unknown, bits), nil
+}
+
+func writeTempPNG(i image.Image) (string, error) {
+	f, err := os.CreateTemp("", "dupehunter-*.png")
+	if err != nil {
+		return "", err
+	}
+	err = png.Encode(f, i)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+
+package main
+
+import "os"
+
+// copyMetadata has no ownership or extended attributes to carry over here,
+// only the permissions copyFile already applied.
+func copyMetadata(_, _ string, _ os.FileInfo) []string {
+	return nil
+}
+
+func linkMetadataLoss(_, _ string, dfi, kfi os.FileInfo) []string {
+	if dfi.Mode().Perm() != kfi.Mode().Perm() {
+		return []string{"permissions " + dfi.Mode().Perm().String()}
+	}
+	return nil
+}
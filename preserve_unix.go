@@ -0,0 +1,92 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrs reads every extended attribute of path. POSIX ACLs are stored as
+// system.posix_acl_* attributes, so they are carried along.
+func xattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	list := make([]byte, size)
+	if size, err = unix.Listxattr(path, list); err != nil {
+		return nil, err
+	}
+	attrs := make(map[string][]byte)
+	for _, name := range bytes.Split(bytes.TrimSuffix(list[:size], []byte{0}), []byte{0}) {
+		n, err := unix.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		val := make([]byte, n)
+		if n, err = unix.Getxattr(path, string(name), val); err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = val[:n]
+	}
+	return attrs, nil
+}
+
+func owner(fi os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// copyMetadata carries the ownership and extended attributes of src, as
+// described by fi, over to dst, listing what couldn't be.
+func copyMetadata(src, dst string, fi os.FileInfo) []string {
+	var lost []string
+	if uid, gid, ok := owner(fi); ok {
+		if err := os.Lchown(dst, uid, gid); err != nil {
+			lost = append(lost, "ownership "+strconv.Itoa(uid)+":"+strconv.Itoa(gid))
+		}
+	}
+	attrs, err := xattrs(src)
+	if err != nil {
+		return append(lost, "extended attributes")
+	}
+	for name, val := range attrs {
+		if err = unix.Setxattr(dst, name, val, 0); err != nil {
+			lost = append(lost, name)
+		}
+	}
+	return lost
+}
+
+// linkMetadataLoss lists the metadata of dupe that a hardlink to keeper, which
+// replaces it, would not have.
+func linkMetadataLoss(dupe, keeper string, dfi, kfi os.FileInfo) []string {
+	var lost []string
+	if dfi.Mode().Perm() != kfi.Mode().Perm() {
+		lost = append(lost, "permissions "+dfi.Mode().Perm().String())
+	}
+	duid, dgid, dok := owner(dfi)
+	kuid, kgid, kok := owner(kfi)
+	if dok && kok && (duid != kuid || dgid != kgid) {
+		lost = append(lost, "ownership "+strconv.Itoa(duid)+":"+strconv.Itoa(dgid))
+	}
+	dattrs, derr := xattrs(dupe)
+	kattrs, kerr := xattrs(keeper)
+	if derr != nil || kerr != nil {
+		return append(lost, "extended attributes")
+	}
+	for name, val := range dattrs {
+		if !bytes.Equal(kattrs[name], val) {
+			lost = append(lost, name)
+		}
+	}
+	return lost
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// problemReport aggregates per-file failures that would otherwise be scattered
+// through the log, so they can be summarized once a scan finishes.
+type problemReport struct {
+	mu         sync.Mutex
+	denied     []string
+	truncated  []string
+	panicked   []string
+	mismatched int
+	// skipped counts the files left alone by why, failed those that couldn't be
+	// ingested.
+	skipped map[string]int
+	failed  map[string]int
+}
+
+var problems = &problemReport{}
+
+// skippedFileError is returned for files that are never worth decoding, like
+// FIFOs (which would block the worker forever) or zero-byte files.
+type skippedFileError struct {
+	path, kind string
+}
+
+func (e *skippedFileError) Error() string {
+	return "skipping " + e.kind + " file: " + e.path
+}
+
+// skipKind classifies path, of finfo, as a file that can't be an image, or
+// returns "".
+func skipKind(path string, finfo fs.FileInfo) string {
+	mode := finfo.Mode()
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeDevice != 0:
+		return "device"
+	case !mode.IsRegular():
+		return "irregular"
+	case finfo.Size() == 0:
+		return "empty"
+	case isSidecar(finfo.Name()):
+		return "sidecar"
+	case skipOffline && offlineFiles.skips(path, finfo):
+		return "offline"
+	}
+	return ""
+}
+
+// note records err against path if it is a permission error or a skipped
+// file, reporting whether it was.
+func (p *problemReport) note(path string, err error) bool {
+	var skipped *skippedFileError
+	switch {
+	case errors.As(err, &skipped):
+		hotLog().Trace().Str("caller", path).Str("kind", skipped.kind).Msg("skipping file")
+		p.mu.Lock()
+		if p.skipped == nil {
+			p.skipped = make(map[string]int)
+		}
+		p.skipped[skipped.kind]++
+		p.mu.Unlock()
+	case errors.Is(err, fs.ErrPermission):
+		p.mu.Lock()
+		p.denied = append(p.denied, path)
+		p.mu.Unlock()
+	default:
+		return false
+	}
+	return true
+}
+
+// noteMismatch reports an image whose extension claims a different type than its content.
+func (p *problemReport) noteMismatch(img *Image) {
+	if img.ClaimedType == img.Type {
+		return
+	}
+	log.Info().Str("caller", img.Path).Str("claimed", img.claimed()).Str("actual", img.Type.String()).
+		Msg("extension does not match content")
+	p.mu.Lock()
+	p.mismatched++
+	p.mu.Unlock()
+}
+
+// noteFailed counts a file that couldn't be ingested for the kind of reason.
+func (p *problemReport) noteFailed(kind string) {
+	p.mu.Lock()
+	if p.failed == nil {
+		p.failed = make(map[string]int)
+	}
+	p.failed[kind]++
+	p.mu.Unlock()
+}
+
+// notePanic reports a file processing panicked on.
+func (p *problemReport) notePanic(path string) {
+	p.mu.Lock()
+	p.panicked = append(p.panicked, path)
+	p.mu.Unlock()
+}
+
+func (p *problemReport) noteTruncated(path string) {
+	p.mu.Lock()
+	p.truncated = append(p.truncated, path)
+	p.mu.Unlock()
+}
+
+// summarize logs the aggregated counts and writes the denied and truncated
+// paths to deniedPath and truncatedPath, if set, one per line.
+func (p *problemReport) summarize(deniedPath, truncatedPath string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.skipped) > 0 {
+		log.Info().Dict("skipped", countsDict(p.skipped)).Msg("skipped files")
+	}
+	if len(p.failed) > 0 {
+		log.Warn().Dict("failed", countsDict(p.failed)).Msg("files that couldn't be ingested")
+	}
+	if len(p.panicked) > 0 {
+		sort.Strings(p.panicked)
+		log.Error().Strs("paths", p.panicked).
+			Msg("files that crashed processing, skipped until they change or -retry-failed")
+	}
+	if p.mismatched > 0 {
+		log.Warn().Int("count", p.mismatched).
+			Msg("ingested files whose extension does not match their content, see db ls --mismatched")
+	}
+	return errors.Join(
+		summarizeList(p.denied, deniedPath, "skipped files due to permission errors"),
+		summarizeList(p.truncated, truncatedPath, "skipped truncated images, re-download them"),
+	)
+}
+
+// countsDict logs counts in key order.
+func countsDict(counts map[string]int) *zerolog.Event {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	dict := zerolog.Dict()
+	for _, k := range keys {
+		dict = dict.Int(k, counts[k])
+	}
+	return dict
+}
+
+func summarizeList(paths []string, listPath, msg string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	sort.Strings(paths)
+	ev := log.Warn().Int("count", len(paths))
+	if listPath != "" {
+		ev = ev.Str("list", listPath)
+	}
+	ev.Msg(msg)
+	if listPath == "" {
+		return nil
+	}
+	f, err := os.Create(listPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, path := range paths {
+		_, _ = w.WriteString(path + "\n")
+	}
+	if err = w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	runtimepprof "runtime/pprof"
+)
+
+// startProfiling enables the requested profilers. The returned function stops
+// the CPU profile and writes the heap profile, and must be called before exit.
+func startProfiling(pprofAddr, cpuProfile, memProfile string) (func(), error) {
+	if pprofAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		go func() {
+			log.Info().Str("addr", pprofAddr).Msg("serving pprof on /debug/pprof/")
+			if err := http.ListenAndServe(pprofAddr, mux); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error().Err(err).Str("addr", pprofAddr).Msg("pprof server failed")
+			}
+		}()
+	}
+
+	var cpuFile *os.File
+	if cpuProfile != "" {
+		var err error
+		if cpuFile, err = os.Create(cpuProfile); err != nil {
+			return nil, err
+		}
+		if err = runtimepprof.StartCPUProfile(cpuFile); err != nil {
+			_ = cpuFile.Close()
+			return nil, err
+		}
+	}
+
+	return func() {
+		if cpuFile != nil {
+			runtimepprof.StopCPUProfile()
+			_ = cpuFile.Close()
+			log.Info().Str("path", cpuProfile).Msg("cpu profile written")
+		}
+		if memProfile == "" {
+			return
+		}
+		f, err := os.Create(memProfile)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to create memory profile")
+			return
+		}
+		runtime.GC()
+		if err = runtimepprof.WriteHeapProfile(f); err != nil {
+			log.Error().Err(err).Msg("failed to write memory profile")
+		}
+		_ = f.Close()
+		log.Info().Str("path", memProfile).Msg("memory profile written")
+	}, nil
+}
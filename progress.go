@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// progress tracks what a long-running process is doing, so the API can
+// report on scans while they run.
+var progress = &scanProgress{phase: phaseIdle}
+
+const (
+	phaseIdle   = "idle"
+	phaseIngest = "ingest"
+	phaseCheck  = "check"
+	phaseClean  = "clean"
+)
+
+type scanProgress struct {
+	mu        sync.Mutex
+	phase     string
+	started   time.Time
+	total     int
+	processed int
+}
+
+type progressSnapshot struct {
+	Phase     string     `json:"phase"`
+	Started   *time.Time `json:"started,omitempty"`
+	Total     int        `json:"total"`
+	Processed int        `json:"processed"`
+	// ETA is only estimated once something was processed.
+	ETA string `json:"eta,omitempty"`
+	// queued work waits for a free worker, interactive work goes first.
+	QueuedInteractive int `json:"queued_interactive"`
+	QueuedBulk        int `json:"queued_bulk"`
+	Workers           int `json:"workers"`
+}
+
+// begin starts a phase of total steps.
+func (p *scanProgress) begin(phase string, total int) {
+	p.mu.Lock()
+	p.phase, p.started, p.total, p.processed = phase, time.Now(), total, 0
+	p.mu.Unlock()
+}
+
+func (p *scanProgress) advance() {
+	p.mu.Lock()
+	p.processed++
+	p.mu.Unlock()
+}
+
+func (p *scanProgress) end() {
+	p.begin(phaseIdle, 0)
+}
+
+func (p *scanProgress) snapshot() progressSnapshot {
+	p.mu.Lock()
+	snap := progressSnapshot{Phase: p.phase, Total: p.total, Processed: p.processed}
+	if p.phase != phaseIdle {
+		started := p.started
+		snap.Started = &started
+		if p.processed > 0 && p.processed < p.total {
+			perStep := time.Since(p.started) / time.Duration(p.processed)
+			snap.ETA = (perStep * time.Duration(p.total-p.processed)).Round(time.Second).String()
+		}
+	}
+	p.mu.Unlock()
+	if workers != nil {
+		snap.QueuedInteractive, snap.QueuedBulk = lanes.queued()
+		snap.Workers = workers.Cap()
+	}
+	return snap
+}
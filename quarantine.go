@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// Every move into a quarantine directory is recorded in a manifest at its top,
+// one JSON object per line, so duplicates can be purged once their grace
+// period is over. The manifest lives with the files rather than in the
+// database, the directory may be inspected or purged from another machine.
+
+const quarantineManifest = ".dupehunter-quarantine"
+
+var quarantineCommands = []command{
+	{"purge", "permanently delete quarantined duplicates after a grace period", func(args []string) error {
+		return quarantinePurge(args, os.Stdout)
+	}},
+}
+
+type quarantineEntry struct {
+	// Path is relative to the quarantine directory.
+	Path        string    `json:"path"`
+	Original    string    `json:"original"`
+	Keeper      string    `json:"keeper"`
+	Quarantined time.Time `json:"quarantined"`
+}
+
+func runQuarantine(args []string) error {
+	fs := newFlagSet("quarantine", "<command> [flags]", "Manage directories duplicates were moved into.")
+	usage := fs.Usage
+	fs.Usage = func() {
+		usage()
+		printCommands(fs.Output(), "quarantine", quarantineCommands)
+	}
+	return dispatch(fs, quarantineCommands, args)
+}
+
+// recordQuarantined appends the entry for a moved duplicate to the manifest of dir.
+func recordQuarantined(dir, dst, original, keeper string) error {
+	rel, err := filepath.Rel(dir, dst)
+	if err != nil {
+		return err
+	}
+	dat, err := sonic.Marshal(quarantineEntry{Path: rel, Original: original, Keeper: keeper, Quarantined: time.Now()})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, quarantineManifest), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(dat, '\n')); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func readQuarantine(dir string) ([]quarantineEntry, error) {
+	f, err := os.Open(filepath.Join(dir, quarantineManifest))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var (
+		entries = make([]quarantineEntry, 0)
+		scanner = bufio.NewScanner(f)
+	)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e quarantineEntry
+		if err = sonic.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("corrupt quarantine manifest line %d: %w", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// writeQuarantine replaces the manifest of dir with entries.
+func writeQuarantine(dir string, entries []quarantineEntry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		dat, err := sonic.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(dat, '\n'))
+	}
+	tmp := filepath.Join(dir, quarantineManifest+".tmp")
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, quarantineManifest))
+}
+
+// parseAge parses a duration that may also be given in days, like 30d.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid number of days %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func quarantinePurge(args []string, w io.Writer) error {
+	fs := newFlagSet("quarantine purge", "--older-than AGE [--dry-run] <dir>",
+		"Permanently delete duplicates that have been in the quarantine directory longer than AGE.")
+	olderThan := fs.String("older-than", "", "grace `age`, e.g. 30d or 72h")
+	dryRun := fs.Bool("dry-run", false, "only print the files that would be deleted")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return usageError(fs, "exactly one quarantine directory is required")
+	}
+	if *olderThan == "" {
+		return usageError(fs, "--older-than is required")
+	}
+	age, err := parseAge(*olderThan)
+	if err != nil {
+		return usageError(fs, "invalid value %q for --older-than: %s", *olderThan, err)
+	}
+
+	dir := args[0]
+	entries, err := readQuarantine(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read quarantine manifest: %w", err)
+	}
+
+	var (
+		cutoff = time.Now().Add(-age)
+		kept   = make([]quarantineEntry, 0, len(entries))
+		purged int
+	)
+	for _, e := range entries {
+		if e.Quarantined.After(cutoff) {
+			kept = append(kept, e)
+			continue
+		}
+		// the manifest is only a file in dir, anyone who can write it
+		// shouldn't get to point purge at files elsewhere.
+		if !filepath.IsLocal(e.Path) {
+			log.Warn().Str("caller", e.Path).Str("quarantine", dir).
+				Msg("refusing to purge a manifest entry that isn't within the quarantine directory")
+			kept = append(kept, e)
+			continue
+		}
+		path := filepath.Join(dir, e.Path)
+		if *dryRun {
+			_, _ = fmt.Fprintf(w, "would delete: %s\n", path)
+			purged++
+			continue
+		}
+		if err = os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warn().Err(err).Str("caller", path).Msg("failed to delete quarantined file")
+			kept = append(kept, e)
+			continue
+		}
+		removeEmptyParents(filepath.Dir(path), dir)
+		audit("purge", path, "quarantined "+e.Quarantined.Format(time.RFC3339))
+		_, _ = fmt.Fprintf(w, "deleted: %s\n", path)
+		purged++
+	}
+
+	if !*dryRun && purged > 0 {
+		if err = writeQuarantine(dir, kept); err != nil {
+			return fmt.Errorf("failed to update quarantine manifest: %w", err)
+		}
+	}
+	log.Info().Int("purged", purged).Int("remaining", len(kept)).Bool("dry_run", *dryRun).Msg("quarantine purge finished")
+	return nil
+}
+
+// removeEmptyParents removes dir and its parents up to, but not including,
+// top for as long as they are empty.
+func removeEmptyParents(dir, top string) {
+	for withinDir(dir, top) && filepath.Clean(dir) != filepath.Clean(top) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/bytedance/sonic"
+)
+
+// queryMatch is an indexed record similar to a queried image.
+type queryMatch struct {
+	Path     string `json:"path"`
+	Distance int    `json:"distance"`
+}
+
+// imageQueried returns the image at path with its PHash set, reusing its
+// record when the file is unchanged since ingest and hashed under this run's
+// layout, and otherwise decoding it in the interactive lane without storing
+// anything.
+func imageQueried(path string) (*Image, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if kind := skipKind(path, finfo); kind != "" {
+		return nil, &skippedFileError{path: path, kind: kind}
+	}
+	if dat, err := imageStore.Get([]byte(path)); err == nil {
+		var rec Image
+		if sonic.Unmarshal(dat, &rec) == nil && !rec.Provisional && !rec.staleLayout() &&
+			rec.ModTime.Equal(finfo.ModTime()) && rec.Size == finfo.Size() {
+			return &rec, nil
+		}
+	}
+
+	img := &Image{
+		Path:      path,
+		Name:      finfo.Name(),
+		ModTime:   finfo.ModTime(),
+		Size:      finfo.Size(),
+		closeOnce: &sync.Once{},
+		b:         bufs.Get(),
+	}
+	done := make(chan error, 1)
+	lanes.submit(func() { done <- img.hashOnly() }, true)
+	if err = <-done; err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// hashOnly decodes and hashes img like FinalProcessing, without ingesting it.
+func (img *Image) hashOnly() (err error) {
+	defer img.release()
+	if err = processFile(img); err != nil {
+		return err
+	}
+	sniffed, contentType, err := img.sniff()
+	if err == nil && sniffed == NULL {
+		err = errors.New("not an image: " + contentType)
+	}
+	if err != nil {
+		_ = img.f.Close()
+		return err
+	}
+	if sandbox != nil {
+		return sandbox.decode(img)
+	}
+	if err = img.decodeImage(); err != nil {
+		return err
+	}
+	return hashImage(img)
+}
+
+// queryIndex returns the records within radius of img, closest first,
+// leaving out those hashed under another layout.
+func queryIndex(img *Image, radius int) ([]queryMatch, error) {
+	h, err := imageHash(img)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := getIndex()
+	if err != nil {
+		return nil, err
+	}
+	var matches = make([]queryMatch, 0)
+	for _, m := range idx.query(h, min(radius, 64)) {
+		other := &Image{}
+		dat, err := imageStore.Get([]byte(m.path))
+		if err != nil || sonic.Unmarshal(dat, other) != nil || other.layout() != img.layout() {
+			continue
+		}
+		distance := m.distance
+		if extendedLayout(img.layout()) {
+			// the index only measured the first words.
+			if distance, err = recordDistance(img, other); err != nil || distance > radius {
+				continue
+			}
+		}
+		matches = append(matches, queryMatch{Path: m.path, Distance: distance})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].Path < matches[j].Path
+	})
+	return matches, nil
+}
+
+// nearestIndex returns the top records closest to img, closest first,
+// however far they are, leaving out img itself. The radius searched grows
+// until it holds top records, the nearest of which are then all within it.
+func nearestIndex(img *Image, top int) ([]queryMatch, error) {
+	var matches []queryMatch
+	for radius := 4; ; radius *= 2 {
+		radius = min(radius, hashing.bits())
+		var err error
+		if matches, err = queryIndex(img, radius); err != nil {
+			return nil, err
+		}
+		matches = slices.DeleteFunc(matches, func(m queryMatch) bool { return m.Path == img.Path })
+		if len(matches) >= top || radius == hashing.bits() {
+			break
+		}
+	}
+	return matches[:min(top, len(matches))], nil
+}
+
+func runQuery(args []string) error {
+	fs := newFlagSet("query", "[--top K] [--json] <image>",
+		"List the indexed images similar to an image, closest first, without ingesting it: those within\n"+
+			"-d, or with --top the K nearest however far they are, e.g. to find the closest thing to a\n"+
+			"picture when nothing is a duplicate of it.")
+	top := fs.Int("top", 0, "list the `K` nearest images regardless of -d")
+	asJSON := fs.Bool("json", false, "write the matches as JSON lines")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return usageError(fs, "exactly one image is required")
+	}
+	if *top < 0 {
+		return usageError(fs, "invalid value %d for --top: must be positive", *top)
+	}
+	img, err := imageQueried(args[0])
+	if err != nil {
+		return err
+	}
+	if len(img.PHash) == 0 {
+		return errors.New("no perceptual hash for " + args[0])
+	}
+	var matches []queryMatch
+	if *top > 0 {
+		matches, err = nearestIndex(img, *top)
+	} else {
+		matches, err = queryIndex(img, rootConfig.maxDistance-1)
+		matches = slices.DeleteFunc(matches, func(m queryMatch) bool { return m.Path == img.Path })
+	}
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	for _, m := range matches {
+		if *asJSON {
+			dat, err := sonic.Marshal(m)
+			if err != nil {
+				return err
+			}
+			_, _ = w.Write(append(dat, '\n'))
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "%d\t%s\n", m.Distance, displayPath(m.Path))
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	log.Info().Str("caller", img.Path).Int("matches", len(matches)).Msg("query finished")
+	return nil
+}
+
+// distancePairLimit caps the pairs of a /v1/distance request.
+const distancePairLimit = 10000
+
+// queryTopLimit caps the top of a /v1/query request.
+const queryTopLimit = 1000
+
+// distanceResult is the distance between the two sides of a requested pair,
+// each a hash as listed by db ls or the absolute path of an image.
+type distanceResult struct {
+	A         string `json:"a"`
+	B         string `json:"b"`
+	Distance  *int   `json:"distance,omitempty"`
+	Duplicate bool   `json:"duplicate"`
+	Error     string `json:"error,omitempty"`
+}
+
+// hashedSide is a side of a distance pair resolved to its hash. img carries
+// the path and dimensions thresholds depend on, which a bare hash lacks.
+type hashedSide struct {
+	img  *Image
+	kind string
+	h    uint64
+}
+
+// errNotIndexed refuses a path without a record to a caller that may only
+// read the index.
+var errNotIndexed = errors.New("not indexed, querying other files needs the ingest scope")
+
+// indexedPath reports whether the absolute path has a record. Checking it
+// before imageQueried keeps read-only callers from statting or decoding any
+// file the server can reach.
+func indexedPath(path string) bool {
+	return imageStore.Has([]byte(filepath.Clean(path)))
+}
+
+// resolveSide hashes a side of a distance pair, refusing paths that aren't
+// indexed when indexedOnly.
+func resolveSide(side string, indexedOnly bool) (*hashedSide, error) {
+	if !filepath.IsAbs(side) {
+		kind, h, ok := splitHash(side)
+		if !ok {
+			return nil, errors.New("expected a hash like d:0123456789abcdef or an absolute path")
+		}
+		return &hashedSide{img: &Image{}, kind: kind, h: h}, nil
+	}
+	if indexedOnly && !indexedPath(side) {
+		return nil, errNotIndexed
+	}
+	img, err := imageQueried(side)
+	if err != nil {
+		return nil, err
+	}
+	if len(img.PHash) == 0 {
+		return nil, errors.New("no perceptual hash for " + side)
+	}
+	// extended hashes don't fit h, images are compared by their records.
+	kind, h, _ := splitHash(img.hashString())
+	return &hashedSide{img: img, kind: kind, h: h}, nil
+}
+
+// pairDistances measures the distance of every pair, resolving each side
+// once however often it appears. Pairs failing to resolve, or of different
+// hash kinds, carry an error rather than failing the others. indexedOnly is
+// passed on to resolveSide.
+func pairDistances(cfg *config, pairs [][2]string, indexedOnly bool) []distanceResult {
+	var (
+		resolved = make(map[string]*hashedSide)
+		failed   = make(map[string]error)
+		results  = make([]distanceResult, 0, len(pairs))
+	)
+	resolve := func(side string) (*hashedSide, error) {
+		if err, ok := failed[side]; ok {
+			return nil, err
+		}
+		if hs, ok := resolved[side]; ok {
+			return hs, nil
+		}
+		hs, err := resolveSide(side, indexedOnly)
+		if err != nil {
+			failed[side] = err
+			return nil, err
+		}
+		resolved[side] = hs
+		return hs, nil
+	}
+	for _, pair := range pairs {
+		result := distanceResult{A: pair[0], B: pair[1]}
+		a, err := resolve(pair[0])
+		if err != nil {
+			result.Error = pair[0] + ": " + err.Error()
+			results = append(results, result)
+			continue
+		}
+		b, err := resolve(pair[1])
+		if err != nil {
+			result.Error = pair[1] + ": " + err.Error()
+			results = append(results, result)
+			continue
+		}
+		if a.img.staleLayout() || b.img.staleLayout() {
+			result.Error = errHashLayout.Error() + ", run db rehash --stale-layout"
+			results = append(results, result)
+			continue
+		}
+		if a.kind != b.kind {
+			result.Error = "hashes of different kinds, " + a.kind + " and " + b.kind + ", can't be compared"
+			results = append(results, result)
+			continue
+		}
+		var distance int
+		switch aImage, bImage := len(a.img.PHash) > 0, len(b.img.PHash) > 0; {
+		case aImage && bImage:
+			distance, err = recordDistance(a.img, b.img)
+		case (aImage && extendedLayout(a.img.layout())) || (bImage && extendedLayout(b.img.layout())):
+			err = errors.New("extended hashes are only compared between images")
+		default:
+			distance = hashDistance(a.h, b.h)
+		}
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+		result.Distance = &distance
+		result.Duplicate = distance < cfg.pairThreshold(a.img, b.img)
+		results = append(results, result)
+	}
+	return results
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// Records are stored as a storedImage rather than whatever the Image struct
+// holds, so what the database keeps is decided here: fields are named
+// explicitly, those of no value are left out, and nothing of the ingest
+// itself, its buffers and channels, can end up on disk. Keys keep the names
+// records had before, so older databases read as they are; a field renamed
+// in Image keeps its key here.
+
+type storedImage struct {
+	Type        ImageType `json:"Type"`
+	ClaimedType ImageType `json:"ClaimedType"`
+	Name        string    `json:"Name"`
+	Path        string    `json:"Path"`
+	// PathBytes holds a path JSON strings can't, see displayPath.
+	PathBytes   []byte       `json:"path_bytes,omitempty"`
+	ModTime     time.Time    `json:"ModTime"`
+	Captured    *time.Time   `json:"Captured,omitempty"`
+	Software    string       `json:"software,omitempty"`
+	Exif        bool         `json:"exif,omitempty"`
+	GPS         *gpsPosition `json:"gps,omitempty"`
+	Size        int64        `json:"Size"`
+	Width       int          `json:"Width"`
+	Height      int          `json:"Height"`
+	Ingested    time.Time    `json:"Ingested"`
+	Origin      Origin       `json:"Origin"`
+	PHash       []byte       `json:"PHash,omitempty"`
+	HashLayout  string       `json:"hash_layout,omitempty"`
+	Center      *centerHash  `json:"center,omitempty"`
+	Grayscale   bool         `json:"grayscale,omitempty"`
+	Checksum    []byte       `json:"Checksum,omitempty"`
+	Provisional bool         `json:"Provisional,omitempty"`
+	Unhashed    bool         `json:"unhashed,omitempty"`
+	History     []revision   `json:"history,omitempty"`
+}
+
+func (img *Image) MarshalJSON() ([]byte, error) {
+	rec := storedImage{
+		Type:        img.Type,
+		ClaimedType: img.ClaimedType,
+		Name:        img.Name,
+		Path:        img.Path,
+		ModTime:     img.ModTime,
+		Software:    img.Software,
+		Exif:        img.Exif,
+		GPS:         img.GPS,
+		Size:        img.Size,
+		Width:       img.Width,
+		Height:      img.Height,
+		Ingested:    img.Ingested,
+		Origin:      img.Origin,
+		PHash:       img.PHash,
+		HashLayout:  img.HashLayout,
+		Center:      img.Center,
+		Grayscale:   img.Grayscale,
+		Checksum:    img.Checksum,
+		Provisional: img.Provisional,
+		Unhashed:    img.Unhashed,
+		History:     img.History,
+	}
+	if !img.Captured.IsZero() {
+		rec.Captured = &img.Captured
+	}
+	if raw := rawPath(img.Path); raw != nil {
+		rec.Path, rec.Name, rec.PathBytes = displayPath(img.Path), displayPath(img.Name), raw
+	}
+	return sonic.Marshal(&rec)
+}
+
+func (img *Image) UnmarshalJSON(dat []byte) error {
+	var rec storedImage
+	if err := sonic.Unmarshal(dat, &rec); err != nil {
+		return err
+	}
+	// the fields of the ingest, if any, are left alone.
+	img.Type, img.ClaimedType, img.Name, img.Path = rec.Type, rec.ClaimedType, rec.Name, rec.Path
+	img.ModTime, img.Captured, img.Software, img.Exif = rec.ModTime, time.Time{}, rec.Software, rec.Exif
+	img.GPS = rec.GPS
+	img.Size, img.Width, img.Height = rec.Size, rec.Width, rec.Height
+	img.Ingested, img.Origin = rec.Ingested, rec.Origin
+	img.PHash, img.HashLayout, img.Center, img.Checksum = rec.PHash, rec.HashLayout, rec.Center, rec.Checksum
+	img.Grayscale = rec.Grayscale
+	img.Provisional, img.Unhashed, img.History = rec.Provisional, rec.Unhashed, rec.History
+	if rec.Captured != nil {
+		img.Captured = *rec.Captured
+	}
+	if rec.PathBytes != nil {
+		img.Path = string(rec.PathBytes)
+		img.Name = filepath.Base(img.Path)
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"git.tcp.direct/tcp.direct/database"
+	"git.tcp.direct/tcp.direct/database/loader"
+	"git.tcp.direct/tcp.direct/database/pogreb"
+	"git.tcp.direct/tcp.direct/database/registry"
+	"github.com/bytedance/sonic"
+)
+
+// When pogreb's own recovery can't open a store, every run fails on it. db
+// recover moves the damaged database aside, next to it with a .damaged-TIME
+// suffix, and copies what it can read of it, store by store and key by key,
+// into a new one: records that decode and match their checksum, and what
+// the other stores hold. The similarity index and the checksums are built
+// anew from the records. A store that can't be opened at all, or panics
+// while being read, is lost as a whole. The paths of the records that were
+// lost, as far as the damaged records, index, and checksums name them, are
+// listed, and those whose files still exist are hashed again with --rehash,
+// or written to lost-files in the damaged directory for later.
+
+// datastorePath is the directory of the database this run opened, "" for the
+// memory backend.
+var datastorePath string
+
+// storeSalvage is what db recover made of a store.
+type storeSalvage struct {
+	name         string
+	copied, lost int
+	// unopened is why the store couldn't be read at all, or to the end.
+	unopened error
+	// rebuilt tells the store is built anew from the records.
+	rebuilt bool
+}
+
+func dbRecover(args []string) error {
+	fs := newFlagSet("db recover", "[--rehash]",
+		"Move a database that fails to open, or to read, aside and copy what can be read of it into a new\n"+
+			"one, listing the records that were lost. With --rehash, the files of lost records that still\n"+
+			"exist are hashed again.")
+	rehash := fs.Bool("rehash", false, "hash the files of lost records again")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument: %s", fs.Arg(0))
+	}
+	return recoverDatabase(*rehash, os.Stdout)
+}
+
+func recoverDatabase(rehash bool, w io.Writer) error {
+	if datastorePath == "" {
+		return errors.New("the memory backend has no database to recover")
+	}
+	dest := datastorePath
+	if DB != nil {
+		// what a damaged store holds is read back from disk, not synced over it.
+		_ = DB.CloseAll()
+		DB = nil
+	}
+	damaged := dest + ".damaged-" + time.Now().Format("20060102-150405")
+	if err := os.Rename(dest, damaged); err != nil {
+		return fmt.Errorf("failed to move the damaged database aside: %w", err)
+	}
+	log.Info().Str("path", damaged).Msg("moved the damaged database aside")
+
+	var err error
+	if DB, err = registry.GetKeeper("pogreb")(dest, &pogreb.WrappedOptions{AllowRecovery: true}); err != nil || DB == nil {
+		if err == nil {
+			err = errors.New("nil keeper")
+		}
+		DB = nil
+		return fmt.Errorf("failed to create a new database: %w", err)
+	}
+	if err = initStores(); err != nil {
+		return fmt.Errorf("failed to create a new database: %w", err)
+	}
+
+	old, err := loader.OpenKeeper(damaged, &pogreb.WrappedOptions{AllowRecovery: true})
+	if err != nil {
+		log.Error().Err(err).Msg("the damaged database can't be opened at all, nothing was salvaged")
+		return fmt.Errorf("nothing salvaged from %s: %w", damaged, err)
+	}
+	defer func() { _ = old.CloseAll() }()
+
+	names := append([]string(nil), storeNames...)
+	if found, err := old.Discover(); err == nil {
+		for _, n := range found {
+			if !slices.Contains(names, n) {
+				names = append(names, n)
+			}
+		}
+	}
+	var (
+		salvages = make([]*storeSalvage, 0, len(names))
+		sums     = openDamaged(old, "checksums")
+		named    = make(map[string]bool)
+	)
+	for _, name := range names {
+		s := &storeSalvage{name: name, rebuilt: name == "index" || name == "checksums"}
+		salvages = append(salvages, s)
+		src := openDamaged(old, name)
+		if src == nil {
+			s.unopened = errors.New("can't be opened")
+			continue
+		}
+		salvageStore(s, src, sums, named)
+	}
+
+	// records that were lost, or never made it out of the index and the checksums.
+	lost := make([]string, 0)
+	for p := range named {
+		if !imageStore.Has([]byte(p)) {
+			lost = append(lost, p)
+		}
+	}
+	sort.Strings(lost)
+
+	if _, err = rebuildIndex(); err != nil {
+		return fmt.Errorf("failed to rebuild the similarity index: %w", err)
+	}
+
+	var (
+		errs     []error
+		existing = make([]string, 0)
+		rehashed int
+	)
+	for _, s := range salvages {
+		switch {
+		case s.rebuilt:
+			log.Info().Str("store", s.name).Msg("rebuilt store from the records")
+		case s.unopened != nil || s.lost > 0:
+			log.Warn().Err(s.unopened).Str("store", s.name).Int("copied", s.copied).Int("lost", s.lost).
+				Msg("salvaged store, losing some of it")
+		default:
+			log.Info().Str("store", s.name).Int("copied", s.copied).Msg("salvaged store")
+		}
+	}
+	for _, p := range lost {
+		file, _, _ := strings.Cut(p, pageSuffix)
+		state := "file is gone"
+		if _, err := os.Stat(file); err == nil {
+			state = "file exists"
+			existing = append(existing, file)
+		}
+		_, _ = fmt.Fprintf(w, "lost: %s: %s\n", displayPath(p), state)
+	}
+	slices.Sort(existing)
+	existing = slices.Compact(existing)
+	audit("recover", "", fmt.Sprintf("from %s, %d records lost", damaged, len(lost)))
+
+	switch {
+	case len(existing) == 0:
+	case rehash:
+		rehashed = len(existing)
+		if err := ingestPaths(context.Background(), rootConfig, existing, newOrigin(rootConfig.source, "recover")); err != nil {
+			errs = append(errs, err)
+		}
+	default:
+		list := filepath.Join(damaged, "lost-files")
+		if err := writeLostFiles(list, existing); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		log.Warn().Int("files", len(existing)).Str("list", list).
+			Msgf("the files of lost records still exist, hash them again with: dupehunter - < %s", list)
+	}
+	if err := DB.SyncAll(); err != nil {
+		errs = append(errs, err)
+	}
+	log.Info().Int("lost", len(lost)).Int("rehashed", rehashed).Str("damaged", damaged).
+		Msg("db recover finished")
+	return errors.Join(errs...)
+}
+
+// openDamaged opens the store name of the damaged database old, nil if it
+// can't be.
+func openDamaged(old database.Keeper, name string) (f database.Filer) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Warn().Str("store", name).Interface("panic", r).Msg("store panicked while opening")
+			f = nil
+		}
+	}()
+	if err := old.Init(name, &pogreb.WrappedOptions{AllowRecovery: true}); err != nil &&
+		!errors.Is(err, pogreb.ErrStoreExists) {
+		log.Warn().Err(err).Str("store", name).Msg("can't open store")
+		return nil
+	}
+	return old.With(name)
+}
+
+// salvageStore copies what can be read of src into the store of the same
+// name, noting in named the paths that the records, index nodes, and
+// checksums of src name. Records must decode and match their checksum in
+// sums, if it has one; the index and the checksums are rebuilt rather than
+// copied.
+func salvageStore(s *storeSalvage, src, sums database.Filer, named map[string]bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.unopened = fmt.Errorf("panicked while being read: %v", r)
+		}
+	}()
+	for _, k := range src.Keys() {
+		v, err := src.Get(k)
+		if err != nil {
+			s.lost++
+			if s.name == "images" || s.name == "checksums" {
+				named[string(k)] = true
+			}
+			continue
+		}
+		switch s.name {
+		case "index":
+			n := &bkNode{}
+			if sonic.Unmarshal(v, n) == nil {
+				for _, p := range n.Paths {
+					named[p] = true
+				}
+			}
+			continue
+		case "checksums":
+			named[string(k)] = true
+			continue
+		case "images":
+			named[string(k)] = true
+			if !salvageRecord(k, v, sums) {
+				s.lost++
+				continue
+			}
+			err = imageStore.Put(k, v)
+		default:
+			err = DB.With(s.name).Put(k, v)
+		}
+		if err != nil {
+			s.lost++
+			log.Warn().Err(err).Str("store", s.name).Str("caller", displayPath(string(k))).Msg("failed to copy")
+			continue
+		}
+		s.copied++
+	}
+}
+
+// salvageRecord reports whether the record v stored under key is intact.
+func salvageRecord(key, v []byte, sums database.Filer) bool {
+	if sums != nil {
+		if sum, err := sums.Get(key); err == nil && !bytes.Equal(sum, recordChecksum(v)) {
+			return false
+		}
+	}
+	img := &Image{}
+	if sonic.Unmarshal(v, img) != nil || img.Path != string(key) {
+		return false
+	}
+	if len(img.PHash) > 0 {
+		if _, err := recordHash(img); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLostFiles(path string, files []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	for _, file := range files {
+		if strings.Contains(file, "\n") {
+			log.Warn().Str("caller", displayPath(file)).Msg("can't list a path with a newline in lost-files")
+			continue
+		}
+		_, _ = bw.WriteString(file + "\n")
+	}
+	err = bw.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
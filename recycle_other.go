@@ -0,0 +1,11 @@
+//go:build !windows || !(amd64 || arm64)
+
+package main
+
+import "errors"
+
+const canRecycle = false
+
+func recycleFile(string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,75 @@
+//go:build windows && (amd64 || arm64)
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// The recycle action deletes duplicates into the Recycle Bin through the
+// shell, where they can be restored from like anything deleted in Explorer.
+// SHFILEOPSTRUCTW is packed on 32-bit Windows, which this layout doesn't
+// match, so recycling is only available on 64-bit Windows.
+
+const canRecycle = true
+
+const (
+	foDelete          = 0x3
+	fofSilent         = 0x4
+	fofNoConfirmation = 0x10
+	fofAllowUndo      = 0x40
+	fofNoErrorUI      = 0x400
+	fofNoConfirmMkdir = 0x200
+)
+
+type shFileOpStruct struct {
+	hwnd                  uintptr
+	wFunc                 uint32
+	pFrom, pTo            *uint16
+	fFlags                uint16
+	fAnyOperationsAborted int32
+	hNameMappings         uintptr
+	lpszProgressTitle     *uint16
+}
+
+var procSHFileOperationW = windows.NewLazySystemDLL("shell32.dll").NewProc("SHFileOperationW")
+
+// recycleFile moves path into the Recycle Bin. The shell silently deletes
+// files for good on volumes without one, like network shares and removable
+// drives, so those are refused up front.
+func recycleFile(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	root, err := windows.UTF16PtrFromString(filepath.VolumeName(path) + `\`)
+	if err != nil {
+		return err
+	}
+	if windows.GetDriveType(root) != windows.DRIVE_FIXED {
+		return fmt.Errorf("%s isn't on a local fixed drive, which has no Recycle Bin", path)
+	}
+	from, err := windows.UTF16FromString(path)
+	if err != nil {
+		return err
+	}
+	// pFrom is a list of paths, terminated by an empty one.
+	from = append(from, 0)
+	op := shFileOpStruct{
+		wFunc:  foDelete,
+		pFrom:  &from[0],
+		fFlags: fofAllowUndo | fofNoConfirmation | fofSilent | fofNoErrorUI | fofNoConfirmMkdir,
+	}
+	ret, _, _ := procSHFileOperationW.Call(uintptr(unsafe.Pointer(&op)))
+	switch {
+	case ret != 0:
+		return fmt.Errorf("failed to recycle %s: shell error %#x", path, ret)
+	case op.fAnyOperationsAborted != 0:
+		return fmt.Errorf("recycling %s was aborted", path)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflinkFile creates dst as a clone of src, on APFS.
+func reflinkFile(src, dst string, perm os.FileMode) error {
+	if err := unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, perm); err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	return nil
+}
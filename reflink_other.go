@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func reflinkFile(_, _ string, _ os.FileMode) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,46 @@
+package main
+
+import "bytes"
+
+// relation guesses from the stored metadata how two matching records came to
+// be, to help decide which one to keep. Only records whose content checksums
+// are equal are exact copies; images are kept without one, so the closest an
+// image pair comes is the same dimensions, format and size.
+func relation(a, b *Image) string {
+	switch {
+	case len(a.Checksum) > 0 && bytes.Equal(a.Checksum, b.Checksum):
+		return "exact copy"
+	case len(a.Checksum) > 0 || len(b.Checksum) > 0:
+		return "different content"
+	case a.Width == b.Width && a.Height == b.Height:
+		switch {
+		case strippedCopy(a, b) != nil:
+			return "EXIF stripped"
+		case !a.Captured.Equal(b.Captured):
+			return "edited (EXIF differs)"
+		case a.Type != b.Type:
+			return "re-encode (same dimensions, different format)"
+		case a.Size != b.Size:
+			return "re-encode (same dimensions and format, different size)"
+		}
+		return "same dimensions, format and size (content not compared)"
+	case sameAspect(a, b):
+		return "resize (same aspect, smaller)"
+	}
+	return "edited (different aspect, e.g. cropped)"
+}
+
+// sameAspect reports whether a and b have the same aspect ratio, allowing for
+// the rounding of scaled dimensions.
+func sameAspect(a, b *Image) bool {
+	if a.Width == 0 || a.Height == 0 || b.Width == 0 || b.Height == 0 {
+		return false
+	}
+	small, large := a, b
+	if a.Width > b.Width {
+		small, large = b, a
+	}
+	// scaling large down to the width of small should land within a pixel of its height.
+	scaled := float64(large.Height) * float64(small.Width) / float64(large.Width)
+	return scaled-float64(small.Height) <= 1 && float64(small.Height)-scaled <= 1
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"syscall"
+)
+
+// The daemons, -watch and serve, reload their configuration on SIGHUP, and
+// serve also on POST /v1/reload, going on with the similarity index they have
+// warmed up. The configuration is the -job document, along with the
+// -thresholds file it or the command line names. A reload takes up the
+// threshold, the thresholds file, the excluded globs and extensions, the
+// number of workers, and with -watch the roots, directories joining and
+// leaving the watch; any other setting, the hash for one, takes a restart.
+// Every reload starts over from the command line, so a setting removed from
+// the document goes back to its flag or default rather than keeping the
+// value it last had. Flags given on the command line still take precedence
+// over the document, and a reload that fails changes nothing.
+
+// liveConfig is the configuration of a running daemon.
+type liveConfig struct {
+	cfg     *config
+	jobPath string
+	// explicit are the flags given on the command line.
+	explicit map[string]bool
+	// rootless is set for serve, which ingests what it is asked to.
+	rootless bool
+	// base is what the command line alone configures, see liveBaseline.
+	base liveBaseline
+}
+
+// liveBaseline is the part of the configuration a reload takes up, as the
+// command line configures it before any document.
+type liveBaseline struct {
+	maxDistance   int
+	thresholdFile string
+	workers       int
+	exts          map[string]bool
+	excludes      []string
+	excludeRes    []*regexp.Regexp
+}
+
+// commandLineBaseline takes the baseline from cfg and the walk filters,
+// before a document or -root changes them.
+func commandLineBaseline(cfg *config) liveBaseline {
+	return liveBaseline{maxDistance: cfg.maxDistance, thresholdFile: cfg.thresholdFile, workers: cfg.workers,
+		exts: maps.Clone(walkFilters.exts), excludes: slices.Clone(walkFilters.excludes),
+		excludeRes: slices.Clone(walkFilters.excludeRes)}
+}
+
+// live is set once the configuration is parsed.
+var live *liveConfig
+
+// flagsSet returns the names of the flags of fs that were set.
+func flagsSet(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// reloaded is what a reload took effect with. Roots are only set with a job
+// document naming them.
+type reloaded struct {
+	Distance   int      `json:"d"`
+	Thresholds int      `json:"threshold_rules"`
+	Excludes   []string `json:"exclude"`
+	Extensions []string `json:"ext"`
+	Workers    int      `json:"workers"`
+	Roots      []string `json:"roots,omitempty"`
+}
+
+// reload re-reads the configuration and applies what can change while
+// running. Callers make sure no scan reads it meanwhile, serve handlers that
+// don't wait for scans read a copy, see apiServer.settle.
+func (l *liveConfig) reload() (*reloaded, error) {
+	doc := &jobDocument{}
+	if l.jobPath != "" {
+		var err error
+		if doc, err = readJob(l.jobPath); err != nil {
+			return nil, err
+		}
+	}
+	takes := func(flag string, set bool) bool { return set && !l.explicit[flag] }
+
+	distance := l.base.maxDistance
+	if takes("d", doc.Threshold != nil) {
+		distance = *doc.Threshold
+	}
+	if distance < 1 || distance > hashing.bits() {
+		return nil, fmt.Errorf("invalid -d %d: must be between 1 and %d", distance, hashing.bits())
+	}
+	thresholdFile := l.base.thresholdFile
+	if takes("thresholds", doc.Thresholds != nil) {
+		thresholdFile = *doc.Thresholds
+	}
+	var rules thresholdRules
+	if thresholdFile != "" {
+		var err error
+		if rules, err = loadThresholdRules(thresholdFile); err != nil {
+			return nil, fmt.Errorf("invalid -thresholds file: %w", err)
+		}
+	}
+	filters := &walkFilter{exts: maps.Clone(l.base.exts)}
+	filters.excludes, filters.excludeRes = slices.Clone(l.base.excludes), slices.Clone(l.base.excludeRes)
+	if takes("exclude", doc.Filters.Exclude != nil) {
+		filters.excludes, filters.excludeRes = nil, nil
+		for _, glob := range doc.Filters.Exclude {
+			if err := filters.addExclude(glob); err != nil {
+				return nil, fmt.Errorf("invalid -exclude %q: %w", glob, err)
+			}
+		}
+	}
+	if takes("ext", doc.Filters.Extensions != nil) {
+		filters.exts = make(map[string]bool)
+		if *doc.Filters.Extensions != "" {
+			if err := filters.addExts(*doc.Filters.Extensions); err != nil {
+				return nil, fmt.Errorf("invalid -ext: %w", err)
+			}
+		}
+	}
+	workerCount := l.base.workers
+	if takes("workers", doc.Workers != nil) {
+		workerCount = *doc.Workers
+		if l.cfg.autoWorkers {
+			log.Warn().Int("workers", workerCount).Msg("-auto-workers sizes the pool, ignoring workers of the job document")
+		}
+	}
+	if workerCount < 1 {
+		return nil, errors.New("workers must be at least 1")
+	}
+	var roots []string
+	if len(doc.Roots) > 0 {
+		if l.rootless {
+			return nil, errors.New("serve ingests what it is asked to, a -job document configuring it has no roots")
+		}
+		var err error
+		if roots, err = expandArgs(doc.Roots); err != nil {
+			return nil, err
+		}
+	}
+
+	l.cfg.maxDistance, l.cfg.thresholdFile, l.cfg.thresholds = distance, thresholdFile, rules
+	walkFilters.exts, walkFilters.excludes, walkFilters.excludeRes = filters.exts, filters.excludes, filters.excludeRes
+	if workerCount != l.cfg.workers && !l.cfg.autoWorkers {
+		l.cfg.workers = workerCount
+		workers.Tune(workerCount)
+	}
+	r := &reloaded{Distance: distance, Thresholds: len(rules), Excludes: walkFilters.excludes,
+		Extensions: walkFilters.extensions(), Workers: workers.Cap(), Roots: roots}
+	log.Info().Int("d", r.Distance).Int("threshold_rules", r.Thresholds).Strs("exclude", r.Excludes).
+		Strs("ext", r.Extensions).Int("workers", r.Workers).Int("roots", len(roots)).Msg("configuration reloaded")
+	return r, nil
+}
+
+// reloadSignals returns a channel receiving SIGHUP, and the function to stop
+// it.
+func reloadSignals() (<-chan os.Signal, func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	return hup, func() { signal.Stop(hup) }
+}
+
+// rootsChanged sets the directories of the watch to those of roots, watching
+// the ones that joined and letting go of the ones that left.
+func (dw *dirWatcher) rootsChanged(roots []string) {
+	wanted := make(map[string]bool, len(roots))
+	for _, p := range roots {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			continue
+		}
+		if finfo, err := os.Stat(abs); err == nil && finfo.IsDir() {
+			wanted[abs] = true
+		}
+	}
+	for dir, depth := range dw.depth {
+		if depth == 0 && !wanted[dir] {
+			dw.removeTree(dir)
+		}
+	}
+	for dir := range wanted {
+		if _, watched := dw.depth[dir]; !watched {
+			dw.addTree(dir, 0, false)
+		}
+	}
+}
+
+// removeTree stops watching dir and the directories below it, dropping the
+// files pending in them.
+func (dw *dirWatcher) removeTree(dir string) {
+	for p := range dw.depth {
+		if withinDir(p, dir) {
+			_ = dw.w.Remove(p)
+			delete(dw.depth, p)
+		}
+	}
+	for p := range dw.pending {
+		if withinDir(p, dir) {
+			delete(dw.pending, p)
+		}
+	}
+}
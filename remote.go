@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// check --remote finds the images two dupehunter instances have in common
+// without either sending the other its whole index. Like the bucket index,
+// it splits hashes into radius+1 segments, any two hashes within radius
+// agreeing on at least one of them. The client sends the segment values of
+// its hashes, and the server answers with only those of its hashes that
+// share a segment with them, under identifiers salted afresh for every
+// check; the client compares them with its own hashes. The server learns
+// segments rather than whole hashes, the narrower the larger the radius, and
+// the client the hashes of likely matches rather than of the whole library,
+// and neither sees a path of the other. At -d 1, radius 0, the one segment is
+// the whole hash, so the server learns every hash of the client; it's the
+// exchange of hashes of a hash-only export then.
+//
+// The narrower the segments, the fewer values there are to ask for all of,
+// and with 1-bit segments two values of one would sweep the whole index. So
+// the radius is at most overlapMaxRadius, segments being 8 bits wide at the
+// least, and a request asks for at most a 1/overlapSegmentShare of the values
+// of each segment. The segment values go in pages under both caps and of at
+// most overlapPageValues, which keeps every request well under
+// overlapBodyLimit however big the library. A check names a random session in
+// each of its pages, which the server derives the salt of its identifiers
+// from, so that an image found on several pages is known to be one.
+
+const (
+	// overlapBodyLimit caps overlap requests.
+	overlapBodyLimit = 64 << 20
+	// overlapPageValues is the most segment values a page of a check sends,
+	// at most 21 bytes each as JSON.
+	overlapPageValues = 1 << 20
+	// overlapMaxRadius is the widest radius of a check, splitting hashes in
+	// segments of 8 bits at the least.
+	overlapMaxRadius = 7
+	// overlapSegmentShare is the share of the values of a segment a request
+	// may ask for at most, 1 in as many.
+	overlapSegmentShare = 16
+)
+
+// overlapSegmentValues is how many values of the i-th segment of layout a
+// request may ask for.
+func overlapSegmentValues(layout *bucketIndex, i int) int {
+	return 1 << min(layout.Width(i)-bits.Len(overlapSegmentShare-1), bits.Len(overlapPageValues-1))
+}
+
+// remoteTokenEnv names the variable holding the token for check --remote,
+// which is kept out of the command line and with it the process list.
+const remoteTokenEnv = "DUPEHUNTER_TOKEN"
+
+type overlapRequest struct {
+	// Kind is the hash kind, the prefix of the hashes in db ls.
+	Kind     string     `json:"kind"`
+	Radius   int        `json:"radius"`
+	Segments [][]uint64 `json:"segments"`
+	// Session is the random name of the check the page is part of, a
+	// request without one gets identifiers of its own.
+	Session string `json:"session,omitempty"`
+}
+
+type overlapCandidate struct {
+	ID   string `json:"id"`
+	Hash string `json:"hash"`
+}
+
+// splitHash splits a hash as listed by db ls into its kind and value.
+func splitHash(s string) (string, uint64, bool) {
+	kind, value, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", 0, false
+	}
+	h, err := strconv.ParseUint(value, 16, 64)
+	return kind, h, err == nil
+}
+
+// hashesByKind returns the hashes of the images in the index by their kind.
+func hashesByKind() (map[string]map[string]uint64, error) {
+	byKind := make(map[string]map[string]uint64)
+	err := forEachRecord(func(img *Image) error {
+		kind, h, ok := splitHash(img.hashString())
+		if !ok {
+			return nil
+		}
+		if byKind[kind] == nil {
+			byKind[kind] = make(map[string]uint64)
+		}
+		byKind[kind][img.Path] = h
+		return nil
+	})
+	return byKind, err
+}
+
+// overlap serves /v1/overlap, answering with the hashes of the index sharing
+// a segment with those of the request.
+func (s *apiServer) overlap(r *http.Request) (any, error) {
+	var req overlapRequest
+	if err := sonic.ConfigDefault.NewDecoder(http.MaxBytesReader(nil, r.Body, overlapBodyLimit)).Decode(&req); err != nil {
+		return nil, &apiBadRequest{"invalid request body: " + err.Error()}
+	}
+	if req.Radius < 0 || req.Radius > overlapMaxRadius {
+		return nil, &apiBadRequest{fmt.Sprintf("radius must be between 0 and %d", overlapMaxRadius)}
+	}
+	layout := buildBuckets(nil, req.Radius)
+	if len(req.Segments) != layout.Segments() {
+		return nil, &apiBadRequest{fmt.Sprintf("expected %d segments for radius %d", layout.Segments(), req.Radius)}
+	}
+	wanted := make([]map[uint64]struct{}, len(req.Segments))
+	for i, values := range req.Segments {
+		if limit := overlapSegmentValues(layout, i); len(values) > limit {
+			return nil, &apiBadRequest{fmt.Sprintf("at most %d values of segment %d per request", limit, i)}
+		}
+		wanted[i] = make(map[uint64]struct{}, len(values))
+		for _, v := range values {
+			wanted[i][v] = struct{}{}
+		}
+	}
+
+	byKind, err := hashesByKind()
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, hashExportSaltLen)
+	if req.Session != "" {
+		mac := hmac.New(sha256.New, s.overlapSecret)
+		mac.Write([]byte(req.Session))
+		salt = mac.Sum(nil)
+	} else if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	candidates := make([]overlapCandidate, 0)
+	for path, h := range byKind[req.Kind] {
+		for i := range wanted {
+			if _, ok := wanted[i][layout.Segment(h, i)]; ok {
+				candidates = append(candidates, overlapCandidate{ID: saltedID(salt, path), Hash: fmt.Sprintf("%s:%016x", req.Kind, h)})
+				break
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].ID < candidates[j].ID })
+	return candidates, nil
+}
+
+// remoteURL turns host, an address or a URL, into the URL of the overlap
+// endpoint. Bare addresses are reached over HTTPS.
+func remoteURL(host string) string {
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	return strings.TrimSuffix(host, "/") + "/v1/overlap"
+}
+
+// overlapPages splits the segment values of the hashes in layout into the
+// requests of the check of session, each asking for no more values of a
+// segment than overlapSegmentValues allows.
+func overlapPages(session, kind string, layout *bucketIndex) []overlapRequest {
+	var (
+		pages []overlapRequest
+		page  overlapRequest
+		n     int
+	)
+	for i := 0; i < layout.Segments(); i++ {
+		for _, v := range layout.Values(i) {
+			if page.Segments == nil {
+				page = overlapRequest{Kind: kind, Radius: layout.Radius(), Session: session,
+					Segments: make([][]uint64, layout.Segments())}
+			}
+			page.Segments[i] = append(page.Segments[i], v)
+			if n++; n == overlapPageValues || len(page.Segments[i]) == overlapSegmentValues(layout, i) {
+				pages, page, n = append(pages, page), overlapRequest{}, 0
+			}
+		}
+	}
+	if page.Segments != nil {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// requestOverlap sends a page of segments to the server at url and returns
+// its candidates.
+func requestOverlap(client *http.Client, url, token string, req overlapRequest) ([]overlapCandidate, error) {
+	body, err := sonic.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	dat, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		if sonic.Unmarshal(dat, &apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, apiErr.Error)
+		}
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	candidates := make([]overlapCandidate, 0)
+	if err = sonic.Unmarshal(dat, &candidates); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return candidates, nil
+}
+
+// checkRemote reports the images of the index within distance of one on the
+// dupehunter serving at host.
+func checkRemote(host string, distance int) error {
+	token := os.Getenv(remoteTokenEnv)
+	if token == "" {
+		return fmt.Errorf("check --remote needs a token with the read scope in $%s", remoteTokenEnv)
+	}
+	byKind, err := hashesByKind()
+	if err != nil {
+		return err
+	}
+	kinds := make([]string, 0, len(byKind))
+	for kind := range byKind {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	session := make([]byte, hashExportSaltLen)
+	if _, err = rand.Read(session); err != nil {
+		return err
+	}
+	var (
+		client  = &http.Client{Timeout: 10 * time.Minute}
+		url     = remoteURL(host)
+		shared  = make(map[string]struct{})
+		remote  = make(map[string]struct{})
+		matches int
+	)
+	for _, kind := range kinds {
+		layout := buildBuckets(byKind[kind], distance-1)
+		// an image sharing segments found on several pages is only compared once.
+		seen := make(map[string]struct{})
+		pages := overlapPages(hex.EncodeToString(session), kind, layout)
+		for n, page := range pages {
+			candidates, err := requestOverlap(client, url, token, page)
+			if err != nil {
+				return fmt.Errorf("remote check against %s: %w", host, err)
+			}
+			log.Debug().Str("kind", kind).Int("page", n+1).Int("pages", len(pages)).
+				Int("candidates", len(candidates)).Msg("remote overlap page")
+			for _, c := range candidates {
+				if _, ok := seen[c.ID]; ok {
+					continue
+				}
+				seen[c.ID] = struct{}{}
+				_, h, ok := splitHash(c.Hash)
+				if !ok {
+					return fmt.Errorf("remote check against %s: invalid hash %q", host, c.Hash)
+				}
+				local := layout.query(h, distance-1)
+				sort.Slice(local, func(i, j int) bool { return local[i].path < local[j].path })
+				for _, m := range local {
+					log.Info().Int("distance", m.distance).Str("remote_id", c.ID).
+						Msgf("on both machines: %s", m.path)
+					shared[m.path] = struct{}{}
+					matches++
+				}
+				if len(local) > 0 {
+					remote[c.ID] = struct{}{}
+				}
+			}
+		}
+	}
+	log.Info().Str("remote", host).Int("local", len(shared)).Int("remote_images", len(remote)).
+		Int("pairs", matches).Msg("remote check finished")
+	return nil
+}
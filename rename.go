@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// canonicalLayout names keepers after when they were captured, so a messy
+// import sorts chronologically once renamed.
+const canonicalLayout = "2006-01-02_150405"
+
+var canonicalExtensions = map[ImageType]string{
+	JPEG: ".jpg",
+	PNG:  ".png",
+	GIF:  ".gif",
+	WEBP: ".webp",
+	TIFF: ".tif",
+	ICO:  ".ico",
+	CUR:  ".cur",
+	BMP:  ".bmp",
+	PDF:  ".pdf",
+}
+
+// canonicalName is the name img would get under the canonical scheme,
+// YYYY-MM-DD_HHMMSS_<hash8> plus the extension of its actual content.
+func canonicalName(img *Image) (string, error) {
+	h, err := imageHash(img)
+	if err != nil {
+		return "", err
+	}
+	return img.captureTime().Format(canonicalLayout) + "_" +
+		fmt.Sprintf("%016x", h)[:8] + canonicalExtensions[img.Type], nil
+}
+
+// writeRenames proposes a canonical name for the keeper of every group as
+// "old<TAB>new" lines. Nothing is renamed; keepers that already follow the
+// scheme, pages of multi-page files, and files that aren't images are left out.
+func writeRenames(w io.Writer, groups []*dupeGroup) error {
+	var (
+		taken = make(map[string]struct{})
+		q     pathQuoter
+	)
+	defer q.warn("-suggest-renames")
+	for _, g := range groups {
+		keeper := g.keeper()
+		if strings.Contains(keeper.Path, pageSuffix) || keeper.Type == NULL {
+			continue
+		}
+		name, err := canonicalName(keeper)
+		if err != nil {
+			log.Warn().Err(err).Str("caller", keeper.Path).Msg("can't propose a name")
+			continue
+		}
+		if name == filepath.Base(keeper.Path) {
+			continue
+		}
+		dir, ext := filepath.Dir(keeper.Path), filepath.Ext(name)
+		target := filepath.Join(dir, name)
+		for n := 2; ; n++ {
+			_, proposed := taken[target]
+			if _, err = os.Lstat(target); !proposed && os.IsNotExist(err) {
+				break
+			}
+			target = filepath.Join(dir, strings.TrimSuffix(name, ext)+"_"+strconv.Itoa(n)+ext)
+		}
+		taken[target] = struct{}{}
+		if _, err = fmt.Fprintf(w, "%s\t%s\n", q.path(keeper.Path), q.path(target)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// -output writes the groups a check reports for scripts, as JSON, CSV, or
+// plain text, to the -out file or to stdout, the log going to stderr then.
+// Each group lists its members keeper first, with their distance to it, and
+// carries an ID derived from their contents that stays the same across runs,
+// for tracking groups until they are resolved. With -report-places, photos
+// carrying GPS coordinates tell where they were taken and groups come ordered
+// by place, see groupsByPlace; nothing of it otherwise. The probable
+// watermark variants and similar scenes follow the groups, with CSV as rows
+// of their own whose group column names them.
+// Scans and check runs writing a report exit with exitDuplicates when it
+// lists any group.
+
+// reportFormats are the values of -output.
+var reportFormats = []string{"text", "json", "csv"}
+
+type reportMember struct {
+	// Path is the display form of the path, PathBytes the path itself when
+	// it isn't valid UTF-8.
+	Path      string    `json:"path"`
+	PathBytes []byte    `json:"path_bytes,omitempty"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mtime"`
+	Hash      string    `json:"hash,omitempty"`
+	Checksum  string    `json:"checksum,omitempty"`
+	// Distance is to the keeper, nil when the two can't be compared.
+	Distance *int `json:"distance"`
+	Keeper   bool `json:"keeper"`
+	// ExifStripped tells that the member is a copy of the keeper stripped
+	// of its EXIF.
+	ExifStripped bool `json:"exif_stripped,omitempty"`
+	// Grayscale tells that the member has no color while others of its group
+	// have.
+	Grayscale bool         `json:"grayscale,omitempty"`
+	GPS       *gpsPosition `json:"gps,omitempty"`
+}
+
+// reportWatermarkVariant is a probable watermark variant, see -watermark-margin.
+type reportWatermarkVariant struct {
+	A              string `json:"a"`
+	B              string `json:"b"`
+	Distance       int    `json:"distance"`
+	MaskedDistance int    `json:"masked_distance"`
+}
+
+// reportSimilarScene is a pair of images of the same scene, see -embed-plugin.
+type reportSimilarScene struct {
+	A        string  `json:"a"`
+	B        string  `json:"b"`
+	Distance float64 `json:"distance"`
+}
+
+type reportGroup struct {
+	Group int `json:"group"`
+	// ID identifies the group across runs, see groupID.
+	ID       string          `json:"id"`
+	Members  []reportMember  `json:"members"`
+	Location *reportLocation `json:"location,omitempty"`
+}
+
+// keeperDistance returns the distance of m to the keeper of its group.
+func keeperDistance(keeper, m *Image) *int {
+	var distance int
+	switch {
+	case keeper == m:
+	case len(keeper.PHash) > 0 && len(m.PHash) > 0:
+		var err error
+		if distance, err = recordDistance(keeper, m); err != nil {
+			return nil
+		}
+	case len(keeper.Checksum) == 0 || string(keeper.Checksum) != string(m.Checksum):
+		return nil
+	}
+	return &distance
+}
+
+// newReportGroups returns the report of groups, telling where they were
+// taken if locations, those of groups, are given.
+func newReportGroups(groups []*dupeGroup, locations []*reportLocation) []reportGroup {
+	report := make([]reportGroup, len(groups))
+	for i, g := range groups {
+		mixed := slices.ContainsFunc(g.members, func(m *Image) bool { return grayscaleCopy(g.keeper(), m) != nil })
+		report[i] = reportGroup{Group: i + 1, ID: groupID(g), Members: make([]reportMember, len(g.members))}
+		if locations != nil {
+			report[i].Location = locations[i]
+		}
+		for j, m := range g.members {
+			report[i].Members[j] = reportMember{
+				Path:         displayPath(m.Path),
+				PathBytes:    rawPath(m.Path),
+				Size:         m.Size,
+				ModTime:      m.ModTime,
+				Hash:         m.hashString(),
+				Checksum:     hex.EncodeToString(m.Checksum),
+				Distance:     keeperDistance(g.keeper(), m),
+				Keeper:       j == 0,
+				ExifStripped: j > 0 && strippedCopy(g.keeper(), m) == m,
+				Grayscale:    mixed && m.Grayscale,
+			}
+			if locations != nil {
+				report[i].Members[j].GPS = m.GPS
+			}
+		}
+	}
+	return report
+}
+
+// reportExtras are the sections a report carries after the groups, of which
+// csv, having room for rows only, takes the pairs and the partial column.
+type reportExtras struct {
+	// conversions adds the -suggest-conversions section.
+	conversions bool
+	// archives, when not nil, are the archives fully duplicated on disk,
+	// see -archives.
+	archives []archiveVerdict
+	// partial marks the groups of a check whose --time-budget ran out,
+	// budgeted that it was given one.
+	partial, budgeted bool
+	// places adds where the photos were taken, ordering the groups by
+	// place, see -report-places.
+	places bool
+	// watermarks and scenes, when not nil, are the probable watermark
+	// variants and similar scenes found besides the groups.
+	watermarks []watermarkPair
+	scenes     []scenePair
+}
+
+// watermarkVariants returns the probable watermark variants of the report.
+func (extras reportExtras) watermarkVariants() []reportWatermarkVariant {
+	if extras.watermarks == nil {
+		return nil
+	}
+	variants := make([]reportWatermarkVariant, len(extras.watermarks))
+	for i, pair := range extras.watermarks {
+		variants[i] = reportWatermarkVariant{A: displayPath(pair.a), B: displayPath(pair.b),
+			Distance: pair.distance, MaskedDistance: pair.masked}
+	}
+	return variants
+}
+
+// similarScenes returns the similar scenes of the report.
+func (extras reportExtras) similarScenes() []reportSimilarScene {
+	if extras.scenes == nil {
+		return nil
+	}
+	scenes := make([]reportSimilarScene, len(extras.scenes))
+	for i, pair := range extras.scenes {
+		scenes[i] = reportSimilarScene{A: displayPath(pair.a), B: displayPath(pair.b), Distance: pair.distance}
+	}
+	return scenes
+}
+
+// writeReport writes groups to w in format, followed by extras.
+func writeReport(w io.Writer, format string, groups []*dupeGroup, extras reportExtras) error {
+	var locations []*reportLocation
+	if extras.places {
+		groups, locations = groupsByPlace(groups)
+	}
+	report := newReportGroups(groups, locations)
+	bw := bufio.NewWriter(w)
+	var err error
+	switch format {
+	case "json":
+		var (
+			dat  []byte
+			body = struct {
+				Partial           bool                     `json:"partial,omitempty"`
+				Groups            []reportGroup            `json:"groups"`
+				Conversions       *conversionSection       `json:"conversions,omitempty"`
+				Archives          []archiveVerdict         `json:"archives,omitempty"`
+				WatermarkVariants []reportWatermarkVariant `json:"watermark_variants,omitempty"`
+				SimilarScenes     []reportSimilarScene     `json:"similar_scenes,omitempty"`
+			}{Partial: extras.partial, Groups: report, Archives: extras.archives,
+				WatermarkVariants: extras.watermarkVariants(), SimilarScenes: extras.similarScenes()}
+		)
+		if extras.conversions {
+			section := suggestConversions(groups)
+			body.Conversions = &section
+		}
+		if dat, err = sonic.Marshal(body); err == nil {
+			_, err = bw.Write(append(dat, '\n'))
+		}
+	case "csv":
+		// paths are written as they are, bytes and all.
+		cw := csv.NewWriter(bw)
+		// with a time budget, every row carries whether the check was cut
+		// short, csv having no room for anything but rows.
+		write := func(record []string, partial string) {
+			if err != nil {
+				return
+			}
+			if extras.budgeted {
+				record = append(record, partial)
+			}
+			err = cw.Write(record)
+		}
+		partial := strconv.FormatBool(extras.partial)
+		write([]string{"group", "id", "path", "size", "mtime", "hash", "checksum", "distance", "keeper",
+			"latitude", "longitude"}, "partial")
+		for i, g := range report {
+			for j, m := range g.Members {
+				distance, lat, lon := "", "", ""
+				if m.Distance != nil {
+					distance = strconv.Itoa(*m.Distance)
+				}
+				if m.GPS != nil {
+					lat, lon = strconv.FormatFloat(m.GPS.Lat, 'f', -1, 64), strconv.FormatFloat(m.GPS.Lon, 'f', -1, 64)
+				}
+				write([]string{strconv.Itoa(g.Group), g.ID, groups[i].members[j].Path,
+					strconv.FormatInt(m.Size, 10), m.ModTime.Format(time.RFC3339), m.Hash, m.Checksum,
+					distance, strconv.FormatBool(m.Keeper), lat, lon}, partial)
+			}
+		}
+		// pairs are two rows sharing an ID, the group column saying what
+		// they are and the distance column how far apart.
+		for i, pair := range extras.watermarks {
+			for _, p := range []string{pair.a, pair.b} {
+				write([]string{"watermark_variant", "w" + strconv.Itoa(i+1), p, "", "", "", "",
+					strconv.Itoa(pair.distance), "false", "", ""}, partial)
+			}
+		}
+		for i, pair := range extras.scenes {
+			for _, p := range []string{pair.a, pair.b} {
+				write([]string{"similar_scene", "s" + strconv.Itoa(i+1), p, "", "", "", "",
+					strconv.FormatFloat(pair.distance, 'f', 3, 64), "false", "", ""}, partial)
+			}
+		}
+		cw.Flush()
+		if err == nil {
+			err = cw.Error()
+		}
+	default:
+		var q pathQuoter
+		defer q.warn("text report")
+		tw := tabwriter.NewWriter(bw, 0, 4, 2, ' ', 0)
+		if extras.partial {
+			_, _ = fmt.Fprint(tw, "partial results, the time budget ran out before every image was compared\n\n")
+		}
+		for i, g := range report {
+			_, _ = fmt.Fprintf(tw, "group %d (%s), %d files", g.Group, g.ID, len(g.Members))
+			if g.Location != nil {
+				_, _ = fmt.Fprintf(tw, ", %s", g.Location.describe())
+			}
+			_, _ = fmt.Fprintln(tw)
+			for j, m := range g.Members {
+				distance := "?"
+				switch {
+				case m.Keeper:
+					distance = "keeper"
+				case m.Distance != nil:
+					distance = "distance " + strconv.Itoa(*m.Distance)
+				}
+				if m.ExifStripped {
+					distance += ", EXIF stripped"
+				}
+				if m.Grayscale {
+					distance += ", grayscale"
+				}
+				_, _ = fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", distance, formatBytes(m.Size),
+					m.ModTime.Format(time.DateTime), q.path(groups[i].members[j].Path))
+			}
+			_, _ = fmt.Fprintln(tw)
+		}
+		err = tw.Flush()
+		// sections after the first are set apart by an empty line.
+		var sections int
+		section := func(write func() error) {
+			if err != nil {
+				return
+			}
+			if sections++; sections > 1 {
+				_, _ = fmt.Fprintln(bw)
+			}
+			err = write()
+		}
+		if extras.conversions {
+			section(func() error { return writeConversions(bw, suggestConversions(groups)) })
+		}
+		if extras.archives != nil {
+			section(func() error { return writeArchives(bw, extras.archives) })
+		}
+		if extras.watermarks != nil {
+			section(func() error { return writeWatermarkVariants(bw, extras.watermarks) })
+		}
+		if extras.scenes != nil {
+			section(func() error { return writeSimilarScenes(bw, extras.scenes) })
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeReportTo writes groups to the file at path, or to stdout if there is
+// none.
+func writeReportTo(path, format string, groups []*dupeGroup, extras reportExtras) error {
+	if path == "" {
+		return writeReport(os.Stdout, format, groups, extras)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = writeReport(f, format, groups, extras)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
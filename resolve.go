@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// POST /v1/groups/ID/resolve settles one group, found by the ID /v1/groups
+// lists it under: cleaning its duplicates with a clean action, keeping the
+// member the request names rather than the one the keep rules chose, or
+// ignoring the group. Cleaning goes through the cleaner like any clean, the
+// members checked against their records first and the undo log written.
+// Ignored groups are kept in the "ignored" store by ID and no longer
+// reported, by check or the API, until a different image joins them and the
+// ID changes; unignore reports them again.
+
+const (
+	resolveIgnore   = "ignore"
+	resolveUnignore = "unignore"
+)
+
+// ignoredGroup is what the "ignored" store keeps of a group.
+type ignoredGroup struct {
+	Members []string  `json:"members"`
+	Ignored time.Time `json:"ignored"`
+	// By is the name of the token that ignored it.
+	By string `json:"by"`
+}
+
+// groupIgnored reports whether g was ignored.
+func groupIgnored(g *dupeGroup) bool {
+	return DB.With("ignored").Has([]byte(groupID(g)))
+}
+
+type apiResolved struct {
+	ID      string `json:"id"`
+	Action  string `json:"action"`
+	Keeper  string `json:"keeper,omitempty"`
+	Cleaned int    `json:"cleaned"`
+	Skipped int    `json:"skipped"`
+	Failed  int    `json:"failed"`
+	DryRun  bool   `json:"dry_run,omitempty"`
+}
+
+// resolveGroup serves /v1/groups/ID/resolve.
+func (s *apiServer) resolveGroup(r *http.Request) (any, error) {
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v1/groups/"), "/resolve")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return nil, &apiNotFound{"no such resource"}
+	}
+	var req struct {
+		Action     string `json:"action"`
+		Keep       string `json:"keep"`
+		Quarantine string `json:"quarantine"`
+		DryRun     bool   `json:"dry_run"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Action != resolveIgnore && req.Action != resolveUnignore {
+		if err := s.validCleanAction(req.Action, req.Quarantine, req.DryRun); err != nil {
+			return nil, err
+		}
+	}
+
+	pairs, records, err := findPairs(s.cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer pairs.close()
+	var g *dupeGroup
+	for _, candidate := range groupPairs(pairs, records, s.cfg.keepOrder) {
+		if groupID(candidate) == id {
+			g = candidate
+			break
+		}
+	}
+	if g == nil {
+		return nil, &apiNotFound{"no such group, it may have changed since it was listed"}
+	}
+	resolved := &apiResolved{ID: id, Action: req.Action, DryRun: req.DryRun}
+	store := DB.With("ignored")
+	switch req.Action {
+	case resolveIgnore:
+		ig := ignoredGroup{Ignored: time.Now(), By: s.authenticate(r).name}
+		for _, m := range g.members {
+			ig.Members = append(ig.Members, m.Path)
+		}
+		dat, err := sonic.Marshal(ig)
+		if err != nil {
+			return nil, err
+		}
+		if req.DryRun {
+			return resolved, nil
+		}
+		if err = store.Put([]byte(id), dat); err != nil {
+			return nil, err
+		}
+		log.Info().Str("group", id).Str("token", ig.By).Int("members", len(ig.Members)).Msg("group ignored")
+		audit("ignore", "", "group "+id)
+		return resolved, store.Sync()
+	case resolveUnignore:
+		if !store.Has([]byte(id)) {
+			return nil, &apiBadRequest{"the group isn't ignored"}
+		}
+		if req.DryRun {
+			return resolved, nil
+		}
+		if err = store.Delete([]byte(id)); err != nil {
+			return nil, err
+		}
+		log.Info().Str("group", id).Msg("group no longer ignored")
+		audit("unignore", "", "group "+id)
+		return resolved, store.Sync()
+	}
+
+	if req.Keep != "" {
+		i := slices.IndexFunc(g.members, func(m *Image) bool { return m.Path == req.Keep })
+		if i < 0 {
+			return nil, &apiBadRequest{req.Keep + " isn't a member of the group"}
+		}
+		keeper := g.members[i]
+		others := slices.Delete(slices.Clone(g.members), i, i+1)
+		if keeper.canonical {
+			// canonical images are never duplicates, as in groupPairs.
+			others = slices.DeleteFunc(others, func(m *Image) bool { return m.canonical })
+		} else if j := slices.IndexFunc(others, func(m *Image) bool { return m.canonical }); j >= 0 {
+			return nil, &apiBadRequest{others[j].Path + " is in a canonical collection, keep it or another canonical member"}
+		}
+		g = &dupeGroup{members: append([]*Image{keeper}, others...)}
+	}
+	resolved.Keeper = g.keeper().Path
+	c := &cleaner{action: req.Action, quarantine: req.Quarantine, preserveTimes: s.cfg.preserveTimes,
+		dryRun: req.DryRun, snapshot: s.cfg.snapshot, vouched: s.cfg.haveSnapshot,
+		nearDupes: s.cfg.nearDupes}
+	err = c.clean(context.Background(), []*dupeGroup{g})
+	resolved.Cleaned, resolved.Skipped, resolved.Failed = c.cleaned, c.skipped, c.failed
+	if err == nil {
+		saveIndexSnapshot()
+	}
+	return resolved, err
+}
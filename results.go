@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Every check writes the pairs it found to a results file in the working
+// directory, dupehunter_ID.log, the run ID being when it started in Unix
+// milliseconds. The probable watermark variants and similar scenes follow as
+// comments, leaving every line that isn't one a pair of duplicates.
+// -keep-results bounds how many of them pile up, removing at the start of
+// each check the results of all but the last N runs, or those older than an
+// age; the results command lists and removes them by hand.
+
+const (
+	resultsPrefix = "dupehunter_"
+	resultsSuffix = ".log"
+)
+
+var resultsCommands = []command{
+	{"ls", "list the results of past check runs", func(args []string) error { return resultsLs(args, os.Stdout) }},
+	{"rm", "remove the results of check runs by run ID", resultsRm},
+}
+
+func runResults(args []string) error {
+	fs := newFlagSet("results", "<command> [flags]", "Manage the pair results check runs leave in the working directory.")
+	usage := fs.Usage
+	fs.Usage = func() {
+		usage()
+		printCommands(fs.Output(), "results", resultsCommands)
+	}
+	return dispatch(fs, resultsCommands, args)
+}
+
+// resultsPath returns the name of the results file of a run started at t.
+func resultsPath(t time.Time) string {
+	return resultsPrefix + strconv.FormatInt(t.UnixMilli(), 10) + resultsSuffix
+}
+
+// resultsRetention is the -keep-results flag: the last runs to keep, or the
+// age up to which results are kept. Zero keeps everything.
+type resultsRetention struct {
+	runs int
+	age  time.Duration
+}
+
+func (r *resultsRetention) String() string {
+	switch {
+	case r == nil:
+		return ""
+	case r.runs > 0:
+		return strconv.Itoa(r.runs)
+	case r.age > 0:
+		return r.age.String()
+	}
+	return ""
+}
+
+func (r *resultsRetention) Set(s string) error {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 1 {
+			return errors.New("must keep at least 1 run")
+		}
+		*r = resultsRetention{runs: n}
+		return nil
+	}
+	age, err := parseAge(s)
+	if err != nil || age <= 0 {
+		return fmt.Errorf("expected a number of runs or an age like 90d, not %q", s)
+	}
+	*r = resultsRetention{age: age}
+	return nil
+}
+
+// resultsRun is the results file of a check run.
+type resultsRun struct {
+	id      string
+	path    string
+	started time.Time
+	size    int64
+}
+
+// listResults returns the results files in dir, oldest first.
+func listResults(dir string) ([]resultsRun, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	runs := make([]resultsRun, 0)
+	for _, e := range entries {
+		name, ok := strings.CutPrefix(e.Name(), resultsPrefix)
+		id, isLog := strings.CutSuffix(name, resultsSuffix)
+		if !ok || !isLog || !e.Type().IsRegular() {
+			continue
+		}
+		ms, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			continue
+		}
+		run := resultsRun{id: id, path: filepath.Join(dir, e.Name()), started: time.UnixMilli(ms)}
+		if finfo, err := e.Info(); err == nil {
+			run.size = finfo.Size()
+		}
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].started.Before(runs[j].started) })
+	return runs, nil
+}
+
+// expired returns the runs, oldest first, that r no longer keeps once
+// another run starts at now.
+func (r resultsRetention) expired(runs []resultsRun, now time.Time) []resultsRun {
+	switch {
+	case r.runs > 0:
+		// the run starting now is one of the last.
+		return runs[:max(0, len(runs)-(r.runs-1))]
+	case r.age > 0:
+		i := sort.Search(len(runs), func(i int) bool { return now.Sub(runs[i].started) <= r.age })
+		return runs[:i]
+	}
+	return nil
+}
+
+// pruneResults removes the results files in dir that r no longer keeps.
+func pruneResults(dir string, r resultsRetention) error {
+	runs, err := listResults(dir)
+	if err != nil {
+		return err
+	}
+	var removed int
+	for _, run := range r.expired(runs, time.Now()) {
+		if err = os.Remove(run.path); err != nil {
+			log.Warn().Err(err).Str("run", run.id).Msg("failed to remove expired results")
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Info().Int("removed", removed).Str("keep", r.String()).Msg("removed the results of past runs")
+	}
+	return nil
+}
+
+func resultsLs(args []string, w io.Writer) error {
+	fs := newFlagSet("results ls", "[--dir DIR]", "List the results check runs left in a directory, oldest first.")
+	dir := fs.String("dir", ".", "`directory` the check runs were started in")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument: %s", fs.Arg(0))
+	}
+	runs, err := listResults(*dir)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "RUN\tSTARTED\tSIZE")
+	for _, run := range runs {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\n", run.id, run.started.Format(time.RFC3339), formatBytes(run.size))
+	}
+	return tw.Flush()
+}
+
+func resultsRm(args []string) error {
+	fs := newFlagSet("results rm", "[--dir DIR] <run-id>...", "Remove the results of check runs, as listed by results ls.")
+	dir := fs.String("dir", ".", "`directory` the check runs were started in")
+	ids, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return usageError(fs, "at least one run ID is required")
+	}
+	runs, err := listResults(*dir)
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]resultsRun, len(runs))
+	for _, run := range runs {
+		byID[run.id] = run
+	}
+	for _, id := range ids {
+		if _, ok := byID[id]; !ok {
+			return fmt.Errorf("no results of run %s in %s", id, *dir)
+		}
+	}
+	for _, id := range ids {
+		if err = os.Remove(byID[id].path); err != nil {
+			return err
+		}
+		log.Info().Str("run", id).Msg("removed results")
+	}
+	return nil
+}
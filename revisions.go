@@ -0,0 +1,122 @@
+package main
+
+import (
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// A file that changed since it was ingested is re-ingested as an update of
+// its record rather than a fresh one: the hashes it had before are kept in
+// the record's History, the similarity index follows the new hash (or lets go
+// of the path when the file isn't an image anymore), and a failure to update
+// the index puts the previous record back, so the record and the index never
+// disagree. A changed file that can't be ingested anymore, or that turned
+// from a multi-page TIFF into a single image or back, has the records it no
+// longer backs retired to tombstones instead of left with stale hashes.
+
+// maxRevisions bounds the History kept per record.
+const maxRevisions = 8
+
+// revision is what a record was before an update replaced it.
+type revision struct {
+	PHash    []byte    `json:"phash,omitempty"`
+	Checksum []byte    `json:"checksum,omitempty"`
+	ModTime  time.Time `json:"mtime"`
+	Size     int64     `json:"size"`
+	Ingested time.Time `json:"ingested"`
+}
+
+// recallRecord returns the stored record of path and its encoding, nil when
+// there is none.
+func recallRecord(path string) (*Image, []byte) {
+	key := []byte(path)
+	if !imageStore.Has(key) {
+		return nil, nil
+	}
+	dat, err := imageStore.Get(key)
+	if err != nil {
+		return nil, nil
+	}
+	prev := &Image{}
+	if err = sonic.Unmarshal(dat, prev); err != nil {
+		log.Warn().Err(err).Str("caller", path).Msg("replacing unreadable record")
+		return nil, dat
+	}
+	return prev, dat
+}
+
+// revisions returns the History of a record replacing prev: prev's own,
+// and prev itself, the oldest dropped beyond maxRevisions.
+func (prev *Image) revisions() []revision {
+	history := append(prev.History, revision{
+		PHash:    prev.PHash,
+		Checksum: prev.Checksum,
+		ModTime:  prev.ModTime,
+		Size:     prev.Size,
+		Ingested: prev.Ingested,
+	})
+	if len(history) > maxRevisions {
+		history = history[len(history)-maxRevisions:]
+	}
+	return history
+}
+
+// rollback puts back the record of path an update replaced once the index
+// couldn't follow, re-indexing it under its previous hash.
+func rollback(idx *bkTree, path string, prev *Image, prevDat []byte) {
+	if prevDat == nil {
+		return
+	}
+	if err := imageStore.Put([]byte(path), prevDat); err != nil {
+		log.Error().Err(err).Str("caller", path).Msg("failed to restore the previous record, run db reindex")
+		return
+	}
+	audit("rollback", path, "the similarity index couldn't take the update")
+	if idx == nil || prev == nil || len(prev.PHash) == 0 {
+		return
+	}
+	h, err := imageHash(prev)
+	if err == nil {
+		err = idx.insert(path, h)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("caller", path).Msg("failed to re-index the previous record, run db reindex")
+	}
+}
+
+// retireStale buries the records of a changed file that its re-ingest didn't
+// replace: all of them when it failed, or those of the pages (or the whole
+// file) when it came back as a single image (or as pages).
+func (img *Image) retireStale() {
+	if !img.replaces {
+		return
+	}
+	idx, err := getIndex()
+	if err != nil {
+		log.Warn().Err(err).Str("caller", img.Path).Msg("failed to retire stale records")
+		return
+	}
+	reason := "changed, no longer ingestible"
+	if len(img.stored) > 0 {
+		reason = "changed, superseded"
+	}
+	stored := make(map[string]bool, len(img.stored))
+	for _, p := range img.stored {
+		stored[p] = true
+	}
+	paths := []string{img.Path}
+	for n := 1; imageStore.Has([]byte(pagePath(img.Path, n))); n++ {
+		paths = append(paths, pagePath(img.Path, n))
+	}
+	for _, p := range paths {
+		if stored[p] || !imageStore.Has([]byte(p)) {
+			continue
+		}
+		if err = buryRecord(idx, p, reason); err != nil {
+			log.Warn().Err(err).Str("caller", p).Msg("failed to retire stale record")
+			continue
+		}
+		log.Debug().Str("caller", p).Str("reason", reason).Msg("retired stale record")
+	}
+}
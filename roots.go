@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// Named roots are directories registered with roots add, along with the root
+// flags given with that command, e.g.
+//
+//	dupehunter -ext jpg,png -exclude '**/thumbs' roots add photos ~/Pictures
+//
+// -root photos scans the directory with those flags, flags on the command
+// line still taking precedence, so every scan of it runs the same way. Roots
+// scanned together share one run, and with it the flags of all of them. A root
+// belongs to the collection it was added under and marks a subtree that
+// collection's index is meant to mirror. Roots are recorded in roots.json next
+// to the collections.
+
+type scanRoot struct {
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	Collection string `json:"collection,omitempty"`
+	// Flags are the root flags the root is scanned with, by name, each with
+	// its values in the order given.
+	Flags map[string][]string `json:"flags,omitempty"`
+	Added time.Time           `json:"added"`
+}
+
+// unkeptRootFlags are root flags that don't describe a scan, never kept with
+// a root: diagnostics, what to do with the duplicates found, and where to
+// report them, which are up to each run.
+var unkeptRootFlags = []string{
+	"root", "job", "pprof", "cpuprofile", "memprofile", "trace", "v", "log-every", "status",
+	"action", "dry-run", "undo-log", "quarantine", "preserve-times", "snapshot", "i-have-a-snapshot",
+	"clean-near-duplicates",
+	"output", "out", "summary-fd", "print0", "suggest-renames", "suggest-conversions", "report-places", "simulate-policies",
+	"treemap", "dedupe-report", "denied-list", "truncated-list", "manifest", "keep-results",
+	"alert-immediately", "alert-events",
+}
+
+// rootSettings are the root flags given on the command line, by name, for
+// roots add to keep.
+var rootSettings map[string][]string
+
+var rootsCommands = []command{
+	{"add", "register a directory under a name, with the root flags given", rootsAdd},
+	{"ls", "list the registered roots", rootsLs},
+	{"rm", "forget registered roots", rootsRm},
+}
+
+func runRoots(args []string) error {
+	fs := newFlagSet("roots", "<command> [flags]", "Manage named scan roots, see -root.")
+	usage := fs.Usage
+	fs.Usage = func() {
+		usage()
+		printCommands(fs.Output(), "roots", rootsCommands)
+	}
+	return dispatch(fs, rootsCommands, args)
+}
+
+// flagRecorder records the values a flag is set to.
+type flagRecorder struct {
+	name   string
+	isBool bool
+	values map[string][]string
+}
+
+func (r *flagRecorder) String() string   { return "" }
+func (r *flagRecorder) IsBoolFlag() bool { return r.isBool }
+
+func (r *flagRecorder) Set(value string) error {
+	r.values[r.name] = append(r.values[r.name], value)
+	return nil
+}
+
+// recordFlags returns the values the flags of fs are given in args, parsed
+// up to the first argument that isn't a flag, by name.
+func recordFlags(fs *flag.FlagSet, args []string) map[string][]string {
+	var (
+		values = make(map[string][]string)
+		rec    = flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	)
+	rec.SetOutput(io.Discard)
+	fs.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		rec.Var(&flagRecorder{name: f.Name, isBool: ok && b.IsBoolFlag(), values: values}, f.Name, "")
+	})
+	// fs has parsed args already, they can't fail here.
+	_ = rec.Parse(args)
+	for _, name := range unkeptRootFlags {
+		delete(values, name)
+	}
+	return values
+}
+
+func rootsPath() (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "roots.json"), nil
+}
+
+// readRoots returns the registered roots, ordered by name.
+func readRoots() ([]scanRoot, error) {
+	path, err := rootsPath()
+	if err != nil {
+		return nil, err
+	}
+	dat, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var roots []scanRoot
+	if err = sonic.Unmarshal(dat, &roots); err != nil {
+		return nil, fmt.Errorf("corrupt %s: %w", path, err)
+	}
+	return roots, nil
+}
+
+func writeRoots(roots []scanRoot) error {
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Name < roots[j].Name })
+	path, err := rootsPath()
+	if err != nil {
+		return err
+	}
+	dat, err := sonic.Marshal(roots)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, dat, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// lookupRoots returns the roots registered under names, in that order.
+func lookupRoots(names []string) ([]scanRoot, error) {
+	roots, err := readRoots()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the roots: %w", err)
+	}
+	found := make([]scanRoot, 0, len(names))
+	for _, name := range names {
+		i := slices.IndexFunc(roots, func(r scanRoot) bool { return r.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("no root named %q, see roots ls", name)
+		}
+		found = append(found, roots[i])
+	}
+	return found, nil
+}
+
+// applyRoots sets the flags of fs that the roots set and the command line
+// doesn't, and returns their directories. Roots setting the same flag must
+// agree on it.
+func applyRoots(fs *flag.FlagSet, roots []scanRoot) ([]string, error) {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var (
+		paths = make([]string, 0, len(roots))
+		setBy = make(map[string]scanRoot)
+	)
+	for _, r := range roots {
+		paths = append(paths, r.Path)
+		names := make([]string, 0, len(r.Flags))
+		for name := range r.Flags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			values := r.Flags[name]
+			switch other, ok := setBy[name]; {
+			case explicit[name]:
+				continue
+			case ok && !slices.Equal(other.Flags[name], values):
+				return nil, fmt.Errorf("roots %s and %s disagree on -%s", other.Name, r.Name, name)
+			case ok:
+				continue
+			}
+			setBy[name] = r
+			for _, value := range values {
+				if err := fs.Set(name, value); err != nil {
+					return nil, fmt.Errorf("root %s: -%s: %w", r.Name, name, err)
+				}
+			}
+		}
+	}
+	return paths, nil
+}
+
+func rootsAdd(args []string) error {
+	fs := newFlagSet("roots add", "<name> <directory>",
+		"Register directory under name, keeping the root flags given before the command, e.g.\n"+
+			"  dupehunter -ext jpg,png -max-depth 3 roots add photos ~/Pictures\n"+
+			"-root name then scans it the same way. Clean actions, reports and diagnostics aren't kept,\n"+
+			"each run gives its own. Adding a name again replaces it.")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return usageError(fs, "a name and a directory are required")
+	}
+	name := args[0]
+	if name == "" || !validCollectionName(name) || strings.Contains(name, ",") {
+		return usageError(fs, "invalid root name %q", name)
+	}
+	dir, err := filepath.Abs(expandHome(args[1]))
+	if err != nil {
+		return err
+	}
+	if finfo, err := os.Stat(dir); err != nil {
+		return err
+	} else if !finfo.IsDir() {
+		return usageError(fs, "%s is not a directory", dir)
+	}
+
+	roots, err := readRoots()
+	if err != nil {
+		return fmt.Errorf("failed to read the roots: %w", err)
+	}
+	roots = slices.DeleteFunc(roots, func(r scanRoot) bool {
+		if r.Name == name {
+			log.Info().Str("root", name).Str("path", r.Path).Msg("replacing root")
+			return true
+		}
+		return false
+	})
+	root := scanRoot{Name: name, Path: dir, Collection: rootConfig.collection, Flags: rootSettings, Added: time.Now()}
+	if err = writeRoots(append(roots, root)); err != nil {
+		return fmt.Errorf("failed to update the roots: %w", err)
+	}
+	log.Info().Str("root", name).Str("path", dir).Str("collection", collectionLabel(root.Collection)).
+		Int("flags", len(root.Flags)).Msg("root added")
+	return nil
+}
+
+func rootsLs(args []string) error {
+	fs := newFlagSet("roots ls", "", "List the registered roots with the flags they are scanned with.")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument: %s", fs.Arg(0))
+	}
+	roots, err := readRoots()
+	if err != nil {
+		return fmt.Errorf("failed to read the roots: %w", err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "NAME\tPATH\tCOLLECTION\tFLAGS")
+	for _, r := range roots {
+		collection := r.Collection
+		if collection == "" {
+			collection = "-"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Name, displayPath(r.Path), collection, r.flagString())
+	}
+	return tw.Flush()
+}
+
+// flagString renders the flags of r as they would be given.
+func (r scanRoot) flagString() string {
+	names := make([]string, 0, len(r.Flags))
+	for name := range r.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var args []string
+	for _, name := range names {
+		for _, value := range r.Flags[name] {
+			args = append(args, "-"+name+"="+value)
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+func rootsRm(args []string) error {
+	fs := newFlagSet("roots rm", "<name>...", "Forget the named roots; their records stay in the index.")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return usageError(fs, "at least one root name is required")
+	}
+	roots, err := readRoots()
+	if err != nil {
+		return fmt.Errorf("failed to read the roots: %w", err)
+	}
+	for _, name := range args {
+		n := len(roots)
+		if roots = slices.DeleteFunc(roots, func(r scanRoot) bool { return r.Name == name }); len(roots) == n {
+			return fmt.Errorf("no root named %q, see roots ls", name)
+		}
+	}
+	if err = writeRoots(roots); err != nil {
+		return fmt.Errorf("failed to update the roots: %w", err)
+	}
+	log.Info().Strs("roots", args).Msg("roots removed")
+	return nil
+}
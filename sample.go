@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// -sample answers whether a full scan of a huge archive is worth it: it
+// walks the files as a scan would, but only hashes a random share of them,
+// into memory like -no-store, and extrapolates from the duplicates among
+// those. A duplicate shows up in the sample only if it and its keeper both
+// were picked, which for a share p of the files happens with probability p²,
+// so the duplicates of the sample are scaled by 1/p². The bounds are those of
+// a 95% confidence interval of the count in the sample, taken for a Poisson
+// count. Groups of more than two copies are over-counted by the scaling, an
+// archive full of them comes out worse than it is.
+
+// sampleRate is the -sample flag, the share of the files to hash.
+type sampleRate float64
+
+func (r *sampleRate) String() string {
+	if r == nil || *r == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(*r)*100, 'f', -1, 64) + "%"
+}
+
+func (r *sampleRate) Set(s string) error {
+	v, percent := strings.CutSuffix(s, "%")
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("expected a share like 5%% or 0.05, not %q", s)
+	}
+	if percent {
+		f /= 100
+	}
+	if f > 1 && f <= 100 && !percent {
+		return fmt.Errorf("a share is at most 1, did you mean %s%%?", v)
+	}
+	if f <= 0 || f > 1 {
+		return errors.New("must be above 0 and at most 100%")
+	}
+	*r = sampleRate(f)
+	return nil
+}
+
+// pathSampler passes on a random share of the paths of a source, counting
+// those it saw and kept.
+type pathSampler struct {
+	rate       float64
+	rnd        *rand.Rand
+	seen, kept int
+}
+
+func newPathSampler(rate sampleRate) *pathSampler {
+	src := rand.NewSource(rand.Int63())
+	if seed != nil {
+		src = rand.NewSource(*seed)
+	}
+	return &pathSampler{rate: float64(rate), rnd: rand.New(src)}
+}
+
+func (s *pathSampler) wrap(src pathSource) pathSource {
+	return func() (string, bool) {
+		for {
+			p, ok := src()
+			if !ok {
+				return "", false
+			}
+			s.seen++
+			if s.rnd.Float64() < s.rate {
+				s.kept++
+				return p, true
+			}
+		}
+	}
+}
+
+// report logs the estimate for all the files the sampler saw from the check
+// of the sample.
+func (s *pathSampler) report(sum checkSummary) {
+	if s.kept == 0 {
+		log.Warn().Int("files", s.seen).Msg("no file was sampled, nothing to estimate from")
+		return
+	}
+	p := float64(s.kept) / float64(s.seen)
+	scale := 1 / (p * p)
+	c := float64(sum.duplicates)
+	low, high := max(0, c-1.96*math.Sqrt(c)), c+1.96*math.Sqrt(c)
+	if sum.duplicates == 0 {
+		high = 3
+	}
+	est := func(n float64) int { return min(s.seen, int(math.Round(n*scale))) }
+	rate := func(n int) string { return strconv.FormatFloat(100*float64(n)/float64(s.seen), 'f', 1, 64) + "%" }
+	log.Info().Int("files", s.seen).Int("sampled", s.kept).Int("duplicates_in_sample", sum.duplicates).
+		Int("duplicates", est(c)).Int("low", est(low)).Int("high", est(high)).
+		Str("reclaimable", formatBytes(int64(float64(sum.reclaimable)*scale))).
+		Msgf("estimated from the sample: %s of the files are duplicates, between %s and %s",
+			rate(est(c)), rate(est(low)), rate(est(high)))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.tcp.direct/kayos/dupehunter/internal/imaging"
+	"github.com/bytedance/sonic"
+)
+
+// With -isolate-decode every image is decoded and hashed by a short-lived copy
+// of this binary instead of in-process. The child reads the image from its
+// stdin, confines itself before touching a single byte of it, and answers with
+// the hash on stdout. A decoder crash, hang, or decompression bomb then only
+// takes down the child, never the process holding the database.
+
+// sandboxCommand is the hidden argument that turns the binary into a decoder child.
+const sandboxCommand = imaging.DecoderCommand
+
+// sandboxTruncated is the exit status of a decoder child that found its input
+// truncated, sandboxReadError of one that failed to read it.
+const (
+	sandboxTruncated = 3
+	sandboxReadError = 4
+)
+
+type decodeSandbox struct {
+	exe      string
+	memoryMB int
+	timeout  time.Duration
+}
+
+// sandbox is set when -isolate-decode is in effect.
+var sandbox *decodeSandbox
+
+type sandboxResult struct {
+	Type   string `json:"type"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Hash   []byte `json:"hash"`
+	// Center is the hash of the center, with -center-weight.
+	Center    *centerHash `json:"center,omitempty"`
+	Grayscale bool        `json:"grayscale,omitempty"`
+}
+
+func newDecodeSandbox(memoryMB int, timeout time.Duration) (*decodeSandbox, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate own executable: %w", err)
+	}
+	if confinement != "" {
+		log.Info().Str("confinement", confinement).Int("memory_mb", memoryMB).
+			Dur("timeout", timeout).Msg("decoding images in isolated child processes")
+	} else {
+		log.Warn().Dur("timeout", timeout).
+			Msg("decoder children can't be resource limited on this platform, only the timeout applies")
+	}
+	return &decodeSandbox{exe: exe, memoryMB: memoryMB, timeout: timeout}, nil
+}
+
+// decode hands img's open file to a decoder child and adopts its result.
+func (s *decodeSandbox) decode(img *Image) (err error) {
+	defer func() {
+		if closeErr := img.f.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}()
+	return s.run(img, img.f.File)
+}
+
+// decodeTIFFPage decodes the page of f whose IFD starts at ifd into page.
+func (s *decodeSandbox) decodeTIFFPage(page *Image, f *os.File, ifd uint32) error {
+	return s.run(page, f, "-tiff-ifd", strconv.FormatUint(uint64(ifd), 10))
+}
+
+// decodeBytes decodes dat, the image of a member of a container, into img,
+// handing it to the child by way of a temporary file.
+func (s *decodeSandbox) decodeBytes(img *Image, dat []byte) error {
+	f, err := os.CreateTemp("", "dupehunter-member-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	if _, err = f.Write(dat); err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.run(img, f)
+}
+
+func (s *decodeSandbox) run(img *Image, f *os.File, args ...string) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	cpuSeconds := int((s.timeout + time.Second - 1) / time.Second)
+	cmd := exec.CommandContext(ctx, s.exe, append([]string{sandboxCommand,
+		"-memory", strconv.Itoa(s.memoryMB), "-cpu", strconv.Itoa(cpuSeconds), "-hash", hashing.String(),
+		"-center-weight", strconv.FormatFloat(centerWeight, 'g', -1, 64)},
+		args...)...)
+	cmd.Env = []string{}
+	cmd.Stdin = f
+	// the child reads the file itself, past any counting.
+	if finfo, err := f.Stat(); err == nil {
+		scanIO.read.Add(finfo.Size())
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	if err = cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return transientError{fmt.Errorf("isolated decoder timed out after %s", s.timeout)}
+		}
+		// only the first line, a crashing child dumps all of its goroutines.
+		msg, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == sandboxTruncated {
+			return fmt.Errorf("%w: %s", ErrTruncated, strings.TrimPrefix(msg, ErrTruncated.Error()+": "))
+		}
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == sandboxReadError {
+			return transientError{fmt.Errorf("isolated decoder failed to read the file: %s", msg)}
+		}
+		if msg != "" {
+			return fmt.Errorf("isolated decoder: %w: %s", err, msg)
+		}
+		return fmt.Errorf("isolated decoder: %w", err)
+	}
+
+	var res sandboxResult
+	if err = sonic.Unmarshal(stdout.Bytes(), &res); err != nil {
+		return fmt.Errorf("isolated decoder returned garbage: %w", err)
+	}
+	if img.Type, err = parseImageType(res.Type); err != nil {
+		return err
+	}
+	// the child is this very executable, hashing under the same layout.
+	img.Width, img.Height, img.PHash, img.HashLayout = res.Width, res.Height, res.Hash, hashLayout
+	img.Center, img.Grayscale = res.Center, res.Grayscale
+	return nil
+}
+
+// runSandboxedDecode is the entry point of a decoder child. It never touches
+// the database and only ever writes its result to stdout.
+func runSandboxedDecode(args []string) int {
+	fs := flag.NewFlagSet(sandboxCommand, flag.ContinueOnError)
+	memoryMB := fs.Int("memory", 1024, "")
+	cpuSeconds := fs.Int("cpu", 30, "")
+	tiffIFD := fs.Uint64("tiff-ifd", 0, "")
+	hash := fs.String("hash", hashing.String(), "")
+	fs.Float64Var(&centerWeight, "center-weight", 0, "")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	algorithm, err := parseHashAlgorithm(*hash)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	hashing = algorithm
+	if err := confineDecoder(uint64(*memoryMB)<<20, uint64(*cpuSeconds)); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to confine decoder: %v\n", err)
+		return 1
+	}
+
+	res, err := decodeConfined(uint32(*tiffIFD))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		switch {
+		case errors.Is(err, ErrTruncated):
+			return sandboxTruncated
+		case transientFailure(err):
+			return sandboxReadError
+		}
+		return 1
+	}
+	// encoding/json rather than sonic: its JIT needs executable mappings the
+	// address space limit may not leave room for.
+	dat, err := json.Marshal(res)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if _, err = os.Stdout.Write(dat); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// decodeConfined decodes the image on stdin, or the TIFF page at tiffIFD if set.
+func decodeConfined(tiffIFD uint32) (*sandboxResult, error) {
+	var (
+		i   image.Image
+		t   = TIFF
+		err error
+	)
+	if tiffIFD != 0 {
+		finfo, err := os.Stdin.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if i, err = imaging.DecodeTIFFPage(os.Stdin, finfo.Size(), tiffIFD); err != nil {
+			return nil, err
+		}
+	} else {
+		cr := &countingReader{r: os.Stdin}
+		if i, t, err = decImg(bufio.NewReaderSize(cr, 64*1024)); err != nil {
+			return nil, classifyDecodeError(os.Stdin, cr.n, err)
+		}
+	}
+	if t == GIF {
+		if err = checkDecodedGIF(os.Stdin); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	if err = hashing.dump(&buf, "", i); err != nil {
+		return nil, err
+	}
+	center, err := hashCenter(i)
+	if err != nil {
+		return nil, err
+	}
+	return &sandboxResult{Type: t.String(), Width: i.Bounds().Dx(), Height: i.Bounds().Dy(), Hash: buf.Bytes(),
+		Center: center, Grayscale: isGrayscale(i)}, nil
+}
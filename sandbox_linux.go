@@ -0,0 +1,108 @@
+package main
+
+import (
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// confinement describes what confineDecoder can enforce on this platform.
+var confinement = "rlimits"
+
+func init() {
+	if _, ok := auditArches[runtime.GOARCH]; ok {
+		confinement = "rlimits+seccomp"
+	}
+}
+
+var auditArches = map[string]uint32{
+	"amd64":   unix.AUDIT_ARCH_X86_64,
+	"arm64":   unix.AUDIT_ARCH_AARCH64,
+	"riscv64": unix.AUDIT_ARCH_RISCV64,
+	"ppc64le": unix.AUDIT_ARCH_PPC64LE,
+	"s390x":   unix.AUDIT_ARCH_S390X,
+}
+
+// deniedSyscalls are refused with EPERM once the decoder child is confined. A
+// decoder has no business opening files, spawning processes, or talking to the
+// network; everything it needs is already on stdin and stdout.
+var deniedSyscalls = append([]uintptr{
+	unix.SYS_OPENAT,
+	unix.SYS_OPENAT2,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_EXECVE,
+	unix.SYS_EXECVEAT,
+	unix.SYS_SOCKET,
+	unix.SYS_SOCKETPAIR,
+	unix.SYS_CONNECT,
+	unix.SYS_BIND,
+	unix.SYS_LISTEN,
+	unix.SYS_ACCEPT4,
+	unix.SYS_SENDTO,
+	unix.SYS_SENDMSG,
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_KILL,
+	unix.SYS_UNLINKAT,
+	unix.SYS_RENAMEAT2,
+	unix.SYS_LINKAT,
+	unix.SYS_SYMLINKAT,
+	unix.SYS_MKDIRAT,
+	unix.SYS_MEMFD_CREATE,
+}, legacySyscalls...)
+
+func confineDecoder(memory, cpuSeconds uint64) error {
+	limits := []struct {
+		resource int
+		max      uint64
+	}{
+		{unix.RLIMIT_AS, memory},
+		{unix.RLIMIT_CPU, cpuSeconds},
+		{unix.RLIMIT_FSIZE, 0},
+		{unix.RLIMIT_NOFILE, 16},
+	}
+	for _, l := range limits {
+		if err := unix.Setrlimit(l.resource, &unix.Rlimit{Cur: l.max, Max: l.max}); err != nil {
+			return err
+		}
+	}
+
+	arch, ok := auditArches[runtime.GOARCH]
+	if !ok {
+		return nil
+	}
+	return installSeccomp(arch)
+}
+
+// installSeccomp loads a filter denying deniedSyscalls on every thread of the process.
+func installSeccomp(arch uint32) error {
+	var (
+		deny   = unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)}
+		filter = []unix.SockFilter{
+			{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4}, // seccomp_data.arch
+			{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: arch, Jt: 1},
+			deny,
+			{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0}, // seccomp_data.nr
+			// x32 syscalls share the x86_64 arch and would bypass the numbers below.
+			{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, K: 0x40000000, Jf: 1},
+			deny,
+		}
+	)
+	for _, nr := range deniedSyscalls {
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: uint32(nr), Jf: 1}, deny)
+	}
+	filter = append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW})
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return err
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// legacySyscalls are the pre-*at variants only some architectures still provide.
+var legacySyscalls = []uintptr{
+	unix.SYS_OPEN,
+	unix.SYS_CREAT,
+	unix.SYS_FORK,
+	unix.SYS_VFORK,
+	unix.SYS_UNLINK,
+	unix.SYS_RENAME,
+	unix.SYS_RENAMEAT,
+	unix.SYS_LINK,
+	unix.SYS_SYMLINK,
+	unix.SYS_MKDIR,
+}
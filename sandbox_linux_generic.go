@@ -0,0 +1,10 @@
+//go:build linux && !amd64 && !riscv64 && !loong64
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// legacySyscalls are the pre-*at variants only some architectures still provide.
+var legacySyscalls = []uintptr{
+	unix.SYS_RENAMEAT,
+}
@@ -0,0 +1,7 @@
+//go:build linux && (riscv64 || loong64)
+
+package main
+
+// legacySyscalls is empty on architectures that only provide renameat2 and
+// the other *at variants.
+var legacySyscalls []uintptr
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+// confinement is empty where decoder children can't be resource limited.
+var confinement = ""
+
+func confineDecoder(memory, cpuSeconds uint64) error {
+	return nil
+}
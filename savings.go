@@ -0,0 +1,60 @@
+package main
+
+import "os"
+
+// Removing a duplicate frees less than its size on filesystems that were
+// partially deduplicated already: a hardlink of the keeper frees nothing, a
+// file with links outside of the duplicates frees nothing either, and extents
+// reflinked with other files stay allocated. The sizes alone are the apparent
+// savings; reclaimable also works out what removing the duplicates actually
+// frees, counting each file once, by the blocks allocated to it.
+
+// reclaimable returns the apparent and actual bytes removing the duplicates of
+// groups would free. Duplicates that can't be looked at count at their size.
+func reclaimable(groups []*dupeGroup) (apparent, actual int64) {
+	type linked struct {
+		removed, links uint64
+		freed          int64
+	}
+	kept := make(map[fileKey]struct{}, len(groups))
+	for _, g := range groups {
+		if finfo, err := os.Stat(g.keeper().Path); err == nil {
+			if id, ok := fileID(finfo); ok {
+				kept[id] = struct{}{}
+			}
+		}
+	}
+
+	files := make(map[fileKey]*linked)
+	for _, g := range groups {
+		for _, dupe := range g.removable() {
+			apparent += dupe.Size
+			finfo, err := os.Stat(dupe.Path)
+			if err != nil {
+				actual += dupe.Size
+				continue
+			}
+			links, allocated := fileUsage(finfo)
+			id, ok := fileID(finfo)
+			if !ok {
+				actual += max(allocated-sharedBytes(dupe.Path), 0)
+				continue
+			}
+			if _, ok = kept[id]; ok {
+				continue
+			}
+			f, seen := files[id]
+			if !seen {
+				f = &linked{links: links, freed: max(allocated-sharedBytes(dupe.Path), 0)}
+				files[id] = f
+			}
+			f.removed++
+		}
+	}
+	for _, f := range files {
+		if f.removed >= f.links {
+			actual += f.freed
+		}
+	}
+	return apparent, actual
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// -seed makes two runs over the same files and records report the same, byte
+// for byte, for reviewing what changed between them in automated pipelines.
+// -sample draws its share of the files from the seed, and the pairs of every
+// group, in the log and the results file, and the probable watermark
+// variants are listed in path order rather than in the order the index
+// happened to find them in. Everything else reported is in path order either
+// way, and the indexes built at random draw from fixed seeds. Scans stopped
+// by -max-files or -max-duration still stop wherever the workers got to.
+
+// seed is the -seed of the run, nil without one.
+var seed *int64
+
+func setSeed(s string) error {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("expected an integer, not %q", s)
+	}
+	seed = &n
+	return nil
+}
+
+// sortPairs orders pairs by their paths under -seed, and leaves them alone
+// otherwise.
+func sortPairs(pairs []dupePair) {
+	if seed == nil {
+		return
+	}
+	slices.SortFunc(pairs, func(x, y dupePair) int {
+		if c := strings.Compare(x.a, y.a); c != 0 {
+			return c
+		}
+		return strings.Compare(x.b, y.b)
+	})
+}
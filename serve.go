@@ -0,0 +1,811 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"crypto/rand"
+	"github.com/bytedance/sonic"
+)
+
+// The HTTP API lets a shared daemon, e.g. on a household NAS, be used by
+// several clients. Every request carries a bearer token, and each token is
+// granted only the scopes it needs: read to list records and duplicates,
+// ingest to add images, and clean to act on duplicates.
+
+const (
+	scopeRead   = "read"
+	scopeIngest = "ingest"
+	scopeClean  = "clean"
+)
+
+var apiScopes = map[string]bool{scopeRead: true, scopeIngest: true, scopeClean: true}
+
+type apiToken struct {
+	name   string
+	secret []byte
+	scopes map[string]bool
+}
+
+// loadTokens reads one token per line as "name secret scope[,scope...]",
+// every secret its own. Blank lines and lines starting with '#' are ignored.
+func loadTokens(path string) ([]apiToken, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	if fi, err := f.Stat(); err == nil && fi.Mode().Perm()&0o077 != 0 {
+		log.Warn().Str("path", path).Msg("token file is readable by other users")
+	}
+
+	var (
+		tokens  = make([]apiToken, 0)
+		lineOf  = make(map[string]int)
+		scanner = bufio.NewScanner(f)
+	)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected name, secret and scopes", path, line)
+		}
+		// tokens sharing a secret can't be told apart, requests would get
+		// the scopes of whichever comes last.
+		if first, ok := lineOf[fields[1]]; ok {
+			return nil, fmt.Errorf("%s:%d: %s has the same secret as the token of line %d", path, line, fields[0], first)
+		}
+		lineOf[fields[1]] = line
+		tok := apiToken{name: fields[0], secret: []byte(fields[1]), scopes: make(map[string]bool)}
+		for _, scope := range strings.Split(fields[2], ",") {
+			if !apiScopes[scope] {
+				return nil, fmt.Errorf("%s:%d: unknown scope %q, expected read, ingest, or clean", path, line, scope)
+			}
+			tok.scopes[scope] = true
+		}
+		tokens = append(tokens, tok)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("no tokens in " + path)
+	}
+	return tokens, nil
+}
+
+type apiServer struct {
+	cfg    *config
+	tokens []apiToken
+	jobs   *jobQueue
+	// jobs and the reads that search the index or need the worker pool take
+	// turns; plain record reads go through imageStore alongside a running job.
+	mu sync.Mutex
+	// settled is a copy of cfg as of the last reload, for the handlers that
+	// don't take turns with jobs and so may run while a reload changes cfg.
+	settled atomic.Pointer[config]
+	// overlapSecret salts the identifiers of the overlap sessions, see overlap.
+	overlapSecret []byte
+}
+
+// authenticate returns the token presented by r, comparing every known secret
+// in constant time.
+func (s *apiServer) authenticate(r *http.Request) *apiToken {
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	var found *apiToken
+	for i := range s.tokens {
+		if subtle.ConstantTimeCompare(s.tokens[i].secret, []byte(secret)) == 1 {
+			found = &s.tokens[i]
+		}
+	}
+	return found
+}
+
+// permits reports whether r carries a token granting scope, answering the
+// request itself when it doesn't.
+func (s *apiServer) permits(w http.ResponseWriter, r *http.Request, scope string) bool {
+	tok := s.authenticate(r)
+	switch {
+	case tok == nil:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="dupehunter"`)
+		writeJSON(w, http.StatusUnauthorized, apiError{"missing or unknown token"})
+		return false
+	case !tok.scopes[scope]:
+		log.Warn().Str("token", tok.name).Str("scope", scope).Str("path", r.URL.Path).Msg("request out of scope")
+		writeJSON(w, http.StatusForbidden, apiError{"token lacks the " + scope + " scope"})
+		return false
+	}
+	log.Info().Str("token", tok.name).Str("method", r.Method).Str("path", r.URL.Path).Msg("api request")
+	return true
+}
+
+// grants reports whether r carries a token granting scope, for handlers whose
+// answers widen with it.
+func (s *apiServer) grants(r *http.Request, scope string) bool {
+	tok := s.authenticate(r)
+	return tok != nil && tok.scopes[scope]
+}
+
+// settle publishes cfg as it is now to the handlers reading settings, with
+// s.mu held.
+func (s *apiServer) settle() {
+	settled := *s.cfg
+	s.settled.Store(&settled)
+}
+
+// settings returns the configuration as of the last reload, for handlers that
+// don't hold s.mu.
+func (s *apiServer) settings() *config {
+	return s.settled.Load()
+}
+
+// handle serves fn as JSON for requests with method whose token grants scope.
+func (s *apiServer) handle(method, scope string, fn func(r *http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"use " + method})
+			return
+		}
+		if s.permits(w, r, scope) {
+			if method != http.MethodGet {
+				actor, command := s.auditRequest(r)
+				auditBy(actor, command, "api", "", "")
+			}
+			respond(w, r, fn)
+		}
+	}
+}
+
+// locked runs fn while no job is running, the changes it makes audited as the
+// request's.
+func (s *apiServer) locked(fn func(r *http.Request) (any, error)) func(r *http.Request) (any, error) {
+	return func(r *http.Request) (any, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r != nil {
+			defer auditAs(s.auditRequest(r))()
+		}
+		return fn(r)
+	}
+}
+
+// apiAccepted is returned for requests that were queued as a job.
+type apiAccepted struct {
+	job jobView
+}
+
+func respond(w http.ResponseWriter, r *http.Request, fn func(r *http.Request) (any, error)) {
+	resp, err := fn(r)
+	var (
+		badRequest *apiBadRequest
+		notFound   *apiNotFound
+		conflict   *apiConflict
+	)
+	switch {
+	case errors.As(err, &badRequest):
+		writeJSON(w, http.StatusBadRequest, apiError{badRequest.msg})
+	case errors.As(err, &notFound):
+		writeJSON(w, http.StatusNotFound, apiError{notFound.msg})
+	case errors.As(err, &conflict):
+		writeJSON(w, http.StatusConflict, apiRejected{conflict.msg, conflict.duplicates})
+	case errors.Is(err, errQueueFull):
+		writeJSON(w, http.StatusServiceUnavailable, apiError{err.Error()})
+	case err != nil:
+		log.Error().Err(err).Str("path", r.URL.Path).Msg("api request failed")
+		writeJSON(w, http.StatusInternalServerError, apiError{err.Error()})
+	default:
+		if accepted, ok := resp.(apiAccepted); ok {
+			w.Header().Set("Location", "/v1/jobs/"+accepted.job.ID)
+			writeJSON(w, http.StatusAccepted, accepted.job)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiBadRequest struct {
+	msg string
+}
+
+func (e *apiBadRequest) Error() string {
+	return e.msg
+}
+
+type apiNotFound struct {
+	msg string
+}
+
+func (e *apiNotFound) Error() string {
+	return e.msg
+}
+
+// apiConflict rejects a request for the duplicates it would ingest.
+type apiConflict struct {
+	msg        string
+	duplicates []apiDuplicate
+}
+
+func (e *apiConflict) Error() string {
+	return e.msg
+}
+
+type apiRejected struct {
+	Error      string         `json:"error"`
+	Duplicates []apiDuplicate `json:"duplicates"`
+}
+
+// apiDuplicate is a path given to ingest along with the records it matches.
+type apiDuplicate struct {
+	Path    string       `json:"path"`
+	Matches []queryMatch `json:"matches"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	dat, err := sonic.Marshal(v)
+	if err != nil {
+		status, dat = http.StatusInternalServerError, []byte(`{"error":"failed to encode response"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(dat, '\n'))
+}
+
+func decodeBody(r *http.Request, v any) error {
+	if err := sonic.ConfigDefault.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20)).Decode(v); err != nil {
+		return &apiBadRequest{"invalid request body: " + err.Error()}
+	}
+	return nil
+}
+
+func (s *apiServer) records(r *http.Request) (any, error) {
+	filter := r.URL.Query().Get("filter")
+	var recs = make([]listedRecord, 0)
+	err := forEachRecord(func(img *Image) error {
+		if matchFilter(filter, img.Path) {
+			recs = append(recs, img.listed())
+		}
+		return nil
+	})
+	return recs, err
+}
+
+type apiGroup struct {
+	// ID identifies the group across runs, see groupID.
+	ID         string   `json:"id"`
+	Keeper     string   `json:"keeper"`
+	Duplicates []string `json:"duplicates"`
+	// Edits are the duplicates clean leaves alone as edits of the keeper.
+	Edits []string `json:"edits,omitempty"`
+}
+
+func newAPIGroup(g *dupeGroup) apiGroup {
+	ag := apiGroup{ID: groupID(g), Keeper: g.keeper().Path}
+	for _, dupe := range g.removable() {
+		ag.Duplicates = append(ag.Duplicates, dupe.Path)
+	}
+	for _, dupe := range g.edits() {
+		ag.Edits = append(ag.Edits, dupe.Path)
+	}
+	return ag
+}
+
+func (s *apiServer) groups() ([]*dupeGroup, error) {
+	pairs, records, err := findPairs(s.cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer pairs.close()
+	return selectGroups(groupPairs(pairs, records, s.cfg.keepOrder),
+		s.cfg.minGroupSize, s.cfg.groupOffset, s.cfg.maxGroups), nil
+}
+
+func (s *apiServer) duplicates(*http.Request) (any, error) {
+	groups, err := s.groups()
+	if err != nil {
+		return nil, err
+	}
+	var resp = make([]apiGroup, 0, len(groups))
+	for _, g := range groups {
+		resp = append(resp, newAPIGroup(g))
+	}
+	return resp, nil
+}
+
+// groupsPageLimit caps the groups of one /v1/groups page.
+const groupsPageLimit = 1000
+
+type apiGroupPage struct {
+	Groups []apiGroupDetail `json:"groups"`
+	// Next is the cursor of the following page, empty on the last one.
+	Next string `json:"next,omitempty"`
+}
+
+type apiGroupDetail struct {
+	apiGroup
+	// Distance is the largest distance between two members found to match.
+	Distance    int   `json:"distance"`
+	Reclaimable int64 `json:"reclaimable"`
+}
+
+// pagedGroups serves /v1/groups, the groups a page at a time in keeper path
+// order. The cursor is the keeper of the last group of the previous page,
+// which stays valid while groups come and go between requests. Filters:
+// min_distance leaves out groups of members closer than that, like exact
+// copies with 1; prefix keeps the groups with a member under a path prefix;
+// min_reclaimable keeps those whose duplicates add up to that many bytes.
+func (s *apiServer) pagedGroups(r *http.Request) (any, error) {
+	q := r.URL.Query()
+	intParam := func(name string, def, limit int64) (int64, error) {
+		v := q.Get(name)
+		if v == "" {
+			return def, nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 || limit > 0 && n > limit {
+			return 0, &apiBadRequest{fmt.Sprintf("invalid %s %q", name, v)}
+		}
+		return n, nil
+	}
+	limit, err := intParam("limit", 100, groupsPageLimit)
+	if err == nil && limit == 0 {
+		err = &apiBadRequest{"limit must be at least 1"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	minDistance, err := intParam("min_distance", 0, 64)
+	if err != nil {
+		return nil, err
+	}
+	minReclaimable, err := intParam("min_reclaimable", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	prefix := q.Get("prefix")
+	var after string
+	if cursor := q.Get("cursor"); cursor != "" {
+		dat, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, &apiBadRequest{"invalid cursor"}
+		}
+		after = string(dat)
+	}
+
+	pairs, records, err := findPairs(s.cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer pairs.close()
+	groups := selectGroups(groupPairs(pairs, records, s.cfg.keepOrder), s.cfg.minGroupSize, 0, 0)
+	groupOf := groupsOf(groups)
+	distance := make(map[*dupeGroup]int, len(groups))
+	pairs.each(func(pair dupePair) {
+		if g := groupOf[pair.a]; g != nil {
+			distance[g] = max(distance[g], pair.distance)
+		}
+	})
+	if err = pairs.failed(); err != nil {
+		return nil, err
+	}
+
+	page := apiGroupPage{Groups: make([]apiGroupDetail, 0, limit)}
+	for _, g := range groups {
+		if after != "" && g.keeper().Path <= after || distance[g] < int(minDistance) {
+			continue
+		}
+		if prefix != "" && !slices.ContainsFunc(g.members, func(m *Image) bool { return strings.HasPrefix(m.Path, prefix) }) {
+			continue
+		}
+		detail := apiGroupDetail{apiGroup: newAPIGroup(g), Distance: distance[g]}
+		for _, dupe := range g.removable() {
+			detail.Reclaimable += dupe.Size
+		}
+		if detail.Reclaimable < minReclaimable {
+			continue
+		}
+		if len(page.Groups) == int(limit) {
+			page.Next = base64.RawURLEncoding.EncodeToString([]byte(page.Groups[limit-1].Keeper))
+			break
+		}
+		page.Groups = append(page.Groups, detail)
+	}
+	return page, nil
+}
+
+func (s *apiServer) ingest(r *http.Request) (any, error) {
+	var req struct {
+		Paths  []string `json:"paths"`
+		Source string   `json:"source"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	}
+	if len(req.Paths) == 0 {
+		return nil, &apiBadRequest{"paths is required"}
+	}
+	for _, p := range req.Paths {
+		// relative paths would resolve against wherever the daemon was started.
+		if !filepath.IsAbs(p) {
+			return nil, &apiBadRequest{"paths must be absolute: " + p}
+		}
+	}
+	if err := s.rejectDuplicates(r, req.Paths); err != nil {
+		return nil, err
+	}
+	origin := newOrigin(req.Source, "api:"+s.authenticate(r).name)
+	return s.submit(r, "ingest", func(ctx context.Context) (any, error) {
+		if err := ingestPaths(ctx, s.cfg, req.Paths, origin); err != nil {
+			return nil, err
+		}
+		return map[string]int{"paths": len(req.Paths)}, nil
+	})
+}
+
+// rejectDuplicates turns the ingest away when ?reject_duplicates=true and any
+// of paths is within ?d= (-d by default) of an indexed record other than its
+// own, for uploads to be gated on. Files that can't be hashed are left for
+// the ingest to report.
+func (s *apiServer) rejectDuplicates(r *http.Request, paths []string) error {
+	query := r.URL.Query()
+	if reject := query.Get("reject_duplicates"); reject == "" {
+		return nil
+	} else if ok, err := strconv.ParseBool(reject); err != nil {
+		return &apiBadRequest{"reject_duplicates must be true or false"}
+	} else if !ok {
+		return nil
+	}
+	distance := s.settings().maxDistance
+	if d := query.Get("d"); d != "" {
+		var err error
+		if distance, err = strconv.Atoi(d); err != nil || distance < 1 || distance > hashing.bits() {
+			return &apiBadRequest{fmt.Sprintf("d must be between 1 and %d", hashing.bits())}
+		}
+	}
+
+	duplicates := make([]apiDuplicate, 0)
+	for _, p := range paths {
+		img, err := imageQueried(p)
+		if err != nil {
+			continue
+		}
+		matches, err := queryIndex(img, distance-1)
+		if err != nil {
+			return err
+		}
+		matches = slices.DeleteFunc(matches, func(m queryMatch) bool { return m.Path == p })
+		if len(matches) > 0 {
+			duplicates = append(duplicates, apiDuplicate{Path: p, Matches: matches})
+		}
+	}
+	if len(duplicates) > 0 {
+		return &apiConflict{msg: "duplicates of indexed records, nothing was ingested", duplicates: duplicates}
+	}
+	return nil
+}
+
+// submit queues run as a job of kind, the changes it makes audited as those
+// of the request r.
+func (s *apiServer) submit(r *http.Request, kind string, run func(ctx context.Context) (any, error)) (any, error) {
+	actor, command := s.auditRequest(r)
+	j, err := s.jobs.submit(kind, func(ctx context.Context) (any, error) {
+		defer auditAs(actor, command)()
+		result, err := run(ctx)
+		saveIndexSnapshot()
+		return result, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return apiAccepted{j.view(false)}, nil
+}
+
+// validCleanAction checks the action and quarantine of a clean request, and
+// that serve was started with -snapshot or -i-have-a-snapshot for a
+// destructive action that isn't a dry run.
+func (s *apiServer) validCleanAction(action, quarantine string, dryRun bool) error {
+	switch action {
+	case actionDelete, actionHardlink, actionSymlink, actionAuto:
+		if cfg := s.settings(); !dryRun && !cfg.snapshot && !cfg.haveSnapshot {
+			return &apiBadRequest{errUnvouched.Error()}
+		}
+	case actionMove:
+		if !filepath.IsAbs(quarantine) {
+			return &apiBadRequest{"the move action needs an absolute quarantine directory"}
+		}
+	case actionRecycle:
+		if !canRecycle {
+			return &apiBadRequest{"the recycle action needs the Recycle Bin of 64-bit Windows"}
+		}
+	default:
+		return &apiBadRequest{"action must be delete, hardlink, symlink, auto, move, or recycle"}
+	}
+	return nil
+}
+
+func (s *apiServer) clean(r *http.Request) (any, error) {
+	var req struct {
+		Action     string `json:"action"`
+		Quarantine string `json:"quarantine"`
+		DryRun     bool   `json:"dry_run"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	}
+	if err := s.validCleanAction(req.Action, req.Quarantine, req.DryRun); err != nil {
+		return nil, err
+	}
+	return s.submit(r, "clean", func(ctx context.Context) (any, error) {
+		groups, err := s.groups()
+		if err != nil {
+			return nil, err
+		}
+		c := &cleaner{action: req.Action, quarantine: req.Quarantine, preserveTimes: s.cfg.preserveTimes,
+			dryRun: req.DryRun, snapshot: s.cfg.snapshot, vouched: s.cfg.haveSnapshot,
+			nearDupes: s.cfg.nearDupes}
+		err = c.clean(ctx, groups)
+		return map[string]int{"cleaned": c.cleaned, "skipped": c.skipped, "failed": c.failed}, err
+	})
+}
+
+// query finds the records similar to one image on the server, or with top
+// the nearest ones however far they are. It runs right away in the
+// interactive lane rather than as a job, overtaking bulk work. Images that
+// aren't indexed are only decoded for tokens with the ingest scope.
+func (s *apiServer) query(r *http.Request) (any, error) {
+	var req struct {
+		Path     string `json:"path"`
+		Distance int    `json:"distance"`
+		Top      int    `json:"top"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(req.Path) {
+		return nil, &apiBadRequest{"path must be absolute"}
+	}
+	if req.Distance == 0 {
+		req.Distance = s.settings().maxDistance
+	}
+	if req.Distance < 1 || req.Distance > hashing.bits() {
+		return nil, &apiBadRequest{fmt.Sprintf("distance must be between 1 and %d", hashing.bits())}
+	}
+	if req.Top < 0 || req.Top > queryTopLimit {
+		return nil, &apiBadRequest{fmt.Sprintf("top must be between 1 and %d", queryTopLimit)}
+	}
+	if !s.grants(r, scopeIngest) && !indexedPath(req.Path) {
+		return nil, &apiBadRequest{errNotIndexed.Error()}
+	}
+	img, err := imageQueried(req.Path)
+	if err != nil {
+		return nil, &apiBadRequest{err.Error()}
+	}
+	if req.Top > 0 {
+		return nearestIndex(img, req.Top)
+	}
+	return queryIndex(img, req.Distance-1)
+}
+
+// distance measures the distances of a batch of pairs of hashes or images,
+// in the interactive lane like query, and whether -d holds them duplicates.
+// Like query, it only decodes images that aren't indexed for ingest tokens.
+func (s *apiServer) distance(r *http.Request) (any, error) {
+	var req struct {
+		Pairs [][2]string `json:"pairs"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	}
+	if len(req.Pairs) == 0 {
+		return nil, &apiBadRequest{"no pairs given"}
+	}
+	if len(req.Pairs) > distancePairLimit {
+		return nil, &apiBadRequest{fmt.Sprintf("at most %d pairs per request", distancePairLimit)}
+	}
+	return pairDistances(s.settings(), req.Pairs, !s.grants(r, scopeIngest)), nil
+}
+
+// reload reloads the configuration once no job is running, see liveConfig.
+func (s *apiServer) reload(*http.Request) (any, error) {
+	r, err := live.reload()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to reload the configuration, keeping the current one")
+		return nil, &apiBadRequest{err.Error()}
+	}
+	s.settle()
+	return r, nil
+}
+
+// jobScopes are needed to cancel a job of each kind.
+var jobScopes = map[string]string{"ingest": scopeIngest, "clean": scopeClean}
+
+// job serves /v1/jobs/<id>: GET inspects a job along with its log, DELETE cancels it.
+func (s *apiServer) job(w http.ResponseWriter, r *http.Request) {
+	find := func(r *http.Request) (*job, error) {
+		j := s.jobs.get(strings.TrimPrefix(r.URL.Path, "/v1/jobs/"))
+		if j == nil {
+			return nil, &apiNotFound{"no such job"}
+		}
+		return j, nil
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if s.permits(w, r, scopeRead) {
+			respond(w, r, func(r *http.Request) (any, error) {
+				j, err := find(r)
+				if err != nil {
+					return nil, err
+				}
+				return j.view(true), nil
+			})
+		}
+	case http.MethodDelete:
+		j, err := find(r)
+		if err != nil {
+			// don't tell unauthenticated clients which jobs exist.
+			if s.permits(w, r, scopeRead) {
+				writeJSON(w, http.StatusNotFound, apiError{err.Error()})
+			}
+			return
+		}
+		if s.permits(w, r, jobScopes[j.kind]) {
+			s.jobs.cancel(j)
+			writeJSON(w, http.StatusOK, j.view(false))
+		}
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"use GET or DELETE"})
+	}
+}
+
+func runServe(args []string) error {
+	fs := newFlagSet("serve", "--tokens FILE [--listen ADDR]",
+		"Serve the HTTP API. Root flags like -d, -keep and -min-group-size, or a -job document without\n"+
+			"roots, apply to its duplicate queries. Endpoints, each requiring a bearer token with the given scope:\n\n"+
+			"  GET    /v1/status                 read    phase, progress, and ETA of the running job\n"+
+			"  GET    /v1/records[?filter=GLOB]  read\n"+
+			"  GET    /v1/duplicates             read\n"+
+			"  GET    /v1/groups[?cursor=C]      read    a page of groups and the cursor of the next; limit,\n"+
+			"                                            min_distance, prefix and min_reclaimable filter them\n"+
+			"  POST   /v1/query                  read    records similar to {\"path\": FILE, \"distance\": N}, or the\n"+
+			"                                            nearest {\"top\": K}; files that aren't indexed need ingest\n"+
+			"  POST   /v1/overlap                read    the hashes sharing a segment with those of check --remote\n"+
+			"  POST   /v1/distance               read    distances of {\"pairs\": [[A, B], ...]}, each a hash as\n"+
+			"                                            listed by db ls or an absolute path, indexed unless ingest\n"+
+			"  POST   /v1/ingest                 ingest  queue a scan of {\"paths\": [...]}; with ?reject_duplicates=true\n"+
+			"                                            and optionally ?d=N, 409 with the matches of any duplicate\n"+
+			"  POST   /v1/records:batch          ingest  store {\"records\": [...]} hashed elsewhere, each with a path or\n"+
+			"                                            URL, a hash or checksum, and metadata; at most 1000\n"+
+			"  POST   /v1/clean                  clean   queue {\"action\": \"hardlink|move|recycle\", \"quarantine\": DIR}\n"+
+			"  POST   /v1/groups/ID/resolve      clean   settle a group: {\"action\": \"delete|hardlink|...\", \"keep\": PATH},\n"+
+			"                                            or {\"action\": \"ignore|unignore\"} to stop or resume reporting it\n"+
+			"  POST   /v1/reload                 clean   reload -job and -thresholds, as SIGHUP does\n"+
+			"  GET    /v1/jobs[/ID]              read    list jobs, or inspect one with its log\n"+
+			"  DELETE /v1/jobs/ID                the scope of the job's kind, cancels it\n\n"+
+			"For container probes, /healthz and /readyz answer without a token: health fails once the\n"+
+			"database can't be written or the worker pool stopped, readiness also while the similarity\n"+
+			"index is loading or being rebuilt. Binaries built with -tags webui serve a web UI under /ui/,\n"+
+			"its assets embedded and the token entered in the browser.")
+	listen := fs.String("listen", "127.0.0.1:8080", "`address` to listen on")
+	tokensFile := fs.String("tokens", "", "`file` of \"name secret scope[,scope...]\" lines granting API access")
+	compactEvery := fs.Duration("compact-every", 0,
+		"compact the database every `interval` while serving, e.g. 24h, requests going on meanwhile")
+	compactWindow := fs.String("compact-window", "",
+		"only compact between the local times `HH:MM-HH:MM`, e.g. 02:00-05:00")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument: %s", fs.Arg(0))
+	}
+	if *tokensFile == "" {
+		return usageError(fs, "--tokens is required, the API is never served without authentication")
+	}
+	if *compactEvery < 0 {
+		return usageError(fs, "--compact-every can't be negative")
+	}
+	var window *compactionWindow
+	if *compactWindow != "" {
+		if *compactEvery == 0 {
+			return usageError(fs, "--compact-window needs --compact-every")
+		}
+		w, err := parseCompactionWindow(*compactWindow)
+		if err != nil {
+			return usageError(fs, "invalid value %q for --compact-window: %s", *compactWindow, err)
+		}
+		window = w
+	}
+	tokens, err := loadTokens(*tokensFile)
+	if err != nil {
+		return err
+	}
+
+	if rootConfig.isolateDecode && sandbox == nil {
+		if sandbox, err = newDecodeSandbox(rootConfig.isolateMemory, rootConfig.isolateLimit); err != nil {
+			return err
+		}
+	}
+
+	s := &apiServer{cfg: rootConfig, tokens: tokens, overlapSecret: make([]byte, hashExportSaltLen)}
+	if _, err = rand.Read(s.overlapSecret); err != nil {
+		return err
+	}
+	s.settle()
+	s.jobs = newJobQueue(&s.mu)
+	log = log.Hook(s.jobs)
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", serveHealth(false))
+	if ui := webUI(); ui != nil {
+		mux.Handle("/ui/", http.StripPrefix("/ui/", ui))
+	}
+	mux.Handle("/readyz", serveHealth(true))
+	// status and jobs are served while a job runs, to watch its progress.
+	mux.Handle("/v1/status", s.handle(http.MethodGet, scopeRead, func(*http.Request) (any, error) {
+		return progress.snapshot(), nil
+	}))
+	mux.Handle("/v1/jobs", s.handle(http.MethodGet, scopeRead, func(*http.Request) (any, error) {
+		return s.jobs.list(), nil
+	}))
+	mux.HandleFunc("/v1/jobs/", s.job)
+	mux.Handle("/v1/records", s.handle(http.MethodGet, scopeRead, s.records))
+	mux.Handle("/v1/duplicates", s.handle(http.MethodGet, scopeRead, s.locked(s.duplicates)))
+	mux.Handle("/v1/groups", s.handle(http.MethodGet, scopeRead, s.locked(s.pagedGroups)))
+	mux.Handle("/v1/groups/", s.handle(http.MethodPost, scopeClean, s.locked(s.resolveGroup)))
+	mux.Handle("/v1/query", s.handle(http.MethodPost, scopeRead, s.query))
+	mux.Handle("/v1/overlap", s.handle(http.MethodPost, scopeRead, s.overlap))
+	mux.Handle("/v1/distance", s.handle(http.MethodPost, scopeRead, s.distance))
+	mux.Handle("/v1/records:batch", s.handle(http.MethodPost, scopeIngest, s.locked(s.recordsBatch)))
+	mux.Handle("/v1/ingest", s.handle(http.MethodPost, scopeIngest, s.ingest))
+	mux.Handle("/v1/clean", s.handle(http.MethodPost, scopeClean, s.clean))
+	mux.Handle("/v1/reload", s.handle(http.MethodPost, scopeClean, s.locked(s.reload)))
+
+	// the index is loaded up front rather than by the first request needing
+	// it, and /readyz holds traffic off until it is. Unless it was mapped
+	// from a snapshot, one is written for the next start.
+	go func() {
+		if _, err := getIndex(); err != nil {
+			log.Error().Err(err).Msg("failed to load the similarity index")
+			return
+		}
+		saveIndexSnapshot()
+	}()
+
+	if *compactEvery > 0 {
+		go scheduleCompaction(*compactEvery, window)
+	}
+	hup, stopHup := reloadSignals()
+	defer stopHup()
+	go func() {
+		for range hup {
+			_, _ = s.locked(s.reload)(nil)
+		}
+	}()
+
+	log.Info().Str("listen", *listen).Int("tokens", len(tokens)).Msg("serving api")
+	srv := &http.Server{Addr: *listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return srv.ListenAndServe()
+}
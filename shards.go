@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// The match phase queries the neighborhood of every record, which is
+// independent from record to record. The records are queried in parallel by
+// a number of tasks on the worker pool, which the ingest is done with by
+// then, each taking the next record not yet taken from a shared cursor and
+// writing only the results of the records it took, so they are collected
+// without any locking. The records are taken in the order they are given,
+// most promising first under a time budget, however many tasks the pool
+// runs at once, and the results are merged in path order afterwards, so the
+// pairs found never depend on how the work was split.
+
+// shardResult is what query returned for one record.
+type shardResult struct {
+	matches []indexMatch
+	cached  bool
+}
+
+// queryShards calls query for each of paths from n tasks, taking them in the
+// order of paths, and returns the results in that order. query must be safe
+// for concurrent use.
+func queryShards(paths []string, n int, query func(path string) ([]indexMatch, bool)) []shardResult {
+	n = min(max(n, 1), max(len(paths), 1))
+	var (
+		results = make([]shardResult, len(paths))
+		next    atomic.Int64
+		wg      sync.WaitGroup
+	)
+	task := func() {
+		defer wg.Done()
+		for i := int(next.Add(1) - 1); i < len(paths); i = int(next.Add(1) - 1) {
+			matches, cached := query(paths[i])
+			results[i] = shardResult{matches: matches, cached: cached}
+			progress.advance()
+		}
+	}
+	for t := 0; t < n; t++ {
+		wg.Add(1)
+		if workers == nil || workers.Submit(task) != nil {
+			// commands that run without the pool, or after it closed.
+			go task()
+		}
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func TestQueryShardsQueriesEachPathOnce(t *testing.T) {
+	const count = 1000
+	var (
+		paths   = make([]string, count)
+		queried = make(map[string]*atomic.Int32, count)
+	)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/img/%04d.png", i)
+		queried[paths[i]] = new(atomic.Int32)
+	}
+	for _, n := range []int{1, 4, 16} {
+		for _, q := range queried {
+			q.Store(0)
+		}
+		results := queryShards(paths, n, func(p string) ([]indexMatch, bool) {
+			queried[p].Add(1)
+			return []indexMatch{{path: p}}, false
+		})
+		for i, p := range paths {
+			if got := queried[p].Load(); got != 1 {
+				t.Errorf("%d shards: %s queried %d times", n, p, got)
+			}
+			if len(results[i].matches) != 1 || results[i].matches[0].path != p {
+				t.Errorf("%d shards: result %d is %v, want the match of %s", n, i, results[i].matches, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// With -sidecars, the keeper decisions of a check are written next to the
+// files, into a .dupehunter.json in every directory with a member of a
+// reported group, keyed by file name. They travel with the directories when
+// those are moved or renamed before the duplicates are cleaned, and later
+// checks honor them over every other keep rule: a file recorded as keeper is
+// kept, one recorded as duplicate is not, whatever its path is now. Editing a
+// role in the sidecar overrules dupehunter's choice.
+
+const sidecarName = ".dupehunter.json"
+
+const sidecarVersion = 1
+
+const (
+	roleKeeper    = "keeper"
+	roleDuplicate = "duplicate"
+)
+
+type sidecarDoc struct {
+	Version int                        `json:"version"`
+	Files   map[string]sidecarDecision `json:"files"`
+}
+
+type sidecarDecision struct {
+	Role string `json:"role"`
+	// Group is the ID of the group, see groupID.
+	Group   string    `json:"group"`
+	Decided time.Time `json:"decided"`
+}
+
+// sidecarCache holds the sidecars read during a check, one per directory.
+type sidecarCache struct {
+	mu   sync.Mutex
+	docs map[string]*sidecarDoc
+}
+
+var sidecars = &sidecarCache{}
+
+// reset forgets the sidecars read so far, they may have changed since.
+func (c *sidecarCache) reset() {
+	c.mu.Lock()
+	c.docs = nil
+	c.mu.Unlock()
+}
+
+// role returns the recorded role of the file at path, or "" if there is none.
+func (c *sidecarCache) role(path string) string {
+	dir := filepath.Dir(path)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.docs == nil {
+		c.docs = make(map[string]*sidecarDoc)
+	}
+	doc, ok := c.docs[dir]
+	if !ok {
+		var err error
+		if doc, err = readSidecar(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warn().Err(err).Str("caller", filepath.Join(dir, sidecarName)).Msg("ignoring sidecar")
+		}
+		c.docs[dir] = doc
+	}
+	if doc == nil {
+		return ""
+	}
+	return doc.Files[filepath.Base(path)].Role
+}
+
+func readSidecar(dir string) (*sidecarDoc, error) {
+	dat, err := os.ReadFile(filepath.Join(dir, sidecarName))
+	if err != nil {
+		return nil, err
+	}
+	doc := &sidecarDoc{}
+	if err = sonic.Unmarshal(dat, doc); err != nil {
+		return nil, fmt.Errorf("invalid sidecar: %w", err)
+	}
+	if doc.Version != sidecarVersion {
+		return nil, fmt.Errorf("unsupported sidecar version %d", doc.Version)
+	}
+	return doc, nil
+}
+
+// keepDecided prefers the member recorded as keeper, and the members without
+// a decision over those recorded as duplicates.
+func keepDecided(a, b *Image) int {
+	rank := func(img *Image) int {
+		switch sidecars.role(img.Path) {
+		case roleKeeper:
+			return 0
+		case roleDuplicate:
+			return 2
+		}
+		return 1
+	}
+	return rank(a) - rank(b)
+}
+
+// writeSidecars records the roles of the members of groups in the sidecars of
+// their directories, dropping the entries of files that are gone. It returns
+// how many sidecars it wrote.
+func writeSidecars(groups []*dupeGroup) (int, error) {
+	var (
+		now   = time.Now().UTC()
+		byDir = make(map[string]map[string]sidecarDecision)
+	)
+	for _, g := range groups {
+		id := groupID(g)
+		for i, m := range g.members {
+			if m.Provisional || !filepath.IsAbs(m.Path) {
+				continue
+			}
+			role := roleDuplicate
+			if i == 0 {
+				role = roleKeeper
+			}
+			dir := filepath.Dir(m.Path)
+			if byDir[dir] == nil {
+				byDir[dir] = make(map[string]sidecarDecision)
+			}
+			byDir[dir][filepath.Base(m.Path)] = sidecarDecision{Role: role, Group: id, Decided: now}
+		}
+	}
+
+	dirs := make([]string, 0, len(byDir))
+	for dir := range byDir {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for i, dir := range dirs {
+		if err := updateSidecar(dir, byDir[dir]); err != nil {
+			return i, fmt.Errorf("failed to write the sidecar of %s: %w", dir, err)
+		}
+	}
+	sidecars.reset()
+	return len(dirs), nil
+}
+
+// updateSidecar merges decisions into the sidecar of dir, replacing it atomically.
+func updateSidecar(dir string, decisions map[string]sidecarDecision) error {
+	doc, err := readSidecar(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warn().Err(err).Str("caller", filepath.Join(dir, sidecarName)).Msg("replacing sidecar")
+		}
+		doc = &sidecarDoc{Version: sidecarVersion}
+	}
+	if doc.Files == nil {
+		doc.Files = make(map[string]sidecarDecision, len(decisions))
+	}
+	for name := range doc.Files {
+		if _, err = os.Lstat(filepath.Join(dir, name)); errors.Is(err, os.ErrNotExist) {
+			delete(doc.Files, name)
+		}
+	}
+	for name, d := range decisions {
+		doc.Files[name] = d
+	}
+	dat, err := sonic.ConfigStd.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, sidecarName+".tmp"+strconv.Itoa(os.Getpid()))
+	if err = os.WriteFile(tmp, append(dat, '\n'), 0o644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(dir, sidecarName)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"slices"
+	"sort"
+)
+
+// -simulate-policies helps picking a -keep policy before anything is
+// cleaned: every group reported is ordered again under each of the keep
+// policies on its own, after canonical collections and before the EXIF rule
+// like -keep, and what clean would remove under each of them is reported,
+// along with how many groups it keeps another member of than the keep rules
+// given do. Nothing is cleaned, and the groups are reported under the rules
+// given as usual. There is no clean command, cleaning is -action, so what a
+// clean --simulate-policies would be is -simulate-policies alone, or along
+// with -action and -dry-run to also list what the action would do under the
+// rules given.
+
+// policySimulation is what clean would do to the groups under a keep policy.
+type policySimulation struct {
+	policy           string
+	files            int
+	apparent, actual int64
+	differs          int
+	keepers          map[*dupeGroup]string
+}
+
+// simulatePolicies orders groups again under every keep policy and sums
+// what clean would remove under each.
+func simulatePolicies(groups []*dupeGroup) []policySimulation {
+	names := make([]string, 0, len(keepPolicies))
+	for name := range keepPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sims := make([]policySimulation, 0, len(names))
+	for _, name := range names {
+		order := keepOrder{keepCanonical, keepPolicies[name], keepExif}
+		sim := policySimulation{policy: name, keepers: make(map[*dupeGroup]string, len(groups))}
+		reordered := make([]*dupeGroup, 0, len(groups))
+		for _, g := range groups {
+			members := slices.Clone(g.members)
+			sort.SliceStable(members, func(i, j int) bool { return order.less(members[i], members[j]) })
+			rg := &dupeGroup{members: members}
+			reordered = append(reordered, rg)
+			sim.files += len(rg.removable())
+			sim.keepers[g] = rg.keeper().Path
+			if rg.keeper() != g.keeper() {
+				sim.differs++
+			}
+		}
+		sim.apparent, sim.actual = reclaimable(reordered)
+		sims = append(sims, sim)
+	}
+	return sims
+}
+
+// reportPolicySimulations logs the simulation of every policy, then on how
+// many of the groups the policies disagree about the keeper.
+func reportPolicySimulations(sims []policySimulation, groups []*dupeGroup) {
+	for _, sim := range sims {
+		log.Info().Str("policy", sim.policy).Int("removes", sim.files).
+			Str("reclaimable", formatBytes(sim.apparent)).Str("reclaimable_actual", formatBytes(sim.actual)).
+			Int("keeper_differs", sim.differs).Msg("keep policy simulated")
+	}
+	var disputed int
+	for _, g := range groups {
+		for _, sim := range sims[min(1, len(sims)):] {
+			if sim.keepers[g] != sims[0].keepers[g] {
+				disputed++
+				break
+			}
+		}
+	}
+	log.Info().Int("groups", len(groups)).Int("disputed", disputed).Int("policies", len(sims)).
+		Msg("keep policies simulated")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// With -snapshot, a clean that deletes or replaces duplicates first takes a
+// snapshot of every filesystem holding one: a read-only Btrfs snapshot of the
+// subvolume mounted there, kept in .dupehunter-snapshots at its top, a ZFS
+// snapshot of the dataset, or an LVM snapshot of the logical volume, sized at
+// a tenth of it. The undo log names the snapshot each duplicate can be
+// recovered from should the undo command fail. If any of the filesystems
+// can't be snapshotted nothing is cleaned, unless -i-have-a-snapshot vouches
+// that they are backed up some other way. Without -snapshot, the destructive
+// actions take -i-have-a-snapshot to vouch for every filesystem, and are
+// refused otherwise; dry runs need neither. Snapshots are left to the user to
+// delete, scans pass over the Btrfs ones. Btrfs subvolumes nested below a
+// mount point aren't in the snapshot of its subvolume.
+
+const (
+	snapshotBtrfs = "btrfs"
+	snapshotZFS   = "zfs"
+	snapshotLVM   = "lvm"
+
+	// btrfsSnapshotDir is where Btrfs snapshots are kept, at the top of the
+	// snapshotted subvolume.
+	btrfsSnapshotDir = ".dupehunter-snapshots"
+)
+
+// fsSnapshot is a snapshot taken of the filesystem mounted at mount.
+type fsSnapshot struct {
+	kind  string
+	mount string
+	// name is what the snapshot goes by for its tools: the path of a Btrfs
+	// snapshot, dataset@name for ZFS, and vg/lv for LVM.
+	name string
+}
+
+// errUnvouched refuses a destructive action that neither -snapshot nor
+// -i-have-a-snapshot backs.
+var errUnvouched = errors.New("delete, hardlink, symlink, and auto need -snapshot, or -i-have-a-snapshot " +
+	"vouching that the duplicates are backed up otherwise")
+
+// destructiveAction reports whether action leaves nothing of the duplicates
+// it cleans to move back, so that -snapshot applies to it.
+func destructiveAction(action string) bool {
+	return action == actionDelete || action == actionHardlink || action == actionSymlink || action == actionAuto
+}
+
+// snapshotFilesystems snapshots the filesystems holding paths, one snapshot
+// for each. With vouched, filesystems that can't be snapshotted are passed
+// over rather than failing.
+func snapshotFilesystems(paths []string, vouched bool) ([]fsSnapshot, error) {
+	type filesystem struct{ fstype, source string }
+	mounts := make(map[string]filesystem)
+	var errs []error
+	for _, p := range paths {
+		mount, fstype, source, err := mountOf(p)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p, err))
+			continue
+		}
+		mounts[mount] = filesystem{fstype, source}
+	}
+	name := "dupehunter-" + time.Now().Format("20060102-150405")
+	var snapshots []fsSnapshot
+	for mount, fs := range mounts {
+		snap, err := takeSnapshot(mount, fs.fstype, fs.source, name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", mount, err))
+			continue
+		}
+		log.Info().Str("mount", mount).Str("kind", snap.kind).Str("snapshot", snap.name).Msg("snapshot taken")
+		snapshots = append(snapshots, snap)
+	}
+	if err := errors.Join(errs...); err != nil {
+		if !vouched {
+			return snapshots, fmt.Errorf("failed to snapshot the filesystems of the duplicates, nothing was "+
+				"cleaned; pass -i-have-a-snapshot if they are backed up otherwise: %w", err)
+		}
+		log.Warn().Err(err).Msg("no snapshot of some filesystems, going on as -i-have-a-snapshot vouches for them")
+	}
+	return snapshots, nil
+}
+
+// takeSnapshot snapshots the filesystem of type fstype from source mounted at
+// mount under name.
+func takeSnapshot(mount, fstype, source, name string) (fsSnapshot, error) {
+	switch {
+	case fstype == "btrfs":
+		dir := filepath.Join(mount, btrfsSnapshotDir)
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return fsSnapshot{}, err
+		}
+		snap := fsSnapshot{kind: snapshotBtrfs, mount: mount, name: filepath.Join(dir, name)}
+		return snap, runSnapshotTool("btrfs", "subvolume", "snapshot", "-r", mount, snap.name)
+	case fstype == "zfs":
+		snap := fsSnapshot{kind: snapshotZFS, mount: mount, name: source + "@" + name}
+		return snap, runSnapshotTool("zfs", "snapshot", snap.name)
+	case strings.HasPrefix(source, "/dev/"):
+		out, err := exec.Command("lvs", "--noheadings", "-o", "vg_name,lv_name", source).Output()
+		fields := strings.Fields(string(out))
+		if err != nil || len(fields) != 2 {
+			return fsSnapshot{}, fmt.Errorf("the %s filesystem on %s isn't on a logical volume", fstype, source)
+		}
+		snap := fsSnapshot{kind: snapshotLVM, mount: mount, name: fields[0] + "/" + name}
+		return snap, runSnapshotTool("lvcreate", "--snapshot", "--name", name, "--extents", "10%ORIGIN",
+			fields[0]+"/"+fields[1])
+	}
+	return fsSnapshot{}, fmt.Errorf("the %s filesystem can't be snapshotted", fstype)
+}
+
+func runSnapshotTool(argv ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w: %s", strings.Join(argv[:min(3, len(argv))], " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// snapshotOf returns the name of the snapshot among snapshots that path is
+// in, "" for none.
+func snapshotOf(snapshots []fsSnapshot, path string) string {
+	var best fsSnapshot
+	for _, s := range snapshots {
+		if withinDir(path, s.mount) && len(s.mount) > len(best.mount) {
+			best = s
+		}
+	}
+	return best.name
+}
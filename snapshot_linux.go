@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// mountOf returns the mount point of the filesystem holding path, along with
+// its type and source, as /proc/self/mountinfo lists them.
+func mountOf(path string) (mount, fstype, source string, err error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		abs = filepath.Join(resolved, filepath.Base(abs))
+	}
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", "", "", err
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// ID parent major:minor root mount-point options [optional...] - type source super-options
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		// later mounts over the same point shadow earlier ones.
+		if point := unescapeMountinfo(fields[4]); withinDir(abs, point) && len(point) >= len(mount) {
+			mount, fstype, source = point, fields[sep+1], unescapeMountinfo(fields[sep+2])
+		}
+	}
+	if err = scanner.Err(); err == nil && mount == "" {
+		err = errors.New("no filesystem is mounted there")
+	}
+	return mount, fstype, source, err
+}
+
+// unescapeMountinfo decodes the octal escapes of spaces and the like in a
+// mountinfo field.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// mountOf finds no mounts, filesystems are only snapshotted on Linux.
+func mountOf(string) (mount, fstype, source string, err error) {
+	return "", "", "", errors.New("filesystems are only snapshotted on Linux")
+}
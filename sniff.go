@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"git.tcp.direct/kayos/dupehunter/internal/imaging"
+)
+
+const sniffLen = imaging.SniffLen
+
+// sniffImageType identifies the image format from the leading bytes of a file,
+// returning NULL for anything we have no decoder for.
+func sniffImageType(head []byte) ImageType {
+	t, _ := parseImageType(imaging.Sniff(head, pdfImages))
+	return t
+}
+
+var extensionTypes = map[string]ImageType{
+	".jpg":  JPEG,
+	".jpeg": JPEG,
+	".jpe":  JPEG,
+	".jfif": JPEG,
+	".png":  PNG,
+	".gif":  GIF,
+	".webp": WEBP,
+	".tif":  TIFF,
+	".tiff": TIFF,
+	".ico":  ICO,
+	".cur":  CUR,
+	".bmp":  BMP,
+	".dib":  BMP,
+	".pdf":  PDF,
+}
+
+// claimedImageType is the type the extension of path claims, NULL when it has
+// none or one we don't know. Only the content decides how a file is decoded.
+func claimedImageType(path string) ImageType {
+	if t := extensionTypes[strings.ToLower(filepath.Ext(path))]; t != PDF || pdfImages {
+		return t
+	}
+	return NULL
+}
+
+// sniff reads the head of the opened file without moving its offset, so that
+// videos, documents and the like are skipped before any decoding is attempted.
+// The detected content type is returned for logging.
+func (img *Image) sniff() (ImageType, string, error) {
+	var head [sniffLen]byte
+	n, err := img.f.ReadAt(head[:], 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return NULL, "", err
+	}
+	return sniffImageType(head[:n]), http.DetectContentType(head[:n]), nil
+}
+
+// claimed names the extension's type for reports, "none" when it claims nothing.
+func (img *Image) claimed() string {
+	if img.ClaimedType == NULL {
+		return "none"
+	}
+	return img.ClaimedType.String()
+}
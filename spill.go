@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A threshold far too loose for the library pairs nearly every image with
+// every other, and a check would grow the pairs in memory until the system
+// gives out. The pairs of a check are therefore held in a pairSet, which keeps
+// up to -spill-pairs of them in memory and beyond that spills all of them to
+// a temporary file, read back for every pass over them. Everything else a
+// check holds is bounded by the records: groups, and the pairs of the groups
+// reported, which are gathered a share of the groups at a time. A check that
+// spills warns that its threshold is likely misconfigured.
+
+// pairSet holds the pairs a check found.
+type pairSet struct {
+	// limit is the pairs held in memory at most, 0 for no limit.
+	limit int
+	mem   []dupePair
+	n     int
+	f     *os.File
+	w     *bufio.Writer
+	// err is the first failure to spill or to read back, see failed.
+	err error
+	// queried and indexed are the hashes the check queried and those it
+	// matched them against, see admits.
+	queried, indexed map[string]uint64
+}
+
+func newPairSet(limit int) *pairSet {
+	return &pairSet{limit: limit, mem: make([]dupePair, 0)}
+}
+
+// len returns the number of pairs.
+func (s *pairSet) len() int {
+	if s == nil {
+		return 0
+	}
+	return s.n
+}
+
+// admits reports whether the check could have paired a and b, one of them
+// queried and the other matched against, as -under and --against scope it.
+func (s *pairSet) admits(a, b string) bool {
+	_, qa := s.queried[a]
+	_, qb := s.queried[b]
+	_, ia := s.indexed[a]
+	_, ib := s.indexed[b]
+	return qa && ib || qb && ia
+}
+
+// spilled reports whether the pairs are on disk.
+func (s *pairSet) spilled() bool {
+	return s.f != nil
+}
+
+func (s *pairSet) add(p dupePair) {
+	s.n++
+	if s.f == nil {
+		s.mem = append(s.mem, p)
+		if s.limit > 0 && len(s.mem) > s.limit {
+			s.spill()
+		}
+		return
+	}
+	s.write(p)
+}
+
+func (s *pairSet) spill() {
+	f, err := os.CreateTemp("", "dupehunter-pairs-*")
+	if err != nil {
+		s.fail(fmt.Errorf("failed to spill pairs: %w", err))
+		return
+	}
+	log.Warn().Int("pairs", len(s.mem)).Str("file", f.Name()).
+		Msg("too many pairs to hold in memory, spilling them to disk; -d is likely far too loose for this library")
+	s.f, s.w = f, bufio.NewWriterSize(f, 1<<20)
+	for _, p := range s.mem {
+		s.write(p)
+	}
+	s.mem = nil
+}
+
+func (s *pairSet) write(p dupePair) {
+	if s.err != nil {
+		return
+	}
+	var buf [3 * binary.MaxVarintLen64]byte
+	rec := binary.AppendUvarint(buf[:0], uint64(len(p.a)))
+	rec = binary.AppendUvarint(rec, uint64(len(p.b)))
+	rec = binary.AppendUvarint(rec, uint64(p.distance))
+	_, _ = s.w.Write(rec)
+	_, _ = s.w.WriteString(p.a)
+	if _, err := s.w.WriteString(p.b); err != nil {
+		s.fail(fmt.Errorf("failed to spill pairs: %w", err))
+	}
+}
+
+func (s *pairSet) fail(err error) {
+	if s.err == nil {
+		s.err = err
+		log.Error().Err(err).Msg("pairs will be missing from the results")
+	}
+}
+
+// failed returns why pairs are missing, if any are.
+func (s *pairSet) failed() error {
+	return s.err
+}
+
+// each calls fn with every pair, in the order they were added.
+func (s *pairSet) each(fn func(dupePair)) {
+	if s.f == nil {
+		for _, p := range s.mem {
+			fn(p)
+		}
+		return
+	}
+	if err := s.w.Flush(); err != nil {
+		s.fail(fmt.Errorf("failed to spill pairs: %w", err))
+		return
+	}
+	end, err := s.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	r := bufio.NewReaderSize(io.NewSectionReader(s.f, 0, end), 1<<20)
+	for {
+		var lens [3]uint64
+		for i := range lens {
+			if lens[i], err = binary.ReadUvarint(r); err != nil {
+				// only the end before a record is the end of the pairs.
+				if i > 0 && errors.Is(err, io.EOF) {
+					err = io.ErrUnexpectedEOF
+				}
+				break
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		name := make([]byte, lens[0]+lens[1])
+		if err == nil {
+			if _, err = io.ReadFull(r, name); errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if err != nil {
+			s.fail(fmt.Errorf("failed to read spilled pairs: %w", err))
+			return
+		}
+		fn(dupePair{a: string(name[:lens[0]]), b: string(name[lens[0]:]), distance: int(lens[2])})
+	}
+}
+
+// close removes the spilled pairs, if any.
+func (s *pairSet) close() {
+	if s.f != nil {
+		_ = s.f.Close()
+		_ = os.Remove(s.f.Name())
+		s.f, s.w = nil, nil
+	}
+}
+
+// eachGroupPairs calls fn with every group of shown, in order, and its pairs,
+// as groupOf maps the paths of the members to their groups. With the pairs
+// spilled, they're gathered for as many groups at a time as fit in memory.
+func (s *pairSet) eachGroupPairs(shown []*dupeGroup, groupOf map[string]*dupeGroup, fn func(*dupeGroup, []dupePair)) {
+	counts := make(map[*dupeGroup]int, len(shown))
+	if s.spilled() {
+		s.each(func(p dupePair) {
+			if g, ok := groupOf[p.a]; ok {
+				counts[g]++
+			}
+		})
+	}
+	for start := 0; start < len(shown); {
+		end, held := start+1, counts[shown[start]]
+		for end < len(shown) && (!s.spilled() || held+counts[shown[end]] <= s.limit) {
+			held += counts[shown[end]]
+			end++
+		}
+		batch := make(map[*dupeGroup]bool, end-start)
+		for _, g := range shown[start:end] {
+			batch[g] = true
+		}
+		pairsOf := make(map[*dupeGroup][]dupePair, end-start)
+		s.each(func(p dupePair) {
+			if g, ok := groupOf[p.a]; ok && batch[g] {
+				pairsOf[g] = append(pairsOf[g], p)
+			}
+		})
+		for _, g := range shown[start:end] {
+			fn(g, pairsOf[g])
+		}
+		start = end
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"image"
+	"io"
+	"os"
+	"strings"
+)
+
+// -stat-only scans take a quick inventory, e.g. of slow network storage:
+// they record the path, size, modification time, and, from the image header
+// alone, the type and dimensions of every file, without reading the pixels
+// or hashing anything. Their records are marked Unhashed and stay out of the
+// similarity index until db rehash --missing, hash-pending when they were
+// queued with -hash-later, or the next scan without -stat-only hashes them.
+
+var (
+	// statOnly makes scans record files without hashing them.
+	statOnly bool
+	// rehashing makes scans re-process files whose records are up to date.
+	rehashing bool
+)
+
+// statStage fills in what the header of the opened file tells, closing it.
+func (img *Image) statStage(sniffed ImageType) {
+	defer func() { _ = img.f.Close() }()
+	img.Type, img.Unhashed = sniffed, true
+	cfg, _, err := image.DecodeConfig(bufio.NewReader(io.NewSectionReader(img.f, 0, img.Size)))
+	if err != nil {
+		// formats without a registered decoder are recorded by type alone.
+		hotLog().Trace().Err(err).Str("caller", img.Name).Msg("no dimensions from header")
+		return
+	}
+	img.Width, img.Height = cfg.Width, cfg.Height
+}
+
+func dbRehash(args []string) error {
+	fs := newFlagSet("db rehash", "[--missing] [--stale-layout] [glob|path...]",
+		"Hash the files of the records again, or with --missing only those recorded by -stat-only scans,\n"+
+			"and with --stale-layout only those hashed by a version that hashed differently, optionally\n"+
+			"only those selected by exact path, glob pattern, or directory.")
+	missing := fs.Bool("missing", false, "only hash the records that have never been hashed")
+	stale := fs.Bool("stale-layout", false, "only hash the records hashed under a layout this version can't compare")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var (
+		paths = make([]string, 0)
+		seen  = make(map[string]bool)
+	)
+	err = forEachRecord(func(img *Image) error {
+		if (*missing && !img.Unhashed) || (*stale && !img.staleLayout()) || !selectedBy(args, img.Path) {
+			return nil
+		}
+		// the pages of a container are hashed along with it.
+		path, _, _ := strings.Cut(img.Path, pageSuffix)
+		if seen[path] {
+			return nil
+		}
+		seen[path] = true
+		if _, statErr := os.Stat(path); statErr != nil {
+			log.Warn().Err(statErr).Str("caller", path).Msg("not rehashing missing file")
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		log.Info().Msg("no records to rehash")
+		return nil
+	}
+
+	statOnly, rehashing = false, true
+	defer func() { rehashing = false }()
+	err = ingestPaths(context.Background(), rootConfig, paths, newOrigin(rootConfig.source, "rehash"))
+	log.Info().Int("files", len(paths)).Bool("missing", *missing).Bool("stale_layout", *stale).
+		Msg("db rehash finished")
+	return err
+}
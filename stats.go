@@ -0,0 +1,52 @@
+package main
+
+import "sync"
+
+// typeStats counts the records a scan stored by image type, records of files
+// that aren't images counting as "file". Together with the skipped and failed
+// counts of the problem report, it tells where every path of a scan went.
+type typeStats struct {
+	mu     sync.Mutex
+	counts map[ImageType]int
+}
+
+var ingestedTypes = &typeStats{}
+
+func (t *typeStats) reset() {
+	t.mu.Lock()
+	t.counts = nil
+	t.mu.Unlock()
+}
+
+func (t *typeStats) note(it ImageType) {
+	t.mu.Lock()
+	if t.counts == nil {
+		t.counts = make(map[ImageType]int)
+	}
+	t.counts[it]++
+	t.mu.Unlock()
+}
+
+// snapshot returns the counts by type name.
+func (t *typeStats) snapshot() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.counts) == 0 {
+		return nil
+	}
+	counts := make(map[string]int, len(t.counts))
+	for it, n := range t.counts {
+		name := it.String()
+		if it == NULL {
+			name = "file"
+		}
+		counts[name] += n
+	}
+	return counts
+}
+
+func (t *typeStats) summarize() {
+	if counts := t.snapshot(); counts != nil {
+		log.Info().Dict("types", countsDict(counts)).Msg("ingested records by type")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// -status trades the scrolling account of a run for a single line at the
+// bottom of the terminal, redrawn every statusEvery: the phase and how far it
+// got, the files per second, the work queued for the workers, and the hash
+// collisions of the scan so far, images the index put under a hash a record
+// indexed before has, copies or not. Debug and per-file messages are dropped
+// as with -bulk, the others scroll by above the line. Without a terminal to draw on, the same counters are logged every
+// bulkReportEvery instead.
+
+const statusEvery = 250 * time.Millisecond
+
+// hashCollisions counts the images the similarity index put under a hash
+// already indexed since the scan began: exact copies, and any others hashing
+// alike.
+var hashCollisions atomic.Int64
+
+// statusLine is the console the log writes to, keeping the status line below
+// whatever is written.
+type statusLine struct {
+	mu   sync.Mutex
+	out  io.Writer
+	line string
+}
+
+func (s *statusLine) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = io.WriteString(s.out, "\r\x1b[K")
+	n, err := s.out.Write(p)
+	_, _ = io.WriteString(s.out, s.line)
+	return n, err
+}
+
+// set redraws the status line as line.
+func (s *statusLine) set(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.line = line
+	_, _ = io.WriteString(s.out, "\r\x1b[K"+line)
+}
+
+// isTerminal reports whether f is a character device, as terminals are.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// enableStatus drops the messages -status does without and starts reporting
+// the counters, on a status line when out is a terminal. It returns the
+// writer for the log, and the function that stops reporting.
+func enableStatus(out *os.File, verbose bool) (io.Writer, func()) {
+	if !verbose {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	progressSampler = neverSampler{}
+	if !isTerminal(out) {
+		return out, reportStatus(bulkReportEvery, func(line string) { log.Info().Msg(line) })
+	}
+	s := &statusLine{out: out}
+	stop := reportStatus(statusEvery, s.set)
+	return s, func() {
+		stop()
+		s.set("")
+	}
+}
+
+// reportStatus hands the counters to show to every interval until the
+// returned function is called.
+func reportStatus(interval time.Duration, show func(string)) (stop func()) {
+	var (
+		done    = make(chan struct{})
+		stopped = make(chan struct{})
+	)
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var (
+			phase string
+			// the rate is taken over a second at least.
+			last  int
+			since = time.Now()
+			rate  float64
+		)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			snap := progress.snapshot()
+			if snap.Phase != phase || snap.Processed < last {
+				phase, last, since, rate = snap.Phase, 0, time.Now(), 0
+			}
+			switch elapsed := time.Since(since); {
+			case elapsed >= time.Second:
+				rate, last, since = float64(snap.Processed-last)/elapsed.Seconds(), snap.Processed, time.Now()
+			case rate == 0:
+				// until the first second of the phase is over.
+				rate = float64(snap.Processed-last) / elapsed.Seconds()
+			}
+			if snap.Phase == phaseIdle {
+				continue
+			}
+			show(statusText(snap, rate))
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func statusText(snap progressSnapshot, rate float64) string {
+	var b strings.Builder
+	b.WriteString(snap.Phase)
+	if snap.Total > 0 {
+		fmt.Fprintf(&b, " %d/%d", snap.Processed, snap.Total)
+	} else {
+		fmt.Fprintf(&b, " %d", snap.Processed)
+	}
+	fmt.Fprintf(&b, ", %.0f/s, %d queued, %d hash collisions", rate, snap.QueuedInteractive+snap.QueuedBulk,
+		hashCollisions.Load())
+	if snap.ETA != "" {
+		b.WriteString(", eta " + snap.ETA)
+	}
+	return b.String()
+}
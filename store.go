@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+
+	"git.tcp.direct/tcp.direct/database"
+)
+
+// guardedStore coordinates access to a store that the scanner, the cleaner
+// and the API handlers share while the daemon runs: reads go ahead alongside
+// each other, writes wait for them and run one at a time, and a batch can
+// hold the store for a whole sequence of writes, like a restore. It
+// implements database.Filer, so it can stand in wherever a store is expected.
+type guardedStore struct {
+	mu   sync.RWMutex
+	name string
+}
+
+// imageStore guards the records of the images store; nothing should use
+// DB.With("images") directly.
+var imageStore = &guardedStore{name: "images"}
+
+// filer returns the store, keeping the checksums of what is written to it.
+func (s *guardedStore) filer() database.Filer {
+	return sealedFiler{DB.With(s.name)}
+}
+
+func (s *guardedStore) Backend() any {
+	return s.filer().Backend()
+}
+
+func (s *guardedStore) Has(key []byte) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.filer().Has(key)
+}
+
+func (s *guardedStore) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.filer().Get(key)
+}
+
+func (s *guardedStore) Put(key []byte, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scanIO.written.Add(int64(len(key) + len(value)))
+	return s.filer().Put(key, value)
+}
+
+func (s *guardedStore) Delete(key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filer().Delete(key)
+}
+
+func (s *guardedStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filer().Close()
+}
+
+func (s *guardedStore) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filer().Sync()
+}
+
+// Keys returns a snapshot of the keys; records may come and go right after.
+func (s *guardedStore) Keys() [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.filer().Keys()
+}
+
+func (s *guardedStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.filer().Len()
+}
+
+// each hands every record to fn, taking the read lock per record so a long
+// listing doesn't hold up a scan. Records removed in the meantime are skipped.
+func (s *guardedStore) each(fn func(key, value []byte) error) error {
+	for _, k := range s.Keys() {
+		s.mu.RLock()
+		var (
+			dat []byte
+			err error
+		)
+		if s.filer().Has(k) {
+			dat, err = s.filer().Get(k)
+		}
+		s.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		if dat == nil {
+			continue
+		}
+		if err = fn(k, dat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batch runs fn with the store to itself.
+func (s *guardedStore) batch(fn func(f database.Filer) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fn(s.filer())
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// thresholdRule overrides -d for the records whose path matches its glob.
+type thresholdRule struct {
+	pattern  string
+	re       *regexp.Regexp
+	distance int
+}
+
+// thresholdRules are consulted in file order, the first match deciding a
+// record's threshold. A pair is held to the stricter threshold of its two
+// members, so a scan is never compared as loosely as a wallpaper.
+type thresholdRules []thresholdRule
+
+// globRegexp translates a glob where * and ? stay within one path element and
+// ** spans any number of them. Globs that aren't absolute may match starting
+// at any directory, e.g. scans/** matches everything below any scans directory.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	glob = filepath.ToSlash(glob)
+	var b strings.Builder
+	if strings.HasPrefix(glob, "/") {
+		b.WriteString("^")
+	} else {
+		b.WriteString("(^|/)")
+	}
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// loadThresholdRules reads "GLOB DISTANCE" lines, skipping blank lines and
+// # comments.
+func loadThresholdRules(path string) (thresholdRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var (
+		rules   = make(thresholdRules, 0)
+		scanner = bufio.NewScanner(f)
+	)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		// the distance is the last field, so globs may contain spaces.
+		cut := strings.LastIndexAny(text, " \t")
+		if cut < 0 {
+			return nil, fmt.Errorf("%s:%d: expected a glob and a distance", path, line)
+		}
+		pattern := strings.TrimSpace(text[:cut])
+		distance, err := strconv.Atoi(text[cut+1:])
+		if err != nil || distance < 1 || distance > hashing.bits() {
+			return nil, fmt.Errorf("%s:%d: invalid distance %q, must be between 1 and %d",
+				path, line, text[cut+1:], hashing.bits())
+		}
+		re, err := globRegexp(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid glob %q: %w", path, line, pattern, err)
+		}
+		rules = append(rules, thresholdRule{pattern: pattern, re: re, distance: distance})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("no rules in " + path)
+	}
+	return rules, nil
+}
+
+// threshold returns the distance path must be below to be a duplicate.
+func (r thresholdRules) threshold(path string, fallback int) int {
+	path = filepath.ToSlash(path)
+	for _, rule := range r {
+		if rule.re.MatchString(path) {
+			return rule.distance
+		}
+	}
+	return fallback
+}
+
+// pairThreshold returns the stricter threshold of a and b.
+func (r thresholdRules) pairThreshold(a, b string, fallback int) int {
+	return min(r.threshold(a, fallback), r.threshold(b, fallback))
+}
+
+// loosest returns the largest threshold any record may be held to, which
+// bounds the neighborhood the similarity index has to be searched in.
+func (r thresholdRules) loosest(fallback int) int {
+	loosest := fallback
+	for _, rule := range r {
+		loosest = max(loosest, rule.distance)
+	}
+	return loosest
+}
+
+// With -adaptive-threshold, -d applies as given to pairs around a megapixel
+// and is scaled with the logarithm of the pair's resolution, the geometric
+// mean of the two images' width and height: icons and thumbnails, whose
+// hashes are made of few pixels, are held to a tighter threshold, and large
+// photos, whose re-encodes and resizes drift further, to a looser one.
+const (
+	adaptiveReference = 1024
+	adaptiveMinScale  = 0.5
+	adaptiveMaxScale  = 1.5
+)
+
+// adaptiveDistance scales maxDistance for the pair of a and b.
+func adaptiveDistance(maxDistance int, a, b *Image) int {
+	resolution := math.Pow(float64(a.Width)*float64(a.Height)*float64(b.Width)*float64(b.Height), 0.25)
+	if resolution < 2 {
+		// dimensions unknown, e.g. files matched by checksum.
+		return maxDistance
+	}
+	scale := math.Log2(resolution) / math.Log2(adaptiveReference)
+	scale = min(max(scale, adaptiveMinScale), adaptiveMaxScale)
+	return min(max(int(math.Round(float64(maxDistance)*scale)), 1), hashing.bits())
+}
+
+// pairThreshold returns the distance the pair of a and b must be below to be
+// duplicates.
+func (cfg *config) pairThreshold(a, b *Image) int {
+	fallback := cfg.maxDistance
+	if cfg.adaptive {
+		fallback = adaptiveDistance(fallback, a, b)
+	}
+	return cfg.thresholds.pairThreshold(a.Path, b.Path, fallback)
+}
+
+// searchRadius returns the largest distance any pair may be a duplicate at.
+func (cfg *config) searchRadius() int {
+	fallback := cfg.maxDistance
+	if cfg.adaptive {
+		fallback = min(int(math.Round(float64(fallback)*adaptiveMaxScale)), hashing.bits())
+	}
+	return cfg.thresholds.loosest(fallback) - 1
+}
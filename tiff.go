@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"git.tcp.direct/kayos/dupehunter/internal/imaging"
+)
+
+// Multi-page TIFFs (typically scanned documents) are ingested page by page,
+// each as its own record keyed "path#page=N", so a scan duplicated into a
+// different container still matches.
+
+// pageSuffix separates a container's path from the page number in record keys.
+const pageSuffix = "#page="
+
+func pagePath(path string, page int) string {
+	return path + pageSuffix + strconv.Itoa(page)
+}
+
+// ingestPages ingests every page of a multi-page TIFF as its own record,
+// reporting false if img has a single page and should be processed as usual.
+func (img *Image) ingestPages(start time.Time) bool {
+	pages, err := imaging.TIFFPages(img.f)
+	if err != nil || len(pages) < 2 {
+		return false
+	}
+
+	hashed := make([]*Image, 0, len(pages))
+	for n, ifd := range pages {
+		page := &Image{
+			Type:        TIFF,
+			ClaimedType: img.ClaimedType,
+			Name:        pagePath(img.Name, n+1),
+			Path:        pagePath(img.Path, n+1),
+			ModTime:     img.ModTime,
+			Captured:    img.Captured,
+			Software:    img.Software,
+			Exif:        img.Exif,
+			GPS:         img.GPS,
+			Origin:      img.Origin,
+			Size:        img.Size,
+			b:           img.b,
+		}
+		if sandbox != nil {
+			err = sandbox.decodeTIFFPage(page, img.f.File, ifd)
+		} else if page.i, err = imaging.DecodeTIFFPage(img.f, img.Size, ifd); err == nil {
+			err = hashImage(page)
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("caller", page.Name).Msg("failed to decode page")
+			continue
+		}
+		hashed = append(hashed, page)
+	}
+	_ = img.f.Close()
+
+	changed, err := img.revalidate()
+	if err != nil {
+		log.Warn().Caller().Err(err).Str("caller", img.Name).Msg("failed to revalidate")
+		return true
+	}
+	if changed {
+		log.Warn().Str("caller", img.Name).Msg("file changed while hashing its pages, storing provisional records")
+	}
+	timings.record(img, time.Since(start))
+
+	for _, page := range hashed {
+		page.ModTime, page.Size, page.Provisional = img.ModTime, img.Size, changed
+		err = ingestImage(page)
+		page.b = nil
+		if err != nil {
+			log.Warn().Err(err).Str("caller", page.Name).Msg("failed to ingest page")
+			continue
+		}
+		img.stored = append(img.stored, page.Path)
+		collectionMu.Lock()
+		Collection = append(Collection, page)
+		collectionMu.Unlock()
+	}
+	if len(hashed) > 0 {
+		forgetFailure(img.Path)
+	}
+	log.Debug().Str("caller", img.Name).Int("pages", len(pages)).Int("ingested", len(hashed)).
+		Msg("ingested multi-page tiff")
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"time"
+)
+
+// -newer-than and -older-than select the images of a time window, e.g. of a
+// recent import, by their mtime or, with -time-by captured, by their EXIF
+// capture time, images without one going by their mtime. Scans skip the files
+// outside of the window before decoding them, leaving their records as they
+// are, and checks compare only the records within it, matching none outside.
+
+// timeBound is a flag of a point in time, given as a date, a date and time in
+// RFC 3339, or an age before now like 30d or 12h.
+type timeBound struct {
+	t time.Time
+}
+
+func (b *timeBound) String() string {
+	if b == nil || b.t.IsZero() {
+		return ""
+	}
+	return b.t.Format(time.RFC3339)
+}
+
+func (b *timeBound) Set(s string) error {
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		b.t = t
+		return nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		b.t = t
+		return nil
+	}
+	age, err := parseAge(s)
+	if err != nil || age < 0 {
+		return fmt.Errorf("expected a date like 2023-01-01, RFC 3339 time, or age like 30d, not %q", s)
+	}
+	b.t = time.Now().Add(-age)
+	return nil
+}
+
+// timeWindow selects images by when they were modified or captured.
+type timeWindow struct {
+	newer, older timeBound // zero for no bound
+	byCaptured   bool
+}
+
+var window = &timeWindow{}
+
+// setTimeBy sets what -time-by selects images by.
+func (w *timeWindow) setTimeBy(s string) error {
+	switch s {
+	case "mtime":
+		w.byCaptured = false
+	case "captured":
+		w.byCaptured = true
+	default:
+		return fmt.Errorf("expected mtime or captured, not %q", s)
+	}
+	return nil
+}
+
+// timeBy names what the window selects images by, "" when there is none.
+func (w *timeWindow) timeBy() string {
+	switch {
+	case !w.active():
+		return ""
+	case w.byCaptured:
+		return "captured"
+	}
+	return "mtime"
+}
+
+// active reports whether a bound is set.
+func (w *timeWindow) active() bool {
+	return !w.newer.t.IsZero() || !w.older.t.IsZero()
+}
+
+// selects reports whether img is within the window.
+func (w *timeWindow) selects(img *Image) bool {
+	t := img.ModTime
+	if w.byCaptured && !img.Captured.IsZero() {
+		t = img.Captured
+	}
+	return (w.newer.t.IsZero() || t.After(w.newer.t)) && (w.older.t.IsZero() || t.Before(w.older.t))
+}
+
+// scope drops the hashes and records outside of the window, returning hashes.
+func (w *timeWindow) scope(hashes map[string]uint64, records map[string]*Image) map[string]uint64 {
+	maps.DeleteFunc(records, func(_ string, img *Image) bool { return !w.selects(img) })
+	maps.DeleteFunc(hashes, func(p string, _ uint64) bool { return records[p] == nil })
+	return hashes
+}
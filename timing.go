@@ -0,0 +1,77 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type fileTiming struct {
+	path    string
+	size    int64
+	elapsed time.Duration
+}
+
+// timingHeap is a min-heap on elapsed time, so the fastest of the retained
+// timings is the one evicted when a slower file comes along.
+type timingHeap []fileTiming
+
+func (h timingHeap) Len() int           { return len(h) }
+func (h timingHeap) Less(i, j int) bool { return h[i].elapsed < h[j].elapsed }
+func (h timingHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *timingHeap) Push(x any)        { *h = append(*h, x.(fileTiming)) }
+func (h *timingHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// slowFiles retains the n slowest decode+hash timings seen during a scan.
+type slowFiles struct {
+	mu    sync.Mutex
+	n     int
+	total time.Duration
+	count int
+	heap  timingHeap
+}
+
+var timings = &slowFiles{n: 5}
+
+func (s *slowFiles) record(img *Image, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total += elapsed
+	s.count++
+	if s.n <= 0 {
+		return
+	}
+	t := fileTiming{path: img.Path, size: img.Size, elapsed: elapsed}
+	if s.heap.Len() < s.n {
+		heap.Push(&s.heap, t)
+		return
+	}
+	if s.heap[0].elapsed < elapsed {
+		s.heap[0] = t
+		heap.Fix(&s.heap, 0)
+	}
+}
+
+func (s *slowFiles) summarize() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 {
+		return
+	}
+	log.Info().Int("files", s.count).Dur("total", s.total).
+		Dur("average", s.total/time.Duration(s.count)).Msg("decode and hash timings")
+	slowest := append(timingHeap(nil), s.heap...)
+	sort.Slice(slowest, func(i, j int) bool { return slowest[i].elapsed > slowest[j].elapsed })
+	for i, t := range slowest {
+		share := float64(t.elapsed) / float64(s.total) * 100
+		log.Info().Int("rank", i+1).Dur("elapsed", t.elapsed).Int64("size", t.size).
+			Str("share", fmt.Sprintf("%.1f%%", share)).Msg("slow file: " + t.path)
+	}
+}
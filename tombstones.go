@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// Removing a record, with db rm or after cleaning its file, leaves a tombstone
+// in the "tombstones" store: the record as it was, and when and why it was
+// removed. They keep the history of what used to be indexed where, for
+// telling a moved file from a new one or undoing a removal, until they are
+// older than -tombstone-retention, when scans purge them, or db purge does.
+// Ingesting the path again brings it back to life and drops its tombstone.
+
+type tombstone struct {
+	Record  *Image    `json:"record"`
+	Removed time.Time `json:"removed"`
+	Reason  string    `json:"reason"`
+}
+
+// tombstoneRetention is how long tombstones are kept, 0 removing records
+// without leaving any.
+var tombstoneRetention = 30 * 24 * time.Hour
+
+// buryRecord removes the record of path from the images store and the
+// similarity index, leaving a tombstone saying why.
+func buryRecord(idx *bkTree, path, reason string) error {
+	key := []byte(path)
+	if tombstoneRetention > 0 {
+		dat, err := imageStore.Get(key)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		img := &Image{}
+		if err = sonic.Unmarshal(dat, img); err != nil {
+			return fmt.Errorf("json deserialize fail for %s: %w", path, err)
+		}
+		if dat, err = sonic.Marshal(tombstone{Record: img, Removed: time.Now(), Reason: reason}); err != nil {
+			return err
+		}
+		if err = DB.With("tombstones").Put(key, dat); err != nil {
+			return fmt.Errorf("failed to leave a tombstone for %s: %w", path, err)
+		}
+	}
+	if err := imageStore.Delete(key); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	if err := idx.remove(path); err != nil {
+		return fmt.Errorf("failed to remove %s from the similarity index: %w", path, err)
+	}
+	audit("remove", path, reason)
+	return nil
+}
+
+// forgetTombstone drops the tombstone of a path that has been ingested again.
+func forgetTombstone(path string) {
+	store := DB.With("tombstones")
+	if !store.Has([]byte(path)) {
+		return
+	}
+	if err := store.Delete([]byte(path)); err != nil {
+		log.Warn().Err(err).Str("caller", path).Msg("failed to forget tombstone")
+	}
+}
+
+// forEachTombstone deserializes every tombstone and hands it to fn.
+func forEachTombstone(fn func(t *tombstone) error) error {
+	store := DB.With("tombstones")
+	for _, k := range store.Keys() {
+		dat, err := store.Get(k)
+		if err != nil {
+			// purged in the meantime.
+			continue
+		}
+		t := &tombstone{}
+		if err = sonic.Unmarshal(dat, t); err != nil {
+			return fmt.Errorf("json deserialize fail for tombstone of %s: %w", string(k), err)
+		}
+		if t.Record == nil {
+			t.Record = &Image{Path: string(k)}
+		}
+		if err = fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeTombstones permanently removes the tombstones removed before cutoff
+// whose paths are selected by targets, all of them when there are none.
+func purgeTombstones(cutoff time.Time, targets []string, dryRun bool, w io.Writer) (int, error) {
+	var purged int
+	err := forEachTombstone(func(t *tombstone) error {
+		if !t.Removed.Before(cutoff) || !selectedBy(targets, t.Record.Path) {
+			return nil
+		}
+		if dryRun {
+			_, _ = fmt.Fprintf(w, "would purge: %s\n", t.Record.Path)
+			purged++
+			return nil
+		}
+		if err := DB.With("tombstones").Delete([]byte(t.Record.Path)); err != nil {
+			return fmt.Errorf("failed to purge %s: %w", t.Record.Path, err)
+		}
+		_, _ = fmt.Fprintf(w, "purged: %s\n", t.Record.Path)
+		purged++
+		return nil
+	})
+	return purged, err
+}
+
+// expireTombstones purges the tombstones past the retention period.
+func expireTombstones() {
+	if tombstoneRetention <= 0 {
+		return
+	}
+	n, err := purgeTombstones(time.Now().Add(-tombstoneRetention), nil, false, io.Discard)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to purge expired tombstones")
+		return
+	}
+	if n > 0 {
+		log.Debug().Int("count", n).Msg("purged expired tombstones")
+	}
+}
+
+// selectedBy reports whether path is selected by any of targets, or there are none.
+func selectedBy(targets []string, path string) bool {
+	if len(targets) == 0 {
+		return true
+	}
+	for _, target := range targets {
+		if matchTarget(target, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func dbPurge(args []string) error {
+	fs := newFlagSet("db purge", "[--older-than AGE] [--dry-run] [glob|path...]",
+		"Permanently remove the tombstones of removed records, by default those past -tombstone-retention,\n"+
+			"optionally only those selected by exact path, glob pattern, or directory.")
+	olderThan := fs.String("older-than", "", "only purge tombstones older than `age`, e.g. 7d or 0 for all")
+	dryRun := fs.Bool("dry-run", false, "only print the tombstones that would be purged")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	age := tombstoneRetention
+	if *olderThan != "" {
+		if age, err = parseAge(*olderThan); err != nil {
+			return usageError(fs, "invalid value %q for --older-than: %s", *olderThan, err)
+		}
+	}
+	purged, err := purgeTombstones(time.Now().Add(-age), args, *dryRun, os.Stdout)
+	log.Info().Int("purged", purged).Bool("dry_run", *dryRun).Msg("db purge finished")
+	return err
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// -trace records where a scan spends its time as OpenTelemetry spans: one
+// per ingest and check, and within an ingest one per file, with a child for
+// each stage it went through (discover, read, decode, hash, persist); the
+// check has one for matching. Spans are exported in batches in the OTLP/JSON
+// encoding, either to a collector over HTTP, whose base URL is taken from
+// OTEL_EXPORTER_OTLP_ENDPOINT and headers from OTEL_EXPORTER_OTLP_HEADERS as
+// OpenTelemetry SDKs do, or to a file, one export request per line. Spans
+// that don't fit into the export queue are dropped and counted rather than
+// slowing the scan down.
+
+const (
+	traceBatchSize     = 512
+	traceQueueSize     = 16 * traceBatchSize
+	traceFlushInterval = 5 * time.Second
+	traceExportTimeout = 10 * time.Second
+)
+
+// tracing is nil unless -trace is given, which all its methods allow for.
+var tracing *tracer
+
+type span struct {
+	t        *tracer
+	traceID  [16]byte
+	id       [8]byte
+	parent   [8]byte
+	name     string
+	start    time.Time
+	mu       sync.Mutex
+	attrs    []otlpAttr
+	failed   string
+	finished bool
+}
+
+type tracer struct {
+	send    func(dat []byte) error
+	close   func() error
+	queue   chan string
+	done    chan struct{}
+	dropped atomic.Int64
+	// stopped guards the queue against spans ending after shutdown.
+	mu      sync.RWMutex
+	stopped bool
+	// batch is the span of the ingest or check running, the parent of
+	// the spans of its files.
+	batch atomic.Pointer[span]
+}
+
+// newTracer returns the tracer exporting to target: otlp for a collector, or
+// file:PATH.
+func newTracer(target string) (*tracer, error) {
+	t := &tracer{queue: make(chan string, traceQueueSize), done: make(chan struct{})}
+	switch {
+	case target == "otlp":
+		endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "http://localhost:4318"
+		}
+		headers, err := parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+		if err != nil {
+			return nil, err
+		}
+		t.send = otlpSender(strings.TrimSuffix(endpoint, "/")+"/v1/traces", headers)
+		t.close = func() error { return nil }
+	case strings.HasPrefix(target, "file:"):
+		f, err := os.OpenFile(strings.TrimPrefix(target, "file:"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		t.send = func(dat []byte) error {
+			_, err := f.Write(append(dat, '\n'))
+			return err
+		}
+		t.close = f.Close
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", target)
+	}
+	go t.export()
+	return t, nil
+}
+
+// parseOTLPHeaders parses "key=value,key=value" headers.
+func parseOTLPHeaders(s string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, kv := range strings.Split(s, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS entry %q", kv)
+		}
+		headers.Set(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	return headers, nil
+}
+
+func otlpSender(url string, headers http.Header) func([]byte) error {
+	client := &http.Client{Timeout: traceExportTimeout}
+	return func(dat []byte) error {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(dat))
+		if err != nil {
+			return err
+		}
+		req.Header = headers.Clone()
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("collector answered %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+// start begins a span named name, a child of parent, or of the running batch
+// for a nil parent.
+func (t *tracer) start(parent *span, name string) *span {
+	if t == nil {
+		return nil
+	}
+	if parent == nil {
+		parent = t.batch.Load()
+	}
+	s := &span{t: t, name: name, start: time.Now()}
+	_, _ = rand.Read(s.id[:])
+	if parent != nil {
+		s.traceID, s.parent = parent.traceID, parent.id
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	return s
+}
+
+// startBatch begins the span of an ingest or check, which the spans started
+// without a parent belong to until it ends.
+func (t *tracer) startBatch(name string) *span {
+	if t == nil {
+		return nil
+	}
+	s := t.start(nil, name)
+	t.batch.Store(s)
+	return s
+}
+
+func (s *span) set(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, otlpAttr{Key: key, Value: otlpValue{StringValue: value}})
+	s.mu.Unlock()
+}
+
+// fail marks the span as failed with err.
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.failed = err.Error()
+	s.mu.Unlock()
+}
+
+// end finishes the span and queues it for export.
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.mu.Unlock()
+	s.t.batch.CompareAndSwap(s, nil)
+	s.t.enqueue(s, time.Now())
+}
+
+// trace runs fn within a child of parent named name.
+func (t *tracer) trace(parent *span, name string, fn func()) {
+	s := t.start(parent, name)
+	fn()
+	s.end()
+}
+
+func (t *tracer) enqueue(s *span, end time.Time) {
+	s.mu.Lock()
+	rec := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.id[:]),
+		Name:              s.name,
+		Kind:              1,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.parent != [8]byte{} {
+		rec.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if s.failed != "" {
+		rec.Status = &otlpStatus{Code: 2, Message: s.failed}
+	}
+	s.mu.Unlock()
+	dat, err := sonic.Marshal(rec)
+	if err != nil {
+		t.dropped.Add(1)
+		return
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.stopped {
+		return
+	}
+	select {
+	case t.queue <- string(dat):
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// export sends the queued spans in batches until shutdown.
+func (t *tracer) export() {
+	defer close(t.done)
+	var (
+		batch  = make([]string, 0, traceBatchSize)
+		ticker = time.NewTicker(traceFlushInterval)
+	)
+	defer ticker.Stop()
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.send(otlpRequest(batch)); err != nil {
+			log.Warn().Err(err).Int("spans", len(batch)).Msg("failed to export trace spans")
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, s); len(batch) == traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// shutdown exports the spans still queued and closes the exporter.
+func (t *tracer) shutdown() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return
+	}
+	t.stopped = true
+	close(t.queue)
+	t.mu.Unlock()
+	select {
+	case <-t.done:
+	case <-time.After(traceExportTimeout):
+		log.Warn().Msg("timed out exporting the last trace spans")
+	}
+	if err := t.close(); err != nil {
+		log.Warn().Err(err).Msg("failed to close the trace exporter")
+	}
+	if n := t.dropped.Load(); n > 0 {
+		log.Warn().Int64("spans", n).Msg("trace spans dropped, the exporter couldn't keep up")
+	}
+}
+
+// otlpRequest wraps encoded spans into an OTLP/JSON ExportTraceServiceRequest.
+func otlpRequest(spans []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"dupehunter"}}]},`)
+	buf.WriteString(`"scopeSpans":[{"scope":{"name":"dupehunter"},"spans":[`)
+	buf.WriteString(strings.Join(spans, ","))
+	buf.WriteString(`]}]}]}`)
+	return buf.Bytes()
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr  `json:"attributes,omitempty"`
+	Status            *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
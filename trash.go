@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Scans pass over trash directories and quarantine directories, which are
+// full of duplicates by design: re-ingesting what -action move put aside
+// would report it again after every clean. Trash is what desktops and
+// operating systems use, and quarantine directories are recognized by the
+// manifest at their top, so ones written by earlier runs are skipped too. The
+// Btrfs snapshots -snapshot takes are skipped along with them.
+// -include-trash scans them anyway.
+
+// includeTrash makes scans ingest files in trash and quarantine directories.
+var includeTrash bool
+
+// isTrashDir reports whether name is that of a trash directory: .Trash and
+// .Trashes on macOS, .Trash-UID on Linux volumes, and $RECYCLE.BIN (RECYCLER
+// before Vista) on Windows. ~/.local/share/Trash is matched by its parent.
+func isTrashDir(name string) bool {
+	switch {
+	case name == ".Trash", name == ".Trashes", strings.HasPrefix(name, ".Trash-"):
+		return true
+	case strings.EqualFold(name, "$RECYCLE.BIN"), strings.EqualFold(name, "RECYCLER"):
+		return true
+	}
+	return false
+}
+
+// excludedDirs caches which directories scans skip, and why.
+type excludedDirs struct {
+	mu    sync.Mutex
+	known map[string]string
+}
+
+var excluded = &excludedDirs{known: make(map[string]string)}
+
+// kind returns "trash", "quarantine" or "snapshot" if dir is, or is within,
+// a directory of that kind, and "" otherwise.
+func (e *excludedDirs) kind(dir string) string {
+	dir = filepath.Clean(dir)
+	e.mu.Lock()
+	kind, ok := e.known[dir]
+	e.mu.Unlock()
+	if ok {
+		return kind
+	}
+
+	switch base := filepath.Base(dir); {
+	case isTrashDir(base):
+		kind = "trash"
+	case base == "Trash" && filepath.Base(filepath.Dir(dir)) == "share" &&
+		filepath.Base(filepath.Dir(filepath.Dir(dir))) == ".local":
+		kind = "trash"
+	case rootConfig != nil && rootConfig.quarantine != "" && dir == filepath.Clean(rootConfig.quarantine):
+		kind = "quarantine"
+	case base == btrfsSnapshotDir:
+		kind = "snapshot"
+	default:
+		if _, err := os.Lstat(filepath.Join(dir, quarantineManifest)); err == nil {
+			kind = "quarantine"
+		} else if parent := filepath.Dir(dir); parent != dir {
+			kind = e.kind(parent)
+		}
+	}
+
+	e.mu.Lock()
+	e.known[dir] = kind
+	e.mu.Unlock()
+	return kind
+}
+
+// excludedFile returns the error skipping path if it is in a trash or
+// quarantine directory, nil otherwise.
+func excludedFile(path string) error {
+	if includeTrash {
+		return nil
+	}
+	if kind := excluded.kind(filepath.Dir(path)); kind != "" {
+		return &skippedFileError{path: path, kind: kind}
+	}
+	return nil
+}
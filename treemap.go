@@ -0,0 +1,166 @@
+package main
+
+import (
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The treemap shows where duplicated bytes live: every duplicate (group
+// members other than the keeper) is a tile sized by its file size, nested in
+// tiles for its directories. Layout is slice-and-dice, alternating direction
+// with depth, and is computed here so the page needs no script.
+
+const (
+	treemapWidth  = 1200
+	treemapHeight = 800
+	// tiles smaller than this many pixels on a side aren't drawn.
+	treemapMinTile = 2
+)
+
+type treemapNode struct {
+	name     string
+	size     int64
+	children map[string]*treemapNode
+}
+
+func (n *treemapNode) add(parts []string, size int64) {
+	n.size += size
+	if len(parts) == 0 {
+		return
+	}
+	if n.children == nil {
+		n.children = make(map[string]*treemapNode)
+	}
+	child, ok := n.children[parts[0]]
+	if !ok {
+		child = &treemapNode{name: parts[0]}
+		n.children[parts[0]] = child
+	}
+	child.add(parts[1:], size)
+}
+
+// sorted returns the children largest first.
+func (n *treemapNode) sorted() []*treemapNode {
+	children := make([]*treemapNode, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].size != children[j].size {
+			return children[i].size > children[j].size
+		}
+		return children[i].name < children[j].name
+	})
+	return children
+}
+
+type treemapTile struct {
+	Label, Title        string
+	X, Y, Width, Height float64
+	Depth               int
+	Leaf                bool
+}
+
+func (n *treemapNode) layout(tiles []treemapTile, path string, x, y, w, h float64, depth int) []treemapTile {
+	if w < treemapMinTile || h < treemapMinTile {
+		return tiles
+	}
+	tiles = append(tiles, treemapTile{
+		Label: n.name, Title: path + " (" + formatBytes(n.size) + ")",
+		X: x, Y: y, Width: w, Height: h, Depth: depth, Leaf: len(n.children) == 0,
+	})
+	offset := 0.0
+	for _, c := range n.sorted() {
+		share := float64(c.size) / float64(n.size)
+		if depth%2 == 0 {
+			tiles = c.layout(tiles, filepath.Join(path, c.name), x+offset, y, w*share, h, depth+1)
+			offset += w * share
+		} else {
+			tiles = c.layout(tiles, filepath.Join(path, c.name), x, y+offset, w, h*share, depth+1)
+			offset += h * share
+		}
+	}
+	return tiles
+}
+
+var treemapPage = template.Must(template.New("treemap").Funcs(template.FuncMap{
+	// directories get lighter the deeper they nest.
+	"shade": func(depth int) int { return max(95-depth*8, 40) },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>dupehunter: {{.Total}} in duplicates</title>
+<style>
+body { font: 12px sans-serif; margin: 1em; }
+.map { position: relative; width: {{.Width}}px; height: {{.Height}}px; }
+.tile { position: absolute; box-sizing: border-box; overflow: hidden; border: 1px solid #fff;
+  white-space: nowrap; text-overflow: ellipsis; padding: 1px 3px; }
+.leaf { background: #d9534f; color: #fff; }
+</style></head><body>
+<h1>{{.Total}} in {{.Files}} duplicates</h1>
+<div class="map">
+{{- range .Tiles}}
+<div class="tile{{if .Leaf}} leaf{{end}}" title="{{.Title}}" style="left:{{printf "%.1f" .X}}px;top:{{printf "%.1f" .Y}}px;width:{{printf "%.1f" .Width}}px;height:{{printf "%.1f" .Height}}px;{{if not .Leaf}}background:hsl(210,30%,{{shade .Depth}}%);{{end}}">{{.Label}}</div>
+{{- end}}
+</div></body></html>
+`))
+
+// formatBytes renders n in binary units, e.g. 1.5 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + " " + string("KMGTPE"[exp]) + "iB"
+}
+
+// writeTreemap renders the duplicates of groups as a standalone HTML treemap at path.
+func writeTreemap(path string, groups []*dupeGroup) error {
+	root := &treemapNode{name: string(filepath.Separator)}
+	var files int
+	for _, g := range groups {
+		for _, dupe := range g.duplicates() {
+			parts := strings.Split(strings.Trim(dupe.Path, string(filepath.Separator)), string(filepath.Separator))
+			root.add(parts, dupe.Size)
+			files++
+		}
+	}
+	// start at the deepest directory every duplicate shares.
+	rootPath := root.name
+	for len(root.children) == 1 {
+		only := root.sorted()[0]
+		if len(only.children) == 0 {
+			break
+		}
+		rootPath = filepath.Join(rootPath, only.name)
+		root = only
+		root.name = rootPath
+	}
+
+	var tiles []treemapTile
+	if root.size > 0 {
+		tiles = root.layout(nil, rootPath, 0, 0, treemapWidth, treemapHeight, 0)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = treemapPage.Execute(f, struct {
+		Total         string
+		Files         int
+		Width, Height int
+		Tiles         []treemapTile
+	}{formatBytes(root.size), files, treemapWidth, treemapHeight, tiles})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
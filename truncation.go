@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrTruncated marks images whose data ends before the image does, typically
+// partial downloads. They are worth re-downloading rather than deduplicating.
+var ErrTruncated = errors.New("truncated image")
+
+// countingReader tracks how far a decoder got into its input.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// statReaderAt is an open file, as far as telling whether it is complete
+// goes.
+type statReaderAt interface {
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+// trailers are the bytes every complete file of a type ends with.
+var trailers = map[ImageType][]byte{
+	JPEG: {0xff, 0xd9},             // EOI marker
+	PNG:  []byte("IEND\xaeB`\x82"), // IEND chunk type and CRC
+	GIF:  {0x3b},                   // trailer block
+}
+
+// classifyDecodeError wraps decodeErr in ErrTruncated when the file ended
+// early: either the decoder ran out of data right at the end of the file, or
+// the file lacks the trailer its format ends with (e.g. the JPEG EOI marker).
+// consumed is how many bytes of f the decoder read.
+func classifyDecodeError(f statReaderAt, consumed int64, decodeErr error) error {
+	finfo, err := f.Stat()
+	if err != nil {
+		return decodeErr
+	}
+	size := finfo.Size()
+
+	if errors.Is(decodeErr, io.ErrUnexpectedEOF) || errors.Is(decodeErr, io.EOF) {
+		if consumed >= size {
+			return fmt.Errorf("%w: %w", ErrTruncated, decodeErr)
+		}
+		return decodeErr
+	}
+
+	var head [sniffLen]byte
+	n, _ := f.ReadAt(head[:], 0)
+	if !hasTrailer(f, size, sniffImageType(head[:n])) {
+		return fmt.Errorf("%w: %w", ErrTruncated, decodeErr)
+	}
+	return decodeErr
+}
+
+// hasTrailer reports whether f ends like a complete file of type t, or whether
+// there is no telling.
+func hasTrailer(f io.ReaderAt, size int64, t ImageType) bool {
+	trailer, ok := trailers[t]
+	if !ok || size < int64(len(trailer)) {
+		return true
+	}
+	tail := make([]byte, len(trailer))
+	if _, err := f.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return true
+	}
+	return bytes.Equal(tail, trailer)
+}
+
+// checkDecodedGIF catches truncated GIFs that decode fine, since only their
+// first frame is decoded and the missing rest goes unnoticed.
+func checkDecodedGIF(f statReaderAt) error {
+	finfo, err := f.Stat()
+	if err != nil || hasTrailer(f, finfo.Size(), GIF) {
+		return nil
+	}
+	return fmt.Errorf("%w: gif: missing trailer", ErrTruncated)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+)
+
+// completed counts images that left the worker pool, successfully or not.
+var completed atomic.Int64
+
+// tuner resizes the worker pool while a scan runs. Decoding is CPU-bound on
+// local SSDs but IO-bound on network storage, so it grows the pool while work is
+// queued and the CPUs sit idle waiting on IO, and shrinks it back towards the
+// core count once the CPUs are saturated.
+type tuner struct {
+	pool     *ants.Pool
+	min, max int
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+
+	lastCompleted int64
+	lastCPU       time.Duration
+	lastIOWait    float64
+	lastTicks     float64
+	lastRate      float64
+	grew          bool
+}
+
+func newTuner(pool *ants.Pool, maxWorkers int) *tuner {
+	return &tuner{
+		pool:     pool,
+		min:      runtime.GOMAXPROCS(0),
+		max:      maxWorkers,
+		interval: time.Second,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (t *tuner) start() {
+	t.lastCompleted = completed.Load()
+	t.lastCPU, _ = processCPUTime()
+	t.lastIOWait, t.lastTicks, _ = systemIOWait()
+	go t.run()
+}
+
+func (t *tuner) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case now := <-ticker.C:
+			t.tick(now.Sub(last))
+			last = now
+		}
+	}
+}
+
+func (t *tuner) tick(elapsed time.Duration) {
+	done := completed.Load()
+	rate := float64(done-t.lastCompleted) / elapsed.Seconds()
+	t.lastCompleted = done
+
+	var cpuBusy float64
+	if cpu, ok := processCPUTime(); ok {
+		cpuBusy = float64(cpu-t.lastCPU) / float64(elapsed) / float64(runtime.GOMAXPROCS(0))
+		t.lastCPU = cpu
+	}
+	var ioWait float64
+	if iow, ticks, ok := systemIOWait(); ok && ticks > t.lastTicks {
+		ioWait = (iow - t.lastIOWait) / (ticks - t.lastTicks)
+		t.lastIOWait, t.lastTicks = iow, ticks
+	}
+
+	size := t.pool.Cap()
+	backlog := t.pool.Waiting() > 0
+	cpuBound := cpuBusy >= 0.85
+	ioBound := ioWait >= 0.2 || cpuBusy < 0.5
+
+	next := size
+	switch {
+	case t.grew && rate < t.lastRate*0.95:
+		// the last increase made things worse, most likely thrashing the disk.
+		next = size * 2 / 3
+	case cpuBound && size > t.min:
+		next = size * 3 / 4
+	case backlog && ioBound && size < t.max:
+		next = size * 3 / 2
+	}
+	next = min(max(next, t.min), t.max)
+
+	t.grew = next > size
+	t.lastRate = rate
+
+	if next == size {
+		return
+	}
+	log.Debug().Int("from", size).Int("to", next).
+		Float64("files_per_sec", rate).Float64("cpu_busy", cpuBusy).Float64("iowait", ioWait).
+		Int("waiting", t.pool.Waiting()).Msg("resizing worker pool")
+	t.pool.Tune(next)
+}
+
+func (t *tuner) close() {
+	close(t.stop)
+	<-t.done
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func processCPUTime() (time.Duration, bool) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, false
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), true
+}
+
+// systemIOWait returns the cumulative cpu ticks spent waiting on IO and in total,
+// read from the aggregate cpu line of /proc/stat.
+func systemIOWait() (iowait, total float64, ok bool) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, 0, false
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return 0, 0, false
+	}
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 6 || fields[0] != "cpu" {
+		return 0, 0, false
+	}
+	for i, field := range fields[1:] {
+		v, convErr := strconv.ParseFloat(field, 64)
+		if convErr != nil {
+			return 0, 0, false
+		}
+		total += v
+		if i == 4 {
+			iowait = v
+		}
+	}
+	return iowait, total, true
+}
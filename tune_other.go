@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
+
+func systemIOWait() (iowait, total float64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// Clean actions write what they are about to do to an undo log, one JSON
+// object per line, synced before the file is touched, so a run that went
+// wrong can be walked back with the undo command even if it was cut short.
+// Moved duplicates are moved back. Linked and deleted duplicates that were
+// identical copies of their keeper come back as copies of it, with their own
+// permissions and modification time. Near-duplicates had content of their own
+// that no copy of the keeper brings back, so their entries are refused and
+// stay in the log, to be restored from a backup or snapshot. Files sent to the
+// Recycle Bin are restored from there. Entries of a -snapshot clean name the
+// snapshot that still has the file.
+
+type undoEntry struct {
+	Action  string      `json:"action"`
+	Path    string      `json:"path"`
+	Keeper  string      `json:"keeper"`
+	MovedTo string      `json:"moved_to,omitempty"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Cleaned time.Time   `json:"cleaned"`
+	// NearDuplicate is set when the duplicate's content differed from the
+	// keeper's, or couldn't be compared.
+	NearDuplicate bool `json:"near_duplicate,omitempty"`
+	// Snapshot is the filesystem snapshot taken before the action, see
+	// snapshotFilesystems.
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+type undoLog struct {
+	path string
+	f    *os.File
+}
+
+// defaultUndoLog returns where a clean run started now keeps its undo log
+// unless -undo-log says otherwise.
+func defaultUndoLog() (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "undo", time.Now().Format("20060102-150405")+".jsonl"), nil
+}
+
+func openUndoLog(path string) (*undoLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &undoLog{path: path, f: f}, nil
+}
+
+// record appends e and syncs it to disk.
+func (u *undoLog) record(e undoEntry) error {
+	e.Cleaned = time.Now()
+	dat, err := sonic.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = u.f.Write(append(dat, '\n')); err != nil {
+		return fmt.Errorf("failed to write undo log: %w", err)
+	}
+	return u.f.Sync()
+}
+
+func (u *undoLog) Close() error {
+	return u.f.Close()
+}
+
+func readUndoLog(path string) ([]undoEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var (
+		entries = make([]undoEntry, 0)
+		scanner = bufio.NewScanner(f)
+	)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e undoEntry
+		if err = sonic.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("corrupt undo log line %d: %w", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func runUndo(args []string) error {
+	fs := newFlagSet("undo", "[--dry-run] <undo log>",
+		"Walk back the clean actions recorded in an undo log, latest first. Entries that can't be\n"+
+			"undone are left in the log for another try; the log is removed once it is empty.")
+	dryRun := fs.Bool("dry-run", false, "only print what would be restored")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return usageError(fs, "exactly one undo log is required")
+	}
+	path := args[0]
+	entries, err := readUndoLog(path)
+	if err != nil {
+		return fmt.Errorf("failed to read undo log: %w", err)
+	}
+
+	var (
+		left     = make([]undoEntry, 0)
+		restored int
+	)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if *dryRun {
+			log.Info().Str("caller", e.Path).Str("action", e.Action).Msg("would restore")
+			continue
+		}
+		done, err := undoEntryAction(e)
+		switch {
+		case err != nil:
+			ev := log.Warn().Err(err).Str("caller", e.Path).Str("action", e.Action)
+			if e.Snapshot != "" {
+				ev = ev.Str("snapshot", e.Snapshot)
+			}
+			ev.Msg("failed to undo")
+			left = append(left, e)
+		case done:
+			log.Info().Str("caller", e.Path).Str("action", e.Action).Msg("restored")
+			audit("undo", e.Path, e.Action)
+			restored++
+		default:
+			log.Info().Str("caller", e.Path).Str("action", e.Action).Msg("nothing to undo")
+		}
+	}
+	if *dryRun {
+		return nil
+	}
+
+	if len(left) == 0 {
+		err = os.Remove(path)
+	} else {
+		// left is latest first, the log oldest first.
+		for i, j := 0, len(left)-1; i < j; i, j = i+1, j-1 {
+			left[i], left[j] = left[j], left[i]
+		}
+		err = writeUndoLog(path, left)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update undo log: %w", err)
+	}
+	log.Info().Int("restored", restored).Int("remaining", len(left)).
+		Msg("undo finished, scan the restored files to index them again")
+	return nil
+}
+
+// writeUndoLog replaces the log at path with entries.
+func writeUndoLog(path string, entries []undoEntry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		dat, err := sonic.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(dat, '\n'))
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// undoEntryAction reverses e, reporting false when there was nothing to undo
+// because the action never happened.
+func undoEntryAction(e undoEntry) (bool, error) {
+	fi, statErr := os.Lstat(e.Path)
+	switch e.Action {
+	case actionMove:
+		if _, err := os.Lstat(e.MovedTo); errors.Is(err, os.ErrNotExist) && statErr == nil {
+			return false, nil
+		}
+		if statErr == nil {
+			return false, fmt.Errorf("%s already exists", e.Path)
+		}
+		return true, moveFile(e.MovedTo, e.Path, true)
+	case actionHardlink, actionSymlink:
+		kfi, err := os.Stat(e.Keeper)
+		switch {
+		case statErr != nil:
+			return false, statErr
+		case err != nil:
+			return false, fmt.Errorf("keeper: %w", err)
+		case e.Action == actionSymlink && fi.Mode()&os.ModeSymlink == 0,
+			e.Action == actionHardlink && !os.SameFile(fi, kfi):
+			// the link was never made, or has been replaced since.
+			return false, nil
+		}
+		return true, restoreCopy(e)
+	case actionReflink:
+		switch {
+		case statErr != nil:
+			return false, statErr
+		case !identicalContent(e.Path, e.Keeper):
+			// the clone has been written to since, or replaced.
+			return false, nil
+		}
+		return true, restoreCopy(e)
+	case actionDelete:
+		if statErr == nil {
+			return false, nil
+		}
+		return true, restoreCopy(e)
+	case actionRecycle:
+		return false, errors.New("restore it from the Recycle Bin")
+	}
+	return false, fmt.Errorf("unknown action %q", e.Action)
+}
+
+// identicalContent reports whether the files at a and b have the same content.
+func identicalContent(a, b string) bool {
+	afi, aErr := os.Stat(a)
+	bfi, bErr := os.Stat(b)
+	if aErr != nil || bErr != nil || afi.Size() != bfi.Size() {
+		return false
+	}
+	asum, aErr := withFile(a, contentChecksum)
+	bsum, bErr := withFile(b, contentChecksum)
+	return aErr == nil && bErr == nil && asum == bsum
+}
+
+// restoreCopy puts a copy of the keeper of e at its path, with the mode and
+// modification time the duplicate had, unless it was a near-duplicate.
+func restoreCopy(e undoEntry) error {
+	if e.NearDuplicate {
+		if e.Snapshot != "" {
+			return fmt.Errorf("it was a near-duplicate of %s, restore it from the snapshot", e.Keeper)
+		}
+		return fmt.Errorf("it was a near-duplicate of %s, a copy of which wouldn't bring it back", e.Keeper)
+	}
+	tmp := e.Path + ".dupehunter-undo"
+	if err := copyFile(e.Keeper, tmp, e.Mode.Perm()); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Chtimes(tmp, time.Time{}, e.ModTime); err != nil {
+		log.Warn().Err(err).Str("caller", e.Path).Msg("failed to restore modification time")
+	}
+	if err := replaceFile(tmp, e.Path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Directory arguments are walked, subdirectories and all, in lexical order.
+// The walk reads one directory at a time and hands its files out as the
+// workers take them, so a tree of a couple hundred thousand files costs no
+// more memory than a small one. -ext, -exclude, -min-size and -max-size
+// select among the files of the arguments, named or found; paths read from
+// stdin are taken as they are. Walks skip symbolic links unless
+// -follow-symlinks is given, which follows them into directories too, each
+// directory being read once however many links lead to it. -max-depth stops
+// the walk that many directories below an argument, 0 taking only the files
+// directly in it.
+
+// walkFilter selects the files of path arguments.
+type walkFilter struct {
+	exts             map[string]bool // lower-case, without the dot; empty for any
+	excludes         []string
+	excludeRes       []*regexp.Regexp
+	minSize, maxSize byteSize // 0 for no bound
+	followSymlinks   bool
+	maxDepth         int // directories walked below an argument, -1 for no bound
+}
+
+var walkFilters = &walkFilter{exts: make(map[string]bool), maxDepth: -1}
+
+// addExts adds the comma-separated extensions of list.
+func (f *walkFilter) addExts(list string) error {
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext == "" {
+			return errors.New("empty extension")
+		}
+		f.exts[ext] = true
+	}
+	return nil
+}
+
+// addExclude adds a glob of paths to skip.
+func (f *walkFilter) addExclude(glob string) error {
+	re, err := globRegexp(expandHome(glob))
+	if err != nil {
+		return err
+	}
+	f.excludes, f.excludeRes = append(f.excludes, glob), append(f.excludeRes, re)
+	return nil
+}
+
+// extensions returns the selected extensions, sorted.
+func (f *walkFilter) extensions() []string {
+	exts := make([]string, 0, len(f.exts))
+	for ext := range f.exts {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// sized reports whether files are selected by their size.
+func (f *walkFilter) sized() bool {
+	return f.minSize > 0 || f.maxSize > 0
+}
+
+// active reports whether any filter is set.
+func (f *walkFilter) active() bool {
+	return len(f.exts) > 0 || len(f.excludes) > 0 || f.sized()
+}
+
+// excluded reports whether path matches an -exclude glob.
+func (f *walkFilter) excluded(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	abs = filepath.ToSlash(abs)
+	for _, re := range f.excludeRes {
+		if re.MatchString(abs) {
+			return true
+		}
+	}
+	return false
+}
+
+// selects reports whether the file at path, size bytes large, passes the
+// filters.
+func (f *walkFilter) selects(path string, size int64) bool {
+	if len(f.exts) > 0 && !f.exts[strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))] {
+		return false
+	}
+	if (f.minSize > 0 && size < int64(f.minSize)) || (f.maxSize > 0 && size > int64(f.maxSize)) {
+		return false
+	}
+	return !f.excluded(path)
+}
+
+// byteSize is a flag of a number of bytes, taking binary units, e.g. 10K or
+// 1.5MiB.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	if *b == 0 {
+		return "0"
+	}
+	return formatBytes(int64(*b))
+}
+
+func (b *byteSize) Set(s string) error {
+	s = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	var shift int
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i >= 0 {
+			shift, s = 10*(i+1), s[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return errors.New("expected a size, e.g. 500K or 2M")
+	}
+	*b = byteSize(n * float64(int64(1)<<shift))
+	return nil
+}
+
+// walkPaths streams the files of paths, walking those naming directories.
+func walkPaths(paths []string) pathSource {
+	w := &walker{args: paths, seen: make(map[string]bool)}
+	return w.next
+}
+
+type walker struct {
+	args  []string        // arguments not taken yet
+	dirs  []walkDir       // directories not read yet, the next one last
+	files []string        // files of the directory read last, not taken yet
+	seen  map[string]bool // directories queued, by real path, when following links
+}
+
+// walkDir is a directory to read, depth directories below its argument.
+type walkDir struct {
+	path  string
+	depth int
+}
+
+func (w *walker) next() (string, bool) {
+	for {
+		switch {
+		case len(w.files) > 0:
+			p := w.files[0]
+			w.files = w.files[1:]
+			return p, true
+		case len(w.dirs) > 0:
+			dir := w.dirs[len(w.dirs)-1]
+			w.dirs = w.dirs[:len(w.dirs)-1]
+			w.read(dir.path, dir.depth)
+		case len(w.args) > 0:
+			arg := w.args[0]
+			w.args = w.args[1:]
+			finfo, err := os.Stat(arg)
+			switch {
+			case err != nil:
+				// fails as it would unwalked.
+				return arg, true
+			case finfo.IsDir():
+				w.enter(arg, 0)
+			case walkFilters.selects(arg, finfo.Size()):
+				return arg, true
+			}
+		default:
+			return "", false
+		}
+	}
+}
+
+// enter queues dir to be read, unless it is skipped, too deep or, following
+// links, already was queued.
+func (w *walker) enter(dir string, depth int) {
+	if (!includeTrash && excluded.kind(dir) != "") || walkFilters.excluded(dir) {
+		return
+	}
+	if walkFilters.maxDepth >= 0 && depth > walkFilters.maxDepth {
+		log.Debug().Str("caller", dir).Msg("skipping directory below -max-depth")
+		return
+	}
+	if walkFilters.followSymlinks {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			if w.seen[real] {
+				log.Debug().Str("caller", dir).Msg("skipping directory already walked")
+				return
+			}
+			w.seen[real] = true
+		}
+	}
+	w.dirs = append(w.dirs, walkDir{path: dir, depth: depth})
+}
+
+// read takes the selected files of dir, depth directories below its
+// argument, and queues its subdirectories.
+func (w *walker) read(dir string, depth int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !problems.note(dir, err) {
+		log.Warn().Err(err).Str("caller", dir).Msg("failed to read directory")
+	}
+	subdirs := make([]string, 0)
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		typ := e.Type()
+		if typ&fs.ModeSymlink != 0 {
+			if !walkFilters.followSymlinks {
+				continue
+			}
+			finfo, err := os.Stat(p)
+			if err != nil {
+				log.Debug().Err(err).Str("caller", p).Msg("skipping broken symbolic link")
+				continue
+			}
+			typ = finfo.Mode().Type()
+		}
+		switch {
+		case typ.IsDir():
+			subdirs = append(subdirs, p)
+		case !typ.IsRegular():
+		case !walkFilters.sized():
+			if walkFilters.selects(p, 0) {
+				w.files = append(w.files, p)
+			}
+		default:
+			finfo, err := os.Stat(p)
+			if err == nil && walkFilters.selects(p, finfo.Size()) {
+				w.files = append(w.files, p)
+			}
+		}
+	}
+	for i := len(subdirs) - 1; i >= 0; i-- {
+		w.enter(subdirs[i], depth+1)
+	}
+}
+
+// hasDirectory reports whether any of paths names a directory.
+func hasDirectory(paths []string) bool {
+	for _, p := range paths {
+		if finfo, err := os.Stat(p); err == nil && finfo.IsDir() {
+			return true
+		}
+	}
+	return false
+}
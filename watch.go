@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// -watch keeps a scan of directories running once it is through them,
+// ingesting the files created or written in them, subdirectories included,
+// as they arrive. A file is only taken once it has gone -watch-settle without
+// being written to, so copies still in progress aren't hashed half way. The
+// filters of the scan apply to arriving files as they do to walked ones.
+// Matches are reported as each image is indexed, as with -alert-immediately
+// which -watch implies, and -alert-events streams them as JSON lines. An
+// interrupt or SIGTERM ends the watch, the database being synced and closed
+// as at the end of any scan, and SIGHUP reloads the configuration, see
+// liveConfig.
+
+type dirWatcher struct {
+	w *fsnotify.Watcher
+	// depth is how many directories below its argument each watched
+	// directory is, for -max-depth.
+	depth map[string]int
+	// pending are the files written lately, by when they were last written.
+	pending map[string]time.Time
+}
+
+// watchPaths watches the directories of paths until ctx is done or the
+// process is interrupted, ingesting the files arriving in them.
+func watchPaths(ctx context.Context, cfg *config, paths []string) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = w.Close() }()
+	dw := &dirWatcher{w: w, depth: make(map[string]int), pending: make(map[string]time.Time)}
+	for _, p := range paths {
+		if finfo, err := os.Stat(p); err == nil && finfo.IsDir() {
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				return err
+			}
+			dw.addTree(abs, 0, false)
+		}
+	}
+	if len(dw.depth) == 0 {
+		return nil
+	}
+	log.Info().Int("directories", len(dw.depth)).Dur("settle", cfg.watchSettle).Msg("watching for new files")
+
+	// arrivals aren't bounded by the limits of the scan before them.
+	limits.begin(stop, 0, 0)
+	defer limits.end()
+	origin := newOrigin(cfg.source, "watch")
+	tick := time.NewTicker(max(cfg.watchSettle/4, 100*time.Millisecond))
+	defer tick.Stop()
+	hup, stopHup := reloadSignals()
+	defer stopHup()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info().Int("pending", len(dw.pending)).Msg("watch stopped")
+			return nil
+		case <-hup:
+			// arrivals are processed in this loop, none is being scanned.
+			r, err := live.reload()
+			if err != nil {
+				log.Error().Err(err).Msg("failed to reload the configuration, keeping the current one")
+				continue
+			}
+			if r.Roots != nil {
+				dw.rootsChanged(r.Roots)
+				log.Info().Int("directories", len(dw.depth)).Msg("watching for new files")
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			log.Warn().Err(err).Msg("watch error")
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			dw.handle(ev)
+		case now := <-tick.C:
+			if settled := dw.settled(now, cfg.watchSettle); len(settled) > 0 {
+				processPaths(ctx, slicePaths(settled), origin)
+			}
+		}
+	}
+}
+
+// addTree watches dir, depth directories below its argument, and the
+// directories within it the walk of a scan would enter. With files, the files
+// found in them are taken as arrivals, for a directory that was created with
+// files in it before it could be watched.
+func (dw *dirWatcher) addTree(dir string, depth int, files bool) {
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if !problems.note(p, err) {
+				log.Warn().Err(err).Str("caller", p).Msg("failed to read directory")
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			if files {
+				dw.pending[p] = time.Now()
+			}
+			return nil
+		}
+		level := depth
+		if rel, _ := filepath.Rel(dir, p); rel != "." {
+			level += strings.Count(rel, string(filepath.Separator)) + 1
+		}
+		switch {
+		case p != dir && ((!includeTrash && excluded.kind(p) != "") || walkFilters.excluded(p)),
+			walkFilters.maxDepth >= 0 && level > walkFilters.maxDepth:
+			return filepath.SkipDir
+		}
+		if _, watched := dw.depth[p]; watched {
+			return nil
+		}
+		if err := dw.w.Add(p); err != nil {
+			log.Warn().Err(err).Str("caller", p).Msg("failed to watch directory")
+			return filepath.SkipDir
+		}
+		dw.depth[p] = level
+		return nil
+	})
+}
+
+func (dw *dirWatcher) handle(ev fsnotify.Event) {
+	switch {
+	case ev.Has(fsnotify.Create) || ev.Has(fsnotify.Write):
+		finfo, err := os.Lstat(ev.Name)
+		if err != nil {
+			return
+		}
+		if finfo.IsDir() {
+			parent, ok := dw.depth[filepath.Dir(ev.Name)]
+			if !ok {
+				return
+			}
+			dw.addTree(ev.Name, parent+1, true)
+			return
+		}
+		dw.pending[ev.Name] = time.Now()
+	case ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename):
+		delete(dw.pending, ev.Name)
+		delete(dw.depth, ev.Name)
+	}
+}
+
+// settled takes the pending files that haven't been written to for settle,
+// those the filters select, in path order.
+func (dw *dirWatcher) settled(now time.Time, settle time.Duration) []string {
+	var paths []string
+	for p, written := range dw.pending {
+		if now.Sub(written) < settle {
+			continue
+		}
+		delete(dw.pending, p)
+		if finfo, err := os.Lstat(p); err == nil && finfo.Mode().IsRegular() && walkFilters.selects(p, finfo.Size()) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// -watermark-margin takes a second look at the near misses, pairs up to that
+// many bits beyond their threshold: both images are decoded again with the
+// zones watermarks are usually stamped into, the bottom strip and the top
+// corners, painted over in gray, and hashed again. Pairs whose masked hashes
+// are within the threshold are reported as probable watermark variants, a
+// tier of their own besides the duplicates, which clean actions never touch.
+// Only images that are files of their own are looked at again, not pages or
+// members of containers.
+
+const (
+	// watermarkStrip is the share of the height the bottom strip spans.
+	watermarkStrip = 0.15
+	// watermarkCornerWidth and watermarkCornerHeight are the shares of the
+	// sides the top corners span.
+	watermarkCornerWidth  = 0.25
+	watermarkCornerHeight = 0.15
+)
+
+// watermarkPair is a near miss that matches with the watermark zones masked.
+type watermarkPair struct {
+	a, b             string
+	distance, masked int
+}
+
+// maskWatermarkZones returns a copy of i with the watermark zones painted
+// over in gray.
+func maskWatermarkZones(i image.Image) image.Image {
+	b := i.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, i, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	cw, ch := int(float64(w)*watermarkCornerWidth), int(float64(h)*watermarkCornerHeight)
+	zones := []image.Rectangle{
+		image.Rect(b.Min.X, b.Max.Y-int(float64(h)*watermarkStrip), b.Max.X, b.Max.Y),
+		image.Rect(b.Min.X, b.Min.Y, b.Min.X+cw, b.Min.Y+ch),
+		image.Rect(b.Max.X-cw, b.Min.Y, b.Max.X, b.Min.Y+ch),
+	}
+	gray := &image.Uniform{C: color.Gray{Y: 128}}
+	for _, z := range zones {
+		draw.Draw(dst, z, gray, image.Point{}, draw.Src)
+	}
+	return dst
+}
+
+// maskedHash decodes the image file at path and hashes it with the watermark
+// zones masked.
+func maskedHash(path string) ([]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	i, _, err := decImg(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = hashing.dump(&buf, "", maskWatermarkZones(i)); err != nil {
+		return nil, err
+	}
+	return loadHash(hashLayout, buf.Bytes())
+}
+
+// findWatermarkVariants compares the near misses among records, those up to
+// margin bits beyond their threshold that groups don't already hold together
+// and the check of pairs could have paired, with their watermark zones masked.
+func findWatermarkVariants(cfg *config, pairs *pairSet, records map[string]*Image, groups []*dupeGroup,
+	margin int) []watermarkPair {
+	hashes := make(map[string]uint64)
+	for p, img := range records {
+		if len(img.PHash) == 0 || img.staleLayout() || strings.Contains(p, pageSuffix) {
+			continue
+		}
+		if h, err := imageHash(img); err == nil {
+			hashes[p] = h
+		}
+	}
+	paths := make([]string, 0, len(hashes))
+	for p := range hashes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	groupOf := groupsOf(groups)
+
+	radius := min(cfg.searchRadius()+margin, 64)
+	idx := buildBuckets(hashes, radius)
+	type nearMiss struct {
+		a, b                string
+		distance, threshold int
+	}
+	misses := make([]nearMiss, 0)
+	for _, k := range paths {
+		for _, m := range idx.query(hashes[k], radius) {
+			l := m.path
+			if g := groupOf[k]; l <= k || g != nil && g == groupOf[l] || !pairs.admits(k, l) {
+				continue
+			}
+			distance, err := recordDistance(records[k], records[l])
+			if err != nil {
+				continue
+			}
+			if threshold := cfg.pairThreshold(records[k], records[l]); distance >= threshold && distance < threshold+margin {
+				misses = append(misses, nearMiss{a: k, b: l, distance: distance, threshold: threshold})
+			}
+		}
+	}
+
+	masked := make(map[string][]uint64)
+	maskedOf := func(p string) []uint64 {
+		if h, ok := masked[p]; ok {
+			return h
+		}
+		h, err := maskedHash(p)
+		if err != nil {
+			log.Debug().Err(err).Str("caller", displayPath(p)).Msg("failed to hash with the watermark zones masked")
+		}
+		masked[p] = h
+		return h
+	}
+	found := make([]watermarkPair, 0)
+	for _, miss := range misses {
+		ha, hb := maskedOf(miss.a), maskedOf(miss.b)
+		if ha == nil || hb == nil || len(ha) != len(hb) {
+			continue
+		}
+		var distance int
+		for i := range ha {
+			distance += hashDistance(ha[i], hb[i])
+		}
+		if distance < miss.threshold {
+			found = append(found, watermarkPair{a: miss.a, b: miss.b, distance: miss.distance, masked: distance})
+		}
+	}
+	if seed != nil {
+		sort.Slice(found, func(i, j int) bool {
+			if found[i].a != found[j].a {
+				return found[i].a < found[j].a
+			}
+			return found[i].b < found[j].b
+		})
+	}
+	log.Debug().Int("near_misses", len(misses)).Int("images", len(masked)).Msg("compared the near misses masked")
+	return found
+}
+
+func reportWatermarkVariants(found []watermarkPair) {
+	for _, pair := range found {
+		log.Info().Int("distance", pair.distance).Int("masked_distance", pair.masked).
+			Msgf("probable watermark variant: %s and %s", displayPath(pair.a), displayPath(pair.b))
+	}
+	log.Info().Int("pairs", len(found)).Msg("probable watermark variants found")
+}
+
+// writeWatermarkVariants writes found as the text of a report.
+func writeWatermarkVariants(w io.Writer, found []watermarkPair) error {
+	if len(found) == 0 {
+		_, err := fmt.Fprintln(w, "no probable watermark variants")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "probable watermark variants")
+	for _, pair := range found {
+		_, _ = fmt.Fprintf(tw, "  distance %d, masked %d\t%s\t%s\n", pair.distance, pair.masked,
+			displayPath(pair.a), displayPath(pair.b))
+	}
+	return tw.Flush()
+}
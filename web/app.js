@@ -0,0 +1,102 @@
+"use strict";
+
+// The UI talks to the API of the serving daemon with a token of the read
+// scope, kept in the browser's session storage.
+
+const tokenKey = "dupehunter-token";
+let cursor = "";
+
+async function api(path) {
+	const resp = await fetch(path, {
+		headers: {Authorization: "Bearer " + sessionStorage.getItem(tokenKey)},
+	});
+	const body = await resp.json();
+	if (!resp.ok) {
+		throw new Error(body.error || resp.statusText);
+	}
+	return body;
+}
+
+function formatBytes(n) {
+	const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+	let i = 0;
+	while (n >= 1024 && i < units.length - 1) {
+		n /= 1024;
+		i++;
+	}
+	return n.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+function cell(row, content) {
+	const td = row.insertCell();
+	if (typeof content === "string") {
+		td.textContent = content;
+	} else {
+		td.append(content);
+	}
+}
+
+function list(paths) {
+	const ul = document.createElement("ul");
+	for (const p of paths || []) {
+		const li = document.createElement("li");
+		li.textContent = p;
+		ul.append(li);
+	}
+	return ul;
+}
+
+async function loadStatus() {
+	const s = await api("/v1/status");
+	let text = s.phase || "idle";
+	if (s.total) {
+		text += ": " + s.processed + " of " + s.total;
+	}
+	if (s.eta) {
+		text += ", " + s.eta + " left";
+	}
+	document.getElementById("status").textContent = text;
+}
+
+async function loadGroups() {
+	const page = await api("/v1/groups?limit=100" + (cursor ? "&cursor=" + encodeURIComponent(cursor) : ""));
+	const tbody = document.querySelector("#groups tbody");
+	for (const g of page.groups) {
+		const row = tbody.insertRow();
+		cell(row, g.keeper);
+		cell(row, list(g.duplicates));
+		cell(row, String(g.distance));
+		cell(row, formatBytes(g.reclaimable));
+	}
+	cursor = page.next || "";
+	document.getElementById("more").hidden = !cursor;
+}
+
+async function refresh() {
+	const error = document.getElementById("error");
+	error.textContent = "";
+	document.querySelector("#groups tbody").replaceChildren();
+	cursor = "";
+	try {
+		await loadStatus();
+		await loadGroups();
+	} catch (err) {
+		error.textContent = err.message;
+	}
+}
+
+document.getElementById("login").addEventListener("submit", (ev) => {
+	ev.preventDefault();
+	sessionStorage.setItem(tokenKey, document.getElementById("token").value);
+	refresh();
+});
+
+document.getElementById("more").addEventListener("click", () => {
+	loadGroups().catch((err) => {
+		document.getElementById("error").textContent = err.message;
+	});
+});
+
+if (sessionStorage.getItem(tokenKey)) {
+	refresh();
+}
@@ -0,0 +1,25 @@
+//go:build webui
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The web UI is a handful of static files talking to the API, embedded in
+// binaries built with -tags webui so that it works without any internet
+// access, e.g. on a NAS.
+
+//go:embed web
+var webAssets embed.FS
+
+// webUI returns the handler of the embedded web UI.
+func webUI() http.Handler {
+	assets, err := fs.Sub(webAssets, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(assets))
+}
@@ -0,0 +1,10 @@
+//go:build !webui
+
+package main
+
+import "net/http"
+
+// webUI returns nil, binaries built without -tags webui have no web UI.
+func webUI() http.Handler {
+	return nil
+}